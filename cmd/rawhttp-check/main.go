@@ -0,0 +1,49 @@
+// Command rawhttp-check runs protocol-conformance probes against a running
+// HTTP server and prints a report.
+//
+//	rawhttp-check -addr localhost:8080 -path /ping
+//
+// It exits with status 1 when any probe fails.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "server address (host:port)")
+	path := flag.String("path", "/", "path of an existing GET route or file")
+	useTLS := flag.Bool("tls", false, "connect with TLS (certificate is not verified)")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout per probe")
+	slowTimeout := flag.Duration("slow-timeout", 35*time.Second, "how long the slow client probe waits for the server to hang up")
+	flag.Parse()
+
+	c := &checker{
+		addr:        *addr,
+		path:        *path,
+		useTLS:      *useTLS,
+		timeout:     *timeout,
+		slowTimeout: *slowTimeout,
+	}
+
+	results := c.runAll()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBE\tRESULT\tDETAIL")
+	failed := false
+	for _, res := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", res.name, res.outcome, res.detail)
+		if res.outcome == fail {
+			failed = true
+		}
+	}
+	w.Flush()
+
+	if failed {
+		os.Exit(1)
+	}
+}
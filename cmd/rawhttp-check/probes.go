@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// outcome is the verdict of a probe
+type outcome string
+
+const (
+	pass outcome = "PASS"
+	warn outcome = "WARN" // allowed by the spec, but worth knowing
+	fail outcome = "FAIL"
+)
+
+// result is the report line of one probe
+type result struct {
+	name    string
+	outcome outcome
+	detail  string
+}
+
+// checker runs probes against one server
+type checker struct {
+	addr        string
+	path        string
+	useTLS      bool
+	timeout     time.Duration
+	slowTimeout time.Duration
+}
+
+// probe is a single conformance check
+type probe struct {
+	name string
+	run  func(c *checker) (outcome, string)
+}
+
+// probes lists every check in report order
+var probes = []probe{
+	{"keep-alive", (*checker).probeKeepAlive},
+	{"head", (*checker).probeHead},
+	{"not-found", (*checker).probeNotFound},
+	{"range", (*checker).probeRange},
+	{"gzip", (*checker).probeGzip},
+	{"chunked-request", (*checker).probeChunked},
+	{"large-headers", (*checker).probeLargeHeaders},
+	{"slow-client", (*checker).probeSlowClient},
+}
+
+// runAll runs every probe in order
+func (c *checker) runAll() []result {
+	results := make([]result, 0, len(probes))
+	for _, p := range probes {
+		verdict, detail := p.run(c)
+		results = append(results, result{name: p.name, outcome: verdict, detail: detail})
+	}
+	return results
+}
+
+// dial opens a connection with the probe timeout as deadline
+func (c *checker) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	return conn, nil
+}
+
+// request builds a raw request with a Host header and extra header lines
+func (c *checker) request(method, path string, headers ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: rawhttp-check\r\n", method, path, c.addr)
+	for _, header := range headers {
+		b.WriteString(header)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// roundTrip sends one request on a fresh connection and reads the response
+func (c *checker) roundTrip(method, raw string) (*http.Response, []byte, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, raw); err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// probeKeepAlive sends two requests over one connection
+func (c *checker) probeKeepAlive() (outcome, string) {
+	conn, err := c.dial()
+	if err != nil {
+		return fail, err.Error()
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for i := 1; i <= 2; i++ {
+		if _, err := io.WriteString(conn, c.request("GET", c.path)); err != nil {
+			return fail, fmt.Sprintf("request %d: %v", i, err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return fail, fmt.Sprintf("response %d: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.Close && i == 1 {
+			return warn, "server closed the connection after the first request"
+		}
+	}
+	return pass, "two requests served on one connection"
+}
+
+// probeHead checks HEAD responses carry no body
+func (c *checker) probeHead() (outcome, string) {
+	conn, err := c.dial()
+	if err != nil {
+		return fail, err.Error()
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	io.WriteString(conn, c.request("HEAD", c.path))
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "HEAD"})
+	if err != nil {
+		return fail, err.Error()
+	}
+	if resp.StatusCode >= 400 {
+		return warn, fmt.Sprintf("HEAD %s answered %d", c.path, resp.StatusCode)
+	}
+
+	// A body after the HEAD response corrupts the next response on the connection
+	io.WriteString(conn, c.request("GET", c.path))
+	next, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return fail, "HEAD response included a body"
+	}
+	next.Body.Close()
+	return pass, fmt.Sprintf("%d with Content-Length %d and no body", resp.StatusCode, resp.ContentLength)
+}
+
+// probeNotFound requests a path that should not exist
+func (c *checker) probeNotFound() (outcome, string) {
+	path := fmt.Sprintf("/rawhttp-check-missing-%d", time.Now().UnixNano())
+	resp, _, err := c.roundTrip("GET", c.request("GET", path))
+	if err != nil {
+		return fail, err.Error()
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return fail, fmt.Sprintf("expected 404, got %d", resp.StatusCode)
+	}
+	return pass, "404 for unknown path"
+}
+
+// probeRange requests the first byte of the resource
+func (c *checker) probeRange() (outcome, string) {
+	resp, body, err := c.roundTrip("GET", c.request("GET", c.path, "Range: bytes=0-0"))
+	if err != nil {
+		return fail, err.Error()
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if len(body) != 1 {
+			return fail, fmt.Sprintf("206 with %d bytes for a 1 byte range", len(body))
+		}
+		return pass, "206 with Content-Range " + resp.Header.Get("Content-Range")
+	case http.StatusOK:
+		return warn, "Range ignored (200 with the full body)"
+	default:
+		return fail, fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+// probeGzip checks a gzip-encoded response decodes
+func (c *checker) probeGzip() (outcome, string) {
+	resp, body, err := c.roundTrip("GET", c.request("GET", c.path, "Accept-Encoding: gzip"))
+	if err != nil {
+		return fail, err.Error()
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return warn, "response not compressed"
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return fail, "invalid gzip body: " + err.Error()
+	}
+	plain, err := io.ReadAll(gz)
+	if err != nil {
+		return fail, "invalid gzip body: " + err.Error()
+	}
+	return pass, fmt.Sprintf("%d bytes compressed to %d", len(plain), len(body))
+}
+
+// probeChunked sends a chunked request body and expects it to be framed correctly
+func (c *checker) probeChunked() (outcome, string) {
+	conn, err := c.dial()
+	if err != nil {
+		return fail, err.Error()
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	raw := c.request("POST", c.path, "Transfer-Encoding: chunked", "Content-Type: text/plain") +
+		"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"
+	io.WriteString(conn, raw)
+
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return fail, err.Error()
+	}
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusLengthRequired || resp.StatusCode >= 500 {
+		return fail, fmt.Sprintf("chunked body rejected with %d", resp.StatusCode)
+	}
+	if resp.Close {
+		return pass, fmt.Sprintf("%d, connection closed", resp.StatusCode)
+	}
+
+	// Leftover chunk bytes would show up as a malformed second request
+	io.WriteString(conn, c.request("GET", c.path))
+	next, err := http.ReadResponse(reader, nil)
+	if err != nil || next.StatusCode == http.StatusBadRequest {
+		return fail, "chunked body was not fully consumed"
+	}
+	return pass, fmt.Sprintf("%d, connection reusable", resp.StatusCode)
+}
+
+// probeLargeHeaders sends 64KB of headers, which should be refused
+func (c *checker) probeLargeHeaders() (outcome, string) {
+	resp, _, err := c.roundTrip("GET", c.request("GET", c.path, "X-Padding: "+strings.Repeat("a", 64*1024)))
+	if err != nil {
+		var netErr net.Error
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) || strings.Contains(err.Error(), "reset") {
+			return warn, "connection dropped without a 431 response"
+		}
+		return fail, err.Error()
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestHeaderFieldsTooLarge:
+		return pass, "431 Request Header Fields Too Large"
+	case http.StatusBadRequest:
+		return warn, "400 instead of 431"
+	default:
+		return fail, fmt.Sprintf("64KB of headers accepted with %d", resp.StatusCode)
+	}
+}
+
+// probeSlowClient sends half a request line and waits for the server to hang up
+func (c *checker) probeSlowClient() (outcome, string) {
+	conn, err := c.dial()
+	if err != nil {
+		return fail, err.Error()
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetDeadline(start.Add(c.slowTimeout))
+	io.WriteString(conn, "GET "+c.path+" HTTP/1.1\r\n")
+
+	_, err = io.Copy(io.Discard, conn)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return warn, fmt.Sprintf("connection still open after %v", c.slowTimeout)
+	}
+	return pass, fmt.Sprintf("closed after %v", time.Since(start).Round(time.Millisecond))
+}
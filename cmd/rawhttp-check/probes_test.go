@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/codetesla51/raw-http/server"
+)
+
+// Test the probe battery against the package's own server
+func TestProbesAgainstRouter(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.ReadTimeout = 200 * time.Millisecond
+	router := server.NewRouterWithConfig(cfg)
+	router.SetFileResolver(nil)
+	router.Use(server.Compress())
+	router.Register("GET", "/", func(req *server.Request) ([]byte, string) {
+		return server.CreateResponseBytes("200", "text/plain", "OK", []byte(strings.Repeat("raw-http ", 100)))
+	})
+	router.StaticFS("/assets", fstest.MapFS{"app.css": {Data: []byte("body{margin:0}")}})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go router.Serve(listener)
+
+	c := &checker{addr: listener.Addr().String(), path: "/", timeout: 2 * time.Second, slowTimeout: 2 * time.Second}
+	results := c.runAll()
+	if len(results) != len(probes) {
+		t.Fatalf("Expected %d results, got %d", len(probes), len(results))
+	}
+
+	mustPass := map[string]bool{"keep-alive": true, "head": true, "not-found": true, "gzip": true, "chunked-request": true, "slow-client": true}
+	for _, res := range results {
+		t.Logf("%-16s %s  %s", res.name, res.outcome, res.detail)
+		if res.outcome == fail || (mustPass[res.name] && res.outcome != pass) {
+			t.Errorf("Probe %s: %s (%s)", res.name, res.outcome, res.detail)
+		}
+	}
+
+	// Static mounts register HEAD routes of their own
+	assets := &checker{addr: c.addr, path: "/assets/app.css", timeout: 2 * time.Second}
+	if outcome, detail := assets.probeHead(); outcome != pass {
+		t.Errorf("Probe head on a static file: %s (%s)", outcome, detail)
+	}
+}
@@ -0,0 +1,71 @@
+// Command rawhttp-replay replays the requests of a log against a server and
+// reports latency and status counts, for before/after comparisons of
+// server changes:
+//
+//	rawhttp-replay -addr localhost:8080 -log audit.jsonl -speed 2
+//
+// The log is either JSON lines with "time", "method" and "path" fields (the
+// format of FileAuditSink) or the server's console log
+// ("2006/01/02 15:04:05 GET /path 200"). Request bodies are not logged, so
+// requests are replayed without one. With -json the report is printed as
+// JSON, ready to diff against an earlier run.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "server address (host:port)")
+	logPath := flag.String("log", "-", "log to replay; - reads stdin")
+	speed := flag.Float64("speed", 1, "replay speed relative to the log's timing; 0 sends as fast as possible")
+	conns := flag.Int("conns", 4, "keep-alive connections to replay over")
+	useTLS := flag.Bool("tls", false, "connect with TLS (certificate is not verified)")
+	timeout := flag.Duration("timeout", 5*time.Second, "timeout per request")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	var in io.Reader = os.Stdin
+	if *logPath != "-" {
+		file, err := os.Open(*logPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		in = file
+	}
+	entries, err := readLog(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(entries) == 0 {
+		log.Fatal("no requests found in log")
+	}
+
+	r := &replayer{addr: *addr, useTLS: *useTLS, timeout: *timeout, speed: *speed, conns: *conns}
+	rep := r.run(entries)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "requests\t%d\n", rep.Requests)
+	fmt.Fprintf(w, "errors\t%d\n", rep.Errors)
+	fmt.Fprintf(w, "duration\t%s\n", rep.Duration)
+	fmt.Fprintf(w, "throughput\t%.1f req/s\n", rep.Throughput)
+	fmt.Fprintf(w, "latency p50/p90/p99/max\t%s / %s / %s / %s\n", rep.P50, rep.P90, rep.P99, rep.Max)
+	for _, status := range rep.sortedStatuses() {
+		fmt.Fprintf(w, "status %d\t%d\n", status, rep.Statuses[status])
+	}
+	w.Flush()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entry is one logged request, offset from the first
+type entry struct {
+	at     time.Duration
+	method string
+	path   string
+}
+
+// jsonLine is the subset of a JSON log line needed for replay
+type jsonLine struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+}
+
+// ansiEscape matches the color codes of the console log
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// consoleTimeLayout is the timestamp of the standard log package
+const consoleTimeLayout = "2006/01/02 15:04:05"
+
+// readLog parses a JSON lines or console log, skipping lines that aren't
+// requests. Entries are returned in log order.
+func readLog(r io.Reader) ([]entry, error) {
+	var entries []entry
+	var first time.Time
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var at time.Time
+		var method, path string
+
+		if strings.HasPrefix(line, "{") {
+			var parsed jsonLine
+			if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+				continue
+			}
+			at, method, path = parsed.Time, parsed.Method, parsed.Path
+		} else {
+			fields := strings.Fields(ansiEscape.ReplaceAllString(line, ""))
+			if len(fields) < 4 {
+				continue
+			}
+			t, err := time.Parse(consoleTimeLayout, fields[0]+" "+fields[1])
+			if err != nil {
+				continue
+			}
+			at, method, path = t, fields[2], fields[3]
+		}
+		if method == "" || !strings.HasPrefix(path, "/") {
+			continue
+		}
+
+		if len(entries) == 0 {
+			first = at
+		}
+		offset := at.Sub(first)
+		if offset < 0 || at.IsZero() {
+			offset = 0
+		}
+		entries = append(entries, entry{at: offset, method: method, path: path})
+	}
+	return entries, scanner.Err()
+}
+
+// replayer sends logged requests to one server
+type replayer struct {
+	addr    string
+	useTLS  bool
+	timeout time.Duration
+	speed   float64 // 0 ignores the logged timing
+	conns   int
+}
+
+// report summarizes a replay
+type report struct {
+	Requests   int           `json:"requests"`
+	Errors     int           `json:"errors"`
+	Statuses   map[int]int   `json:"statuses"`
+	Duration   time.Duration `json:"duration_ns"`
+	Throughput float64       `json:"throughput_rps"`
+	P50        time.Duration `json:"p50_ns"`
+	P90        time.Duration `json:"p90_ns"`
+	P99        time.Duration `json:"p99_ns"`
+	Max        time.Duration `json:"max_ns"`
+}
+
+// sortedStatuses returns the status codes in order
+func (rep *report) sortedStatuses() []int {
+	statuses := make([]int, 0, len(rep.Statuses))
+	for status := range rep.Statuses {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	return statuses
+}
+
+// run replays entries, pacing them by their offsets divided by speed
+func (r *replayer) run(entries []entry) *report {
+	conns := max(r.conns, 1)
+	queue := make(chan entry)
+	var mu sync.Mutex
+	rep := &report{Statuses: make(map[int]int)}
+	var latencies []time.Duration
+
+	var wg sync.WaitGroup
+	for range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &replayConn{r: r}
+			defer c.close()
+			for e := range queue {
+				start := time.Now()
+				status, err := c.send(e)
+				elapsed := time.Since(start)
+
+				mu.Lock()
+				rep.Requests++
+				if err != nil {
+					rep.Errors++
+				} else {
+					rep.Statuses[status]++
+					latencies = append(latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	start := time.Now()
+	for _, e := range entries {
+		if r.speed > 0 {
+			due := start.Add(time.Duration(float64(e.at) / r.speed))
+			time.Sleep(time.Until(due))
+		}
+		queue <- e
+	}
+	close(queue)
+	wg.Wait()
+
+	rep.Duration = time.Since(start)
+	if rep.Duration > 0 {
+		rep.Throughput = float64(rep.Requests) / rep.Duration.Seconds()
+	}
+	slices.Sort(latencies)
+	rep.P50 = percentile(latencies, 50)
+	rep.P90 = percentile(latencies, 90)
+	rep.P99 = percentile(latencies, 99)
+	rep.Max = percentile(latencies, 100)
+	return rep
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	return sorted[max(i-1, 0)]
+}
+
+// replayConn is a keep-alive connection, redialed after errors or when the
+// server closes it
+type replayConn struct {
+	r    *replayer
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// send writes one request and reads the whole response, returning its status
+func (c *replayConn) send(e entry) (int, error) {
+	if c.conn == nil {
+		if err := c.dial(); err != nil {
+			return 0, err
+		}
+	}
+	c.conn.SetDeadline(time.Now().Add(c.r.timeout))
+
+	body := ""
+	if e.method == "POST" || e.method == "PUT" || e.method == "PATCH" {
+		body = "Content-Length: 0\r\n"
+	}
+	raw := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: rawhttp-replay\r\n%s\r\n", e.method, e.path, c.r.addr, body)
+	if _, err := io.WriteString(c.conn, raw); err != nil {
+		c.close()
+		return 0, err
+	}
+	resp, err := http.ReadResponse(c.br, &http.Request{Method: e.method})
+	if err != nil {
+		c.close()
+		return 0, err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.Close {
+		c.close()
+	}
+	return resp.StatusCode, err
+}
+
+// dial opens the connection
+func (c *replayConn) dial() error {
+	dialer := &net.Dialer{Timeout: c.r.timeout}
+	var err error
+	if c.r.useTLS {
+		c.conn, err = tls.DialWithDialer(dialer, "tcp", c.r.addr, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		c.conn, err = dialer.Dial("tcp", c.r.addr)
+	}
+	if err != nil {
+		c.conn = nil
+		return err
+	}
+	c.br = bufio.NewReader(c.conn)
+	return nil
+}
+
+// close closes the connection, if open
+func (c *replayConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
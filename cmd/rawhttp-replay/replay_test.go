@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/raw-http/server"
+)
+
+// Test both log formats are parsed with their relative timing
+func TestReadLog(t *testing.T) {
+	log := `{"time":"2025-01-01T10:00:00Z","method":"POST","path":"/api/items","status":201}
+{"time":"2025-01-01T10:00:02Z","method":"DELETE","path":"/api/items/1","status":204}
+2025/01/01 10:00:05 GET /ping 200
+2025/01/01 10:00:06 ` + "\x1b[31mGET /missing 404\x1b[0m" + `
+Server starting on :8080
+not json {`
+	entries, err := readLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatalf("readLog failed: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %+v", entries)
+	}
+	if entries[1].at != 2*time.Second || entries[3].method != "GET" || entries[3].path != "/missing" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
+
+// Test a replay against the package's own server
+func TestReplay(t *testing.T) {
+	router := server.NewRouter()
+	router.SetFileResolver(nil)
+	router.Register("GET", "/ping", func(req *server.Request) ([]byte, string) {
+		return server.CreateResponseBytes("200", "text/plain", "OK", []byte("pong"))
+	})
+	router.Register("POST", "/items", func(req *server.Request) ([]byte, string) {
+		return server.Serve201("created")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go router.Serve(listener)
+
+	entries := []entry{
+		{0, "GET", "/ping"},
+		{10 * time.Millisecond, "POST", "/items"},
+		{20 * time.Millisecond, "GET", "/missing"},
+		{40 * time.Millisecond, "GET", "/ping"},
+	}
+	r := &replayer{addr: listener.Addr().String(), timeout: 2 * time.Second, speed: 2, conns: 2}
+	rep := r.run(entries)
+	if rep.Requests != 4 || rep.Errors != 0 {
+		t.Fatalf("Expected 4 requests without errors, got %+v", rep)
+	}
+	if rep.Statuses[200] != 2 || rep.Statuses[201] != 1 || rep.Statuses[404] != 1 {
+		t.Errorf("Unexpected statuses %v", rep.Statuses)
+	}
+	if rep.Duration < 20*time.Millisecond || rep.Max < rep.P50 {
+		t.Errorf("Expected paced replay at 2x, got %+v", rep)
+	}
+}
@@ -0,0 +1,263 @@
+package conformance
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codetesla51/raw-http/server"
+)
+
+// startServer serves a router configured by setup on a loopback port and
+// returns its base URL
+func startServer(t *testing.T, config *server.Config, setup func(r *server.Router)) string {
+	t.Helper()
+	if config == nil {
+		config = server.DefaultConfig()
+	}
+	config.DisableStatic = true
+	router := server.NewRouterWithConfig(config)
+	setup(router)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go router.Serve(listener)
+	return "http://" + listener.Addr().String()
+}
+
+// echo answers with the request body
+func echo(req *server.Request) ([]byte, string) {
+	return server.CreateResponseBytes("200", "text/plain", "OK", req.RawBody)
+}
+
+// readAll reads and closes a response body
+func readAll(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	return string(body)
+}
+
+// Test consecutive requests reuse the same keep-alive connection
+func TestKeepAliveReuse(t *testing.T) {
+	base := startServer(t, nil, func(r *server.Router) {
+		r.Register("GET", "/ping", func(req *server.Request) ([]byte, string) {
+			return server.CreateResponseBytes("200", "text/plain", "OK", []byte("pong"))
+		})
+	})
+	client := &http.Client{Transport: &http.Transport{}}
+
+	var reused []bool
+	for range 3 {
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) }}
+		req, _ := http.NewRequest("GET", base+"/ping", nil)
+		resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if body := readAll(t, resp); resp.StatusCode != 200 || body != "pong" {
+			t.Fatalf("Expected 200 pong, got %d %q", resp.StatusCode, body)
+		}
+	}
+	if len(reused) != 3 || reused[0] || !reused[1] || !reused[2] {
+		t.Errorf("Expected the connection to be reused after the first request, got %v", reused)
+	}
+}
+
+// Test bodies of unknown length are uploaded chunked and decoded
+func TestChunkedUpload(t *testing.T) {
+	var encoding string
+	base := startServer(t, nil, func(r *server.Router) {
+		r.Register("POST", "/echo", func(req *server.Request) ([]byte, string) {
+			encoding = req.Headers["Transfer-Encoding"]
+			return echo(req)
+		})
+	})
+
+	payload := strings.Repeat("chunk-", 5000)
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < len(payload); i += 1000 {
+			pw.Write([]byte(payload[i:min(i+1000, len(payload))]))
+		}
+		pw.Close()
+	}()
+
+	req, _ := http.NewRequest("POST", base+"/echo", pr)
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := readAll(t, resp); body != payload {
+		t.Errorf("Expected %d echoed bytes, got %d", len(payload), len(body))
+	}
+	if encoding != "chunked" {
+		t.Errorf("Expected a chunked upload, got Transfer-Encoding %q", encoding)
+	}
+}
+
+// Test gzip works in both directions with the standard transport
+func TestGzip(t *testing.T) {
+	text := strings.Repeat("compressible text ", 200)
+	base := startServer(t, nil, func(r *server.Router) {
+		r.Use(server.Compress())
+		r.Register("GET", "/text", func(req *server.Request) ([]byte, string) {
+			return server.CreateResponseBytes("200", "text/plain", "OK", []byte(text))
+		})
+		r.Register("POST", "/echo", echo)
+	})
+
+	// The transport asks for gzip and decodes it transparently
+	resp, err := http.Get(base + "/text")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := readAll(t, resp); !resp.Uncompressed || body != text {
+		t.Errorf("Expected a transparently decoded gzip response, got uncompressed=%v and %d bytes", resp.Uncompressed, len(body))
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(text))
+	zw.Close()
+	req, _ := http.NewRequest("POST", base+"/echo", &compressed)
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := readAll(t, resp); body != text {
+		t.Errorf("Expected the gzip request body to be decoded, got %d bytes", len(body))
+	}
+}
+
+// Test handler and header timeouts surface to clients as a 503 and a closed connection
+func TestTimeouts(t *testing.T) {
+	config := server.DefaultConfig()
+	config.HeaderReadTimeout = 100 * time.Millisecond
+	config.HandlerTimeout = 100 * time.Millisecond
+	base := startServer(t, config, func(r *server.Router) {
+		r.Register("GET", "/slow", func(req *server.Request) ([]byte, string) {
+			time.Sleep(time.Second)
+			return server.CreateResponseBytes("200", "text/plain", "OK", nil)
+		})
+	})
+
+	resp, err := http.Get(base + "/slow")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	readAll(t, resp)
+	if resp.StatusCode != http.StatusServiceUnavailable || !resp.Close {
+		t.Errorf("Expected 503 with Connection: close, got %d (close=%v)", resp.StatusCode, resp.Close)
+	}
+
+	// A client that never finishes its headers is disconnected
+	conn, err := net.Dial("tcp", strings.TrimPrefix(base, "http://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: x\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("Expected the server to close the connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the header timeout to apply, took %v", elapsed)
+	}
+}
+
+// Test clients sending Expect: 100-continue get their body through
+func TestExpectContinue(t *testing.T) {
+	base := startServer(t, nil, func(r *server.Router) {
+		r.Register("PUT", "/upload", echo)
+	})
+	// The client would wait this long for 100 Continue before sending anyway
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+
+	req, _ := http.NewRequest("PUT", base+"/upload", strings.NewReader("payload"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Expect", "100-continue")
+	// Without 100 Continue the client still sends the body once the timeout
+	// expires, so the interim response itself is what's checked
+	continued := false
+	trace := &httptrace.ClientTrace{Got100Continue: func() { continued = true }}
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if body := readAll(t, resp); resp.StatusCode != 200 || body != "payload" {
+		t.Errorf("Expected 200 payload, got %d %q", resp.StatusCode, body)
+	}
+	if !continued {
+		t.Error("Expected a 100 Continue before the body was sent")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected an immediate 100 Continue, the client waited %v", elapsed)
+	}
+}
+
+// Test the same scenarios with curl, when it is installed
+func TestCurl(t *testing.T) {
+	curl, err := exec.LookPath("curl")
+	if err != nil {
+		t.Skip("curl not installed")
+	}
+	text := strings.Repeat("compressible text ", 200)
+	base := startServer(t, nil, func(r *server.Router) {
+		r.Use(server.Compress())
+		r.Register("GET", "/text", func(req *server.Request) ([]byte, string) {
+			return server.CreateResponseBytes("200", "text/plain", "OK", []byte(text))
+		})
+		r.Register("POST", "/echo", echo)
+	})
+
+	run := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command(curl, append([]string{"-sS", "--http1.1", "--max-time", "5"}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("curl %v: %v", args, err)
+		}
+		return string(out)
+	}
+
+	// Two transfers in one invocation share the connection
+	out := run("-o", "/dev/null", "-o", "/dev/null", "-w", "%{num_connects}\n", base+"/text", base+"/text")
+	if out != "1\n0\n" {
+		t.Errorf("Expected the second transfer to reuse the connection, got %q", out)
+	}
+
+	if out := run("--compressed", base+"/text"); out != text {
+		t.Errorf("Expected the decompressed body, got %d bytes", len(out))
+	}
+
+	out = run("-H", "Transfer-Encoding: chunked", "-H", "Content-Type: text/plain", "--data-binary", "chunked body", base+"/echo")
+	if out != "chunked body" {
+		t.Errorf("Expected the chunked upload to be echoed, got %q", out)
+	}
+
+	// curl waits a second for 100 Continue before sending the body anyway
+	start := time.Now()
+	out = run("-H", "Expect: 100-continue", "-H", "Content-Type: text/plain", "--data-binary", "expect body", base+"/echo")
+	if out != "expect body" || time.Since(start) > 900*time.Millisecond {
+		t.Errorf("Expected an immediate 100 Continue, got %q after %v", out, time.Since(start))
+	}
+}
@@ -0,0 +1,6 @@
+// Package conformance holds end-to-end tests that drive the server with
+// Go's net/http client and, when installed, curl, to catch interoperability
+// regressions as the parser evolves. It has no exported API; run it with
+//
+//	go test ./conformance
+package conformance
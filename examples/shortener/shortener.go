@@ -0,0 +1,186 @@
+// Package shortener is a URL shortener built on raw-http, installed as a
+// plugin. It is a reference app that combines a JSON API, cookie sessions
+// and hit metrics:
+//
+//	srv := server.NewServer(":8080")
+//	if err := srv.Install(shortener.New(shortener.NewMemoryStore())); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// Routes:
+//
+//	POST /api/links        create a link from {"url": "...", "code": "optional"}
+//	GET  /api/links        list the links created in this session
+//	GET  /api/links/:code  link details with its hit count
+//	GET  /api/metrics      totals in Prometheus text format
+//	GET  /s/:code          redirect to the link's URL, counting a hit
+package shortener
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/codetesla51/raw-http/server"
+)
+
+// SessionCookie names the cookie that identifies who created a link
+const SessionCookie = "shortener_session"
+
+// codeLength is the length of generated codes
+const codeLength = 7
+
+// Shortener is the URL shortener plugin
+type Shortener struct {
+	Store  Store
+	Random server.RandomSource // Source of codes and session IDs; CryptoRandom if nil
+
+	created   atomic.Int64
+	redirects atomic.Int64
+	misses    atomic.Int64
+}
+
+// New creates a shortener backed by store
+func New(store Store) *Shortener {
+	return &Shortener{Store: store}
+}
+
+func (s *Shortener) Init(srv *server.Server) error {
+	if s.Store == nil {
+		return errors.New("no store configured")
+	}
+	if s.Random == nil {
+		s.Random = server.CryptoRandom
+	}
+	return nil
+}
+
+func (s *Shortener) RegisterRoutes(r *server.Router) {
+	r.Register("POST", "/api/links", s.create)
+	r.Register("GET", "/api/links", s.list)
+	r.Register("GET", "/api/links/:code", s.stats)
+	r.Register("GET", "/api/metrics", s.metrics)
+	r.Register("GET", "/s/:code", s.resolve)
+}
+
+// Shutdown closes the store if it holds resources
+func (s *Shortener) Shutdown() error {
+	if closer, ok := s.Store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// create handles POST /api/links
+func (s *Shortener) create(req *server.Request) ([]byte, string) {
+	target, err := url.Parse(req.Body["url"])
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return server.Serve400("url must be an absolute http(s) URL")
+	}
+	owner, newSession := s.session(req)
+	link := Link{URL: target.String(), Owner: owner, Created: time.Now()}
+
+	if code := req.Body["code"]; code != "" {
+		if !validCode(code) {
+			return server.Serve400("code may only contain letters, digits, '-' and '_' (max 32)")
+		}
+		link.Code = code
+		err = s.Store.Create(link)
+	} else {
+		// Generated codes rarely collide; retry a few times if they do
+		for range 3 {
+			link.Code = server.NewToken(s.Random)[:codeLength]
+			if err = s.Store.Create(link); !errors.Is(err, ErrCodeTaken) {
+				break
+			}
+		}
+	}
+	if errors.Is(err, ErrCodeTaken) {
+		return server.Respond(server.StatusConflict, "text/plain", []byte("code already taken"))
+	}
+	if err != nil {
+		return server.Serve500("could not save link")
+	}
+	s.created.Add(1)
+
+	response, status := server.ServeJSON("201", link)
+	response = server.AddResponseHeaders(response, map[string]string{"Location": "/api/links/" + link.Code})
+	if newSession {
+		response = server.SetCookie(response, &server.Cookie{
+			Name: SessionCookie, Value: owner, Path: "/", HttpOnly: true, SameSite: server.SameSiteLax,
+		})
+	}
+	return response, status
+}
+
+// list handles GET /api/links
+func (s *Shortener) list(req *server.Request) ([]byte, string) {
+	owner := req.Cookies[SessionCookie]
+	links := []Link{}
+	if owner != "" {
+		var err error
+		if links, err = s.Store.List(owner); err != nil {
+			return server.Serve500("could not list links")
+		}
+	}
+	return server.ServeJSON("200", links)
+}
+
+// stats handles GET /api/links/:code
+func (s *Shortener) stats(req *server.Request) ([]byte, string) {
+	link, err := s.Store.Get(req.PathParams["code"])
+	if errors.Is(err, ErrNotFound) {
+		return server.Respond(server.StatusNotFound, "text/plain", []byte("no such link"))
+	}
+	if err != nil {
+		return server.Serve500("could not load link")
+	}
+	return server.ServeJSON("200", link)
+}
+
+// resolve handles GET /s/:code
+func (s *Shortener) resolve(req *server.Request) ([]byte, string) {
+	link, err := s.Store.Hit(req.PathParams["code"])
+	if errors.Is(err, ErrNotFound) {
+		s.misses.Add(1)
+		return server.Respond(server.StatusNotFound, "text/plain", []byte("no such link"))
+	}
+	if err != nil {
+		return server.Serve500("could not load link")
+	}
+	s.redirects.Add(1)
+	return server.Serve302(link.URL)
+}
+
+// metrics handles GET /api/metrics
+func (s *Shortener) metrics(req *server.Request) ([]byte, string) {
+	body := fmt.Sprintf("# TYPE shortener_links_created_total counter\nshortener_links_created_total %d\n"+
+		"# TYPE shortener_redirects_total counter\nshortener_redirects_total %d\n"+
+		"# TYPE shortener_misses_total counter\nshortener_misses_total %d\n",
+		s.created.Load(), s.redirects.Load(), s.misses.Load())
+	return server.CreateResponseBytes("200", "text/plain; version=0.0.4", "OK", []byte(body))
+}
+
+// session returns the caller's session ID, minting one if the request has none
+func (s *Shortener) session(req *server.Request) (id string, isNew bool) {
+	if id := req.Cookies[SessionCookie]; id != "" {
+		return id, false
+	}
+	return server.NewToken(s.Random), true
+}
+
+// validCode reports whether a custom code is safe to use in a URL path
+func validCode(code string) bool {
+	if len(code) > 32 {
+		return false
+	}
+	for _, c := range code {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package shortener
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"testing"
+
+	"github.com/codetesla51/raw-http/server"
+)
+
+// Test creating, listing, resolving and counting links over a live server
+func TestShortener(t *testing.T) {
+	srv := server.NewServer("")
+	if err := srv.Install(&Shortener{Store: NewMemoryStore(), Random: server.NewDeterministicRandom(1)}); err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go srv.Router.Serve(ln)
+	base := "http://" + ln.Addr().String()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar:           jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	post := func(body string) *http.Response {
+		resp, err := client.Post(base+"/api/links", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := post(`{"url":"https://example.com/docs"}`)
+	if resp.StatusCode != 201 || !strings.HasPrefix(resp.Header.Get("Location"), "/api/links/") {
+		t.Fatalf("Expected 201 with Location, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if post(`{"url":"https://example.com/","code":"home"}`).StatusCode != 201 {
+		t.Fatal("Expected custom code to be created")
+	}
+	for body, status := range map[string]int{
+		`{"url":"https://example.com/","code":"home"}`: 409,
+		`{"url":"javascript:alert(1)"}`:                400,
+		`{"url":"https://example.com/","code":"a/b"}`:  400,
+	} {
+		if got := post(body).StatusCode; got != status {
+			t.Errorf("Expected %d for %s, got %d", status, body, got)
+		}
+	}
+
+	// The session cookie ties both links to this client
+	resp, err = client.Get(base + "/api/links")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	var links []Link
+	json.NewDecoder(resp.Body).Decode(&links)
+	resp.Body.Close()
+	if len(links) != 2 {
+		t.Fatalf("Expected 2 links in the session, got %+v", links)
+	}
+	if resp, _ := http.Get(base + "/api/links"); resp != nil {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "[]" {
+			t.Errorf("Expected no links without a session, got %s", body)
+		}
+	}
+
+	for range 2 {
+		resp, err = client.Get(base + "/s/home")
+		if err != nil || resp.StatusCode != 302 || resp.Header.Get("Location") != "https://example.com/" {
+			t.Fatalf("Expected redirect to https://example.com/, got %v %v", resp, err)
+		}
+		resp.Body.Close()
+	}
+	if resp, _ = client.Get(base + "/s/nope"); resp.StatusCode != 404 {
+		t.Errorf("Expected 404 for an unknown code, got %d", resp.StatusCode)
+	}
+
+	resp, _ = client.Get(base + "/api/links/home")
+	var link Link
+	json.NewDecoder(resp.Body).Decode(&link)
+	resp.Body.Close()
+	if link.Hits != 2 {
+		t.Errorf("Expected 2 hits, got %+v", link)
+	}
+
+	resp, _ = client.Get(base + "/api/metrics")
+	metrics, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{"shortener_links_created_total 2", "shortener_redirects_total 2", "shortener_misses_total 1"} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("Expected %q in metrics:\n%s", want, metrics)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package shortener
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for codes that have no link
+	ErrNotFound = errors.New("shortener: link not found")
+	// ErrCodeTaken is returned when creating a link under a code in use
+	ErrCodeTaken = errors.New("shortener: code already taken")
+)
+
+// Link maps a short code to a target URL
+type Link struct {
+	Code    string    `json:"code"`
+	URL     string    `json:"url"`
+	Owner   string    `json:"-"` // Session that created the link
+	Hits    int64     `json:"hits"`
+	Created time.Time `json:"created"`
+}
+
+// Store persists links. Implementations must be safe for concurrent use;
+// a database-backed store only needs these four operations.
+type Store interface {
+	// Create saves a new link, returning ErrCodeTaken if its code is in use
+	Create(link Link) error
+	// Get returns the link for a code, or ErrNotFound
+	Get(code string) (Link, error)
+	// Hit counts a visit and returns the updated link, or ErrNotFound
+	Hit(code string) (Link, error)
+	// List returns the links created by an owner, newest first
+	List(owner string) ([]Link, error)
+}
+
+// MemoryStore keeps links in memory; they are lost on restart
+type MemoryStore struct {
+	mu    sync.Mutex
+	links map[string]*Link
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{links: make(map[string]*Link)}
+}
+
+func (m *MemoryStore) Create(link Link) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.links[link.Code]; ok {
+		return ErrCodeTaken
+	}
+	m.links[link.Code] = &link
+	return nil
+}
+
+func (m *MemoryStore) Get(code string) (Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link, ok := m.links[code]
+	if !ok {
+		return Link{}, ErrNotFound
+	}
+	return *link, nil
+}
+
+func (m *MemoryStore) Hit(code string) (Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	link, ok := m.links[code]
+	if !ok {
+		return Link{}, ErrNotFound
+	}
+	link.Hits++
+	return *link, nil
+}
+
+func (m *MemoryStore) List(owner string) ([]Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	links := []Link{}
+	for _, link := range m.links {
+		if link.Owner == owner {
+			links = append(links, *link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Created.After(links[j].Created) })
+	return links, nil
+}
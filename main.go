@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -9,10 +10,24 @@ import (
 )
 
 func main() {
+	routes := flag.String("routes", "", "JSON route table (static mounts, redirects, proxies) to load")
+	flag.Parse()
+
 	// Create server with HTTPS support
 	srv := server.NewServer(":8080")
 	srv.EnableTLS(":8443", "server.crt", "server.key")
 
+	// Declarative routes, so the binary can act as a gateway
+	if *routes != "" {
+		table, err := server.LoadRouteTable(*routes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := table.Apply(srv.Router); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// API endpoint with query parameter
 	srv.Register("GET", "/data", func(req *server.Request) ([]byte, string) {
 		id := req.Query["id"]
@@ -60,7 +75,7 @@ func main() {
 	})
 
 	// Start server (graceful shutdown on Ctrl+C)
-	if err := srv.ListenAndServe(); err != nil {
+	if err := srv.ListenAndServe(""); err != nil {
 		log.Fatal(err)
 	}
 }
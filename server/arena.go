@@ -0,0 +1,67 @@
+//go:build rawhttp_arena
+
+package server
+
+import (
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// arenaSlabSize is the per-request slab; strings that don't fit fall back to the heap
+const arenaSlabSize = 16 * 1024
+
+// requestArena is an experimental per-request bump allocator, enabled with
+// the rawhttp_arena build tag. Header strings are carved out of one slab,
+// which is recycled wholesale when the request finishes. Handlers and
+// middleware must not keep header strings after returning; state that
+// outlives the request (cookies, usage counters, tokens) is copied out.
+// The arena of a handler still running after HandlerTimeout is abandoned
+// to the garbage collector rather than recycled.
+type requestArena struct {
+	slab      []byte
+	abandoned bool
+}
+
+var arenaPool = sync.Pool{
+	New: func() any {
+		return &requestArena{slab: make([]byte, 0, arenaSlabSize)}
+	},
+}
+
+// newRequestArena takes an arena from the pool
+func newRequestArena() *requestArena {
+	return arenaPool.Get().(*requestArena)
+}
+
+// string copies b into the slab and returns a string backed by it
+func (a *requestArena) string(b []byte) string {
+	if a == nil || len(b) == 0 || len(a.slab)+len(b) > cap(a.slab) {
+		return string(b)
+	}
+	start := len(a.slab)
+	a.slab = append(a.slab, b...)
+	return unsafe.String(&a.slab[start], len(b))
+}
+
+// escape returns a heap copy of s, which may be backed by the slab
+func (a *requestArena) escape(s string) string {
+	return strings.Clone(s)
+}
+
+// abandon leaves the slab to the garbage collector instead of the pool,
+// for requests whose handler may still be reading it
+func (a *requestArena) abandon() {
+	if a != nil {
+		a.abandoned = true
+	}
+}
+
+// release resets the arena and returns it to the pool
+func (a *requestArena) release() {
+	if a == nil || a.abandoned {
+		return
+	}
+	a.slab = a.slab[:0]
+	arenaPool.Put(a)
+}
@@ -0,0 +1,28 @@
+//go:build !rawhttp_arena
+
+package server
+
+// requestArena is a no-op unless built with the rawhttp_arena tag: strings
+// and maps are ordinary heap allocations owned by the garbage collector
+type requestArena struct{}
+
+// newRequestArena returns the no-op arena
+func newRequestArena() *requestArena {
+	return nil
+}
+
+// string returns a heap copy of b
+func (a *requestArena) string(b []byte) string {
+	return string(b)
+}
+
+// escape returns s, which is already on the heap
+func (a *requestArena) escape(s string) string {
+	return s
+}
+
+// abandon does nothing
+func (a *requestArena) abandon() {}
+
+// release does nothing
+func (a *requestArena) release() {}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// Principal is the authenticated caller, as resolved by a PrincipalLoader
+type Principal struct {
+	ID          string
+	Roles       []string
+	Permissions []string
+}
+
+// HasRole reports whether the principal has the role
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && slices.Contains(p.Roles, role)
+}
+
+// HasPermission reports whether the principal has the permission
+func (p *Principal) HasPermission(permission string) bool {
+	return p != nil && slices.Contains(p.Permissions, permission)
+}
+
+// PrincipalLoader resolves the caller of a request, e.g. from a session
+// cookie or a bearer token. It returns nil when the caller is anonymous.
+type PrincipalLoader func(req *Request) (*Principal, error)
+
+// RequireRoles restricts the route to principals holding any of the roles.
+// It takes effect with the Authorize middleware.
+func RequireRoles(roles ...string) RouteOption {
+	return func(rt *route) {
+		rt.roles = append(rt.roles, roles...)
+	}
+}
+
+// RequirePermissions restricts the route to principals holding all of the
+// permissions. It takes effect with the Authorize middleware.
+func RequirePermissions(permissions ...string) RouteOption {
+	return func(rt *route) {
+		rt.permissions = append(rt.permissions, permissions...)
+	}
+}
+
+// Authorize enforces RequireRoles and RequirePermissions. Guarded routes
+// consult load: anonymous callers get a 401, callers lacking a role or
+// permission a 403, both with a JSON {"error": ...} body. The principal is
+// available to handlers through req.Principal. Unguarded routes skip load.
+func Authorize(load PrincipalLoader) Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			rt := req.route
+			if rt == nil || (len(rt.roles) == 0 && len(rt.permissions) == 0) {
+				return next(req)
+			}
+
+			principal, err := load(req)
+			if err != nil || principal == nil {
+				return authzError("401", "Unauthorized", "authentication required")
+			}
+			if len(rt.roles) > 0 && !slices.ContainsFunc(rt.roles, principal.HasRole) {
+				return authzError("403", "Forbidden", "missing required role")
+			}
+			for _, permission := range rt.permissions {
+				if !principal.HasPermission(permission) {
+					return authzError("403", "Forbidden", "missing required permission")
+				}
+			}
+
+			req.principal = principal
+			return next(req)
+		}
+	}
+}
+
+// Principal returns the caller resolved by Authorize, or nil
+func (req *Request) Principal() *Principal {
+	return req.principal
+}
+
+// authzError builds the JSON error response of Authorize
+func authzError(status, statusText, msg string) ([]byte, string) {
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	return CreateResponseBytes(status, "application/json", statusText, body)
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errInvalidChunk reports a malformed chunked request body
+var errInvalidChunk = errors.New("invalid chunked encoding")
+
+// maxChunkLineSize bounds chunk-size and trailer lines
+const maxChunkLineSize = 4096
+
+// isChunked reports whether chunked is the final transfer coding
+func isChunked(transferEncoding string) bool {
+	codings := strings.Split(transferEncoding, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// readChunkedBody decodes a whole chunked request body from src, capped at
+// maxSize (0 means unlimited)
+func readChunkedBody(src io.Reader, maxSize int64, report func(received, total int64)) ([]byte, error) {
+	return io.ReadAll(limitBody(&chunkedReader{src: src, report: report}, maxSize))
+}
+
+// chunkedReader decodes chunked Transfer-Encoding as it is read, stopping at
+// the terminating chunk so pipelined data on the connection isn't consumed.
+// Chunk extensions and trailers are discarded.
+type chunkedReader struct {
+	src       io.Reader
+	remaining int64 // unread bytes of the current chunk
+	needCRLF  bool  // a chunk's data was read and its CRLF is pending
+	done      bool
+	received  int64
+	report    func(received, total int64)
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for cr.remaining == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := cr.src.Read(p[:min(int64(len(p)), cr.remaining)])
+	cr.remaining -= int64(n)
+	cr.received += int64(n)
+	if cr.remaining == 0 {
+		cr.needCRLF = true
+		if cr.report != nil {
+			cr.report(cr.received, -1)
+		}
+	}
+	if err == io.EOF && cr.remaining > 0 {
+		return n, errInvalidChunk
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// nextChunk reads the next chunk-size line, or the trailers after the last chunk
+func (cr *chunkedReader) nextChunk() error {
+	if cr.needCRLF {
+		if crlf, err := readChunkLine(cr.src); err != nil || crlf != "" {
+			return errInvalidChunk
+		}
+		cr.needCRLF = false
+	}
+
+	line, err := readChunkLine(cr.src)
+	if err != nil {
+		return err
+	}
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+	if err != nil || size < 0 {
+		return errInvalidChunk
+	}
+	if size > 0 {
+		cr.remaining = size
+		return nil
+	}
+
+	// Skip trailer fields up to the final empty line
+	for {
+		trailer, err := readChunkLine(cr.src)
+		if err != nil {
+			return err
+		}
+		if trailer == "" {
+			cr.done = true
+			return nil
+		}
+	}
+}
+
+// readChunkLine reads one CRLF-terminated line a byte at a time
+func readChunkLine(src io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) <= maxChunkLineSize {
+		if _, err := io.ReadFull(src, b); err != nil {
+			return "", errInvalidChunk
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errInvalidChunk
+}
+
+// bodyLimitReader fails with errBodyTooLarge once more than its limit is read
+type bodyLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+// limitBody caps r at maxSize bytes; 0 means unlimited
+func limitBody(r io.Reader, maxSize int64) io.Reader {
+	if maxSize <= 0 {
+		return r
+	}
+	return &bodyLimitReader{r: r, remaining: maxSize}
+}
+
+func (l *bodyLimitReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// At the limit: any further byte means the body is too large
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// continueResponse is the interim response inviting a client to send its body
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// continueBody answers an Expect header before the body is read. For
+// "100-continue" it sends 100 Continue when a body is expected and hasn't
+// arrived yet, or refuses with 413 when its declared length is over
+// maxBody. Other expectations are refused with 417. HTTP/1.0 requests
+// are exempt (RFC 9110 section 10.1.1).
+func (r *Router) continueBody(conn net.Conn, br *bufio.Reader, proto string, headerMap Headers, maxBody int64) ([]byte, string, bool) {
+	expect := headerMap.Get("Expect")
+	if expect == "" || proto == "HTTP/1.0" {
+		return nil, "", false
+	}
+	if !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+		resp, status := CreateResponseBytes("417", "text/plain", "Expectation Failed", []byte("Unsupported expectation: "+expect))
+		return resp, status, true
+	}
+
+	contentLength, _ := strconv.ParseInt(headerMap.Get("Content-Length"), 10, 64)
+	if maxBody > 0 && contentLength > maxBody {
+		resp, status := Serve413("Request body too large")
+		return resp, status, true
+	}
+	if conn == nil || br.Buffered() > 0 || contentLength <= 0 && !isChunked(headerMap.Get("Transfer-Encoding")) {
+		return nil, "", false
+	}
+	if r.config.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(r.config.WriteTimeout))
+	}
+	conn.Write(continueResponse)
+	return nil, "", false
+}
+
+// errInvalidContentLength is returned for a malformed or negative
+// Content-Length, including differing repeated values
+var errInvalidContentLength = errors.New("invalid Content-Length")
+
+// connReader reads from src, the buffered reader of conn, refreshing the
+// read deadline before every read so a long body only times out when the
+// client stalls
+type connReader struct {
+	src     io.Reader
+	conn    net.Conn // nil when src isn't backed by a connection
+	timeout time.Duration
+}
+
+func (c connReader) Read(p []byte) (int, error) {
+	if c.conn != nil {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.src.Read(p)
+}
+
+// bodyStream is the live request body of a StreamBody route
+type bodyStream struct {
+	framed  io.Reader // body bytes after Content-Length or chunked framing
+	decoded io.Reader // framed, decompressed and size-limited
+	eof     bool
+}
+
+func (s *bodyStream) Read(p []byte) (int, error) {
+	n, err := s.decoded.Read(p)
+	if err == io.EOF {
+		s.eof = true
+	}
+	return n, err
+}
+
+// drain discards up to limit unread body bytes, reporting whether the whole
+// body has then been consumed from the connection
+func (s *bodyStream) drain(limit int64) bool {
+	if s.eof {
+		return true
+	}
+	n, err := io.CopyN(io.Discard, s.framed, max(limit, 0)+1)
+	return n <= limit && err == io.EOF
+}
+
+// declaredLength is the body size announced by the request head: the
+// Content-Length, 0 without a body, or -1 when the body is chunked
+func declaredLength(headerMap Headers) int64 {
+	if isChunked(headerValue(headerMap, "Transfer-Encoding")) {
+		return -1
+	}
+	contentLength, err := strconv.ParseInt(headerMap.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return contentLength
+}
+
+// openBodyStream prepares the body of a StreamBody request without reading
+// it from br, the buffered reader of conn
+func (r *Router) openBodyStream(conn net.Conn, br *bufio.Reader, headerMap Headers, maxBody int64) (*bodyStream, error) {
+	src := connReader{src: br, conn: conn, timeout: r.config.bodyReadTimeout()}
+
+	var framed io.Reader
+	switch {
+	case isChunked(headerValue(headerMap, "Transfer-Encoding")):
+		framed = &chunkedReader{src: src}
+	case headerMap.Get("Content-Length") != "":
+		contentLength, err := strconv.ParseInt(headerMap.Get("Content-Length"), 10, 64)
+		if err != nil || contentLength < 0 {
+			return nil, errInvalidContentLength
+		}
+		if maxBody > 0 && contentLength > maxBody {
+			return nil, errBodyTooLarge
+		}
+		framed = io.LimitReader(src, contentLength)
+	default:
+		framed = bytes.NewReader(nil)
+	}
+
+	decoded, err := newBodyDecoder(headerValue(headerMap, "Content-Encoding"), framed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bodyStream{framed: framed, decoded: limitBody(decoded, maxBody)}, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
+)
+
+// BodyParser fills req.Body from a request body that has been read and
+// decoded. contentType is the request's Content-Type header. An error is
+// answered with 400 Bad Request.
+type BodyParser func(contentType string, body []byte) (map[string]string, error)
+
+// WithBodyParser replaces the automatic body parsing of a route, e.g.
+// WithBodyParser(ParseJSONBody) for JSON endpoints that shouldn't fall back
+// to form parsing. A nil parser leaves Body nil, for binary endpoints that
+// only read RawBody.
+func WithBodyParser(parser BodyParser) RouteOption {
+	return func(rt *route) {
+		rt.bodyParser = parser
+		rt.customBody = true
+	}
+}
+
+// ParseFormBody parses a URL-encoded body
+func ParseFormBody(contentType string, body []byte) (map[string]string, error) {
+	return parseKeyValuePairsFromBytes(body), nil
+}
+
+// ParseJSONBody parses a JSON object, formatting each value with %v. Unlike
+// the automatic parsing it rejects bodies that aren't a JSON object.
+func ParseJSONBody(contentType string, body []byte) (map[string]string, error) {
+	var jsonData map[string]any
+	if err := json.Unmarshal(body, &jsonData); err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(jsonData))
+	for key, value := range jsonData {
+		result[key] = fmt.Sprintf("%v", value)
+	}
+	return result, nil
+}
+
+// ParseMultipartBody parses the fields of a multipart/form-data body. File
+// parts are skipped; read them with mime/multipart from req.BodyReader().
+func ParseMultipartBody(contentType string, body []byte) (map[string]string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return nil, errors.New("not a multipart body")
+	}
+
+	result := make(map[string]string)
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "" || part.FileName() != "" {
+			continue
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		result[part.FormName()] = string(value)
+	}
+}
+
+// parseBodyAuto is the default BodyParser: JSON for JSON content types,
+// URL-encoded form otherwise. Malformed JSON yields an empty map and the
+// syntax error; valid JSON that isn't an object yields just an empty map.
+func parseBodyAuto(contentType string, body []byte) (map[string]string, error) {
+	if strings.Contains(contentType, "application/json") {
+		result, err := ParseJSONBody(contentType, body)
+		if err != nil {
+			if json.Valid(body) {
+				err = nil
+			}
+			return make(map[string]string), err
+		}
+		return result, nil
+	}
+	return parseKeyValuePairsFromBytes(body), nil
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheEntries bounds how many resources a ResponseCache or AutoETag
+// keeps; the least recently used one is dropped to make room
+const maxCacheEntries = 1024
+
+// maxCacheVariants bounds the Vary variants kept per resource
+const maxCacheVariants = 16
+
+// ResponseCache caches successful GET responses in memory for a fixed TTL.
+// When a cached response carries an ETag header, requests whose If-None-Match
+// matches it get a 304 without invoking the handler.
+// Responses are cached per Host and per value of the request headers they
+// Vary on. Requests with Authorization or Cookie headers bypass the cache,
+// and responses setting cookies or marked Cache-Control private, no-store
+// or no-cache aren't stored. Routes registered with NoCache are never cached.
+type ResponseCache struct {
+	Clock Clock // Time source for expiry; nil means SystemClock
+
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries *varyCache[cacheEntry]
+}
+
+// cacheEntry is a cached response and its expiry time
+type cacheEntry struct {
+	response []byte
+	status   string
+	etag     string
+	expires  time.Time
+}
+
+// NewResponseCache creates a cache that keeps responses for ttl
+func NewResponseCache(ttl time.Duration) *ResponseCache {
+	return &ResponseCache{ttl: ttl, entries: newVaryCache[cacheEntry]()}
+}
+
+// Middleware returns the caching middleware
+func (c *ResponseCache) Middleware() Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			if req.Method != "GET" || (req.route != nil && req.route.noCache) || !sharedRequest(req) {
+				return next(req)
+			}
+
+			now := clockOrSystem(c.Clock).Now()
+
+			c.mu.Lock()
+			entry, ok := c.entries.get(req)
+			c.mu.Unlock()
+			ifNoneMatch := headerValue(req.Headers, "If-None-Match")
+			if ok && now.Before(entry.expires) {
+				if entry.etag != "" && etagMatches(ifNoneMatch, entry.etag) {
+					return Serve304(entry.etag)
+				}
+				return entry.response, entry.status
+			}
+
+			response, status := next(req)
+			head, _, ok := splitResponse(response)
+			if StatusCode(status) != StatusOK || !ok || !storableResponse(head) {
+				return response, status
+			}
+
+			etag := responseHeader(head, "ETag")
+			c.mu.Lock()
+			c.entries.put(req, head, cacheEntry{response: response, status: status, etag: etag, expires: now.Add(c.ttl)})
+			c.mu.Unlock()
+
+			if etag != "" && etagMatches(ifNoneMatch, etag) {
+				return Serve304(etag)
+			}
+			return response, status
+		}
+	}
+}
+
+// Purge removes every cached response
+func (c *ResponseCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.clear()
+}
+
+// PurgeKey removes the cached responses of one resource and reports how
+// many resources were removed. Keys are host, path and sorted query, e.g.
+// "example.com/articles?page=2"; a key starting with "/" matches the path
+// and query on every host.
+func (c *ResponseCache) PurgeKey(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.removeKeys(func(k string) bool { return purgeMatch(k, key, false) })
+}
+
+// PurgePrefix removes the cached responses of every resource whose key
+// starts with prefix, e.g. "/articles/" after an editor publishes, and
+// reports how many resources were removed
+func (c *ResponseCache) PurgePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.removeKeys(func(k string) bool { return purgeMatch(k, prefix, true) })
+}
+
+// PurgeExpired removes the responses whose TTL has passed, which otherwise
+// stay in memory until evicted, and reports how many were removed
+func (c *ResponseCache) PurgeExpired() int {
+	now := clockOrSystem(c.Clock).Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.removeValues(func(entry cacheEntry) bool { return !now.Before(entry.expires) })
+}
+
+// Purger is a cache whose entries can be removed before they expire:
+// ResponseCache and ETagCache
+type Purger interface {
+	Purge()
+	PurgeKey(key string) int
+	PurgePrefix(prefix string) int
+	PurgeExpired() int
+}
+
+// PurgeHandler returns an admin endpoint purging caches: the "key" query
+// parameter purges one resource, "prefix" every resource below it,
+// "expired=1" only the expired entries, and none of them
+// everything. It answers {"purged":n}. Protect the route, e.g. with
+// RequireRoles, since anyone reaching it can empty the caches.
+//
+//	router.Register("POST", "/admin/purge", server.PurgeHandler(cache, etags), server.RequireRoles("editor"))
+func PurgeHandler(caches ...Purger) RouteHandler {
+	return func(req *Request) ([]byte, string) {
+		purged := 0
+		for _, cache := range caches {
+			switch {
+			case req.Query["key"] != "":
+				purged += cache.PurgeKey(req.Query["key"])
+			case req.Query["prefix"] != "":
+				purged += cache.PurgePrefix(req.Query["prefix"])
+			case req.Query["expired"] != "":
+				purged += cache.PurgeExpired()
+			default:
+				purged += cache.PurgePrefix("")
+			}
+		}
+		return ServeJSON("200", map[string]int{"purged": purged})
+	}
+}
+
+// sharedRequest reports whether a request carries no credentials, so its
+// response may be shared with other clients
+func sharedRequest(req *Request) bool {
+	return headerValue(req.Headers, "Authorization") == "" && headerValue(req.Headers, "Cookie") == ""
+}
+
+// storableResponse reports whether a response may be kept for other
+// clients: it sets no cookies and Cache-Control doesn't forbid it
+func storableResponse(head []byte) bool {
+	if responseHeader(head, "Set-Cookie") != "" {
+		return false
+	}
+	for _, directive := range strings.Split(responseHeader(head, "Cache-Control"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "private") || strings.EqualFold(name, "no-store") || strings.EqualFold(name, "no-cache") {
+			return false
+		}
+	}
+	return true
+}
+
+// varyCache keeps values per resource (Host, path and query) and, within
+// a resource, per value of the request headers its responses Vary on.
+// At most maxCacheEntries resources are kept. Callers synchronize access.
+type varyCache[V any] struct {
+	resources *lru[*varyResource[V]]
+}
+
+// varyResource holds the variants of one resource
+type varyResource[V any] struct {
+	vary     []string // canonical request header names, sorted
+	variants map[string]V
+}
+
+// newVaryCache creates an empty varyCache
+func newVaryCache[V any]() *varyCache[V] {
+	return &varyCache[V]{resources: newLRU[*varyResource[V]](maxCacheEntries)}
+}
+
+// get returns the value stored for the request's resource and variant
+func (c *varyCache[V]) get(req *Request) (V, bool) {
+	res, ok := c.resources.get(cacheKey(req))
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	value, ok := res.variants[variantKey(req, res.vary)]
+	return value, ok
+}
+
+// put stores value for the request, varying on the headers named by the
+// Vary header of the response head. "Vary: *" responses aren't stored.
+func (c *varyCache[V]) put(req *Request, head []byte, value V) {
+	vary := responseVary(head)
+	if slices.Contains(vary, "*") {
+		return
+	}
+	key := cacheKey(req)
+	res, ok := c.resources.get(key)
+	if !ok || !slices.Equal(res.vary, vary) {
+		res = &varyResource[V]{vary: vary, variants: make(map[string]V)}
+		c.resources.put(key, res)
+	}
+	if len(res.variants) >= maxCacheVariants {
+		clear(res.variants)
+	}
+	res.variants[variantKey(req, vary)] = value
+}
+
+// clear drops every stored value
+func (c *varyCache[V]) clear() {
+	c.resources.clear()
+}
+
+// removeKeys drops the resources whose key matches and returns how many
+// were dropped
+func (c *varyCache[V]) removeKeys(match func(key string) bool) int {
+	return c.resources.removeFunc(func(key string, _ *varyResource[V]) bool {
+		return match(key)
+	})
+}
+
+// removeValues drops the variants whose value matches, and resources left
+// without variants, and returns how many variants were dropped
+func (c *varyCache[V]) removeValues(match func(value V) bool) int {
+	removed := 0
+	c.resources.removeFunc(func(_ string, res *varyResource[V]) bool {
+		for variant, value := range res.variants {
+			if match(value) {
+				delete(res.variants, variant)
+				removed++
+			}
+		}
+		return len(res.variants) == 0
+	})
+	return removed
+}
+
+// purgeMatch reports whether a cache key equals pattern, or starts with it
+// when prefix is set. A pattern starting with "/" is compared with the
+// path and query of the key, ignoring its host.
+func purgeMatch(key, pattern string, prefix bool) bool {
+	if strings.HasPrefix(pattern, "/") {
+		if i := strings.IndexByte(key, '/'); i >= 0 {
+			key = key[i:]
+		}
+	}
+	if prefix {
+		return strings.HasPrefix(key, pattern)
+	}
+	return key == pattern
+}
+
+// cacheKey identifies a resource by host, path and sorted query string
+func cacheKey(req *Request) string {
+	key := hostName(req.Host) + req.Path
+	if len(req.Query) == 0 {
+		return key
+	}
+	return key + "?" + queryValues(req.Query).Encode()
+}
+
+// responseVary lists the request headers a response head varies on
+func responseVary(head []byte) []string {
+	var vary []string
+	for _, name := range strings.Split(responseHeader(head, "Vary"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			vary = append(vary, CanonicalHeaderKey(name))
+		}
+	}
+	slices.Sort(vary)
+	return slices.Compact(vary)
+}
+
+// variantKey joins the request's values of the vary headers
+func variantKey(req *Request, vary []string) string {
+	var b strings.Builder
+	for _, name := range vary {
+		b.WriteString(headerValue(req.Headers, name))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison RFC 9110 prescribes for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ClientIP returns the IP of the client that sent the request. When the
+// connected peer is one of Config.TrustedProxies, the Config.ForwardedHeader
+// it added is followed from the right, skipping further trusted proxies, to
+// the first address the proxies didn't vouch for. Otherwise, and for
+// untrusted peers whose headers could be forged, it is the IP of RemoteAddr.
+func (req *Request) ClientIP() string {
+	peer := remoteIP(req)
+	addr, err := netip.ParseAddr(peer)
+	if err != nil || !isTrustedProxy(req.trustedProxies, addr) {
+		return peer
+	}
+
+	client := peer
+	hops := forwardedHops(req.Headers, req.forwardedHeader)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			// "unknown" or an obfuscated identifier hides the rest of the chain
+			break
+		}
+		client = hop.Unmap().String()
+		if !isTrustedProxy(req.trustedProxies, hop) {
+			break
+		}
+	}
+	return client
+}
+
+// isTrustedProxy reports whether addr is in one of the trusted prefixes
+func isTrustedProxy(trusted []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHops lists the client addresses recorded by proxies in the
+// named header, oldest first; "" means X-Forwarded-For
+func forwardedHops(headers Headers, name string) []string {
+	switch CanonicalHeaderKey(name) {
+	case "Forwarded":
+		elements := headers.Values("Forwarded")
+		hops := make([]string, 0, len(elements))
+		for _, element := range elements {
+			hops = append(hops, forwardedFor(element))
+		}
+		return hops
+	case "X-Real-Ip":
+		if realIP := strings.TrimSpace(headers.Get("X-Real-IP")); realIP != "" {
+			return []string{realIP}
+		}
+		return nil
+	default:
+		return headers.Values("X-Forwarded-For")
+	}
+}
+
+// forwardedFor extracts the address of the for= parameter of a Forwarded
+// element, e.g. `for="[2001:db8::1]:4711";proto=https` gives 2001:db8::1.
+// It returns "" when the element has none.
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !strings.EqualFold(key, "for") {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if host, _, err := net.SplitHostPort(value); err == nil {
+			return host
+		}
+		return strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// StreamCommand starts cmd and streams its standard output to w as
+// text/plain chunks, flushing after every read so output such as a build
+// log appears while the process runs. A client that disconnects makes the
+// next write fail, which kills the process; build cmd with
+// exec.CommandContext to also bound how long it may run. Standard error
+// goes wherever cmd.Stderr points. It returns the write error, or else
+// the result of cmd.Wait, and writes nothing when cmd can't be started.
+func StreamCommand(w ResponseWriter, cmd *exec.Cmd) error {
+	return runStreamed(cmd, func(stdout io.Reader) error {
+		w.SetHeader("Content-Type", "text/plain; charset=utf-8")
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return err
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// StreamCommandEvents is StreamCommand sending each output line as a
+// Server-Sent Event (`data: <line>`), followed by an `exit` event whose data
+// is the exit code (-1 when the process was killed), for dashboards that
+// follow a job with EventSource.
+func StreamCommandEvents(w ResponseWriter, cmd *exec.Cmd) error {
+	err := runStreamed(cmd, func(stdout io.Reader) error {
+		w.SetHeader("Content-Type", "text/event-stream")
+		w.SetHeader("Cache-Control", "no-store")
+		lines := bufio.NewReader(stdout)
+		for {
+			line, err := lines.ReadString('\n')
+			if line != "" {
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", strings.TrimRight(line, "\r\n")); err != nil {
+					return err
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if cmd.ProcessState != nil {
+		fmt.Fprintf(w, "event: exit\ndata: %d\n\n", cmd.ProcessState.ExitCode())
+	}
+	return err
+}
+
+// runStreamed starts cmd and hands its standard output to send. When send
+// fails the client is gone, so the process is killed rather than left to
+// block on a pipe nobody reads.
+func runStreamed(cmd *exec.Cmd, send func(stdout io.Reader) error) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := send(stdout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minCompressSize is the smallest body worth compressing
+const minCompressSize = 512
+
+// EncoderFunc wraps w in a compressing writer. level is the encoding's entry
+// in Config.CompressionLevels, or -1 for the encoder's default.
+type EncoderFunc func(w io.Writer, level int) (io.WriteCloser, error)
+
+// encoder is a registered Content-Encoding
+type encoder struct {
+	name string
+	fn   EncoderFunc
+}
+
+var (
+	encodersMu sync.RWMutex
+	// encoders in server preference order, most preferred first
+	encoders = []encoder{{name: "gzip", fn: newGzipEncoder}}
+)
+
+// RegisterEncoder makes Compress offer a Content-Encoding such as "br" or
+// "zstd", backed by a compression library of your choice. Only gzip is
+// built in: the standard library has no brotli or zstd encoder, and the
+// module takes no compression dependencies.
+//
+//	server.RegisterEncoder("br", func(w io.Writer, level int) (io.WriteCloser, error) {
+//		return brotli.NewWriterLevel(w, level), nil
+//	})
+//
+// Encoders registered later are preferred when the client ranks several
+// equally. Registering an existing name replaces it.
+func RegisterEncoder(name string, fn EncoderFunc) {
+	name = strings.ToLower(name)
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	for i, enc := range encoders {
+		if enc.name == name {
+			encoders = append(encoders[:i], encoders[i+1:]...)
+			break
+		}
+	}
+	encoders = append([]encoder{{name: name, fn: fn}}, encoders...)
+}
+
+// newGzipEncoder is the built-in gzip EncoderFunc
+func newGzipEncoder(w io.Writer, level int) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, level)
+}
+
+// Compress compresses response bodies with the best encoding both the client
+// (by Accept-Encoding quality values) and the server support. Small bodies,
+// already-encoded responses, streamed responses, media types that don't
+// compress, and routes registered with NoCompress are sent unchanged.
+func Compress() Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			response, status := next(req)
+			if req.route != nil && req.route.noCompress {
+				return response, status
+			}
+			return compressResponse(req, response), status
+		}
+	}
+}
+
+// compressResponse encodes the body of a built response for the client,
+// updating Content-Length and adding Content-Encoding and Vary. Responses
+// Compress skips are returned unchanged.
+func compressResponse(req *Request, response []byte) []byte {
+	head, body, ok := splitResponse(response)
+	if !ok || len(body) < minCompressSize {
+		return response
+	}
+	if responseHeader(head, "Content-Encoding") != "" || !compressible(responseHeader(head, "Content-Type")) {
+		return response
+	}
+
+	enc, ok := negotiateEncoder(headerValue(req.Headers, "Accept-Encoding"))
+	if !ok {
+		return response
+	}
+	level, ok := req.compressionLevels[enc.name]
+	if !ok {
+		level = -1
+	}
+
+	var buf bytes.Buffer
+	w, err := enc.fn(&buf, level)
+	if err != nil {
+		return response
+	}
+	w.Write(body)
+	if err := w.Close(); err != nil {
+		return response
+	}
+	headers := map[string]string{"Content-Encoding": enc.name, "Vary": "Accept-Encoding"}
+	return replaceResponseBody(response, buf.Bytes(), headers)
+}
+
+// negotiateEncoder picks the registered encoder with the highest quality in
+// an Accept-Encoding header, breaking ties by server preference
+func negotiateEncoder(acceptEncoding string) (encoder, bool) {
+	if acceptEncoding == "" {
+		return encoder{}, false
+	}
+	qualities := parseQualityValues(acceptEncoding)
+
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+
+	var best encoder
+	bestQ := 0.0
+	for _, enc := range encoders {
+		q, ok := qualities[enc.name]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// parseQualityValues parses a list like "gzip;q=0.8, br" into lowercased
+// tokens and their q-values (1 when absent, 0 when malformed)
+func parseQualityValues(header string) map[string]float64 {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		token, params, _ := strings.Cut(part, ";")
+		token = strings.ToLower(strings.TrimSpace(token))
+		if token == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(key), "q") {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		qualities[token] = q
+	}
+	return qualities
+}
+
+// compressible reports whether a content type benefits from compression
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	for _, kind := range []string{"json", "xml", "javascript", "svg"} {
+		if strings.Contains(contentType, kind) {
+			return true
+		}
+	}
+	return false
+}
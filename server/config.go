@@ -1,15 +1,168 @@
 package server
 
-import "time"
+import (
+	"net/netip"
+	"time"
+)
 
 type Config struct {
-	ReadTimeout     time.Duration
-	WriteTimeout    time.Duration
-	IdleTimeout     time.Duration
-	MaxHeaderSize   int
-	MaxBodySize     int64
-	EnableKeepAlive bool
-	EnableLogging   bool
+	ReadTimeout       time.Duration // Default for HeaderReadTimeout and BodyReadTimeout
+	WriteTimeout      time.Duration // Writing each response (or streamed chunk)
+	IdleTimeout       time.Duration // Waiting for the next request on a keep-alive connection
+	MaxHeaderSize     int           // Request line plus headers; 0 means 8KB
+	MaxURLLength      int           // Longest request target (path and query); 0 means no limit
+	MaxHeaderCount    int           // Most header fields per request; 0 means 100
+	MaxHeaderLineSize int           // Longest single header line; 0 means only MaxHeaderSize applies
+	MaxBodySize       int64
+	EnableKeepAlive   bool
+	EnableLogging     bool
+
+	// MaxDrainSize is how much of a StreamBody request body the handler left
+	// unread is discarded to keep the connection alive; longer remainders
+	// close it. 0 means 256KB, a negative value always closes.
+	MaxDrainSize int64
+
+	// ConcurrentRequests handles pipelined GET and HEAD requests on a
+	// connection concurrently, so a slow handler doesn't hold up the ones
+	// behind it. Responses are still sent in request order. Their handlers
+	// can't stream: ResponseWriter.Flush keeps buffering. Other methods
+	// wait for the responses before them.
+	ConcurrentRequests bool
+
+	// RejectInvalidBody answers 400 when the automatic body parsing fails,
+	// e.g. on malformed JSON. Otherwise the handler gets an empty Body and
+	// the error in req.BodyErr.
+	RejectInvalidBody bool
+
+	// HeaderReadTimeout bounds reading the request line and headers, and
+	// BodyReadTimeout each wait for body data; 0 means ReadTimeout.
+	// HandlerTimeout answers with 503 and closes the connection when a
+	// handler hasn't produced a response in time; 0 disables it.
+	HeaderReadTimeout time.Duration
+	BodyReadTimeout   time.Duration
+	HandlerTimeout    time.Duration
+
+	// StaticDir is the directory served at "/" and searched for 404.html;
+	// empty means "pages". DisableStatic turns both off.
+	StaticDir     string
+	DisableStatic bool
+
+	// DirectoryListing answers requests for static directories without an
+	// index.html with a generated HTML listing. Off by default, since it
+	// reveals every file in the directory.
+	DirectoryListing bool
+
+	// ResponseBufferSize is how many body bytes a ResponseWriter collects
+	// before flushing them as a chunk. 0 buffers the whole response, which
+	// is then sent with Content-Length. Routes override it with
+	// ResponseBuffer or WriteThrough.
+	ResponseBufferSize int
+
+	// SPAFallback serves the static root's index.html for GET and HEAD
+	// requests that match neither a file nor a route, for single-page apps
+	// with client-side routing. Paths under SPAExcludePrefixes still get a
+	// 404; nil means {"/api"}.
+	SPAFallback        bool
+	SPAExcludePrefixes []string
+
+	// Static file extension filters (compared case-insensitively, with the dot).
+	// When StaticAllowedExtensions is non-empty only those extensions are served.
+	// StaticDeniedExtensions are never served; nil means DefaultDeniedExtensions,
+	// an empty non-nil slice disables the deny list.
+	StaticAllowedExtensions []string
+	StaticDeniedExtensions  []string
+
+	// AllowDotfiles serves paths with dot-prefixed segments (.git, .env, .htaccess).
+	// They are blocked by default; /.well-known is always allowed.
+	AllowDotfiles bool
+
+	// RedirectNormalizedPaths answers GET/HEAD requests for non-canonical paths
+	// (//a, /a/./b, /a/../b) with a 301 to the normalized path instead of
+	// silently routing the normalized form.
+	RedirectNormalizedPaths bool
+
+	// RedirectTrailingSlash answers GET/HEAD requests whose trailing slash
+	// differs from the matched route's pattern with a 301 to the pattern's
+	// form (/users/ to /users for a "/users" route). Without it both forms
+	// reach the handler.
+	RedirectTrailingSlash bool
+
+	// CaseInsensitiveRouting matches the static segments of route patterns
+	// regardless of case, so /Users/42 reaches "/users/:id". Path
+	// parameters keep the case they were sent in.
+	CaseInsensitiveRouting bool
+
+	// CompressionLevels sets the level Compress uses per Content-Encoding,
+	// e.g. {"gzip": 6, "br": 4}; missing entries use the encoder's default
+	CompressionLevels map[string]int
+
+	// GeoIP resolves each client address into req.Geo; nil disables lookups
+	GeoIP GeoResolver
+
+	// Faults injects delays, truncated writes and resets into every
+	// connection (chaos testing). nil disables fault injection.
+	Faults *FaultConfig
+
+	// ProxyProtocol expects every connection to start with a PROXY protocol
+	// v1 or v2 preamble (HAProxy, AWS NLB) and reports the client address
+	// it carries in req.RemoteAddr. Connections without one are dropped, so
+	// only enable it when all traffic arrives through the balancer.
+	ProxyProtocol bool
+
+	// TrustedProxies lists the reverse proxies (nginx, a load balancer)
+	// whose forwarding headers req.ClientIP() believes, e.g.
+	// netip.MustParsePrefix("10.0.0.0/8"). Requests from other peers keep
+	// the socket address, since anyone can send X-Forwarded-For.
+	TrustedProxies []netip.Prefix
+
+	// ForwardedHeader names the one forwarding header the trusted proxies
+	// set: "X-Forwarded-For" (the default when empty), "Forwarded" or
+	// "X-Real-IP". The others are ignored, since a proxy that only appends
+	// X-Forwarded-For passes a client's own Forwarded header through.
+	ForwardedHeader string
+
+	// Tunnel answers CONNECT requests by tunneling to the requested
+	// host:port (forward proxy mode); nil leaves CONNECT to the routes
+	Tunnel *TunnelConfig
+}
+
+// DefaultDeniedExtensions lists source, secret and key files that the static
+// server refuses to serve even if they sit inside the static root
+var DefaultDeniedExtensions = []string{
+	".go", ".mod", ".sum", ".env", ".key", ".pem", ".p12", ".pfx",
+	".htaccess", ".htpasswd", ".git", ".gitignore", ".sql", ".sqlite", ".db",
+}
+
+// maxHeaderSize returns MaxHeaderSize, defaulting to 8KB
+func (c *Config) maxHeaderSize() int {
+	if c.MaxHeaderSize <= 0 {
+		return 8192
+	}
+	return c.MaxHeaderSize
+}
+
+// maxHeaderCount returns MaxHeaderCount, defaulting to 100
+func (c *Config) maxHeaderCount() int {
+	if c.MaxHeaderCount <= 0 {
+		return 100
+	}
+	return c.MaxHeaderCount
+}
+
+// maxDrainSize returns MaxDrainSize, defaulting to 256KB
+func (c *Config) maxDrainSize() int64 {
+	if c.MaxDrainSize == 0 {
+		return 256 * 1024
+	}
+	return c.MaxDrainSize
+}
+
+// staticDir returns StaticDir, defaulting to "pages"
+func (c *Config) staticDir() string {
+	if c.StaticDir == "" {
+		return "pages"
+	}
+	return c.StaticDir
 }
 
 func DefaultConfig() *Config {
@@ -18,8 +171,11 @@ func DefaultConfig() *Config {
 		WriteTimeout:    30 * time.Second,
 		IdleTimeout:     120 * time.Second,
 		MaxHeaderSize:   8192,
+		MaxURLLength:    4096,
+		MaxHeaderCount:  100,
 		MaxBodySize:     10 * 1024 * 1024, // 10MB
 		EnableKeepAlive: true,
 		EnableLogging:   false,
+		StaticDir:       "pages",
 	}
 }
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SameSite is the SameSite attribute of a cookie
+type SameSite string
+
+const (
+	SameSiteLax    SameSite = "Lax"
+	SameSiteStrict SameSite = "Strict"
+	SameSiteNone   SameSite = "None" // Browsers require Secure with None
+)
+
+// Cookie is a cookie sent to the client in a Set-Cookie header
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path     string
+	Domain   string
+	Expires  time.Time // Zero means a session cookie
+	MaxAge   int       // Seconds; 0 omits Max-Age, negative deletes the cookie now
+	Secure   bool
+	HttpOnly bool
+	SameSite SameSite
+}
+
+// String serializes the cookie as a Set-Cookie header value. Characters that
+// are not allowed in cookie values are dropped; an invalid name yields "".
+func (c *Cookie) String() string {
+	if !validCookieName(c.Name) {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteString("=")
+	b.WriteString(sanitizeCookieValue(c.Value))
+
+	if c.Path != "" {
+		b.WriteString("; Path=")
+		b.WriteString(sanitizeCookieValue(c.Path))
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=")
+		b.WriteString(strings.TrimPrefix(sanitizeCookieValue(c.Domain), "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=")
+		b.WriteString(c.Expires.UTC().Format(httpTimeFormat))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=")
+		b.WriteString(strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.SameSite != "" {
+		b.WriteString("; SameSite=")
+		b.WriteString(string(c.SameSite))
+	}
+	return b.String()
+}
+
+// SetCookie adds a Set-Cookie header to a built response. It can be called
+// several times to set several cookies.
+func SetCookie(response []byte, cookie *Cookie) []byte {
+	value := cookie.String()
+	if value == "" {
+		return response
+	}
+	return appendResponseHeader(response, "Set-Cookie", value)
+}
+
+// parseCookies parses a Cookie request header ("a=1; b=2").
+// The first value of a repeated name wins.
+func parseCookies(header string) map[string]string {
+	if header == "" {
+		return nil
+	}
+	cookies := make(map[string]string)
+	for _, part := range strings.Split(header, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found || !validCookieName(name) {
+			continue
+		}
+		if _, exists := cookies[name]; exists {
+			continue
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		cookies[name] = value
+	}
+	return cookies
+}
+
+// validCookieName reports whether name is a non-empty RFC 7230 token
+func validCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`()<>@,;:\"/[]?={}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sanitizeCookieValue drops bytes not allowed in a cookie value and quotes
+// values containing spaces or commas
+func sanitizeCookieValue(value string) string {
+	var b strings.Builder
+	quote := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == ' ' || c == ',':
+			quote = true
+			b.WriteByte(c)
+		case c < 0x21 || c >= 0x7f || c == '"' || c == ';' || c == '\\':
+			// Not allowed in cookie-octet
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quote {
+		return `"` + b.String() + `"`
+	}
+	return b.String()
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DebugALPN is the ALPN protocol that opens the debug console on a TLS
+// connection when Server.DebugConsole is set
+const DebugALPN = "raw-debug"
+
+// debugConsoleIdleTimeout closes consoles left without input
+const debugConsoleIdleTimeout = 5 * time.Minute
+
+// debugConsoleHelp lists the console commands
+const debugConsoleHelp = `commands:
+  stats         uptime, goroutines, routes and TLS handshake failures
+  routes        registered routes
+  log on|off    toggle request logging
+  help          this list
+  quit          close the console
+`
+
+// isDebugConsole reports whether a TLS connection negotiated the console
+func (s *Server) isDebugConsole(conn *tls.Conn) bool {
+	return s.DebugConsole && conn.ConnectionState().NegotiatedProtocol == DebugALPN
+}
+
+// serveDebugConsole runs the line-based debug console on conn, e.g.
+//
+//	openssl s_client -connect localhost:8443 -alpn raw-debug
+func (s *Server) serveDebugConsole(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "raw-http debug console\n%s> ", debugConsoleHelp)
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(debugConsoleIdleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			io.WriteString(conn, "> ")
+			continue
+		}
+
+		switch strings.ToLower(fields[0]) {
+		case "stats":
+			s.writeDebugStats(conn)
+		case "routes":
+			for _, info := range s.Router.Routes() {
+				fmt.Fprintf(conn, "%-7s %s\n", info.Method, info.Path)
+			}
+		case "log":
+			if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+				io.WriteString(conn, "usage: log on|off\n")
+				break
+			}
+			s.Router.SetLogging(fields[1] == "on")
+			fmt.Fprintf(conn, "request logging %s\n", fields[1])
+		case "help":
+			io.WriteString(conn, debugConsoleHelp)
+		case "quit", "exit":
+			io.WriteString(conn, "bye\n")
+			return
+		default:
+			fmt.Fprintf(conn, "unknown command %q, try help\n", fields[0])
+		}
+		io.WriteString(conn, "> ")
+	}
+}
+
+// writeDebugStats prints the stats command's report
+func (s *Server) writeDebugStats(w io.Writer) {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+
+	uptime := "not running"
+	if !started.IsZero() {
+		uptime = time.Since(started).Round(time.Second).String()
+	}
+	fmt.Fprintf(w, "uptime      %s\n", uptime)
+	fmt.Fprintf(w, "goroutines  %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "routes      %d\n", len(s.Router.Routes()))
+	fmt.Fprintf(w, "logging     %v\n", s.Router.logging.Load())
+
+	failures := s.TLSHandshakeFailures()
+	reasons := make([]string, 0, len(failures))
+	for reason := range failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "tls failure %-12s %d\n", reason, failures[reason])
+	}
+}
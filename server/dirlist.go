@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"io/fs"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// serveDirectory answers a request for a static directory with its
+// index.html, or with a listing when Config.DirectoryListing is set. It
+// reports false when dir isn't a directory of the resolver.
+func (r *Router) serveDirectory(req *Request, resolver FileResolver, dir string) ([]byte, string, bool) {
+	lister, ok := resolver.(DirectoryLister)
+	if !ok || !staticPathAllowed(r.config, dir) {
+		return nil, "", false
+	}
+	entries, err := lister.ReadDir(dir)
+	if err != nil {
+		return nil, "", false
+	}
+
+	index := path.Join(dir, "index.html")
+	if file, err := resolver.Open(index); err == nil {
+		response, status := serveStaticFile(req, resolver, index, file)
+		return response, status, true
+	}
+	if !r.config.DirectoryListing {
+		return nil, "", false
+	}
+
+	// Hide entries that static serving would refuse
+	entries = slices.DeleteFunc(entries, func(info fs.FileInfo) bool {
+		return !staticPathAllowed(r.config, path.Join(dir, info.Name()))
+	})
+	response, status := CreateResponseBytes("200", "text/html; charset=utf-8", "OK", directoryListing(req.Path, entries))
+	return response, status, true
+}
+
+// directoryListing renders an HTML table of entries, directories first
+func directoryListing(urlPath string, entries []fs.FileInfo) []byte {
+	slices.SortFunc(entries, func(a, b fs.FileInfo) int {
+		if a.IsDir() != b.IsDir() {
+			if a.IsDir() {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	base := strings.TrimSuffix(urlPath, "/") + "/"
+	title := html.EscapeString("Index of " + base)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<table>\n", title, title)
+	b.WriteString("<tr><th>Name</th><th>Size</th><th>Modified</th></tr>\n")
+	if base != "/" {
+		fmt.Fprintf(&b, "<tr><td><a href=\"%s\">../</a></td><td></td><td></td></tr>\n", html.EscapeString(path.Dir(strings.TrimSuffix(base, "/"))))
+	}
+	for _, entry := range entries {
+		name, size := entry.Name(), fmt.Sprint(entry.Size())
+		if entry.IsDir() {
+			name, size = name+"/", "-"
+		}
+		href := base + (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&b, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(href), html.EscapeString(name), size, entry.ModTime().UTC().Format(httpTimeFormat))
+	}
+	b.WriteString("</table>\n</body>\n</html>\n")
+	return []byte(b.String())
+}
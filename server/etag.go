@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// AutoETagConfig configures the AutoETag middleware
+type AutoETagConfig struct {
+	// MaxAge lets a remembered fingerprint answer matching If-None-Match
+	// requests with 304 without calling the handler, for this long after it
+	// was computed. 0 always calls the handler and compares the fresh body.
+	MaxAge time.Duration
+
+	Clock Clock // nil means SystemClock
+}
+
+// fingerprint is a remembered response ETag
+type fingerprint struct {
+	etag    string
+	expires time.Time
+}
+
+// AutoETag adds a weak ETag hashed from the body to successful GET and HEAD
+// responses that don't set one, and answers a matching If-None-Match with
+// 304. The ETag is weak so it stays valid when Compress re-encodes the body.
+// Fingerprints are remembered like ResponseCache entries: per Host and Vary,
+// never for requests with credentials, and at most maxCacheEntries of them.
+// Routes registered with NoCache always call the handler. Use NewETagCache
+// instead to purge the remembered fingerprints.
+func AutoETag(cfg AutoETagConfig) Middleware {
+	return NewETagCache(cfg).Middleware()
+}
+
+// ETagCache holds the fingerprints AutoETag remembers with MaxAge set, so
+// they can be purged when content changes before they expire
+type ETagCache struct {
+	cfg          AutoETagConfig
+	mu           sync.Mutex
+	fingerprints *varyCache[fingerprint]
+}
+
+// NewETagCache creates an empty fingerprint cache; install it with Middleware
+func NewETagCache(cfg AutoETagConfig) *ETagCache {
+	return &ETagCache{cfg: cfg, fingerprints: newVaryCache[fingerprint]()}
+}
+
+// Purge forgets every fingerprint
+func (c *ETagCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fingerprints.clear()
+}
+
+// PurgeKey forgets the fingerprints of one resource, keyed like
+// ResponseCache.PurgeKey, and reports how many resources were forgotten
+func (c *ETagCache) PurgeKey(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fingerprints.removeKeys(func(k string) bool { return purgeMatch(k, key, false) })
+}
+
+// PurgePrefix forgets the fingerprints of every resource whose key starts
+// with prefix and reports how many resources were forgotten
+func (c *ETagCache) PurgePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fingerprints.removeKeys(func(k string) bool { return purgeMatch(k, prefix, true) })
+}
+
+// PurgeExpired forgets the fingerprints older than MaxAge and reports how
+// many were forgotten
+func (c *ETagCache) PurgeExpired() int {
+	now := clockOrSystem(c.cfg.Clock).Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fingerprints.removeValues(func(fp fingerprint) bool { return !now.Before(fp.expires) })
+}
+
+// Middleware returns the AutoETag middleware backed by this cache
+func (c *ETagCache) Middleware() Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			if req.Method != "GET" && req.Method != "HEAD" {
+				return next(req)
+			}
+			ifNoneMatch := headerValue(req.Headers, "If-None-Match")
+			remember := c.cfg.MaxAge > 0 && (req.route == nil || !req.route.noCache) && sharedRequest(req)
+			now := clockOrSystem(c.cfg.Clock).Now()
+
+			if remember && ifNoneMatch != "" {
+				c.mu.Lock()
+				fp, ok := c.fingerprints.get(req)
+				c.mu.Unlock()
+				if ok && now.Before(fp.expires) && etagMatches(ifNoneMatch, fp.etag) {
+					return Serve304(fp.etag)
+				}
+			}
+
+			response, status := next(req)
+			head, body, ok := splitResponse(response)
+			if StatusCode(status) != StatusOK || !ok || responseHeader(head, "ETag") != "" {
+				return response, status
+			}
+
+			h := fnv.New64a()
+			h.Write(body)
+			etag := fmt.Sprintf(`W/"%016x"`, h.Sum64())
+
+			if remember {
+				c.mu.Lock()
+				c.fingerprints.put(req, head, fingerprint{etag: etag, expires: now.Add(c.cfg.MaxAge)})
+				c.mu.Unlock()
+			}
+
+			if etagMatches(ifNoneMatch, etag) {
+				return Serve304(etag)
+			}
+			return appendResponseHeader(response, "ETag", etag), status
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// FaultConfig enables connection fault injection for resilience testing.
+// Each probability is between 0 and 1 and is drawn per Read/Write call.
+// Never enable it in production.
+type FaultConfig struct {
+	DelayProbability    float64       // Sleep up to MaxDelay before a read or write
+	MaxDelay            time.Duration // Upper bound for injected delays
+	TruncateProbability float64       // Write only part of the data, then close
+	ResetProbability    float64       // Abort the connection (TCP RST when possible)
+
+	// Random drives the fault decisions; nil means CryptoRandom.
+	// Use NewDeterministicRandom for reproducible runs.
+	Random RandomSource
+}
+
+// errInjectedReset is returned by reads and writes on a reset connection
+var errInjectedReset = errors.New("fault injection: connection reset")
+
+// faultConn wraps a connection and injects faults into reads and writes
+type faultConn struct {
+	net.Conn
+	faults *FaultConfig
+}
+
+// newFaultConn wraps conn according to faults
+func newFaultConn(conn net.Conn, faults *FaultConfig) net.Conn {
+	return &faultConn{Conn: conn, faults: faults}
+}
+
+// NetConn returns the wrapped connection
+func (c *faultConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	c.maybeDelay()
+	if c.chance(c.faults.ResetProbability) {
+		c.reset()
+		return 0, errInjectedReset
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	c.maybeDelay()
+	if c.chance(c.faults.ResetProbability) {
+		c.reset()
+		return 0, errInjectedReset
+	}
+	if len(p) > 1 && c.chance(c.faults.TruncateProbability) {
+		n, _ := c.Conn.Write(p[:len(p)/2])
+		c.Conn.Close()
+		return n, errInjectedReset
+	}
+	return c.Conn.Write(p)
+}
+
+// maybeDelay sleeps for a random duration up to MaxDelay
+func (c *faultConn) maybeDelay() {
+	if c.faults.MaxDelay > 0 && c.chance(c.faults.DelayProbability) {
+		time.Sleep(time.Duration(c.random() * float64(c.faults.MaxDelay)))
+	}
+}
+
+// reset closes the connection, discarding unsent data on TCP sockets
+func (c *faultConn) reset() {
+	if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	c.Conn.Close()
+}
+
+// chance returns true with the given probability
+func (c *faultConn) chance(probability float64) bool {
+	return probability > 0 && c.random() < probability
+}
+
+// random returns a float in [0, 1) drawn from the configured source
+func (c *faultConn) random() float64 {
+	buf := randomBytes(c.faults.Random, 8)
+	return float64(binary.LittleEndian.Uint64(buf)>>11) / (1 << 53)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// GeoInfo is what a GeoResolver knows about a client address
+type GeoInfo struct {
+	Country string // ISO 3166-1 alpha-2 code, e.g. "DE"; empty when unknown
+	ASN     uint   // Autonomous system number; 0 when unknown
+	ASOrg   string // Autonomous system organization
+}
+
+// GeoResolver looks up a client address. Set Config.GeoIP to resolve every
+// request into req.Geo; MaxMindDB is a ready-made resolver.
+type GeoResolver interface {
+	Lookup(addr netip.Addr) (GeoInfo, error)
+}
+
+// lookupGeo resolves the IP of a "host:port" remote address, returning the
+// zero GeoInfo when it can't
+func lookupGeo(resolver GeoResolver, remoteAddr string) GeoInfo {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return GeoInfo{}
+	}
+	info, err := resolver.Lookup(addr.Unmap())
+	if err != nil {
+		return GeoInfo{}
+	}
+	return info
+}
+
+// CountryFilter rejects requests by req.Geo.Country with a 403. When allow
+// is non-empty only those countries pass (unknown countries don't); deny
+// lists countries that never pass. Codes are compared case-insensitively.
+func CountryFilter(allow, deny []string) Middleware {
+	normalize := func(codes []string) []string {
+		out := make([]string, len(codes))
+		for i, code := range codes {
+			out[i] = strings.ToUpper(code)
+		}
+		return out
+	}
+	allow, deny = normalize(allow), normalize(deny)
+
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			country := strings.ToUpper(req.Geo.Country)
+			if len(allow) > 0 && !slices.Contains(allow, country) {
+				return Serve403("")
+			}
+			if country != "" && slices.Contains(deny, country) {
+				return Serve403("")
+			}
+			return next(req)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind DB
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// errMMDBCorrupt is returned for malformed MaxMind DB files
+var errMMDBCorrupt = errors.New("maxmind: corrupt database")
+
+// MaxMindDB resolves addresses from a MaxMind DB (.mmdb) file such as
+// GeoLite2-Country or GeoLite2-ASN. It reads "country.iso_code",
+// "autonomous_system_number" and "autonomous_system_organization".
+type MaxMindDB struct {
+	buf        []byte
+	data       []byte // Data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+// OpenMaxMindDB loads a MaxMind DB file into memory
+func OpenMaxMindDB(path string) (*MaxMindDB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("maxmind: %w", err)
+	}
+	return NewMaxMindDB(buf)
+}
+
+// NewMaxMindDB parses a MaxMind DB held in memory
+func NewMaxMindDB(buf []byte) (*MaxMindDB, error) {
+	start := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, errors.New("maxmind: metadata not found")
+	}
+	metaSection := buf[start+len(mmdbMetadataMarker):]
+	value, _, err := decodeMMDB(metaSection, 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := value.(map[string]any)
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+
+	db := &MaxMindDB{buf: buf}
+	db.nodeCount = mmdbUint(meta["node_count"])
+	db.recordSize = mmdbUint(meta["record_size"])
+	db.ipVersion = mmdbUint(meta["ip_version"])
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("maxmind: unsupported record size %d", db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(start) {
+		return nil, errMMDBCorrupt
+	}
+	db.data = buf[treeSize+16 : start]
+	return db, nil
+}
+
+// Lookup implements GeoResolver
+func (db *MaxMindDB) Lookup(addr netip.Addr) (GeoInfo, error) {
+	record, err := db.search(addr)
+	if err != nil || record == nil {
+		return GeoInfo{}, err
+	}
+
+	var info GeoInfo
+	if country, ok := record["country"].(map[string]any); ok {
+		info.Country, _ = country["iso_code"].(string)
+	}
+	info.ASN = mmdbUint(record["autonomous_system_number"])
+	info.ASOrg, _ = record["autonomous_system_organization"].(string)
+	return info, nil
+}
+
+// search walks the binary tree for addr and decodes its record, returning
+// nil when the address isn't in the database
+func (db *MaxMindDB) search(addr netip.Addr) (map[string]any, error) {
+	var ip []byte
+	switch {
+	case addr.Is4() && db.ipVersion == 6:
+		// IPv4 lives in the ::/96 subtree
+		a4 := addr.As4()
+		ip = make([]byte, 16)
+		copy(ip[12:], a4[:])
+	case addr.Is4():
+		a4 := addr.As4()
+		ip = a4[:]
+	case db.ipVersion == 6:
+		a16 := addr.As16()
+		ip = a16[:]
+	default:
+		return nil, nil
+	}
+
+	node := uint(0)
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		node = db.readRecord(node, bit)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, errMMDBCorrupt
+	}
+	value, _, err := decodeMMDB(db.data, offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]any)
+	return record, nil
+}
+
+// readRecord returns the left (bit 0) or right (bit 1) record of a node
+func (db *MaxMindDB) readRecord(node uint, bit byte) uint {
+	size := db.recordSize / 4
+	if int(node*size+size) > len(db.buf) {
+		return db.nodeCount
+	}
+	b := db.buf[node*size : node*size+size]
+	switch db.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4]))
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+// decodeMMDB decodes the data field at offset, returning it and the offset
+// just past it. Pointers are resolved relative to the start of data.
+func decodeMMDB(data []byte, offset uint) (any, uint, error) {
+	if offset >= uint(len(data)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == 1 { // Pointer
+		ss := uint(ctrl>>3) & 3
+		if offset+ss+1 > uint(len(data)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		var target uint
+		b := data[offset : offset+ss+1]
+		switch ss {
+		case 0:
+			target = uint(ctrl&7)<<8 | uint(b[0])
+		case 1:
+			target = 2048 + (uint(ctrl&7)<<16 | uint(b[0])<<8 | uint(b[1]))
+		case 2:
+			target = 526336 + (uint(ctrl&7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		default:
+			target = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := decodeMMDB(data, target)
+		return value, offset + ss + 1, err
+	}
+
+	if typ == 0 { // Extended type
+		if offset >= uint(len(data)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		extra := uint(0)
+		for _, c := range data[offset : offset+n] {
+			extra = extra<<8 | uint(c)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + extra
+		case 30:
+			size = 285 + extra
+		default:
+			size = 65821 + extra
+		}
+	}
+
+	switch typ {
+	case 7: // Map
+		m := make(map[string]any, size)
+		for range size {
+			key, next, err := decodeMMDB(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			value, next, err := decodeMMDB(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[name] = value
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // Array
+		values := make([]any, 0, size)
+		for range size {
+			value, next, err := decodeMMDB(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = next
+		}
+		return values, offset, nil
+	case 14: // Boolean, stored in the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := data[offset : offset+size]
+	offset += size
+
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // Double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // Float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8: // int32
+		n := int32(0)
+		for _, c := range b {
+			n = n<<8 | int32(c)
+		}
+		return int64(n), offset, nil
+	case 4, 10: // Bytes, uint128
+		return b, offset, nil
+	}
+	return nil, 0, fmt.Errorf("maxmind: unsupported data type %d", typ)
+}
+
+// mmdbUint converts a decoded unsigned integer to uint
+func mmdbUint(value any) uint {
+	n, _ := value.(uint64)
+	return uint(n)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/textproto"
+	"strings"
+)
+
+// Headers holds HTTP header fields keyed by canonical name ("Content-Type"),
+// one value per field. Parsed request headers are canonicalized, so
+// req.Headers.Get("content-type") and req.Headers["Content-Type"] both find
+// a header sent as "content-type". Repeated fields are combined into one
+// comma-separated value, as RFC 9110 section 5.3 allows.
+type Headers map[string]string
+
+// CanonicalHeaderKey returns the canonical form of a header name, e.g.
+// "content-type" becomes "Content-Type"
+func CanonicalHeaderKey(key string) string {
+	return textproto.CanonicalMIMEHeaderKey(key)
+}
+
+// Get returns the value of a header, matching the name case-insensitively.
+// Maps built by hand with non-canonical keys are searched as well, once
+// neither key nor its canonical form is found.
+func (h Headers) Get(key string) string {
+	if value, ok := h[key]; ok {
+		return value
+	}
+	if value, ok := h[CanonicalHeaderKey(key)]; ok {
+		return value
+	}
+	for k, value := range h {
+		if strings.EqualFold(k, key) {
+			return value
+		}
+	}
+	return ""
+}
+
+// Values returns the elements of a comma-separated header such as
+// Accept-Encoding, trimmed of whitespace. It returns nil when the header is absent.
+func (h Headers) Values(key string) []string {
+	value := h.Get(key)
+	if value == "" {
+		return nil
+	}
+	parts := strings.Split(value, ",")
+	values := parts[:0]
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
+
+// Set replaces any value of a header, whatever the case of its existing key
+func (h Headers) Set(key, value string) {
+	h.Del(key)
+	h[CanonicalHeaderKey(key)] = value
+}
+
+// Add appends a value to a header, joining it to an existing value with
+// ", " (or "; " for Cookie)
+func (h Headers) Add(key, value string) {
+	key = CanonicalHeaderKey(key)
+	if _, ok := h[key]; !ok {
+		// A map built by hand may hold the header under another spelling
+		for k, v := range h {
+			if strings.EqualFold(k, key) {
+				delete(h, k)
+				h[key] = v
+				break
+			}
+		}
+	}
+	h.addCanonical(key, value)
+}
+
+// addCanonical is Add for a map whose keys are all canonical, such as one
+// being parsed, so no other spelling needs searching. key is canonicalized.
+func (h Headers) addCanonical(key, value string) {
+	key = CanonicalHeaderKey(key)
+	existing, ok := h[key]
+	if !ok {
+		h[key] = value
+		return
+	}
+	separator := ", "
+	if key == "Cookie" {
+		separator = "; "
+	}
+	h[key] = existing + separator + value
+}
+
+// Del removes a header, whatever the case of its key
+func (h Headers) Del(key string) {
+	delete(h, key)
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultTrapPaths are paths only vulnerability scanners ask for
+var DefaultTrapPaths = []string{
+	"/wp-login.php",
+	"/wp-admin",
+	"/xmlrpc.php",
+	"/.env",
+	"/.git/config",
+	"/phpmyadmin",
+	"/admin.php",
+}
+
+// HoneypotConfig configures a Honeypot
+type HoneypotConfig struct {
+	Paths  []string // Trap paths; nil means DefaultTrapPaths
+	Status int      // Trap response status; 0 means 418
+
+	// Tarpit drips the trap response out over this long before closing the
+	// connection, tying up the scanner; 0 responds immediately
+	Tarpit time.Duration
+
+	// MaxTarpits bounds how many connections are tarpitted at once, so a
+	// flood of trapped requests can't tie up the server instead; further
+	// ones are answered immediately. 0 means 64.
+	MaxTarpits int
+
+	// BanFor denies every request from a trapped client IP for this long;
+	// 0 disables the deny list
+	BanFor time.Duration
+
+	// OnTrap is called with the client IP and path of each trapped request,
+	// e.g. to feed an external firewall
+	OnTrap func(ip, path string)
+
+	Clock Clock // Time source for bans; nil means SystemClock
+}
+
+// Honeypot answers requests for trap paths and keeps a deny list of the
+// clients that asked for them
+type Honeypot struct {
+	cfg       HoneypotConfig
+	tarpits   chan struct{} // semaphore of running tarpits
+	mu        sync.Mutex
+	banned    map[string]time.Time // client IP -> ban expiry
+	lastPrune time.Time
+}
+
+// NewHoneypot creates a honeypot; install it with Register and Middleware
+func NewHoneypot(cfg HoneypotConfig) *Honeypot {
+	if cfg.Paths == nil {
+		cfg.Paths = DefaultTrapPaths
+	}
+	if cfg.Status == 0 {
+		cfg.Status = 418
+	}
+	if cfg.MaxTarpits <= 0 {
+		cfg.MaxTarpits = 64
+	}
+	return &Honeypot{cfg: cfg, tarpits: make(chan struct{}, cfg.MaxTarpits), banned: make(map[string]time.Time)}
+}
+
+// Register adds the trap routes to the router for GET, HEAD and POST
+func (h *Honeypot) Register(r *Router) {
+	for _, path := range h.cfg.Paths {
+		for _, method := range []string{"GET", "HEAD", "POST"} {
+			r.Register(method, path, h.trap, NoCache())
+		}
+	}
+}
+
+// Middleware rejects banned clients with a 403 and closes their connection.
+// Add it first so banned clients don't reach other middleware.
+func (h *Honeypot) Middleware() Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			if h.Banned(req.ClientIP()) {
+				return CloseConnection(Serve403(""))
+			}
+			return next(req)
+		}
+	}
+}
+
+// Banned reports whether ip is on the deny list. Expired bans of clients
+// that never come back are pruned once per BanFor.
+func (h *Honeypot) Banned(ip string) bool {
+	now := clockOrSystem(h.cfg.Clock).Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pruneBans(now)
+	until, ok := h.banned[ip]
+	return ok && now.Before(until)
+}
+
+// pruneBans drops expired bans if BanFor has passed since the last prune
+func (h *Honeypot) pruneBans(now time.Time) {
+	if now.Sub(h.lastPrune) < h.cfg.BanFor {
+		return
+	}
+	for ip, until := range h.banned {
+		if !now.Before(until) {
+			delete(h.banned, ip)
+		}
+	}
+	h.lastPrune = now
+}
+
+// trap handles a request for a trap path
+func (h *Honeypot) trap(req *Request) ([]byte, string) {
+	ip := req.ClientIP()
+	if h.cfg.BanFor > 0 {
+		now := clockOrSystem(h.cfg.Clock).Now()
+		h.mu.Lock()
+		h.pruneBans(now)
+		h.banned[ip] = now.Add(h.cfg.BanFor)
+		h.mu.Unlock()
+	}
+	if h.cfg.OnTrap != nil {
+		h.cfg.OnTrap(ip, req.Path)
+	}
+
+	response, status := CloseConnection(Respond(h.cfg.Status, "text/plain", []byte(reasonPhrase(h.cfg.Status))))
+	if h.cfg.Tarpit <= 0 || req.conn == nil {
+		return response, status
+	}
+	select {
+	case h.tarpits <- struct{}{}:
+		defer func() { <-h.tarpits }()
+	default:
+		return response, status
+	}
+	if !req.startResponse() {
+		return response, status
+	}
+
+	// Write the response a byte at a time and close the connection
+	req.closeConn = true
+	interval := h.cfg.Tarpit / time.Duration(len(response))
+	for i := range response {
+		if req.writeTimeout > 0 {
+			req.conn.SetWriteDeadline(time.Now().Add(req.writeTimeout))
+		}
+		if _, err := req.conn.Write(response[i : i+1]); err != nil {
+			log.Println("Tarpit write failed:", err)
+			break
+		}
+		time.Sleep(interval)
+	}
+	return nil, status
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// RouteInfo describes a registered route
+type RouteInfo struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Doc    string `json:"doc,omitempty"`
+}
+
+// Routes lists the registered routes sorted by path and method.
+// A path registered with several matcher variants appears once per variant.
+func (r *Router) Routes() []RouteInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var infos []RouteInfo
+	for method, methodRoutes := range r.routes {
+		for path, variants := range methodRoutes {
+			for _, rt := range variants {
+				infos = append(infos, RouteInfo{Method: method, Path: path, Doc: rt.doc})
+			}
+		}
+	}
+	sortRouteInfos(infos)
+	return infos
+}
+
+// RoutesHandler returns a handler serving Routes as JSON, e.g.
+//
+//	router.Register("GET", "/debug/routes", router.RoutesHandler())
+func (r *Router) RoutesHandler() RouteHandler {
+	return func(req *Request) ([]byte, string) {
+		body, err := json.Marshal(r.Routes())
+		if err != nil {
+			return Serve500("Failed to encode routes")
+		}
+		return CreateResponseBytes("200", "application/json", "OK", body)
+	}
+}
+
+// optionsResponse answers an OPTIONS request that has no explicit route by
+// listing the methods and docs registered for the path. Callers hold r.mu.
+func (r *Router) optionsResponse(req *Request) ([]byte, string) {
+	var infos []RouteInfo
+	for method, methodRoutes := range r.routes {
+		for pattern, variants := range methodRoutes {
+			if pattern != req.Path {
+				if _, matched := r.matchPath(req.Path, pattern); !matched {
+					continue
+				}
+			}
+			for _, rt := range variants {
+				infos = append(infos, RouteInfo{Method: method, Path: pattern, Doc: rt.doc})
+			}
+		}
+	}
+	if len(infos) == 0 {
+		return serve404Bytes(r.config)
+	}
+	sortRouteInfos(infos)
+
+	body, err := json.Marshal(map[string]any{"path": req.Path, "routes": infos})
+	if err != nil {
+		return Serve500("Failed to encode routes")
+	}
+	headers := map[string]string{"Allow": allowHeader(r.allowedMethods(req.Path))}
+	return CreateResponseBytesWithHeaders("200", "application/json", "OK", headers, body)
+}
+
+// sortRouteInfos orders routes by path, then method
+func sortRouteInfos(infos []RouteInfo) {
+	sort.SliceStable(infos, func(i, j int) bool {
+		if infos[i].Path != infos[j].Path {
+			return infos[i].Path < infos[j].Path
+		}
+		return infos[i].Method < infos[j].Method
+	})
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Claims are the decoded payload of a verified JWT
+type Claims map[string]any
+
+// Subject returns the "sub" claim
+func (c Claims) Subject() string {
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+// JWTConfig configures the JWT middleware
+type JWTConfig struct {
+	// Key returns the HMAC secret for a token's "kid" header (empty when
+	// absent), allowing key rotation. Required.
+	Key func(kid string) ([]byte, error)
+
+	Issuer   string // Required "iss" claim; empty skips the check
+	Audience string // Required entry of the "aud" claim; empty skips the check
+
+	// Optional lets requests without a bearer token through with nil
+	// req.Auth; invalid tokens are still rejected
+	Optional bool
+
+	Clock Clock // Time source for "exp" and "nbf"; nil means SystemClock
+}
+
+// jwtHashes maps the supported HMAC algorithms to their hash
+var jwtHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+// JWT authenticates requests carrying "Authorization: Bearer <token>" signed
+// with HS256, HS384 or HS512. Verified claims are stored in req.Auth;
+// missing, malformed, expired or badly signed tokens get a 401 with a
+// WWW-Authenticate header.
+func JWT(cfg JWTConfig) Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			token, ok := bearerToken(headerValue(req.Headers, "Authorization"))
+			if !ok {
+				if cfg.Optional {
+					return next(req)
+				}
+				return jwtUnauthorized(`Bearer`)
+			}
+
+			claims, err := cfg.verify(token)
+			if err != nil {
+				return jwtUnauthorized(`Bearer error="invalid_token"`)
+			}
+			req.Auth = claims
+			return next(req)
+		}
+	}
+}
+
+// bearerToken extracts the token of a Bearer authorization header
+func bearerToken(authorization string) (string, bool) {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// verify checks the signature and registered claims of a compact JWT
+func (cfg JWTConfig) verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok || cfg.Key == nil {
+		return nil, errInvalidToken
+	}
+	key, err := cfg.Key(header.Kid)
+	if err != nil || len(key) == 0 {
+		return nil, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	mac := hmac.New(hash.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := clockOrSystem(cfg.Clock).Now()
+	exp, hasExp, err := numericDate(claims, "exp")
+	if err != nil || hasExp && !now.Before(exp) {
+		return nil, errInvalidToken
+	}
+	nbf, hasNbf, err := numericDate(claims, "nbf")
+	if err != nil || hasNbf && now.Before(nbf) {
+		return nil, errInvalidToken
+	}
+	if cfg.Issuer != "" && claims["iss"] != cfg.Issuer {
+		return nil, errInvalidToken
+	}
+	if cfg.Audience != "" && !audienceContains(claims["aud"], cfg.Audience) {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+// numericDate reads a NumericDate claim such as "exp". A claim that is
+// present but not a JSON number is an error, so a token can't dodge expiry
+// by sending its date as a string.
+func numericDate(claims Claims, name string) (time.Time, bool, error) {
+	value, present := claims[name]
+	if !present {
+		return time.Time{}, false, nil
+	}
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, false, errInvalidToken
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// decodeJWTSegment decodes one base64url JSON segment of a token
+func decodeJWTSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// audienceContains reports whether an "aud" claim (string or array) names audience
+func audienceContains(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, entry := range aud {
+			if entry == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtUnauthorized builds the 401 response of the JWT middleware
+func jwtUnauthorized(challenge string) ([]byte, string) {
+	response, status := Serve401("")
+	return appendResponseHeader(response, "WWW-Authenticate", challenge), status
+}
@@ -7,13 +7,13 @@ import (
 )
 
 // logRequest logs an HTTP request with color-coded status
-func logRequest(method, path, status string) {
+func logRequest(method, path string, status int) {
 	switch status {
-	case "200":
-		log.Print(color.GreenString("%s %s %s", method, path, status))
-	case "404", "403", "405":
-		log.Print(color.RedString("%s %s %s", method, path, status))
+	case StatusOK:
+		log.Print(color.GreenString("%s %s %d", method, path, status))
+	case StatusNotFound, StatusForbidden, StatusMethodNotAllowed:
+		log.Print(color.RedString("%s %s %d", method, path, status))
 	default:
-		log.Printf("%s %s %s", method, path, status)
+		log.Printf("%s %s %d", method, path, status)
 	}
 }
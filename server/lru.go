@@ -0,0 +1,83 @@
+package server
+
+import "container/list"
+
+// lru is a map holding at most capacity entries, dropping the least
+// recently used one to make room. It isn't safe for concurrent use.
+type lru[V any] struct {
+	capacity int
+	order    *list.List // most recently used first, holding *lruItem[V]
+	items    map[string]*list.Element
+}
+
+// lruItem is one entry of an lru
+type lruItem[V any] struct {
+	key   string
+	value V
+}
+
+// newLRU creates an empty lru bounded to capacity entries
+func newLRU[V any](capacity int) *lru[V] {
+	return &lru[V]{capacity: capacity, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the value for key, marking it recently used
+func (l *lru[V]) get(key string) (V, bool) {
+	elem, ok := l.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruItem[V]).value, true
+}
+
+// put stores value under key, evicting the least recently used entry when full
+func (l *lru[V]) put(key string, value V) {
+	if elem, ok := l.items[key]; ok {
+		elem.Value.(*lruItem[V]).value = value
+		l.order.MoveToFront(elem)
+		return
+	}
+	if l.order.Len() >= l.capacity {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruItem[V]).key)
+	}
+	l.items[key] = l.order.PushFront(&lruItem[V]{key: key, value: value})
+}
+
+// remove drops key
+func (l *lru[V]) remove(key string) {
+	if elem, ok := l.items[key]; ok {
+		l.order.Remove(elem)
+		delete(l.items, key)
+	}
+}
+
+// removeFunc drops the entries for which match returns true and returns
+// how many were dropped
+func (l *lru[V]) removeFunc(match func(key string, value V) bool) int {
+	removed := 0
+	for elem := l.order.Front(); elem != nil; {
+		next := elem.Next()
+		if item := elem.Value.(*lruItem[V]); match(item.key, item.value) {
+			l.order.Remove(elem)
+			delete(l.items, item.key)
+			removed++
+		}
+		elem = next
+	}
+	return removed
+}
+
+// clear drops every entry
+func (l *lru[V]) clear() {
+	l.order.Init()
+	clear(l.items)
+}
+
+// len returns the number of entries
+func (l *lru[V]) len() int {
+	return l.order.Len()
+}
@@ -0,0 +1,328 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"sync"
+)
+
+// maxMinifyCacheEntries bounds the minified body cache; it is reset when full
+const maxMinifyCacheEntries = 256
+
+// Minify strips comments and redundant whitespace from HTML, CSS and
+// JavaScript responses. The minifiers are conservative: <pre>, <textarea>,
+// <script> and <style> contents and quoted attribute values are kept as-is
+// in HTML, and JavaScript keeps string, template and regular expression
+// literals intact and its line breaks so automatic semicolon insertion is
+// unaffected. Minified bodies are cached by the SHA-256 of their content, so
+// static assets (with ApplyMiddlewareToStatic) are only minified once. Add
+// Minify after Compress so it sees uncompressed bodies.
+func Minify() Middleware {
+	var mu sync.Mutex
+	cache := make(map[[sha256.Size]byte][]byte)
+
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			response, status := next(req)
+			head, body, ok := splitResponse(response)
+			if !ok || len(body) == 0 || responseHeader(head, "Content-Encoding") != "" {
+				return response, status
+			}
+			minifier := minifierFor(responseHeader(head, "Content-Type"))
+			if minifier == nil {
+				return response, status
+			}
+
+			key := sha256.Sum256(body)
+
+			mu.Lock()
+			minified, ok := cache[key]
+			mu.Unlock()
+			if !ok {
+				minified = minifier(body)
+				mu.Lock()
+				if len(cache) >= maxMinifyCacheEntries {
+					clear(cache)
+				}
+				cache[key] = minified
+				mu.Unlock()
+			}
+			if len(minified) >= len(body) {
+				return response, status
+			}
+			return replaceResponseBody(response, minified, nil), status
+		}
+	}
+}
+
+// minifierFor returns the minifier for a content type, or nil
+func minifierFor(contentType string) func([]byte) []byte {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	switch strings.TrimSpace(mediaType) {
+	case "text/html":
+		return minifyHTML
+	case "text/css":
+		return minifyCSS
+	case "text/javascript", "application/javascript":
+		return minifyJS
+	}
+	return nil
+}
+
+// isSpace reports whether c is CSS/JS/HTML whitespace
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// copyQuoted copies the string literal starting at src[i] to out and
+// returns the index just past it
+func copyQuoted(out *bytes.Buffer, src []byte, i int) int {
+	quote := src[i]
+	out.WriteByte(quote)
+	for i++; i < len(src); i++ {
+		out.WriteByte(src[i])
+		if src[i] == '\\' && i+1 < len(src) {
+			i++
+			out.WriteByte(src[i])
+		} else if src[i] == quote {
+			return i + 1
+		}
+	}
+	return i
+}
+
+// minifyCSS removes comments and whitespace that doesn't separate tokens
+func minifyCSS(src []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(src))
+	// Whitespace after these or before those (but ":" only after, as in
+	// "a :hover") never separates tokens
+	const tightAfter, tightBefore = "{}:;,>", "{};,>"
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'':
+			i = copyQuoted(&out, src, i)
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end + 4
+			}
+		case isSpace(c):
+			for i < len(src) && isSpace(src[i]) {
+				i++
+			}
+			prev := lastByte(&out)
+			if out.Len() > 0 && i < len(src) && !strings.ContainsRune(tightAfter, rune(prev)) && !strings.ContainsRune(tightBefore, rune(src[i])) {
+				out.WriteByte(' ')
+			}
+		case c == '}' && lastByte(&out) == ';':
+			out.Truncate(out.Len() - 1)
+			out.WriteByte(c)
+			i++
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes()
+}
+
+// minifyJS removes comments, indentation and blank lines, keeping line breaks.
+// A "/" starts a regular expression literal, rather than dividing, where an
+// operand is expected: after an operator, an opening bracket or a keyword
+// such as return.
+func minifyJS(src []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(src))
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '"' || c == '\'' || c == '`':
+			i = copyQuoted(&out, src, i)
+		case c == '/' && i+1 < len(src) && src[i+1] != '/' && src[i+1] != '*' && regexAllowed(out.Bytes()):
+			i = copyRegex(&out, src, i)
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end + 4
+			}
+		case isSpace(c):
+			newline := false
+			for i < len(src) && isSpace(src[i]) {
+				newline = newline || src[i] == '\n'
+				i++
+			}
+			switch {
+			case out.Len() == 0 || i == len(src):
+			case newline:
+				if lastByte(&out) == ' ' {
+					out.Truncate(out.Len() - 1)
+				}
+				if lastByte(&out) != '\n' {
+					out.WriteByte('\n')
+				}
+			default:
+				out.WriteByte(' ')
+			}
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	// A trailing comment leaves the whitespace before it
+	return bytes.TrimRight(out.Bytes(), " \n")
+}
+
+// regexKeywords are the keywords after which "/" starts a regular expression
+var regexKeywords = []string{"return", "typeof", "instanceof", "in", "of", "new", "delete", "void", "throw", "case", "do", "else", "yield", "await"}
+
+// regexAllowed reports whether a "/" following the minified output so far
+// starts a regular expression literal
+func regexAllowed(out []byte) bool {
+	out = bytes.TrimRight(out, " \n")
+	if len(out) == 0 {
+		return true
+	}
+	last := out[len(out)-1]
+	if strings.IndexByte("(,=:[!&|?{};+-*%<>~^", last) >= 0 {
+		return true
+	}
+	word := out[bytes.LastIndexFunc(out, func(r rune) bool { return !isIdentByte(byte(r)) })+1:]
+	for _, keyword := range regexKeywords {
+		if string(word) == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// isIdentByte reports whether c can be part of an ASCII JS identifier
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// copyRegex copies the regular expression literal starting at src[i] to
+// out and returns the index just past its closing "/". A "/" inside a
+// character class doesn't end it.
+func copyRegex(out *bytes.Buffer, src []byte, i int) int {
+	out.WriteByte(src[i])
+	inClass := false
+	for i++; i < len(src) && src[i] != '\n'; i++ {
+		out.WriteByte(src[i])
+		switch {
+		case src[i] == '\\' && i+1 < len(src):
+			i++
+			out.WriteByte(src[i])
+		case src[i] == '[':
+			inClass = true
+		case src[i] == ']':
+			inClass = false
+		case src[i] == '/' && !inClass:
+			return i + 1
+		}
+	}
+	return i
+}
+
+// rawHTMLElements keep their contents untouched by minifyHTML
+var rawHTMLElements = []string{"pre", "textarea", "script", "style"}
+
+// minifyHTML removes comments (except conditional comments) and collapses
+// whitespace runs to a single space or line break. Tags are copied as-is,
+// so quoted attribute values keep their whitespace.
+func minifyHTML(src []byte) []byte {
+	var out bytes.Buffer
+	out.Grow(len(src))
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case bytes.HasPrefix(src[i:], []byte("<!--")) && !bytes.HasPrefix(src[i:], []byte("<!--[if")):
+			end := bytes.Index(src[i+4:], []byte("-->"))
+			if end < 0 {
+				i = len(src)
+			} else {
+				i += end + 7
+			}
+		case c == '<':
+			if name, ok := rawElementAt(src[i:]); ok {
+				closing := []byte("</" + name)
+				end := bytes.Index(bytes.ToLower(src[i+1:]), closing)
+				if end < 0 {
+					end = len(src) - i - 1
+				}
+				out.Write(src[i : i+1+end])
+				i += 1 + end
+				continue
+			}
+			i = copyTag(&out, src, i)
+		case isSpace(c):
+			newline := false
+			for i < len(src) && isSpace(src[i]) {
+				newline = newline || src[i] == '\n'
+				i++
+			}
+			if out.Len() > 0 && i < len(src) {
+				if newline {
+					out.WriteByte('\n')
+				} else {
+					out.WriteByte(' ')
+				}
+			}
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.Bytes()
+}
+
+// copyTag copies the tag starting at src[i] to out, up to the ">" that
+// isn't inside a quoted attribute value, and returns the index just past it
+func copyTag(out *bytes.Buffer, src []byte, i int) int {
+	var quote byte
+	for ; i < len(src); i++ {
+		c := src[i]
+		out.WriteByte(c)
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return i
+}
+
+// rawElementAt reports whether src starts with an opening tag of a raw element
+func rawElementAt(src []byte) (string, bool) {
+	for _, name := range rawHTMLElements {
+		if len(src) > len(name)+1 && strings.EqualFold(string(src[1:len(name)+1]), name) {
+			if next := src[len(name)+1]; next == '>' || isSpace(next) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// lastByte returns the last byte written to buf, or 0
+func lastByte(buf *bytes.Buffer) byte {
+	if buf.Len() == 0 {
+		return 0
+	}
+	return buf.Bytes()[buf.Len()-1]
+}
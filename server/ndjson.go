@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// NDJSONWriter streams newline-delimited JSON (JSON Lines) to a ResponseWriter,
+// flushing periodically so consumers see records as they are produced
+type NDJSONWriter struct {
+	Clock Clock // Time source for the flush interval; nil means SystemClock
+
+	w         ResponseWriter
+	interval  time.Duration
+	lastFlush time.Time
+	flushed   bool
+}
+
+// NewNDJSONWriter sets the application/x-ndjson content type and returns a
+// writer that flushes at most once per flushInterval (0 flushes every line)
+func NewNDJSONWriter(w ResponseWriter, flushInterval time.Duration) *NDJSONWriter {
+	w.SetHeader("Content-Type", "application/x-ndjson")
+	return &NDJSONWriter{w: w, interval: flushInterval}
+}
+
+// WriteJSONLine encodes v as one line. The first line is flushed right away
+// so the client receives the headers without waiting for the interval.
+func (nw *NDJSONWriter) WriteJSONLine(v any) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := nw.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	now := clockOrSystem(nw.Clock).Now()
+	if !nw.flushed || now.Sub(nw.lastFlush) >= nw.interval {
+		return nw.flushAt(now)
+	}
+	return nil
+}
+
+// Flush sends buffered lines immediately
+func (nw *NDJSONWriter) Flush() error {
+	return nw.flushAt(clockOrSystem(nw.Clock).Now())
+}
+
+// flushAt flushes and records the flush time
+func (nw *NDJSONWriter) flushAt(now time.Time) error {
+	nw.flushed = true
+	nw.lastFlush = now
+	return nw.w.Flush()
+}
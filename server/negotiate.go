@@ -0,0 +1,70 @@
+package server
+
+import "strings"
+
+// Accepts returns the offered media type the client prefers according to
+// its Accept header, e.g.
+//
+//	switch req.Accepts("application/json", "text/html") {
+//	case "text/html":
+//		...
+//	}
+//
+// Each offer is rated by the most specific matching range (text/html, then
+// text/*, then */*); ties go to the earlier offer. Without an Accept header
+// the first offer is returned, and "" when the client accepts none of them.
+func (req *Request) Accepts(offers ...string) string {
+	return negotiate(req.Headers.Get("Accept"), offers, mediaRanges)
+}
+
+// AcceptsLanguage returns the offered language tag the client prefers
+// according to its Accept-Language header. A range such as "en" also
+// matches the offer "en-US". It returns the first offer when the header is
+// missing and "" when no offer is acceptable.
+func (req *Request) AcceptsLanguage(offers ...string) string {
+	return negotiate(req.Headers.Get("Accept-Language"), offers, languageRanges)
+}
+
+// negotiate picks the offer with the highest quality in header, looking up
+// each offer under the ranges returned by rangesFor, most specific first
+func negotiate(header string, offers []string, rangesFor func(offer string) []string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+	qualities := parseQualityValues(header)
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		for _, r := range rangesFor(strings.ToLower(offer)) {
+			if q, ok := qualities[r]; ok {
+				if q > bestQ {
+					best, bestQ = offer, q
+				}
+				break
+			}
+		}
+	}
+	return best
+}
+
+// mediaRanges lists the Accept ranges matching a media type
+func mediaRanges(offer string) []string {
+	offer, _, _ = strings.Cut(offer, ";")
+	offer = strings.TrimSpace(offer)
+	kind, _, _ := strings.Cut(offer, "/")
+	return []string{offer, kind + "/*", "*/*"}
+}
+
+// languageRanges lists the Accept-Language ranges matching a language tag:
+// the tag, its prefixes ("en-us", "en") and "*"
+func languageRanges(offer string) []string {
+	ranges := []string{offer}
+	for i := strings.LastIndexByte(offer, '-'); i > 0; i = strings.LastIndexByte(offer, '-') {
+		offer = offer[:i]
+		ranges = append(ranges, offer)
+	}
+	return append(ranges, "*")
+}
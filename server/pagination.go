@@ -0,0 +1,153 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PaginationOptions bounds the values accepted by ParsePagination
+type PaginationOptions struct {
+	DefaultLimit int      // Limit used when the query has none (default 20)
+	MaxLimit     int      // Largest limit a client may request (default 100)
+	SortFields   []string // Fields allowed in ?sort=; empty allows any field
+}
+
+// SortField is one entry of a ?sort=name,-created parameter
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// Pagination holds list parameters parsed from the query string
+type Pagination struct {
+	Limit  int
+	Offset int
+	Cursor string
+	Sort   []SortField
+}
+
+// ParsePagination reads limit, offset, cursor and sort from query parameters.
+// Returned errors are safe to show to clients, e.g. via Serve400(err.Error()).
+func ParsePagination(query map[string]string, opts PaginationOptions) (Pagination, error) {
+	if opts.DefaultLimit <= 0 {
+		opts.DefaultLimit = 20
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = 100
+	}
+
+	p := Pagination{Limit: opts.DefaultLimit, Cursor: query["cursor"]}
+
+	if raw := query["limit"]; raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 {
+			return p, errors.New("limit must be a positive integer")
+		}
+		if limit > opts.MaxLimit {
+			return p, fmt.Errorf("limit must not exceed %d", opts.MaxLimit)
+		}
+		p.Limit = limit
+	}
+
+	if raw := query["offset"]; raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return p, errors.New("offset must be a non-negative integer")
+		}
+		p.Offset = offset
+	}
+
+	if p.Cursor != "" && p.Offset > 0 {
+		return p, errors.New("cursor and offset cannot be combined")
+	}
+
+	if raw := query["sort"]; raw != "" {
+		for _, field := range strings.Split(raw, ",") {
+			sf := SortField{Field: strings.TrimSpace(field)}
+			if strings.HasPrefix(sf.Field, "-") {
+				sf.Field = sf.Field[1:]
+				sf.Desc = true
+			}
+			if sf.Field == "" {
+				return p, errors.New("sort contains an empty field")
+			}
+			if len(opts.SortFields) > 0 && !slices.Contains(opts.SortFields, sf.Field) {
+				return p, fmt.Errorf("cannot sort by %q", sf.Field)
+			}
+			p.Sort = append(p.Sort, sf)
+		}
+	}
+
+	return p, nil
+}
+
+// Headers returns X-Total-Count and Link (first, prev, next, last) headers
+// for an offset-paginated list of total items served at path. A Pagination
+// without a positive Limit, such as the zero value, has no pages to link,
+// so only X-Total-Count is set.
+func (p Pagination) Headers(path string, query map[string]string, total int) map[string]string {
+	headers := map[string]string{"X-Total-Count": strconv.Itoa(total)}
+	if p.Limit <= 0 {
+		return headers
+	}
+
+	var links []string
+	addLink := func(rel string, offset int) {
+		links = append(links, fmt.Sprintf(`<%s>; rel="%s"`, pageURL(path, query, p.Limit, offset), rel))
+	}
+
+	addLink("first", 0)
+	if p.Offset > 0 {
+		prev := p.Offset - p.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		addLink("prev", prev)
+	}
+	if p.Offset+p.Limit < total {
+		addLink("next", p.Offset+p.Limit)
+	}
+	last := 0
+	if total > 0 {
+		last = ((total - 1) / p.Limit) * p.Limit
+	}
+	addLink("last", last)
+
+	headers["Link"] = strings.Join(links, ", ")
+	return headers
+}
+
+// CursorHeaders returns a Link header pointing at the next page of a
+// cursor-paginated list. An empty nextCursor means there are no more pages.
+func CursorHeaders(path string, query map[string]string, nextCursor string) map[string]string {
+	if nextCursor == "" {
+		return map[string]string{}
+	}
+	values := queryValues(query)
+	values.Del("offset")
+	values.Set("cursor", nextCursor)
+	return map[string]string{"Link": fmt.Sprintf(`<%s?%s>; rel="next"`, path, values.Encode())}
+}
+
+// pageURL rebuilds the request URL with a different limit/offset
+func pageURL(path string, query map[string]string, limit, offset int) string {
+	values := queryValues(query)
+	// A cursor can't be combined with an offset
+	values.Del("cursor")
+	values.Set("limit", strconv.Itoa(limit))
+	values.Set("offset", strconv.Itoa(offset))
+	return path + "?" + values.Encode()
+}
+
+// queryValues copies a query map into url.Values
+func queryValues(query map[string]string) url.Values {
+	values := make(url.Values, len(query)+2)
+	for key, value := range query {
+		values.Set(key, value)
+	}
+	return values
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// pipelineDepth bounds how many requests of one connection are in flight
+const pipelineDepth = 16
+
+// concurrentSafe reports whether a request may run alongside the ones before
+// it: a GET or HEAD without a body or Expect header. Other requests wait for
+// the earlier responses to be written, so their bodies, interim responses
+// and streamed output stay in order.
+func concurrentSafe(head *requestHead) bool {
+	if head.method != "GET" && head.method != "HEAD" {
+		return false
+	}
+	length := head.headers.Get("Content-Length")
+	return (length == "" || length == "0") && head.headers.Get("Transfer-Encoding") == "" &&
+		head.headers.Get("Expect") == ""
+}
+
+// runPipelined serves conn with Config.ConcurrentRequests: safe requests are
+// handled in their own goroutines while the next request is read, and a
+// writer goroutine sends the responses in request order
+func (r *Router) runPipelined(conn net.Conn, br *bufio.Reader) {
+	queue := make(chan chan served, pipelineDepth)
+	var pending sync.WaitGroup // queued responses not yet written
+	writerDone := make(chan struct{})
+
+	go func() {
+		defer close(writerDone)
+		closed := false
+		for result := range queue {
+			res := <-result
+			if !closed && len(res.response) > 0 {
+				if r.config.WriteTimeout > 0 {
+					conn.SetWriteDeadline(time.Now().Add(r.config.WriteTimeout))
+				}
+				if _, err := conn.Write(setConnectionHeader(res.response, !res.close)); err != nil {
+					res.close = true
+				}
+			}
+			if res.close && !closed {
+				// Unblocks the reader; later responses are discarded
+				closed = true
+				conn.Close()
+			}
+			pending.Done()
+		}
+	}()
+	defer func() {
+		close(queue)
+		<-writerDone
+	}()
+
+	waitTimeout := r.config.headerReadTimeout()
+	for {
+		conn.SetReadDeadline(time.Now().Add(waitTimeout))
+		if _, err := br.Peek(1); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(r.config.headerReadTimeout()))
+
+		arena := newRequestArena()
+		target, head, early := r.readHead(br, arena)
+		result := make(chan served, 1)
+		stop := false
+
+		switch {
+		case early != nil:
+			arena.release()
+			result <- *early
+			stop = early.close
+		case concurrentSafe(head):
+			req, stream, early := target.prepareRequest(conn, br, head)
+			if early != nil {
+				arena.release()
+				result <- *early
+				stop = early.close
+				break
+			}
+			// The response is written by the writer goroutine, so the
+			// handler can't stream to the connection
+			req.conn = nil
+			stop = !req.keepAlive
+			go func() {
+				defer arena.release()
+				defer func() {
+					if err := recover(); err != nil {
+						log.Printf("PANIC recovered: %v\n%s", err, debug.Stack())
+						response, status := Serve500("Internal server error occurred")
+						result <- served{response, status, true}
+					}
+				}()
+				result <- target.finishRequest(req, stream)
+			}()
+		default:
+			pending.Wait()
+			req, stream, early := target.prepareRequest(conn, br, head)
+			res := early
+			if res == nil {
+				finished := target.finishRequest(req, stream)
+				res = &finished
+			}
+			arena.release()
+			result <- *res
+			stop = res.close
+		}
+
+		pending.Add(1)
+		queue <- result
+		if stop {
+			return
+		}
+		if r.config.IdleTimeout > 0 {
+			waitTimeout = r.config.IdleTimeout
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"log"
+)
+
+// Plugin is an optional feature (metrics, sessions, an admin UI, ...) that
+// ships as its own module and is added to a server with Install.
+type Plugin interface {
+	// Init prepares the plugin, e.g. adding middleware or reading config.
+	// An error aborts the installation.
+	Init(s *Server) error
+	// RegisterRoutes adds the plugin's routes
+	RegisterRoutes(r *Router)
+	// Shutdown releases the plugin's resources when the server stops
+	Shutdown() error
+}
+
+// Install initializes each plugin and registers its routes, in order. It
+// stops at the first Init error; plugins installed before it stay active.
+// Installed plugins are shut down in reverse order after the OnShutdown hooks.
+func (s *Server) Install(plugins ...Plugin) error {
+	for _, p := range plugins {
+		if err := p.Init(s); err != nil {
+			return fmt.Errorf("plugin %T: %w", p, err)
+		}
+		p.RegisterRoutes(s.Router)
+
+		s.mu.Lock()
+		s.plugins = append(s.plugins, p)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// shutdownPlugins shuts the installed plugins down, last installed first
+func (s *Server) shutdownPlugins() []error {
+	s.mu.Lock()
+	plugins := s.plugins
+	s.mu.Unlock()
+
+	var errs []error
+	for i := len(plugins) - 1; i >= 0; i-- {
+		if err := plugins[i].Shutdown(); err != nil {
+			err = fmt.Errorf("plugin %T: %w", plugins[i], err)
+			log.Println("Plugin shutdown failed:", err)
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
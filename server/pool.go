@@ -7,22 +7,6 @@ import (
 
 // Buffer pools for reducing allocations
 
-// chunkBufferPool holds 4KB buffers for reading from connections
-var chunkBufferPool = sync.Pool{
-	New: func() interface{} {
-		buf := make([]byte, 4096)
-		return &buf
-	},
-}
-
-// requestBufferPool holds 8KB buffers for accumulating request headers
-var requestBufferPool = sync.Pool{
-	New: func() interface{} {
-		buf := make([]byte, 8192)
-		return &buf
-	},
-}
-
 // responseBufferPool holds bytes.Buffer for building responses
 var responseBufferPool = sync.Pool{
 	New: func() interface{} {
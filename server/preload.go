@@ -0,0 +1,50 @@
+package server
+
+import (
+	"path"
+	"strings"
+)
+
+// Preload adds a "Link: <asset>; rel=preload" header for each asset to the
+// route's HTML responses, so browsers start fetching critical CSS, scripts
+// and fonts before parsing the page. The "as" type is inferred from the
+// extension. Streamed responses are sent unchanged.
+func Preload(assets ...string) RouteOption {
+	links := make([]string, len(assets))
+	for i, asset := range assets {
+		links[i] = preloadLink(asset)
+	}
+	return func(rt *route) {
+		next := rt.handler
+		rt.handler = func(req *Request) ([]byte, string) {
+			response, status := next(req)
+			head, _, ok := splitResponse(response)
+			if !ok || !strings.HasPrefix(strings.ToLower(responseHeader(head, "Content-Type")), "text/html") {
+				return response, status
+			}
+			for _, link := range links {
+				response = appendResponseHeader(response, "Link", link)
+			}
+			return response, status
+		}
+	}
+}
+
+// preloadLink formats the Link header value preloading asset
+func preloadLink(asset string) string {
+	link := "<" + asset + ">; rel=preload"
+	switch strings.ToLower(path.Ext(strings.SplitN(asset, "?", 2)[0])) {
+	case ".css":
+		link += "; as=style"
+	case ".js", ".mjs":
+		link += "; as=script"
+	case ".woff2", ".woff", ".ttf", ".otf":
+		// Fonts are always fetched in CORS mode
+		link += "; as=font; crossorigin"
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico":
+		link += "; as=image"
+	case ".json":
+		link += "; as=fetch; crossorigin"
+	}
+	return link
+}
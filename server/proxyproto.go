@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errInvalidProxyHeader is returned by reads on a connection whose PROXY
+// protocol preamble is missing or malformed
+var errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyV2Signature starts every PROXY protocol v2 preamble
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Length is the longest v1 line the spec allows, CRLF included
+const maxProxyV1Length = 107
+
+// proxyConn strips the PROXY protocol preamble (v1 text or v2 binary) a load
+// balancer sends ahead of the client's bytes and reports the client address
+// it carries as RemoteAddr. The preamble is read on first use, under
+// whatever read deadline the caller has set.
+type proxyConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr // client address from the preamble; nil keeps the peer's
+	err    error
+}
+
+// newProxyConn wraps conn, which must start with a PROXY protocol preamble
+func newProxyConn(conn net.Conn) *proxyConn {
+	return &proxyConn{Conn: conn, br: bufio.NewReader(conn)}
+}
+
+// NetConn returns the wrapped connection
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readPreamble)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readPreamble)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readPreamble reads the v1 or v2 preamble, telling them apart by the
+// first byte
+func (c *proxyConn) readPreamble() {
+	first, err := c.br.Peek(1)
+	if err != nil {
+		c.err = err
+		return
+	}
+	switch first[0] {
+	case 'P':
+		c.remote, c.err = readProxyV1(c.br)
+	case '\r':
+		c.remote, c.err = readProxyV2(c.br)
+	default:
+		c.err = errInvalidProxyHeader
+	}
+}
+
+// readProxyV1 reads a "PROXY TCP4 src dst srcport dstport\r\n" line. UNKNOWN
+// connections keep the peer's address.
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyV1Length {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errInvalidProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary preamble. LOCAL connections (health checks
+// from the balancer itself) and address families other than IPv4 and IPv6
+// keep the peer's address; TLVs are skipped.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	switch command := header[12] & 0x0f; {
+	case command == 0:
+		return nil, nil
+	case command != 1:
+		return nil, errInvalidProxyHeader
+	}
+	switch family := header[13] >> 4; {
+	case family == 1 && len(payload) >= 12:
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case family == 2 && len(payload) >= 36:
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	case family == 1 || family == 2:
+		return nil, errInvalidProxyHeader
+	}
+	return nil, nil
+}
+
+// hasProxyConn reports whether conn or a connection it wraps already reads
+// the PROXY preamble
+func hasProxyConn(conn net.Conn) bool {
+	for {
+		if _, ok := conn.(*proxyConn); ok {
+			return true
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return false
+		}
+		conn = wrapper.NetConn()
+	}
+}
+
+// proxyListener wraps accepted connections in proxyConn, so the preamble is
+// stripped before a TLS handshake reads the connection
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newProxyConn(conn), nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	mathrand "math/rand/v2"
+	"sync"
+)
+
+// RandomSource supplies random bytes for identifiers and tokens.
+//
+// Entropy guarantees with the default CryptoRandom source:
+//   - NewRequestID: 128 bits, hex-encoded (32 characters)
+//   - NewToken:     256 bits, base64url-encoded (43 characters), suitable for
+//     session IDs, CSRF tokens and other secrets
+//
+// A deterministic source gives no security guarantees and is for tests only.
+type RandomSource interface {
+	Read(p []byte) (n int, err error)
+}
+
+// CryptoRandom is the default source, backed by crypto/rand
+var CryptoRandom RandomSource = rand.Reader
+
+// deterministicRandom is a seeded ChaCha8 stream guarded for concurrent use
+type deterministicRandom struct {
+	mu  sync.Mutex
+	rng *mathrand.ChaCha8
+}
+
+// NewDeterministicRandom returns a reproducible source: the same seed always
+// yields the same bytes. Use it in tests, never for real secrets.
+func NewDeterministicRandom(seed uint64) RandomSource {
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], seed)
+	return &deterministicRandom{rng: mathrand.NewChaCha8(key)}
+}
+
+func (d *deterministicRandom) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rng.Read(p)
+}
+
+// randomBytes reads n bytes from src (CryptoRandom when nil)
+func randomBytes(src RandomSource, n int) []byte {
+	if src == nil {
+		src = CryptoRandom
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(src, buf); err != nil {
+		// crypto/rand only fails if the OS entropy source is broken
+		panic("server: random source failed: " + err.Error())
+	}
+	return buf
+}
+
+// NewRequestID returns a 128-bit hex identifier for correlating requests
+func NewRequestID(src RandomSource) string {
+	return hex.EncodeToString(randomBytes(src, 16))
+}
+
+// NewToken returns a 256-bit URL-safe token for sessions and CSRF protection
+func NewToken(src RandomSource) string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(src, 32))
+}
+
+// RequestID returns middleware that ensures every request has an X-Request-Id
+// header (keeping a well-formed client-supplied one) and echoes it on the response
+func RequestID(src RandomSource) Middleware {
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			id := headerValue(req.Headers, "X-Request-Id")
+			if !validRequestID(id) {
+				id = NewRequestID(src)
+				if req.Headers == nil {
+					req.Headers = make(map[string]string)
+				}
+				req.Headers["X-Request-Id"] = id
+			}
+			response, status := next(req)
+			return AddResponseHeaders(response, map[string]string{"X-Request-Id": id}), status
+		}
+	}
+}
+
+// validRequestID accepts short IDs made of letters, digits, '-', '_' and '.'
+// so client-supplied values cannot inject into headers or logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
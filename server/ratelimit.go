@@ -0,0 +1,115 @@
+package server
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig configures the RateLimit middleware
+type RateLimitConfig struct {
+	Requests int           // Requests allowed per Window
+	Window   time.Duration // Refill period for Requests tokens
+	Burst    int           // Bucket capacity; 0 means Requests
+
+	// Key identifies the client; nil means req.ClientIP()
+	Key func(req *Request) string
+
+	Clock Clock // Time source for refills and eviction; nil means SystemClock
+}
+
+// tokenBucket is one client's remaining allowance
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the buckets of a RateLimit middleware
+type rateLimiter struct {
+	cfg       RateLimitConfig
+	rate      float64 // Tokens per second
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// RateLimit limits each client to cfg.Requests per cfg.Window using a token
+// bucket, answering 429 with a Retry-After header once the bucket is empty.
+// Buckets idle long enough to have refilled are evicted once per window.
+func RateLimit(cfg RateLimitConfig) Middleware {
+	if cfg.Requests <= 0 || cfg.Window <= 0 {
+		panic("server: RateLimit needs positive Requests and Window")
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = cfg.Requests
+	}
+	if cfg.Key == nil {
+		cfg.Key = (*Request).ClientIP
+	}
+	l := &rateLimiter{
+		cfg:     cfg,
+		rate:    float64(cfg.Requests) / cfg.Window.Seconds(),
+		buckets: make(map[string]*tokenBucket),
+	}
+
+	return func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			if wait, ok := l.allow(cfg.Key(req)); !ok {
+				seconds := int(math.Ceil(wait.Seconds()))
+				response, status := Serve429("")
+				return appendResponseHeader(response, "Retry-After", strconv.Itoa(max(seconds, 1))), status
+			}
+			return next(req)
+		}
+	}
+}
+
+// allow takes a token from key's bucket, or reports how long until one is available
+func (l *rateLimiter) allow(key string) (time.Duration, bool) {
+	now := clockOrSystem(l.cfg.Clock).Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= l.cfg.Window {
+		l.evictIdle(now)
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.cfg.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = min(float64(l.cfg.Burst), bucket.tokens+elapsed*l.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	return 0, true
+}
+
+// evictIdle drops buckets that would be full by now, since a fresh bucket
+// behaves the same. Caller holds the lock.
+func (l *rateLimiter) evictIdle(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= float64(l.cfg.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// remoteIP returns the IP part of the request's RemoteAddr
+func remoteIP(req *Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
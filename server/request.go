@@ -1,11 +1,17 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
+	"mime"
 	"net"
+	"net/netip"
 	"net/url"
 	"strings"
 	"time"
@@ -17,74 +23,305 @@ type Request struct {
 	Path       string
 	Query      map[string]string
 	PathParams map[string]string
-	Body       map[string]string
-	Headers    map[string]string
+	Body       map[string]string // Parsed JSON or form fields (convenience)
+	BodyErr    error             // Why the body couldn't be parsed into Body, e.g. malformed JSON
+	RawBody    []byte            // Body bytes as received (after Content-Encoding decoding)
+	Headers    Headers
+	Host       string            // Host header as sent, e.g. "example.com:8080"
+	Cookies    map[string]string // Parsed from the Cookie header
+	Auth       Claims            // Claims of a bearer token verified by JWT
 	Browser    string
+
+	ContentLength int64     // Body size before Content-Encoding decoding; -1 if unknown (chunked StreamBody)
+	ContentType   MediaType // Parsed Content-Type header
+
+	Proto      string  // Protocol from the request line, e.g. "HTTP/1.1"
+	RemoteAddr string  // Address of the connected client ("ip:port")
+	TLS        bool    // Whether the request arrived over TLS
+	Geo        GeoInfo // Client location, resolved when Config.GeoIP is set
+
+	conn  net.Conn  // Connection the request arrived on, used for streaming responses
+	route *route    // Matched route, consulted by middleware for per-route options
+	body  io.Reader // Live body of StreamBody routes
+
+	hostParams map[string]string // Host labels captured by VirtualHosts, merged into PathParams
+
+	principal *Principal       // Caller resolved by Authorize
+	deadline  *handlerDeadline // Set while HandlerTimeout applies
+	arena     *requestArena    // Backs the header strings; see arena.go
+
+	keepAlive    bool          // Connection stays open after the response
+	timeout      time.Duration // HandlerTimeout, or the route's WithTimeout
+	closeConn    bool          // Handler asked to close the connection
+	writeTimeout time.Duration // WriteTimeout for streamed responses
+	bufferSize   int           // Config.ResponseBufferSize for ResponseWriters
+
+	rawQuery string // Query string as sent, kept for redirects
+
+	compressionLevels map[string]int // Config.CompressionLevels, used by Compress
+	trustedProxies    []netip.Prefix // Config.TrustedProxies, consulted by ClientIP
+	forwardedHeader   string         // Config.ForwardedHeader, consulted by ClientIP
 }
 
-// readHTTPRequest reads HTTP request headers from a connection
-func readHTTPRequest(conn net.Conn, config *Config) ([]byte, error) {
-	bufPtr := requestBufferPool.Get().(*[]byte)
-	headerBuffer := (*bufPtr)[:0]
+// MediaType is a parsed Content-Type header
+type MediaType struct {
+	Type   string            // Lowercased media type, e.g. "application/json"
+	Params map[string]string // Parameters such as charset or boundary, keys lowercased
+}
 
-	defer func() {
-		if cap(headerBuffer) <= maxPoolBufferSize {
-			requestBufferPool.Put(bufPtr)
-		}
-	}()
+// parseMediaType parses a Content-Type value. A value mime can't parse
+// keeps the media type before the first ";" so handlers can still match it.
+func parseMediaType(value string) MediaType {
+	if value == "" {
+		return MediaType{}
+	}
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil && mediaType == "" {
+		mediaType, _, _ = strings.Cut(value, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	}
+	return MediaType{Type: mediaType, Params: params}
+}
 
-	endMarker := []byte("\r\n\r\n")
+// BodyReader returns a reader over the request body. For routes registered
+// with StreamBody it reads directly from the connection.
+func (req *Request) BodyReader() io.Reader {
+	if req.body != nil {
+		return req.body
+	}
+	return bytes.NewReader(req.RawBody)
+}
 
-	for {
-		conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+// JSONDecoder returns a JSON decoder over the request body, suited to
+// decoding large arrays or NDJSON one value at a time on StreamBody routes
+func (req *Request) JSONDecoder() *json.Decoder {
+	return json.NewDecoder(req.BodyReader())
+}
 
-		if len(headerBuffer) > config.MaxHeaderSize {
-			return nil, errors.New("headers too large")
-		}
+// errURITooLong is returned when the request target exceeds MaxURLLength
+var errURITooLong = errors.New("request URI too long")
+
+// maxRequestLineOverhead allows for the method, protocol and separators
+// around the request target
+const maxRequestLineOverhead = 32
+
+// errHeadersTooLarge is returned when the request head exceeds MaxHeaderSize,
+// a header line exceeds MaxHeaderLineSize or there are more than MaxHeaderCount
+var errHeadersTooLarge = errors.New("request headers too large")
 
-		chunkPtr := chunkBufferPool.Get().(*[]byte)
-		chunk := *chunkPtr
+// errInvalidRequestLine is returned for a request line that isn't a method
+// token, a target without spaces or control bytes and an HTTP version
+var errInvalidRequestLine = errors.New("invalid request line")
+
+// errInvalidHeader is returned for a header line without a colon, with a name
+// that isn't a token or with control bytes such as a bare CR in its value
+var errInvalidHeader = errors.New("invalid header field")
+
+// requestHead is the parsed request line and header fields
+type requestHead struct {
+	method  string
+	target  string // path and query as sent
+	proto   string
+	headers Headers
+
+	hostParams map[string]string // captured by a VirtualHosts name pattern
+	arena      *requestArena     // backs the header strings
+}
 
-		n, err := conn.Read(chunk)
+// readRequestHead parses the request line and headers from br one line at a
+// time. Only the parsed fields are kept, and a head is rejected as soon as it
+// passes MaxHeaderSize, or its request line passes MaxURLLength, without
+// reading the rest. Body bytes and pipelined requests stay buffered in br.
+func readRequestHead(br *bufio.Reader, config *Config, arena *requestArena) (*requestHead, error) {
+	budget := config.maxHeaderSize()
+	var scratch []byte
+
+	// Request line, skipping empty lines left over from a previous request
+	var line []byte
+	for {
+		limit, limitErr := budget, errHeadersTooLarge
+		if config.MaxURLLength > 0 && config.MaxURLLength+maxRequestLineOverhead < limit {
+			limit, limitErr = config.MaxURLLength+maxRequestLineOverhead, errURITooLong
+		}
+		var n int
+		var err error
+		line, n, err = readHeadLine(br, limit, &scratch)
+		if errors.Is(err, errLineTooLong) {
+			return nil, limitErr
+		}
 		if err != nil {
-			chunkBufferPool.Put(chunkPtr)
 			return nil, err
 		}
-
-		headerBuffer = append(headerBuffer, chunk[:n]...)
-		chunkBufferPool.Put(chunkPtr)
-
-		if bytes.Contains(headerBuffer, endMarker) {
+		budget -= n
+		if len(line) > 0 {
 			break
 		}
 	}
+	method, target, proto, err := parseRequestLineFromBytes(line)
+	if err != nil {
+		return nil, errInvalidRequestLine
+	}
+	head := &requestHead{method: method, target: string(target), proto: proto}
+
+	head.arena = arena
+	head.headers = make(Headers, 16)
+	for count := 0; ; count++ {
+		limit := budget
+		if config.MaxHeaderLineSize > 0 {
+			// Allow for the CRLF ending
+			limit = min(limit, config.MaxHeaderLineSize+2)
+		}
+		line, n, err := readHeadLine(br, limit, &scratch)
+		if errors.Is(err, errLineTooLong) {
+			return nil, errHeadersTooLarge
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		budget -= n
+		if len(line) == 0 {
+			return head, nil
+		}
+		if count == config.maxHeaderCount() {
+			return nil, errHeadersTooLarge
+		}
+		// Whitespace before the colon and folded lines fail the token check
+		key, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !isToken(key) || !validFieldValue(value) {
+			return nil, errInvalidHeader
+		}
+		head.headers.addCanonical(arena.string(key), arena.string(bytes.Trim(value, " \t")))
+	}
+}
 
-	result := make([]byte, len(headerBuffer))
-	copy(result, headerBuffer)
-	return result, nil
+// errLineTooLong is returned by readHeadLine when a line passes its limit
+var errLineTooLong = errors.New("line too long")
+
+// readHeadLine reads a line of at most limit bytes, returning it without the
+// CRLF or LF ending and the number of bytes consumed. The line is only valid
+// until the next read.
+func readHeadLine(br *bufio.Reader, limit int, scratch *[]byte) ([]byte, int, error) {
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		*scratch = append((*scratch)[:0], line...)
+		for errors.Is(err, bufio.ErrBufferFull) && len(*scratch) <= limit {
+			line, err = br.ReadSlice('\n')
+			*scratch = append(*scratch, line...)
+		}
+		line = *scratch
+	}
+	if len(line) > limit {
+		return nil, 0, errLineTooLong
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	n := len(line)
+	line = bytes.TrimSuffix(line[:n-1], []byte("\r"))
+	return line, n, nil
 }
 
-// parseRequestLineFromBytes extracts method and path from request line
-func parseRequestLineFromBytes(firstLine []byte) (method string, path []byte, err error) {
+// parseRequestLineFromBytes extracts method, path and protocol from request line
+func parseRequestLineFromBytes(firstLine []byte) (method string, path []byte, proto string, err error) {
 	parts := bytes.Split(firstLine, []byte(" "))
-	if len(parts) < 3 {
-		return "", nil, errors.New("invalid request line")
+	if len(parts) != 3 || !isToken(parts[0]) || !validTarget(parts[1]) || !validProto(parts[2]) {
+		return "", nil, "", errInvalidRequestLine
 	}
-	return string(parts[0]), parts[1], nil
+	return string(parts[0]), parts[1], string(parts[2]), nil
 }
 
-// parseHeadersFromBytes parses HTTP headers from byte slices
-func parseHeadersFromBytes(headerLines [][]byte) map[string]string {
-	headerMap := make(map[string]string, len(headerLines))
-	for _, line := range headerLines {
-		parts := bytes.SplitN(line, []byte(":"), 2)
-		if len(parts) == 2 {
-			key := string(bytes.TrimSpace(parts[0]))
-			value := string(bytes.TrimSpace(parts[1]))
-			headerMap[key] = value
+// isTokenChar reports whether c is a tchar of RFC 9110
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// isToken reports whether b is a non-empty token, as methods and header
+// names must be
+func isToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if !isTokenChar(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validHost reports whether a Host header value is a host and optional
+// port: an IP-literal such as "[::1]", or a reg-name of letters, digits,
+// "-", ".", "_", "~" and percent-encoded bytes. The RFC 3986 sub-delims
+// ("!$&'()*+,;=") are refused: no DNS name uses them, and a comma is how
+// repeated Host headers show up once combined.
+func validHost(host string) bool {
+	name, port := host, ""
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		name, port = host[:i], host[i+1:]
+	}
+	if len(port) > 5 || strings.Trim(port, "0123456789") != "" {
+		return false
+	}
+	if strings.HasPrefix(name, "[") {
+		addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(name, "["), "]"))
+		return strings.HasSuffix(name, "]") && err == nil && addr.Is6() && addr.Zone() == ""
+	}
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.', c == '_', c == '~':
+		case c == '%' && i+2 < len(name) && isHex(name[i+1]) && isHex(name[i+2]):
+			i += 2
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isHex reports whether c is a hexadecimal digit
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// validTarget reports whether a request target is free of spaces and
+// control bytes
+func validTarget(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c <= ' ' || c == 0x7f {
+			return false
 		}
 	}
-	return headerMap
+	return true
+}
+
+// validProto reports whether b is an HTTP version such as "HTTP/1.1"
+func validProto(b []byte) bool {
+	return len(b) == 8 && bytes.HasPrefix(b, []byte("HTTP/")) &&
+		b[5] >= '0' && b[5] <= '9' && b[6] == '.' && b[7] >= '0' && b[7] <= '9'
+}
+
+// validFieldValue reports whether a header value has no control bytes
+// other than horizontal tab
+func validFieldValue(b []byte) bool {
+	for _, c := range b {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
 }
 
 // parseKeyValuePairsFromBytes parses URL-encoded key-value pairs
@@ -107,18 +344,79 @@ func parseKeyValuePairsFromBytes(data []byte) map[string]string {
 
 // parseJSONBodyFromBytes parses a JSON body into a string map
 func parseJSONBodyFromBytes(bodyData []byte) map[string]string {
-	var jsonData map[string]any
-	result := make(map[string]string, 8)
+	result, err := ParseJSONBody("application/json", bodyData)
+	if err != nil {
+		return make(map[string]string)
+	}
+	return result
+}
+
+// errBodyTooLarge is returned when a decoded body exceeds the configured limit
+var errBodyTooLarge = errors.New("request body too large")
+
+// errUnsupportedEncoding is returned for request Content-Encodings the server can't decode
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// newBodyDecoder wraps a request body in a decoder for its Content-Encoding:
+// gzip, or deflate (zlib-wrapped, per RFC 9110)
+func newBodyDecoder(contentEncoding string, body io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
 
-	if err := json.Unmarshal(bodyData, &jsonData); err != nil {
-		return result
+// decodeRequestBody undoes a gzip or deflate Content-Encoding, capping the
+// decompressed size
+func decodeRequestBody(contentEncoding string, bodyData []byte, maxSize int64) ([]byte, error) {
+	zr, err := newBodyDecoder(contentEncoding, bytes.NewReader(bodyData))
+	if err != nil {
+		return nil, err
 	}
+	defer zr.Close()
 
-	for key, value := range jsonData {
-		result[key] = fmt.Sprintf("%v", value)
+	var reader io.Reader = zr
+	if maxSize > 0 {
+		// Read one byte past the limit to detect oversized payloads (zip bombs)
+		reader = io.LimitReader(zr, maxSize+1)
 	}
 
-	return result
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && int64(len(decoded)) > maxSize {
+		return nil, errBodyTooLarge
+	}
+	return decoded, nil
+}
+
+// connectionInfo returns the client address of a connection and whether it uses TLS
+func connectionInfo(conn net.Conn) (remoteAddr string, isTLS bool) {
+	if conn == nil {
+		return "", false
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		remoteAddr = addr.String()
+	}
+
+	// Look through wrappers (e.g. fault injection) for a TLS connection
+	for {
+		if _, ok := conn.(*tls.Conn); ok {
+			return remoteAddr, true
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return remoteAddr, false
+		}
+		conn = wrapper.NetConn()
+	}
 }
 
 // safeURLDecode decodes a URL-encoded string, returning original on error
@@ -130,6 +428,38 @@ func safeURLDecode(encoded string) string {
 	return decoded
 }
 
+// normalizePath collapses repeated slashes and removes "." and ".." segments
+// (RFC 3986 remove_dot_segments), keeping a trailing slash if present
+func normalizePath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	if !strings.Contains(p, "//") && !strings.Contains(p, "/.") {
+		return p
+	}
+
+	trailingSlash := strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")
+	segments := strings.Split(p, "/")
+	out := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		switch segment {
+		case "", ".":
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+
+	normalized := "/" + strings.Join(out, "/")
+	if trailingSlash && normalized != "/" {
+		normalized += "/"
+	}
+	return normalized
+}
+
 // detectBrowser determines browser from User-Agent header
 func detectBrowser(userAgent string) string {
 	switch {
@@ -143,26 +473,50 @@ func detectBrowser(userAgent string) string {
 		return "Unknown Browser"
 	}
 }
+
+// matchRoute matches a request path against a route pattern.
+// ":name" captures one segment; a final "*name" segment captures the rest of
+// the path (possibly empty) without its leading slash.
 func matchRoute(requestPath string, routePattern string) (map[string]string, bool) {
+	return matchPattern(requestPath, routePattern, false)
+}
+
+// matchPattern is matchRoute, comparing static segments case-insensitively
+// when foldCase is set. Captured parameters keep the request's case.
+func matchPattern(requestPath string, routePattern string, foldCase bool) (map[string]string, bool) {
 	// Split both into parts
 	requestParts := strings.Split(strings.Trim(requestPath, "/"), "/")
 	patternParts := strings.Split(strings.Trim(routePattern, "/"), "/")
 
-	// Must have same number of segments
-	if len(requestParts) != len(patternParts) {
+	last := len(patternParts) - 1
+	catchAll := strings.HasPrefix(patternParts[last], "*")
+
+	// Must have same number of segments, unless a catch-all absorbs the rest
+	if catchAll {
+		if len(requestParts) < last {
+			return nil, false
+		}
+	} else if len(requestParts) != len(patternParts) {
 		return nil, false
 	}
 
 	// Extract parameters
 	params := make(map[string]string)
 
-	for i := 0; i < len(requestParts); i++ {
-		if strings.HasPrefix(patternParts[i], ":") {
+	for i := 0; i < len(patternParts); i++ {
+		if catchAll && i == last {
+			paramName := patternParts[i][1:]
+			if paramName == "" {
+				paramName = "*"
+			}
+			params[paramName] = strings.Join(requestParts[i:], "/")
+			break
+		}
 
+		if strings.HasPrefix(patternParts[i], ":") {
 			paramName := patternParts[i][1:]
 			params[paramName] = requestParts[i]
-		} else if requestParts[i] != patternParts[i] {
-
+		} else if requestParts[i] != patternParts[i] && !(foldCase && strings.EqualFold(requestParts[i], patternParts[i])) {
 			return nil, false
 		}
 	}
@@ -178,26 +532,19 @@ func matchRoute(requestPath string, routePattern string) (map[string]string, boo
 // parseRequestLine parses request line from string (TEST ONLY)
 // Wrapper around parseRequestLineFromBytes for test convenience
 func parseRequestLine(line string) (method string, path string, err error) {
-	parts := strings.Split(line, " ")
-	if len(parts) < 3 {
-		return "", "", errors.New("invalid request line")
-	}
-	return parts[0], parts[1], nil
+	method, target, _, err := parseRequestLineFromBytes([]byte(line))
+	return method, string(target), err
 }
 
 // parseHeaders parses headers from string slice (TEST ONLY)
-// Wrapper around parseHeadersFromBytes for test convenience
-func parseHeaders(headerLines []string) map[string]string {
-	headerMap := make(map[string]string, len(headerLines))
-	for _, line := range headerLines {
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) == 2 {
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-			headerMap[key] = value
-		}
+// Wrapper around readRequestHead for test convenience; nil when it rejects them
+func parseHeaders(headerLines []string) Headers {
+	raw := "GET / HTTP/1.1\r\n" + strings.Join(headerLines, "\r\n") + "\r\n\r\n"
+	head, err := readRequestHead(bufio.NewReader(strings.NewReader(raw)), DefaultConfig(), nil)
+	if err != nil {
+		return nil
 	}
-	return headerMap
+	return head.headers
 }
 
 // parseKeyValuePairs parses URL-encoded string (TEST ONLY)
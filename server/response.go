@@ -2,12 +2,52 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
+	"log"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 )
 
+// Respond builds an HTTP response for an integer status code, using its
+// canonical reason phrase:
+//
+//	return server.Respond(server.StatusCreated, "application/json", body)
+func Respond(code int, contentType string, body []byte) ([]byte, string) {
+	return RespondWithHeaders(code, contentType, nil, body)
+}
+
+// RespondWithHeaders is Respond with additional headers
+func RespondWithHeaders(code int, contentType string, headers Headers, body []byte) ([]byte, string) {
+	return CreateResponseBytesWithHeaders(strconv.Itoa(code), contentType, reasonPhrase(code), headers, body)
+}
+
+// jsonContentType is the Content-Type of ServeJSON and WriteJSON responses
+const jsonContentType = "application/json; charset=utf-8"
+
+// ServeJSON marshals v into a response with the given status ("200").
+// A value that can't be marshaled is logged and answered with a 500.
+func ServeJSON(status string, v any) ([]byte, string) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("ServeJSON: %v\n", err)
+		return Serve500("Failed to encode JSON response")
+	}
+	return CreateResponseBytes(status, jsonContentType, reasonPhrase(StatusCode(status)), body)
+}
+
 // CreateResponseBytes builds an HTTP response as bytes
 func CreateResponseBytes(statusCode, contentType, statusMessage string, body []byte) ([]byte, string) {
+	return CreateResponseBytesWithHeaders(statusCode, contentType, statusMessage, nil, body)
+}
+
+// CreateResponseBytesWithHeaders builds an HTTP response with additional headers.
+// Extra headers are written in sorted order so responses are deterministic.
+// A 304 gets neither Content-Type nor Content-Length: it has no body, and
+// only the validators describe the client's cached copy (RFC 9110 section
+// 15.4.5).
+func CreateResponseBytesWithHeaders(statusCode, contentType, statusMessage string, headers Headers, body []byte) ([]byte, string) {
 	buf := responseBufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
 
@@ -21,11 +61,17 @@ func CreateResponseBytes(statusCode, contentType, statusMessage string, body []b
 	buf.WriteString(statusCode)
 	buf.WriteString(" ")
 	buf.WriteString(statusMessage)
-	buf.WriteString("\r\nContent-Type: ")
-	buf.WriteString(contentType)
+	notModified := statusCode == "304"
+	if !notModified {
+		buf.WriteString("\r\nContent-Type: ")
+		buf.WriteString(contentType)
+	}
 	buf.WriteString("\r\nConnection: keep-alive")
-	buf.WriteString("\r\nContent-Length: ")
-	buf.WriteString(strconv.Itoa(len(body)))
+	if !notModified {
+		buf.WriteString("\r\nContent-Length: ")
+		buf.WriteString(strconv.Itoa(len(body)))
+	}
+	writeHeaderLines(buf, headers)
 	buf.WriteString("\r\n\r\n")
 	buf.Write(body)
 
@@ -34,16 +80,203 @@ func CreateResponseBytes(statusCode, contentType, statusMessage string, body []b
 	return result, statusCode
 }
 
+// chunkedResponseHead builds the status line and headers of a streamed
+// response whose body follows in chunked Transfer-Encoding
+func chunkedResponseHead(statusCode, contentType, statusMessage string, headers Headers, keepAlive bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("HTTP/1.1 ")
+	buf.WriteString(statusCode)
+	buf.WriteString(" ")
+	buf.WriteString(statusMessage)
+	buf.WriteString("\r\nContent-Type: ")
+	buf.WriteString(contentType)
+	buf.WriteString("\r\nConnection: ")
+	buf.WriteString(connectionValue(keepAlive))
+	buf.WriteString("\r\nTransfer-Encoding: chunked")
+	writeHeaderLines(&buf, headers)
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+// writeHeaderLines writes "\r\nKey: Value" lines in sorted key order
+func writeHeaderLines(buf *bytes.Buffer, headers Headers) {
+	if len(headers) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteString("\r\n")
+		buf.WriteString(key)
+		buf.WriteString(": ")
+		buf.WriteString(headers[key])
+	}
+}
+
+// AddResponseHeaders inserts headers into an already-built response.
+// It is meant for wrappers that decorate the bytes returned by a RouteHandler.
+func AddResponseHeaders(response []byte, headers Headers) []byte {
+	headerEnd := bytes.Index(response, []byte("\r\n\r\n"))
+	if headerEnd < 0 || len(headers) == 0 {
+		return response
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(response) + 64*len(headers))
+	buf.Write(response[:headerEnd])
+	writeHeaderLines(&buf, headers)
+	buf.Write(response[headerEnd:])
+	return buf.Bytes()
+}
+
+// CloseConnection marks a response so the server closes the connection after
+// sending it, e.g. after an authentication failure or protocol violation:
+//
+//	return server.CloseConnection(server.Serve401("invalid token"))
+func CloseConnection(response []byte, status string) ([]byte, string) {
+	return setConnectionHeader(response, false), status
+}
+
+// requestsClose reports whether a built response carries "Connection: close"
+func requestsClose(response []byte) bool {
+	head, _, ok := splitResponse(response)
+	return ok && hasToken(responseHeader(head, "Connection"), "close")
+}
+
+// connectionValue is the Connection header value for a keep-alive decision
+func connectionValue(keepAlive bool) string {
+	if keepAlive {
+		return "keep-alive"
+	}
+	return "close"
+}
+
+// setConnectionHeader makes the Connection header of a built response match
+// the connection layer's keep-alive decision
+func setConnectionHeader(response []byte, keepAlive bool) []byte {
+	return setResponseHeader(response, "Connection", connectionValue(keepAlive))
+}
+
+// setResponseHeader replaces a header in a built response, or adds it
+func setResponseHeader(response []byte, name, value string) []byte {
+	head, body, ok := splitResponse(response)
+	if !ok {
+		return response
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(response) + len(name) + len(value) + 4)
+	replaced := false
+	for i, line := range bytes.Split(head, []byte("\r\n")) {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		if key, _, found := bytes.Cut(line, []byte(":")); i > 0 && found && strings.EqualFold(string(key), name) {
+			if replaced {
+				continue
+			}
+			line = []byte(name + ": " + value)
+			replaced = true
+		}
+		buf.Write(line)
+	}
+	if !replaced {
+		buf.WriteString("\r\n" + name + ": " + value)
+	}
+	buf.WriteString("\r\n\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// splitResponse separates the status line and headers from the body
+func splitResponse(response []byte) (head, body []byte, ok bool) {
+	headerEnd := bytes.Index(response, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return nil, nil, false
+	}
+	return response[:headerEnd], response[headerEnd+4:], true
+}
+
+// responseHeader returns a header value from a response head, case-insensitively
+func responseHeader(head []byte, name string) string {
+	for _, line := range bytes.Split(head, []byte("\r\n"))[1:] {
+		key, value, found := bytes.Cut(line, []byte(":"))
+		if found && strings.EqualFold(string(key), name) {
+			return string(bytes.TrimSpace(value))
+		}
+	}
+	return ""
+}
+
+// replaceResponseBody swaps the body of a built response, updating
+// Content-Length and adding headers
+func replaceResponseBody(response, body []byte, headers Headers) []byte {
+	head, _, ok := splitResponse(response)
+	if !ok {
+		return response
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(head) + len(body) + 64*len(headers))
+	for i, line := range bytes.Split(head, []byte("\r\n")) {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		if key, _, found := bytes.Cut(line, []byte(":")); found && strings.EqualFold(string(key), "Content-Length") {
+			buf.WriteString("Content-Length: ")
+			buf.WriteString(strconv.Itoa(len(body)))
+			continue
+		}
+		buf.Write(line)
+	}
+	writeHeaderLines(&buf, headers)
+	buf.WriteString("\r\n\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// stripBody drops the body of a built response for HEAD, keeping its
+// Content-Length so the client learns the size of the GET response
+func stripBody(response []byte) []byte {
+	headerEnd := bytes.Index(response, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return response
+	}
+	return response[:headerEnd+4]
+}
+
+// appendResponseHeader adds a header line to a built response, keeping any
+// existing headers of the same name (as needed for Set-Cookie)
+func appendResponseHeader(response []byte, name, value string) []byte {
+	headerEnd := bytes.Index(response, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return response
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(response) + len(name) + len(value) + 4)
+	buf.Write(response[:headerEnd])
+	buf.WriteString("\r\n" + name + ": " + value)
+	buf.Write(response[headerEnd:])
+	return buf.Bytes()
+}
+
 // CreateResponse builds an HTTP response as string (for compatibility)
 func CreateResponse(statusCode, contentType, statusMessage, body string) (string, string) {
 	responseBytes, status := CreateResponseBytes(statusCode, contentType, statusMessage, []byte(body))
 	return string(responseBytes), status
 }
 
-// serve404Bytes returns a 404 response, using custom page if available
-func serve404Bytes() ([]byte, string) {
-	cleanedPath := filepath.Clean("pages/404.html")
-	content, success := readFileContent(cleanedPath)
+// serve404Bytes returns a 404 response, using the static directory's
+// 404.html if available
+func serve404Bytes(config *Config) ([]byte, string) {
+	if config.DisableStatic {
+		return CreateResponseBytes("404", "text/plain", "Not Found", []byte("Route Not Found"))
+	}
+	content, success := readFileContent(filepath.Join(config.staticDir(), "404.html"))
 	if !success {
 		return CreateResponseBytes("404", "text/plain", "Not Found", []byte("Route Not Found"))
 	}
@@ -78,6 +311,30 @@ func Serve405(method, path string) ([]byte, string) {
 	return CreateResponseBytes("405", "text/plain", "Method Not Allowed", []byte(msg))
 }
 
+// 413 Payload Too Large - request body exceeds MaxBodySize
+func Serve413(msg string) ([]byte, string) {
+	if msg == "" {
+		msg = "Payload Too Large"
+	}
+	return CreateResponseBytes("413", "text/plain", "Payload Too Large", []byte(msg))
+}
+
+// 414 URI Too Long - request target exceeds MaxURLLength
+func Serve414(msg string) ([]byte, string) {
+	if msg == "" {
+		msg = "URI Too Long"
+	}
+	return CreateResponseBytes("414", "text/plain", "URI Too Long", []byte(msg))
+}
+
+// 415 Unsupported Media Type - e.g. an unknown request Content-Encoding
+func Serve415(msg string) ([]byte, string) {
+	if msg == "" {
+		msg = "Unsupported Media Type"
+	}
+	return CreateResponseBytes("415", "text/plain", "Unsupported Media Type", []byte(msg))
+}
+
 // 429 Too Many Requests - rate limit exceeded
 func Serve429(msg string) ([]byte, string) {
 	if msg == "" {
@@ -86,6 +343,15 @@ func Serve429(msg string) ([]byte, string) {
 	return CreateResponseBytes("429", "text/plain", "Too Many Requests", []byte(msg))
 }
 
+// 431 Request Header Fields Too Large - head exceeds MaxHeaderSize,
+// MaxHeaderLineSize or MaxHeaderCount
+func Serve431(msg string) ([]byte, string) {
+	if msg == "" {
+		msg = "Request Header Fields Too Large"
+	}
+	return CreateResponseBytes("431", "text/plain", "Request Header Fields Too Large", []byte(msg))
+}
+
 // 500 Internal Server Error
 func Serve500(msg string) ([]byte, string) {
 	if msg == "" {
@@ -123,14 +389,23 @@ func Serve204() ([]byte, string) {
 	return CreateResponseBytes("204", "text/plain", "No Content", []byte(""))
 }
 
-// 301 Moved Permanently - use for redirects (note: requires Location header in real use)
+// 301 Moved Permanently - redirect with a Location header
 func Serve301(url string) ([]byte, string) {
 	msg := "Moved to " + url
-	return CreateResponseBytes("301", "text/plain", "Moved Permanently", []byte(msg))
+	return CreateResponseBytesWithHeaders("301", "text/plain", "Moved Permanently", map[string]string{"Location": url}, []byte(msg))
 }
 
-// 302 Found - temporary redirect
+// 302 Found - temporary redirect with a Location header
 func Serve302(url string) ([]byte, string) {
 	msg := "Found at " + url
-	return CreateResponseBytes("302", "text/plain", "Found", []byte(msg))
+	return CreateResponseBytesWithHeaders("302", "text/plain", "Found", map[string]string{"Location": url}, []byte(msg))
+}
+
+// 304 Not Modified - the client's cached copy identified by etag is current
+func Serve304(etag string) ([]byte, string) {
+	var headers map[string]string
+	if etag != "" {
+		headers = map[string]string{"ETag": etag}
+	}
+	return CreateResponseBytesWithHeaders("304", "", "Not Modified", headers, nil)
 }
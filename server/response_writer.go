@@ -0,0 +1,237 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResponseWriter builds the response of a HandlerFunc
+type ResponseWriter interface {
+	// SetHeader sets a response header, replacing any previous value
+	SetHeader(key, value string)
+	// AddHeader adds a header line, keeping earlier values (e.g. Set-Cookie)
+	AddHeader(key, value string)
+	// WriteHeader sets the status code; only the first call has an effect
+	WriteHeader(statusCode int)
+	// Write appends to the response body, implying WriteHeader(200) if needed.
+	// The body is flushed automatically once it reaches the buffer size set
+	// by Config.ResponseBufferSize or ResponseBuffer, or after every Write on
+	// WriteThrough routes.
+	Write(p []byte) (int, error)
+	// Flush sends the status, headers and body written so far using chunked
+	// Transfer-Encoding; later writes are sent as further chunks on the next
+	// Flush or when the handler returns. Headers set after the first Flush
+	// are ignored. Without a live HTTP/1.1 connection Flush is a no-op and
+	// the response stays buffered.
+	Flush() error
+}
+
+// HandlerFunc handles a request by writing to a ResponseWriter.
+// It is the alternative to RouteHandler when a handler needs custom headers.
+type HandlerFunc func(w ResponseWriter, req *Request)
+
+// bufferedWriter collects a response in memory, switching to chunked
+// streaming on the connection once Flush is called
+type bufferedWriter struct {
+	status  int
+	headers Headers
+	added   [][2]string // AddHeader lines, in call order
+	body    bytes.Buffer
+
+	conn         net.Conn      // nil when the response can't be streamed
+	writeTimeout time.Duration // deadline for each streamed write
+	keepAlive    bool          // Connection header of the streamed head
+	headOnly     bool          // HEAD request: only the head is streamed
+	writeThrough bool          // flush after every Write
+	bufferSize   int           // flush once this many body bytes are buffered; 0 never
+	closeConn    bool          // handler set "Connection: close"
+	req          *Request      // request to flag when the handler closes the connection
+	streaming    bool          // head already sent, body goes out as chunks
+	err          error         // first write error while streaming
+}
+
+// newBufferedWriter creates an empty writer
+func newBufferedWriter() *bufferedWriter {
+	return &bufferedWriter{headers: make(Headers)}
+}
+
+// newRequestWriter creates a writer that may stream to the request's connection
+func newRequestWriter(req *Request) *bufferedWriter {
+	w := newBufferedWriter()
+	w.req = req
+	if req.Proto != "HTTP/1.0" {
+		w.conn = req.conn
+		w.writeTimeout = req.writeTimeout
+		w.keepAlive = req.keepAlive
+		w.headOnly = req.Method == "HEAD"
+		w.bufferSize = req.bufferSize
+		if req.route != nil {
+			w.writeThrough = req.route.writeThrough
+			if req.route.bufferSize > 0 {
+				w.bufferSize = req.route.bufferSize
+			}
+		}
+	}
+	return w
+}
+
+func (w *bufferedWriter) SetHeader(key, value string) {
+	// "Connection: close" asks the server to hang up after this response
+	if strings.EqualFold(key, "Connection") && hasToken(value, "close") && !w.streaming {
+		w.closeConn = true
+		w.keepAlive = false
+		if w.req != nil {
+			w.req.closeConn = true
+		}
+	}
+	w.headers.Set(key, value)
+}
+
+func (w *bufferedWriter) AddHeader(key, value string) {
+	w.added = append(w.added, [2]string{key, value})
+}
+
+func (w *bufferedWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(200)
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, _ := w.body.Write(p)
+	if w.conn != nil && (w.writeThrough || w.bufferSize > 0 && w.body.Len() >= w.bufferSize) {
+		if err := w.Flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *bufferedWriter) Flush() error {
+	if w.conn == nil || w.err != nil {
+		return w.err
+	}
+	if w.req != nil && !w.req.startResponse() {
+		w.err = errHandlerTimeout
+		return w.err
+	}
+	w.WriteHeader(200)
+
+	var out bytes.Buffer
+	if !w.streaming {
+		contentType, extra := w.splitHeaders()
+		out.Write(w.addHeaderLines(chunkedResponseHead(strconv.Itoa(w.status), contentType, reasonPhrase(w.status), extra, w.keepAlive)))
+		w.streaming = true
+	}
+	if w.headOnly {
+		w.body.Reset()
+	}
+	if w.body.Len() > 0 {
+		out.WriteString(strconv.FormatInt(int64(w.body.Len()), 16))
+		out.WriteString("\r\n")
+		out.Write(w.body.Bytes())
+		out.WriteString("\r\n")
+		w.body.Reset()
+	}
+	if w.writeTimeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+	}
+	if _, err := w.conn.Write(out.Bytes()); err != nil {
+		w.err = err
+	}
+	return w.err
+}
+
+// bytes serializes the collected response. A streamed response is finished
+// on the connection instead and nil is returned; when writing it failed the
+// connection is closed, since the client saw only part of it.
+func (w *bufferedWriter) bytes() ([]byte, string) {
+	w.WriteHeader(200)
+	status := strconv.Itoa(w.status)
+
+	if w.streaming {
+		if w.Flush() == nil && !w.headOnly {
+			if _, err := w.conn.Write([]byte("0\r\n\r\n")); err != nil {
+				w.err = err
+			}
+		}
+		if w.err != nil && w.req != nil {
+			w.req.closeConn = true
+		}
+		return nil, status
+	}
+
+	contentType, extra := w.splitHeaders()
+	response, _ := RespondWithHeaders(w.status, contentType, extra, w.body.Bytes())
+	if w.closeConn {
+		response = setConnectionHeader(response, false)
+	}
+	return w.addHeaderLines(response), status
+}
+
+// addHeaderLines appends the AddHeader lines to a built response
+func (w *bufferedWriter) addHeaderLines(response []byte) []byte {
+	for _, header := range w.added {
+		response = appendResponseHeader(response, header[0], header[1])
+	}
+	return response
+}
+
+// splitHeaders separates Content-Type from the extra headers, dropping the
+// headers the server computes itself
+func (w *bufferedWriter) splitHeaders() (string, Headers) {
+	contentType := "text/plain"
+	extra := make(Headers, len(w.headers))
+	for key, value := range w.headers {
+		switch {
+		case strings.EqualFold(key, "Content-Type"):
+			contentType = value
+		case strings.EqualFold(key, "Content-Length"), strings.EqualFold(key, "Connection"),
+			strings.EqualFold(key, "Transfer-Encoding"):
+			// Computed by the server
+		default:
+			extra[key] = value
+		}
+	}
+	return contentType, extra
+}
+
+// WriteJSON marshals v and writes it with the given status code and a JSON
+// Content-Type. A value that can't be marshaled gets a 500 instead, and the
+// error is returned.
+func WriteJSON(w ResponseWriter, code int, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		w.SetHeader("Content-Type", "text/plain")
+		w.WriteHeader(StatusInternalServerError)
+		w.Write([]byte("Failed to encode JSON response"))
+		return err
+	}
+	w.SetHeader("Content-Type", jsonContentType)
+	w.WriteHeader(code)
+	_, err = w.Write(body)
+	return err
+}
+
+// WrapHandlerFunc adapts a HandlerFunc to a RouteHandler, so writer-based
+// handlers work with Register, middleware and every other RouteHandler API
+func WrapHandlerFunc(handler HandlerFunc) RouteHandler {
+	return func(req *Request) ([]byte, string) {
+		w := newRequestWriter(req)
+		handler(w, req)
+		return w.bytes()
+	}
+}
+
+// HandleFunc registers a writer-based handler for a method and path
+func (r *Router) HandleFunc(method, path string, handler HandlerFunc, opts ...RouteOption) {
+	r.Register(method, path, WrapHandlerFunc(handler), opts...)
+}
@@ -0,0 +1,341 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tusVersion is the version of the tus resumable upload protocol served
+const tusVersion = "1.0.0"
+
+// AppendStorage is a Storage whose objects can grow in place, which
+// resumable uploads need. DiskStorage implements it.
+type AppendStorage interface {
+	Storage
+
+	// Append writes r to the end of the object at key, creating it when
+	// offset is 0, and fails unless the object is offset bytes long. It
+	// returns how many bytes were written, also when r fails part way.
+	Append(key string, offset int64, r io.Reader) (int64, error)
+}
+
+// ResumableConfig configures ResumableUploads
+type ResumableConfig struct {
+	Storage AppendStorage // Where the uploaded bytes are kept
+	Prefix  string        // Key prefix of the stored uploads, e.g. "incoming"
+
+	// MaxSize is the largest Upload-Length accepted, and also bounds each
+	// PATCH body; 0 means no limit beyond Config.MaxBodySize per PATCH
+	MaxSize int64
+
+	// Expiry deletes unfinished uploads this long after they were created
+	// or last received bytes; 0 means 24 hours
+	Expiry time.Duration
+
+	// OnComplete is called once the last byte of an upload is stored
+	OnComplete func(upload ResumableUpload)
+
+	Clock  Clock        // Time source for expiry; nil means SystemClock
+	Random RandomSource // Source of upload IDs; nil means CryptoRandom
+}
+
+// ResumableUpload describes one upload
+type ResumableUpload struct {
+	ID       string
+	Key      string // Storage key of the uploaded bytes
+	Offset   int64  // Bytes received so far
+	Length   int64  // Declared Upload-Length
+	Metadata map[string]string
+	Expires  time.Time
+
+	rawMetadata string // Upload-Metadata as sent, echoed by HEAD
+	busy        bool   // a PATCH is appending
+}
+
+// done reports whether every declared byte has arrived
+func (u *ResumableUpload) done() bool {
+	return u.Offset >= u.Length
+}
+
+// ResumableUploads implements the tus resumable upload protocol (creation,
+// expiration and termination extensions) on top of an AppendStorage, so
+// clients on flaky connections resume where they stopped instead of starting
+// over. Upload state is kept in memory, so unfinished uploads don't survive
+// a restart.
+type ResumableUploads struct {
+	cfg       ResumableConfig
+	mu        sync.Mutex
+	uploads   map[string]*ResumableUpload
+	lastSweep time.Time
+}
+
+// NewResumableUploads creates the upload handler; mount it with Register
+func NewResumableUploads(cfg ResumableConfig) *ResumableUploads {
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = 24 * time.Hour
+	}
+	return &ResumableUploads{cfg: cfg, uploads: make(map[string]*ResumableUpload)}
+}
+
+// Register mounts the endpoints at path: POST path creates an upload and
+// answers with its URL in Location, HEAD path/:id reports its offset, PATCH
+// path/:id appends at that offset and DELETE path/:id abandons it.
+// OPTIONS path advertises the protocol version and extensions.
+func (u *ResumableUploads) Register(r *Router, path string) {
+	path = strings.TrimSuffix(path, "/")
+	r.Register("OPTIONS", path, u.options, NoCache())
+	r.Register("POST", path, u.tusHandler(u.create), NoCache())
+	r.Register("HEAD", path+"/:id", u.tusHandler(u.head), NoCache())
+	patchOpts := []RouteOption{StreamBody(), NoCache()}
+	if u.cfg.MaxSize > 0 {
+		patchOpts = append(patchOpts, WithMaxBodySize(u.cfg.MaxSize))
+	}
+	r.Register("PATCH", path+"/:id", u.tusHandler(u.patch), patchOpts...)
+	r.Register("DELETE", path+"/:id", u.tusHandler(u.terminate), NoCache())
+}
+
+// Get returns the state of an upload that hasn't expired
+func (u *ResumableUploads) Get(id string) (ResumableUpload, bool) {
+	now := clockOrSystem(u.cfg.Clock).Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	upload, ok := u.lookup(id, now)
+	if !ok {
+		return ResumableUpload{}, false
+	}
+	return *upload, true
+}
+
+// lookup returns a live upload, deleting an unfinished one that expired.
+// Callers hold u.mu.
+func (u *ResumableUploads) lookup(id string, now time.Time) (*ResumableUpload, bool) {
+	u.sweep(now)
+	upload, ok := u.uploads[id]
+	if ok && !now.Before(upload.Expires) {
+		u.expire(upload)
+		return nil, false
+	}
+	return upload, ok
+}
+
+// sweep expires the uploads clients abandoned, at most once per Expiry.
+// Callers hold u.mu.
+func (u *ResumableUploads) sweep(now time.Time) {
+	if now.Sub(u.lastSweep) < u.cfg.Expiry {
+		return
+	}
+	for _, upload := range u.uploads {
+		if !now.Before(upload.Expires) {
+			u.expire(upload)
+		}
+	}
+	u.lastSweep = now
+}
+
+// expire forgets an upload, deleting its bytes unless it completed.
+// Callers hold u.mu.
+func (u *ResumableUploads) expire(upload *ResumableUpload) {
+	if !upload.done() && !upload.busy {
+		u.cfg.Storage.Delete(upload.Key)
+	}
+	delete(u.uploads, upload.ID)
+}
+
+// tusHandler answers requests without a supported Tus-Resumable header
+// with 412 and adds Tus-Resumable to every response
+func (u *ResumableUploads) tusHandler(next RouteHandler) RouteHandler {
+	return func(req *Request) ([]byte, string) {
+		if req.Headers.Get("Tus-Resumable") != tusVersion {
+			return RespondWithHeaders(StatusPreconditionFailed, "text/plain",
+				Headers{"Tus-Version": tusVersion}, []byte("Unsupported Tus-Resumable version"))
+		}
+		response, status := next(req)
+		return AddResponseHeaders(response, Headers{"Tus-Resumable": tusVersion}), status
+	}
+}
+
+// options advertises the protocol version and extensions
+func (u *ResumableUploads) options(req *Request) ([]byte, string) {
+	headers := Headers{
+		"Tus-Resumable": tusVersion,
+		"Tus-Version":   tusVersion,
+		"Tus-Extension": "creation,expiration,termination",
+	}
+	if u.cfg.MaxSize > 0 {
+		headers["Tus-Max-Size"] = strconv.FormatInt(u.cfg.MaxSize, 10)
+	}
+	return RespondWithHeaders(StatusNoContent, "text/plain", headers, nil)
+}
+
+// create starts an upload of the declared Upload-Length
+func (u *ResumableUploads) create(req *Request) ([]byte, string) {
+	length, err := strconv.ParseInt(req.Headers.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return Serve400("Upload-Length required")
+	}
+	if u.cfg.MaxSize > 0 && length > u.cfg.MaxSize {
+		return Serve413("Upload-Length exceeds " + strconv.FormatInt(u.cfg.MaxSize, 10) + " bytes")
+	}
+	// Header values don't outlive the request, the upload does
+	rawMetadata := strings.Clone(req.Headers.Get("Upload-Metadata"))
+	metadata, err := parseUploadMetadata(rawMetadata)
+	if err != nil {
+		return Serve400("Invalid Upload-Metadata")
+	}
+
+	id := NewRequestID(u.cfg.Random)
+	key, err := cleanStorageKey(path.Join(u.cfg.Prefix, id))
+	if err != nil {
+		return Serve500("Invalid upload prefix")
+	}
+	if _, err := u.cfg.Storage.Append(key, 0, strings.NewReader("")); err != nil {
+		return Serve500("Failed to create upload")
+	}
+
+	now := clockOrSystem(u.cfg.Clock).Now()
+	upload := &ResumableUpload{
+		ID:          id,
+		Key:         key,
+		Length:      length,
+		Metadata:    metadata,
+		Expires:     now.Add(u.cfg.Expiry),
+		rawMetadata: rawMetadata,
+	}
+	u.mu.Lock()
+	u.sweep(now)
+	u.uploads[id] = upload
+	snapshot := *upload
+	u.mu.Unlock()
+	if snapshot.done() && u.cfg.OnComplete != nil {
+		u.cfg.OnComplete(snapshot)
+	}
+
+	return RespondWithHeaders(StatusCreated, "text/plain", Headers{
+		"Location":       strings.TrimSuffix(req.Path, "/") + "/" + id,
+		"Upload-Expires": snapshot.Expires.UTC().Format(httpTimeFormat),
+	}, nil)
+}
+
+// head reports how many bytes of an upload have been stored
+func (u *ResumableUploads) head(req *Request) ([]byte, string) {
+	upload, ok := u.Get(req.PathParams["id"])
+	if !ok {
+		return RespondWithHeaders(StatusNotFound, "text/plain", nil, []byte("Unknown upload"))
+	}
+	headers := Headers{
+		"Upload-Offset":  strconv.FormatInt(upload.Offset, 10),
+		"Upload-Length":  strconv.FormatInt(upload.Length, 10),
+		"Upload-Expires": upload.Expires.UTC().Format(httpTimeFormat),
+		"Cache-Control":  "no-store",
+	}
+	if upload.rawMetadata != "" {
+		headers["Upload-Metadata"] = upload.rawMetadata
+	}
+	return RespondWithHeaders(StatusOK, "text/plain", headers, nil)
+}
+
+// patch appends the request body at the Upload-Offset the client sent,
+// which must be the current offset. Bytes stored before the body broke off
+// count, so the client resumes after them.
+func (u *ResumableUploads) patch(req *Request) ([]byte, string) {
+	if req.ContentType.Type != "application/offset+octet-stream" {
+		return Serve415("Content-Type must be application/offset+octet-stream")
+	}
+	offset, err := strconv.ParseInt(req.Headers.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return Serve400("Upload-Offset required")
+	}
+
+	now := clockOrSystem(u.cfg.Clock).Now()
+	u.mu.Lock()
+	upload, ok := u.lookup(req.PathParams["id"], now)
+	switch {
+	case !ok:
+		u.mu.Unlock()
+		return RespondWithHeaders(StatusNotFound, "text/plain", nil, []byte("Unknown upload"))
+	case upload.busy || upload.Offset != offset:
+		current := upload.Offset
+		u.mu.Unlock()
+		return RespondWithHeaders(StatusConflict, "text/plain",
+			Headers{"Upload-Offset": strconv.FormatInt(current, 10)}, []byte("Upload-Offset mismatch"))
+	}
+	remaining := upload.Length - upload.Offset
+	if length, err := strconv.ParseInt(req.Headers.Get("Content-Length"), 10, 64); err == nil && length > remaining {
+		u.mu.Unlock()
+		return Serve413("Body exceeds the remaining Upload-Length")
+	}
+	upload.busy = true
+	key := upload.Key
+	u.mu.Unlock()
+
+	written, appendErr := u.cfg.Storage.Append(key, offset, io.LimitReader(req.BodyReader(), remaining))
+
+	now = clockOrSystem(u.cfg.Clock).Now()
+	u.mu.Lock()
+	upload.busy = false
+	upload.Offset += written
+	upload.Expires = now.Add(u.cfg.Expiry)
+	snapshot := *upload
+	u.mu.Unlock()
+
+	if appendErr != nil && written == 0 {
+		return Serve500("Failed to store upload")
+	}
+	if snapshot.done() && u.cfg.OnComplete != nil {
+		u.cfg.OnComplete(snapshot)
+	}
+	return RespondWithHeaders(StatusNoContent, "text/plain", Headers{
+		"Upload-Offset":  strconv.FormatInt(snapshot.Offset, 10),
+		"Upload-Expires": snapshot.Expires.UTC().Format(httpTimeFormat),
+	}, nil)
+}
+
+// terminate abandons an upload and deletes its bytes
+func (u *ResumableUploads) terminate(req *Request) ([]byte, string) {
+	now := clockOrSystem(u.cfg.Clock).Now()
+	u.mu.Lock()
+	upload, ok := u.lookup(req.PathParams["id"], now)
+	if ok && upload.busy {
+		u.mu.Unlock()
+		return RespondWithHeaders(StatusConflict, "text/plain", nil, []byte("Upload in progress"))
+	}
+	if ok {
+		delete(u.uploads, upload.ID)
+	}
+	u.mu.Unlock()
+	if !ok {
+		return RespondWithHeaders(StatusNotFound, "text/plain", nil, []byte("Unknown upload"))
+	}
+	u.cfg.Storage.Delete(upload.Key)
+	return RespondWithHeaders(StatusNoContent, "text/plain", nil, nil)
+}
+
+// errInvalidMetadata is returned for a malformed Upload-Metadata header
+var errInvalidMetadata = errors.New("invalid Upload-Metadata")
+
+// parseUploadMetadata decodes Upload-Metadata, comma-separated pairs of a
+// key and an optional base64 value, e.g. "filename d29ybGQ=,is_private"
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errInvalidMetadata
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errInvalidMetadata
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
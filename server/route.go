@@ -0,0 +1,159 @@
+package server
+
+import (
+	"strings"
+	"time"
+)
+
+// RouteMatcher reports whether a request satisfies an extra routing condition
+type RouteMatcher func(req *Request) bool
+
+// RouteOption configures a route at registration time
+type RouteOption func(rt *route)
+
+// route is a registered handler plus its options
+type route struct {
+	pattern  string
+	handler  RouteHandler
+	matchers []RouteMatcher
+	doc      string
+
+	noCompress bool // skipped by Compress
+	noCache    bool // skipped by ResponseCache
+	streamBody bool // body is read by the handler, not buffered
+
+	bodyParser BodyParser // set by WithBodyParser
+	customBody bool       // bodyParser replaces the automatic parsing
+
+	writeThrough bool // ResponseWriter flushes every Write
+	bufferSize   int  // ResponseWriter flush threshold; 0 uses Config.ResponseBufferSize
+
+	roles       []string // any of these, checked by Authorize
+	permissions []string // all of these, checked by Authorize
+
+	middleware  []Middleware  // wraps the handler, inside the router's middleware
+	timeout     time.Duration // overrides Config.HandlerTimeout; 0 keeps it
+	maxBodySize int64         // overrides Config.MaxBodySize; 0 keeps it
+}
+
+// hasRequestOptions reports whether the route has options the router must
+// know before the request is routed
+func (rt *route) hasRequestOptions() bool {
+	return rt.streamBody || rt.customBody || rt.timeout > 0 || rt.maxBodySize > 0
+}
+
+// matches reports whether every matcher of the route accepts the request
+func (rt *route) matches(req *Request) bool {
+	for _, matcher := range rt.matchers {
+		if !matcher(req) {
+			return false
+		}
+	}
+	return true
+}
+
+// WithMatcher only routes requests for which fn returns true
+func WithMatcher(fn RouteMatcher) RouteOption {
+	return func(rt *route) {
+		rt.matchers = append(rt.matchers, fn)
+	}
+}
+
+// WithDoc attaches a human-readable description to the route. It is listed
+// by Routes and in the JSON body of automatic OPTIONS responses.
+func WithDoc(description string) RouteOption {
+	return func(rt *route) {
+		rt.doc = description
+	}
+}
+
+// StreamBody leaves the request body on the connection for the handler to
+// read through req.BodyReader or req.JSONDecoder, instead of buffering it
+// into RawBody and Body. MaxBodySize still applies.
+func StreamBody() RouteOption {
+	return func(rt *route) {
+		rt.streamBody = true
+	}
+}
+
+// NoCompress exempts the route from the Compress middleware, e.g. for
+// event streams or downloads that are already compressed
+func NoCompress() RouteOption {
+	return func(rt *route) {
+		rt.noCompress = true
+	}
+}
+
+// WriteThrough makes a ResponseWriter send every Write to the client
+// immediately, for latency-sensitive handlers such as event streams and
+// progress reports
+func WriteThrough() RouteOption {
+	return func(rt *route) {
+		rt.writeThrough = true
+	}
+}
+
+// ResponseBuffer sets how many body bytes a ResponseWriter collects before
+// flushing them on its own, overriding Config.ResponseBufferSize for the route
+func ResponseBuffer(size int) RouteOption {
+	return func(rt *route) {
+		rt.bufferSize = size
+	}
+}
+
+// NoCache exempts the route from ResponseCache middleware
+func NoCache() RouteOption {
+	return func(rt *route) {
+		rt.noCache = true
+	}
+}
+
+// WithMiddleware wraps the route's handler in middleware, which runs after
+// the router's Use middleware, in the order given
+func WithMiddleware(mw ...Middleware) RouteOption {
+	return func(rt *route) {
+		rt.middleware = append(rt.middleware, mw...)
+	}
+}
+
+// WithTimeout answers with 503 when the route's handler runs longer than d,
+// overriding Config.HandlerTimeout
+func WithTimeout(d time.Duration) RouteOption {
+	return func(rt *route) {
+		rt.timeout = d
+	}
+}
+
+// WithMaxBodySize limits request bodies for the route to size bytes,
+// overriding Config.MaxBodySize in either direction
+func WithMaxBodySize(size int64) RouteOption {
+	return func(rt *route) {
+		rt.maxBodySize = size
+	}
+}
+
+// WithHeader only routes requests carrying the header with the given value.
+// The comparison is case-insensitive and ignores parameters after ";", so
+// WithHeader("Content-Type", "application/json") also matches
+// "application/json; charset=utf-8".
+func WithHeader(name, value string) RouteOption {
+	return WithMatcher(func(req *Request) bool {
+		actual := headerValue(req.Headers, name)
+		if i := strings.IndexByte(actual, ';'); i >= 0 && !strings.Contains(value, ";") {
+			actual = actual[:i]
+		}
+		return strings.EqualFold(strings.TrimSpace(actual), value)
+	})
+}
+
+// WithQuery only routes requests whose query parameter equals value
+func WithQuery(key, value string) RouteOption {
+	return WithMatcher(func(req *Request) bool {
+		return req.Query[key] == value
+	})
+}
+
+// headerValue looks up a header case-insensitively in a plain map
+func headerValue(headers map[string]string, name string) string {
+	return Headers(headers).Get(name)
+}
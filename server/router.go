@@ -1,103 +1,458 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net"
-	"path/filepath"
 	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // RouteHandler is a function that handles an HTTP request
 type RouteHandler func(req *Request) (response []byte, status string)
 
+// Middleware wraps a handler to run code before and/or after it
+type Middleware func(next RouteHandler) RouteHandler
+
 // Router manages HTTP routes and dispatches requests
 type Router struct {
-	mu     sync.RWMutex
-	routes map[string]map[string]RouteHandler
-	config *Config
+	mu       sync.RWMutex
+	routes   map[string]map[string][]*route
+	config   *Config
+	resolver FileResolver
+	progress ProgressFunc
+
+	middleware       []Middleware
+	staticMiddleware bool
+	optionRoutes     bool        // some route has options applied before routing (StreamBody, WithTimeout, ...)
+	logging          atomic.Bool // request logging, from Config.EnableLogging or SetLogging
+
+	// allowed caches the methods registered per pattern for Allow headers
+	allowed map[string][]string
+	// patterns lists each method's patterns in matching priority order
+	patterns map[string][]string
+
+	vhosts *VirtualHosts // set by NewVirtualHosts on the connection-serving router
 }
 
 // NewRouter creates a new Router instance
 func NewRouter() *Router {
-	return &Router{
-		routes: make(map[string]map[string]RouteHandler),
-		config: DefaultConfig(),
-	}
-
+	return NewRouterWithConfig(DefaultConfig())
 }
 
 // router instance with config
 func NewRouterWithConfig(config *Config) *Router {
-	return &Router{
-		routes: make(map[string]map[string]RouteHandler),
+	r := &Router{
+		routes: make(map[string]map[string][]*route),
 		config: config,
 	}
+	if !config.DisableStatic {
+		r.resolver = DirResolver(config.staticDir())
+	}
+	r.logging.Store(config.EnableLogging)
+	return r
+}
 
+// SetLogging turns request logging on or off while the router is serving,
+// overriding Config.EnableLogging
+func (r *Router) SetLogging(enabled bool) {
+	r.logging.Store(enabled)
 }
 
-// Register adds a route handler for a method and path
-func (r *Router) Register(method, path string, handler RouteHandler) {
+// Register adds a route handler for a method and path.
+// Options such as WithHeader restrict which requests reach the handler, so
+// several handlers can share a path and be told apart by headers or query.
+// Registering the same path again without matchers replaces the previous handler.
+func (r *Router) Register(method, path string, handler RouteHandler, opts ...RouteOption) {
+	rt := &route{pattern: path, handler: handler}
+	for _, opt := range opts {
+		opt(rt)
+	}
+	rt.handler = applyMiddleware(rt.handler, rt.middleware)
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	if _, exists := r.routes[method][path]; !exists {
+		if err := patternConflict(r.patterns[method], method, path); err != nil {
+			panic("server: " + err.Error())
+		}
+		if r.patterns == nil {
+			r.patterns = make(map[string][]string)
+		}
+		ordered := append(r.patterns[method], path)
+		slices.SortFunc(ordered, comparePatterns)
+		r.patterns[method] = ordered
+	}
+	if rt.hasRequestOptions() {
+		r.optionRoutes = true
+	}
 	if r.routes[method] == nil {
-		r.routes[method] = make(map[string]RouteHandler)
+		r.routes[method] = make(map[string][]*route)
+	}
+	if r.allowed == nil {
+		r.allowed = make(map[string][]string)
+	}
+	if !slices.Contains(r.allowed[path], method) {
+		r.allowed[path] = append(r.allowed[path], method)
+		slices.Sort(r.allowed[path])
+	}
+
+	variants := r.routes[method][path]
+	if len(rt.matchers) == 0 {
+		// Routes without matchers are the fallback and are tried last
+		if n := len(variants); n > 0 && len(variants[n-1].matchers) == 0 {
+			variants = variants[:n-1]
+		}
+		r.routes[method][path] = append(variants, rt)
+		return
 	}
-	r.routes[method][path] = handler
+
+	// Routes with matchers are tried in registration order, before the fallback
+	if n := len(variants); n > 0 && len(variants[n-1].matchers) == 0 {
+		variants = append(variants[:n-1], rt, variants[n-1])
+	} else {
+		variants = append(variants, rt)
+	}
+	r.routes[method][path] = variants
+}
+
+// conflict returns the error Register would panic with when registering
+// path for method: another pattern of the same shape is registered
+func (r *Router) conflict(method, path string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return patternConflict(r.patterns[method], method, path)
+}
+
+// patternConflict reports a pattern other than path among patterns that
+// matches the same paths
+func patternConflict(patterns []string, method, path string) error {
+	for _, other := range patterns {
+		if other != path && patternShape(other) == patternShape(path) {
+			return fmt.Errorf("route %s %s conflicts with %s %s: both match the same paths", method, path, method, other)
+		}
+	}
+	return nil
+}
+
+// Unregister removes every handler registered for a method and path pattern,
+// reporting whether there was one. It is safe to call while the server is
+// running: requests already inside a handler finish with it, later requests
+// see the route gone.
+func (r *Router) Unregister(method, path string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.routes[method][path]; !ok {
+		return false
+	}
+	delete(r.routes[method], path)
+	if len(r.routes[method]) == 0 {
+		delete(r.routes, method)
+	}
+	r.patterns[method] = slices.DeleteFunc(r.patterns[method], func(p string) bool { return p == path })
+	if len(r.patterns[method]) == 0 {
+		delete(r.patterns, method)
+	}
+
+	r.allowed[path] = slices.DeleteFunc(r.allowed[path], func(m string) bool { return m == method })
+	if len(r.allowed[path]) == 0 {
+		delete(r.allowed, path)
+	}
+
+	r.optionRoutes = false
+	for _, methodRoutes := range r.routes {
+		for _, variants := range methodRoutes {
+			for _, rt := range variants {
+				r.optionRoutes = r.optionRoutes || rt.hasRequestOptions()
+			}
+		}
+	}
+	return true
+}
+
+// SetFileResolver replaces the source of static files (defaults to Config.StaticDir).
+// Passing nil disables static file serving.
+func (r *Router) SetFileResolver(resolver FileResolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolver = resolver
+}
+
+// Use appends middleware applied to every matched route handler.
+// Middleware runs in the order added: the first one is the outermost.
+func (r *Router) Use(mw ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middleware = append(r.middleware, mw...)
+}
+
+// ApplyMiddlewareToStatic controls whether middleware also wraps static file responses
+func (r *Router) ApplyMiddlewareToStatic(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.staticMiddleware = enabled
+}
+
+// applyMiddleware wraps a handler with the router's middleware chain
+func applyMiddleware(handler RouteHandler, middleware []Middleware) RouteHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// OnBodyProgress registers a callback invoked as request bodies arrive.
+// Only requests carrying an X-Upload-Token header or upload_token query
+// parameter are reported.
+func (r *Router) OnBodyProgress(fn ProgressFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress = fn
 }
 
 // HandleBytes routes a request and returns response bytes
 func (r *Router) HandleBytes(method, cleanPath string, queryMap, bodyMap map[string]string, browserName string) ([]byte, string) {
+	req := &Request{
+		Method:  method,
+		Path:    cleanPath,
+		Query:   queryMap,
+		Body:    bodyMap,
+		Browser: browserName,
+	}
+	return r.dispatch(req)
+}
+
+// dispatch finds the route for a parsed request and invokes its handler.
+// The lock is released before the handler runs, so handlers may register
+// and unregister routes.
+func (r *Router) dispatch(req *Request) ([]byte, string) {
 	r.mu.RLock()
-	methodRoutes, exists := r.routes[method]
+	rt, params := r.findRoute(req)
+	middleware := r.middleware
 	r.mu.RUnlock()
 
-	if !exists {
-		return serve404Bytes()
+	if rt != nil {
+		if r.config.RedirectTrailingSlash {
+			if location, ok := trailingSlashRedirect(req, rt.pattern); ok {
+				return Serve301(location)
+			}
+		}
+		for name, value := range req.hostParams {
+			if _, ok := params[name]; !ok {
+				params[name] = value
+			}
+		}
+		req.PathParams = params
+		req.route = rt
+		return applyMiddleware(rt.handler, middleware)(req)
+	}
+	if response, status, ok := r.unmatched(req); ok {
+		return response, status
+	}
+	if response, status, ok := r.spaFallback(req); ok {
+		return response, status
 	}
+	return serve404Bytes(r.config)
+}
 
-	// Try to find a matching route
+// unmatched answers OPTIONS and wrong-method requests for paths without a
+// matching route
+func (r *Router) unmatched(req *Request) ([]byte, string, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	var handler RouteHandler
-	var pathParams map[string]string
-	found := false
+	if req.Method == "OPTIONS" {
+		response, status := r.optionsResponse(req)
+		return response, status, true
+	}
 
-	if exactHandler, ok := methodRoutes[cleanPath]; ok {
-		handler = exactHandler
-		pathParams = make(map[string]string)
-		found = true
-	} else {
-		// Try pattern matching
-		for pattern, h := range methodRoutes {
-			params, matched := matchRoute(cleanPath, pattern)
-			if matched {
-				handler = h
-				pathParams = params
-				found = true
-				break
+	// The path exists, but only under other methods
+	if allow := r.allowedMethods(req.Path); len(allow) > 0 && !slices.Contains(allow, req.Method) {
+		response, status := Serve405(req.Method, req.Path)
+		return AddResponseHeaders(response, map[string]string{"Allow": allowHeader(allow)}), status, true
+	}
+	return nil, "", false
+}
+
+// allowHeader formats methods for an Allow header; OPTIONS is always
+// answered, so it is always listed
+func allowHeader(methods []string) string {
+	if !slices.Contains(methods, "OPTIONS") {
+		methods = append(slices.Clone(methods), "OPTIONS")
+		slices.Sort(methods)
+	}
+	return strings.Join(methods, ", ")
+}
+
+// allowedMethods returns the sorted methods registered for patterns that
+// match path, with HEAD wherever GET is. Callers hold r.mu.
+func (r *Router) allowedMethods(path string) []string {
+	var methods []string
+	for pattern, patternMethods := range r.allowed {
+		if pattern != path {
+			if _, matched := r.matchPath(path, pattern); !matched {
+				continue
+			}
+		}
+		for _, method := range patternMethods {
+			if !slices.Contains(methods, method) {
+				methods = append(methods, method)
 			}
 		}
 	}
+	if slices.Contains(methods, "GET") && !slices.Contains(methods, "HEAD") {
+		methods = append(methods, "HEAD")
+	}
+	slices.Sort(methods)
+	return methods
+}
 
-	if !found {
-		return serve404Bytes()
+// findRoute returns the route matching the request and its path parameters.
+// HEAD requests without a HEAD route use the GET route; the body it builds
+// is dropped before sending (RFC 9110 section 9.3.2). Callers hold r.mu.
+func (r *Router) findRoute(req *Request) (*route, map[string]string) {
+	rt, params := r.findMethodRoute(req, req.Method)
+	if rt == nil && req.Method == "HEAD" {
+		rt, params = r.findMethodRoute(req, "GET")
 	}
-	req := &Request{
-		Method:     method,
-		Path:       cleanPath,
-		PathParams: pathParams,
-		Query:      queryMap,
-		Body:       bodyMap,
-		Browser:    browserName,
+	return rt, params
+}
+
+// findMethodRoute returns the route registered for method that matches the
+// request, and its path parameters. Callers hold r.mu.
+func (r *Router) findMethodRoute(req *Request, method string) (*route, map[string]string) {
+	// A missing method map behaves like an empty one
+	methodRoutes := r.routes[method]
+
+	// Exact match first, then pattern matching
+	if rt := selectRoute(methodRoutes[req.Path], req); rt != nil {
+		return rt, make(map[string]string)
 	}
 
-	return handler(req)
+	// Patterns are tried in priority order, so /users/new wins over /users/:id
+	for _, pattern := range r.patterns[method] {
+		if pattern == req.Path {
+			continue
+		}
+		params, matched := r.matchPath(req.Path, pattern)
+		if !matched {
+			continue
+		}
+		req.PathParams = params
+		if rt := selectRoute(methodRoutes[pattern], req); rt != nil {
+			return rt, params
+		}
+	}
+	return nil, nil
+}
+
+// matchPath matches a path against a pattern, ignoring case when
+// Config.CaseInsensitiveRouting is set
+func (r *Router) matchPath(path, pattern string) (map[string]string, bool) {
+	return matchPattern(path, pattern, r.config.CaseInsensitiveRouting)
+}
+
+// trailingSlashRedirect returns where to redirect a GET or HEAD request
+// whose trailing slash differs from its route's pattern, if anywhere.
+// Catch-all routes take paths either way, and paths that would redirect
+// off-site aren't redirected.
+func trailingSlashRedirect(req *Request, pattern string) (string, bool) {
+	if req.Method != "GET" && req.Method != "HEAD" || req.Path == "/" || strings.Contains(pattern, "/*") {
+		return "", false
+	}
+	wantSlash := strings.HasSuffix(pattern, "/")
+	if strings.HasSuffix(req.Path, "/") == wantSlash {
+		return "", false
+	}
+	location := strings.TrimSuffix(req.Path, "/")
+	if wantSlash {
+		location += "/"
+	}
+	// Browsers read "//host" and "/\host" as another origin
+	if strings.HasPrefix(location, "//") || strings.HasPrefix(location, "/\\") {
+		return "", false
+	}
+	if req.rawQuery != "" {
+		location += "?" + req.rawQuery
+	}
+	return location, true
+}
+
+// comparePatterns orders route patterns by matching priority: at the first
+// segment where they differ in kind, a static segment beats a ":param",
+// which beats a "*catchall". Patterns of the same shape are ordered by
+// length and then text, so the order never depends on registration.
+func comparePatterns(a, b string) int {
+	aParts := strings.Split(strings.Trim(a, "/"), "/")
+	bParts := strings.Split(strings.Trim(b, "/"), "/")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if kind := segmentKind(aParts[i]) - segmentKind(bParts[i]); kind != 0 {
+			return kind
+		}
+	}
+	if len(aParts) != len(bParts) {
+		return len(aParts) - len(bParts)
+	}
+	return strings.Compare(a, b)
+}
+
+// segmentKind ranks a pattern segment: 0 static, 1 ":param", 2 "*catchall"
+func segmentKind(segment string) int {
+	switch {
+	case strings.HasPrefix(segment, "*"):
+		return 2
+	case strings.HasPrefix(segment, ":"):
+		return 1
+	}
+	return 0
+}
+
+// patternShape strips parameter names from a pattern, so patterns that
+// differ only in those names, and so match exactly the same paths, share
+// a shape: /users/:id and /users/:name both become /users/:
+func patternShape(pattern string) string {
+	parts := strings.Split(pattern, "/")
+	for i, part := range parts {
+		if kind := segmentKind(part); kind != 0 {
+			parts[i] = part[:1]
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// optionRoute returns the request's route when it has options that apply
+// before routing, such as how the body is read or parsed, and nil otherwise
+func (r *Router) optionRoute(req *Request) *route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.optionRoutes {
+		return nil
+	}
+	rt, _ := r.findRoute(req)
+	if rt == nil || !rt.hasRequestOptions() {
+		return nil
+	}
+	return rt
+}
+
+// selectRoute returns the first variant whose matchers accept the request
+func selectRoute(variants []*route, req *Request) *route {
+	for _, rt := range variants {
+		if rt.matches(req) {
+			return rt
+		}
+	}
+	return nil
 }
 
 // Handle routes a request and returns response string (for compatibility)
@@ -108,6 +463,12 @@ func (r *Router) Handle(method, cleanPath string, queryMap, bodyMap map[string]s
 
 // RunConnection handles an HTTP connection (supports keep-alive)
 func (r *Router) RunConnection(conn net.Conn) {
+	if r.config.ProxyProtocol && !hasProxyConn(conn) {
+		conn = newProxyConn(conn)
+	}
+	if r.config.Faults != nil {
+		conn = newFaultConn(conn, r.config.Faults)
+	}
 	defer conn.Close()
 
 	defer func() {
@@ -119,22 +480,46 @@ func (r *Router) RunConnection(conn net.Conn) {
 				"Internal Server Error",
 				[]byte("Internal server error occurred"),
 			)
-			conn.Write(errorResponse)
+			conn.Write(setConnectionHeader(errorResponse, false))
 		}
 	}()
 
+	br := bufio.NewReader(conn)
+	if r.config.ConcurrentRequests {
+		r.runPipelined(conn, br)
+		return
+	}
+
+	// The first request gets HeaderReadTimeout; later ones may idle for IdleTimeout
+	waitTimeout := r.config.headerReadTimeout()
+
 	for {
-		// Read request
-		requestData, err := readHTTPRequest(conn, r.config)
-		if err != nil {
+		// Wait for the request to start (pipelined requests are already
+		// buffered); once it has, the whole head must arrive within
+		// HeaderReadTimeout, so trickling clients can't hold the connection
+		conn.SetReadDeadline(time.Now().Add(waitTimeout))
+		if _, err := br.Peek(1); err != nil {
 			return
 		}
+		conn.SetReadDeadline(time.Now().Add(r.config.headerReadTimeout()))
+
+		responseBytes, _, shouldClose := r.serveRequest(conn, br)
 
-		// Parse and handle request
-		responseBytes, _, shouldClose := r.processRequest(conn, requestData)
+		// Send response (streamed responses were already written). A client
+		// that stops reading is dropped once WriteTimeout passes.
+		if len(responseBytes) > 0 {
+			responseBytes = setConnectionHeader(responseBytes, !shouldClose)
+			if r.config.WriteTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(r.config.WriteTimeout))
+			}
+			if _, err := conn.Write(responseBytes); err != nil {
+				return
+			}
+		}
 
-		// Send response
-		conn.Write(responseBytes)
+		if r.config.IdleTimeout > 0 {
+			waitTimeout = r.config.IdleTimeout
+		}
 
 		if shouldClose {
 			break
@@ -142,150 +527,440 @@ func (r *Router) RunConnection(conn net.Conn) {
 	}
 }
 
-// processRequest parses and handles a single HTTP request
+// keepAlive decides whether the connection stays open after this request:
+// never when EnableKeepAlive is off, by default on HTTP/1.1 unless the client
+// sends "Connection: close", and on HTTP/1.0 only with "Connection: keep-alive".
+// A request with both Transfer-Encoding and Content-Length may be a smuggling
+// attempt, so its connection is closed after the response (RFC 9112 section 6.1).
+func (r *Router) keepAlive(proto string, headerMap Headers) bool {
+	if !r.config.EnableKeepAlive {
+		return false
+	}
+	if headerMap.Get("Transfer-Encoding") != "" && headerMap.Get("Content-Length") != "" {
+		return false
+	}
+	connection := headerMap.Get("Connection")
+	if proto == "HTTP/1.0" {
+		return hasToken(connection, "keep-alive")
+	}
+	return !hasToken(connection, "close")
+}
+
+// hasToken reports whether a comma-separated header value contains token
+func hasToken(value, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// processRequest handles a request whose head, and possibly part of its
+// body, is in requestData; the rest of the body is read from conn
 func (r *Router) processRequest(conn net.Conn, requestData []byte) ([]byte, string, bool) {
-	// Split headers and body
-	endMarker := []byte("\r\n\r\n")
-	parts := bytes.SplitN(requestData, endMarker, 2)
-	if len(parts) == 0 {
-		resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("Invalid request"))
-		return resp, status, true
+	var src io.Reader = bytes.NewReader(requestData)
+	if conn != nil {
+		src = io.MultiReader(src, conn)
 	}
+	return r.serveRequest(conn, bufio.NewReader(src))
+}
 
-	headerSection := parts[0]
-	var bodyData []byte
-	if len(parts) > 1 {
-		bodyData = parts[1]
+// serveRequest reads one request from br, the buffered reader of conn, and
+// handles it. It returns the response to send (nil when the head was
+// unreadable or the response was streamed), its status, and whether to
+// close the connection.
+func (r *Router) serveRequest(conn net.Conn, br *bufio.Reader) ([]byte, string, bool) {
+	// With the rawhttp_arena build tag the headers live in a per-request
+	// arena released once the response is built
+	arena := newRequestArena()
+	defer arena.release()
+
+	target, head, early := r.readHead(br, arena)
+	if early != nil {
+		return early.response, early.status, early.close
+	}
+	req, stream, early := target.prepareRequest(conn, br, head)
+	if early != nil {
+		return early.response, early.status, early.close
 	}
+	res := target.finishRequest(req, stream)
+	return res.response, res.status, res.close
+}
 
-	// Parse header lines
-	headerLines := bytes.Split(headerSection, []byte("\r\n"))
-	if len(headerLines) == 0 {
-		resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("No headers"))
-		return resp, status, true
+// ReadRequest reads one request from br and parses it exactly as a Router
+// with the default config does before routing: query, cookies, body and
+// all. No handler runs. It is meant for tests that call handlers directly;
+// see the servertest package. A request the router would refuse gives an
+// error naming the status it would answer with.
+func ReadRequest(br *bufio.Reader) (*Request, error) {
+	config := DefaultConfig()
+	config.DisableStatic = true
+	r := NewRouterWithConfig(config)
+
+	_, head, early := r.readHead(br, nil)
+	if early == nil {
+		var req *Request
+		if req, _, early = r.prepareRequest(nil, br, head); early == nil {
+			return req, nil
+		}
 	}
+	if early.status == "" {
+		return nil, errors.New("server: unreadable request")
+	}
+	return nil, fmt.Errorf("server: request refused with status %s", early.status)
+}
 
-	firstLine := headerLines[0]
-	remainingHeaders := headerLines[1:]
+// served is the outcome of a request: the response to send (nil when the
+// head was unreadable or the response was streamed), its status, and
+// whether to close the connection afterwards
+type served struct {
+	response []byte
+	status   string
+	close    bool
+}
 
-	// Parse request line
-	method, pathBytes, err := parseRequestLineFromBytes(firstLine)
-	if err != nil {
+// readHead reads a request head from br and picks the router that handles
+// it, which differs from r for virtual hosts. A head that can't be served
+// yields the response to send instead.
+func (r *Router) readHead(br *bufio.Reader, arena *requestArena) (*Router, *requestHead, *served) {
+	head, err := readRequestHead(br, r.config, arena)
+	switch {
+	case errors.Is(err, errURITooLong):
+		resp, status := Serve414("")
+		return nil, nil, &served{resp, status, true}
+	case errors.Is(err, errInvalidRequestLine):
 		resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("Invalid request line"))
-		return resp, status, true
+		return nil, nil, &served{resp, status, true}
+	case errors.Is(err, errInvalidHeader):
+		resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("Invalid header field"))
+		return nil, nil, &served{resp, status, true}
+	case errors.Is(err, errHeadersTooLarge):
+		resp, status := Serve431("")
+		return nil, nil, &served{resp, status, true}
+	case err != nil:
+		// Closed connections and timeouts get no response
+		return nil, nil, &served{close: true}
+	}
+	if r.config.MaxURLLength > 0 && len(head.target) > r.config.MaxURLLength {
+		resp, status := Serve414("")
+		return nil, nil, &served{resp, status, true}
 	}
 
-	// Parse headers
-	headerMap := parseHeadersFromBytes(remainingHeaders)
+	// HTTP/1.1 requests must carry exactly one valid Host header
+	host, hasHost := head.headers["Host"]
+	if head.proto == "HTTP/1.1" && !hasHost || !validHost(host) {
+		resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("Missing or invalid Host header"))
+		return nil, nil, &served{resp, status, true}
+	}
+
+	// A Transfer-Encoding that doesn't end in chunked leaves the body
+	// length unknown (RFC 9112 section 6.3)
+	if te, ok := head.headers["Transfer-Encoding"]; ok && !isChunked(te) {
+		resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("Invalid Transfer-Encoding"))
+		return nil, nil, &served{resp, status, true}
+	}
+
+	r.mu.RLock()
+	vhosts := r.vhosts
+	r.mu.RUnlock()
+	if vhosts != nil {
+		router, params := vhosts.router(host)
+		head.hostParams = params
+		return router, head, nil
+	}
+	return r, head, nil
+}
 
-	// Read remaining body if needed
-	bodyData = r.readRemainingBody(conn, headerMap, bodyData)
+// prepareRequest reads the body of a request whose head has been read from
+// br and builds the Request for it. The connection's limits have been
+// applied by the router that read the head; routing, body limits and
+// middleware are this router's. A request that can't be served yields the
+// response to send instead.
+func (r *Router) prepareRequest(conn net.Conn, br *bufio.Reader, head *requestHead) (*Request, *bodyStream, *served) {
+	method, proto, headerMap := head.method, head.proto, head.headers
+	var err error
+
+	if method == "CONNECT" && r.config.Tunnel != nil {
+		return nil, nil, r.serveTunnel(conn, br, head)
+	}
 
 	// Parse query string
 	var queryMap map[string]string
-	pathParts := bytes.SplitN(pathBytes, []byte("?"), 2)
-	cleanPath := string(pathParts[0])
+	cleanPath, rawQuery, hasQuery := strings.Cut(head.target, "?")
+	if hasQuery {
+		queryMap = parseKeyValuePairsFromBytes([]byte(rawQuery))
+	}
+
+	// Route options such as WithMaxBodySize apply before the body is read
+	rt := r.optionRoute(&Request{Method: method, Path: normalizePath(cleanPath), Query: queryMap, Headers: headerMap})
+	maxBody, timeout := r.config.MaxBodySize, r.config.HandlerTimeout
+	if rt != nil && rt.maxBodySize > 0 {
+		maxBody = rt.maxBodySize
+	}
+	if rt != nil && rt.timeout > 0 {
+		timeout = rt.timeout
+	}
+
+	// Clients sending "Expect: 100-continue" wait for a go-ahead before the body
+	if resp, status, refused := r.continueBody(conn, br, proto, headerMap, maxBody); refused {
+		return nil, nil, &served{resp, status, true}
+	}
+
+	// Routes registered with StreamBody read the body from the connection
+	// themselves; everything else gets the body buffered up front
+	var stream *bodyStream
+	var bodyData []byte
+	var contentLength int64
+	if rt != nil && rt.streamBody {
+		stream, err = r.openBodyStream(conn, br, headerMap, maxBody)
+		if errors.Is(err, errBodyTooLarge) {
+			resp, status := Serve413("Request body too large")
+			return nil, nil, &served{resp, status, true}
+		}
+		if errors.Is(err, errUnsupportedEncoding) {
+			resp, status := Serve415("Unsupported Content-Encoding: " + headerValue(headerMap, "Content-Encoding"))
+			return nil, nil, &served{resp, status, true}
+		}
+		if err != nil {
+			resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("Invalid request body"))
+			return nil, nil, &served{resp, status, true}
+		}
+		contentLength = declaredLength(headerMap)
+	} else {
+		bodyData, err = r.readBody(conn, br, headerMap, maxBody, r.progressReporter(headerMap, queryMap))
+		if errors.Is(err, errBodyTooLarge) {
+			resp, status := Serve413("Request body too large")
+			return nil, nil, &served{resp, status, true}
+		}
+		if err != nil {
+			resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("Invalid request body"))
+			return nil, nil, &served{resp, status, true}
+		}
+		contentLength = int64(len(bodyData))
+
+		// Decompress body if the client sent it encoded
+		if encoding := headerValue(headerMap, "Content-Encoding"); encoding != "" && len(bodyData) > 0 {
+			bodyData, err = decodeRequestBody(encoding, bodyData, maxBody)
+			if errors.Is(err, errBodyTooLarge) {
+				resp, status := Serve413("Decompressed body too large")
+				return nil, nil, &served{resp, status, true}
+			}
+			if errors.Is(err, errUnsupportedEncoding) {
+				resp, status := Serve415("Unsupported Content-Encoding: " + encoding)
+				return nil, nil, &served{resp, status, true}
+			}
+			if err != nil {
+				resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("Invalid compressed body"))
+				return nil, nil, &served{resp, status, true}
+			}
+		}
+	}
 
-	if len(pathParts) > 1 {
-		queryMap = parseKeyValuePairsFromBytes(pathParts[1])
+	// Normalize //, /./ and /../ before routing and static mapping
+	if normalized := normalizePath(cleanPath); normalized != cleanPath {
+		if r.config.RedirectNormalizedPaths && (method == "GET" || method == "HEAD") {
+			location := normalized
+			if hasQuery {
+				location += "?" + rawQuery
+			}
+			resp, status := Serve301(location)
+			return nil, nil, &served{resp, status, !r.keepAlive(proto, headerMap)}
+		}
+		cleanPath = normalized
 	}
 
-	// Parse body
+	// Parse body. Route parsers reject bad bodies; the automatic parser
+	// leaves the error to the handler unless RejectInvalidBody is set.
 	var bodyMap map[string]string
-	contentType := headerMap["Content-Type"]
-	if len(bodyData) > 0 {
-		if strings.Contains(contentType, "application/json") {
-			bodyMap = parseJSONBodyFromBytes(bodyData)
-		} else {
-			bodyMap = parseKeyValuePairsFromBytes(bodyData)
+	var bodyErr error
+	parseBody := parseBodyAuto
+	custom := rt != nil && rt.customBody
+	if custom {
+		parseBody = rt.bodyParser
+	}
+	if len(bodyData) > 0 && parseBody != nil {
+		bodyMap, bodyErr = parseBody(headerMap.Get("Content-Type"), bodyData)
+		if bodyErr != nil && (custom || r.config.RejectInvalidBody) {
+			resp, status := CreateResponseBytes("400", "text/plain", "Bad Request", []byte("Invalid request body"))
+			return nil, nil, &served{resp, status, !r.keepAlive(proto, headerMap)}
 		}
 	}
 
 	// Detect browser
-	browserName := detectBrowser(headerMap["User-Agent"])
+	browserName := detectBrowser(headerMap.Get("User-Agent"))
 
 	// Route request
-	responseBytes, status := r.routeRequest(method, cleanPath, queryMap, bodyMap, browserName)
+	remoteAddr, isTLS := connectionInfo(conn)
+	req := &Request{
+		Method:     method,
+		Path:       cleanPath,
+		Query:      queryMap,
+		Body:       bodyMap,
+		BodyErr:    bodyErr,
+		RawBody:    bodyData,
+		Headers:    headerMap,
+		Host:       headerMap["Host"],
+		hostParams: head.hostParams,
+		Cookies:    parseCookies(head.arena.escape(headerValue(headerMap, "Cookie"))),
+		Browser:    browserName,
+		Proto:      proto,
+		RemoteAddr: remoteAddr,
+		TLS:        isTLS,
+		conn:       conn,
+		rawQuery:   rawQuery,
+		arena:      head.arena,
+
+		ContentLength: contentLength,
+		ContentType:   parseMediaType(headerMap.Get("Content-Type")),
+
+		keepAlive:    r.keepAlive(proto, headerMap),
+		timeout:      timeout,
+		writeTimeout: r.config.WriteTimeout,
+		bufferSize:   r.config.ResponseBufferSize,
+
+		compressionLevels: r.config.CompressionLevels,
+		trustedProxies:    r.config.TrustedProxies,
+		forwardedHeader:   r.config.ForwardedHeader,
+	}
+	if stream != nil {
+		req.body = stream
+	}
+	if r.config.GeoIP != nil {
+		req.Geo = lookupGeo(r.config.GeoIP, req.ClientIP())
+	}
+	return req, stream, nil
+}
 
-	if r.config.EnableLogging {
-		logRequest(method, cleanPath, status)
+// finishRequest runs the handler of a prepared request and decides whether
+// the connection stays open
+func (r *Router) finishRequest(req *Request, stream *bodyStream) served {
+	responseBytes, status, timedOut := r.runHandler(req)
+	if req.Method == "HEAD" {
+		// Handlers and static files may build a body; the client must not get it
+		responseBytes = stripBody(responseBytes)
 	}
 
-	// Check if connection should close
-	shouldClose := headerMap["Connection"] == "close"
+	if r.logging.Load() {
+		logRequest(req.Method, req.Path, StatusCode(status))
+	}
 
-	return responseBytes, status, shouldClose
+	// Check if connection should close, either by the client's request or
+	// because the handler sent "Connection: close". The rest of a streamed
+	// body the handler didn't finish is discarded up to MaxDrainSize so the
+	// next request starts in the right place; a longer one closes instead.
+	if timedOut {
+		return served{responseBytes, status, true}
+	}
+	shouldClose := !req.keepAlive || req.closeConn || requestsClose(responseBytes)
+	if stream != nil && !shouldClose && !stream.drain(r.config.maxDrainSize()) {
+		shouldClose = true
+	}
+
+	return served{responseBytes, status, shouldClose}
 }
 
-// readRemainingBody reads body data if Content-Length indicates more data
-func (r *Router) readRemainingBody(conn net.Conn, headerMap map[string]string, bodyData []byte) []byte {
-	contentLengthStr := headerMap["Content-Length"]
-	if contentLengthStr == "" {
-		return bodyData
+// progressReporter returns a callback reporting body progress for an upload
+// token, or nil when no progress callback or token is present
+func (r *Router) progressReporter(headerMap, queryMap map[string]string) func(received, total int64) {
+	r.mu.RLock()
+	progress := r.progress
+	r.mu.RUnlock()
+	if progress == nil {
+		return nil
 	}
 
-	contentLength, err := strconv.Atoi(contentLengthStr)
-	if err != nil || len(bodyData) >= contentLength {
-		return bodyData
+	token := headerValue(headerMap, "X-Upload-Token")
+	if token == "" {
+		token = queryMap["upload_token"]
+	}
+	if token == "" {
+		return nil
+	}
+	return func(received, total int64) {
+		progress(token, received, total)
 	}
+}
 
-	remainingBytes := contentLength - len(bodyData)
-	remainingBuffer := make([]byte, remainingBytes)
-	totalRead := 0
+// readBody reads a Content-Length or chunked request body from br, the
+// buffered reader of conn, leaving any pipelined request after it buffered
+func (r *Router) readBody(conn net.Conn, br *bufio.Reader, headerMap Headers, maxBody int64, report func(received, total int64)) ([]byte, error) {
+	src := connReader{src: br, conn: conn, timeout: r.config.bodyReadTimeout()}
+	if isChunked(headerMap.Get("Transfer-Encoding")) {
+		return readChunkedBody(src, maxBody, report)
+	}
 
-	conn.SetReadDeadline(time.Now().Add(r.config.ReadTimeout))
+	contentLengthStr := headerMap.Get("Content-Length")
+	if contentLengthStr == "" {
+		return nil, nil
+	}
+	contentLength, err := strconv.Atoi(contentLengthStr)
+	if err != nil || contentLength < 0 {
+		return nil, errInvalidContentLength
+	}
+	// Refuse oversized bodies before reading or allocating them
+	if maxBody > 0 && int64(contentLength) > maxBody {
+		return nil, errBodyTooLarge
+	}
 
-	for totalRead < remainingBytes {
-		n, err := conn.Read(remainingBuffer[totalRead:])
+	body := make([]byte, contentLength)
+	received := 0
+	for received < contentLength {
+		n, err := src.Read(body[received:])
+		received += n
+		if report != nil && n > 0 {
+			report(int64(received), int64(contentLength))
+		}
 		if err != nil {
-			return bodyData
+			// The connection ended before Content-Length bytes arrived
+			return nil, io.ErrUnexpectedEOF
 		}
-		totalRead += n
 	}
-
-	return append(bodyData, remainingBuffer[:totalRead]...)
+	return body, nil
 }
 
 // routeRequest determines how to handle a request (static file or route)
-func (r *Router) routeRequest(method, cleanPath string, queryMap, bodyMap map[string]string, browserName string) ([]byte, string) {
-	// Determine file path
-	var filePath string
-	if cleanPath == "/" {
-		filePath = "pages/index.html"
-	} else {
-		filePath = "pages" + cleanPath
+func (r *Router) routeRequest(req *Request) ([]byte, string) {
+	r.mu.RLock()
+	resolver := r.resolver
+	var middleware []Middleware
+	if r.staticMiddleware {
+		middleware = r.middleware
 	}
+	r.mu.RUnlock()
 
-	// Security: Check for path traversal
-	baseDir := "pages"
-	absBaseDir, err := filepath.Abs(baseDir)
-	if err != nil {
-		return CreateResponseBytes("500", "text/plain", "Internal Server Error", []byte("Server configuration error"))
-	}
-	absFilePath, err := filepath.Abs(filePath)
-	if err != nil {
-		return CreateResponseBytes("500", "text/plain", "Internal Server Error", []byte("Path resolution error"))
+	// Determine file path
+	name := req.Path
+	if name == "/" {
+		name = "/index.html"
 	}
 
-	isPathTraversal := !strings.HasPrefix(absFilePath, absBaseDir)
-
-	// Serve static file if exists (with path traversal protection)
-	if !isPathTraversal && FileExists(filePath) {
-		content, success := readFileContent(filePath)
-		if success {
-			contentType := getContentType(filePath)
-			return CreateResponseBytes("200", contentType, "OK", content)
+	// Hidden paths and filtered extensions skip static serving and fall through to routing
+	if resolver != nil && staticPathAllowed(r.config, name) {
+		file, err := resolver.Open(name)
+		switch {
+		case err == nil:
+			serveFile := func(req *Request) ([]byte, string) {
+				return serveStaticFile(req, resolver, name, file)
+			}
+			return applyMiddleware(serveFile, middleware)(req)
+		case errors.Is(err, fs.ErrPermission):
+			// Path traversal attempt
+			return CreateResponseBytes("403", "text/plain", "Forbidden", []byte("Access denied"))
+		case !errors.Is(err, fs.ErrNotExist):
+			log.Printf("Static file error for %s: %v\n", req.Path, err)
+			return CreateResponseBytes("500", "text/plain", "Internal Server Error", []byte("Static file error"))
 		}
-		return serve404Bytes()
-	}
 
-	// Path traversal attempt
-	if isPathTraversal {
-		return CreateResponseBytes("403", "text/plain", "Forbidden", []byte("Access denied"))
+		// Directories serve their index.html or, if enabled, a listing
+		if response, status, ok := r.serveDirectory(req, resolver, req.Path); ok {
+			serveDir := func(*Request) ([]byte, string) { return response, status }
+			return applyMiddleware(serveDir, middleware)(req)
+		}
 	}
 
 	// Try routing
-	return r.HandleBytes(method, cleanPath, queryMap, bodyMap, browserName)
+	return r.dispatch(req)
 }
 
 // ListenAndServe starts the HTTP server on the given address.
@@ -300,22 +975,19 @@ func (r *Router) ListenAndServe(addr string) error {
 
 	log.Printf("Server listening on http://%s\n", addr)
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Error accepting connection:", err)
-			continue
-		}
-		go r.RunConnection(conn)
-	}
+	return r.Serve(listener)
 }
 
 // Serve accepts connections on the given listener and handles them.
 // This allows using a custom listener (e.g., TLS).
+// It returns when the listener is closed.
 func (r *Router) Serve(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Println("Error accepting connection:", err)
 			continue
 		}
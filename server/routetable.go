@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RouteTable is a declarative set of routes, usually loaded from JSON:
+//
+//	{"routes": [
+//		{"path": "/assets", "static": "./public"},
+//		{"path": "/old-blog", "redirect": "https://blog.example.com", "status": 301},
+//		{"path": "/api", "proxy": "http://localhost:9000",
+//		 "request_headers": {"set": {"X-Env": "prod"}, "remove": ["Cookie"]}}
+//	]}
+type RouteTable struct {
+	Routes []RouteSpec `json:"routes"`
+}
+
+// RouteSpec declares one route. Exactly one of Static, Redirect and Proxy is set.
+type RouteSpec struct {
+	Method string `json:"method"` // Redirects only; empty means GET
+	Path   string `json:"path"`
+
+	Static   string `json:"static"`   // Directory served below Path
+	Redirect string `json:"redirect"` // Location to redirect Path to
+	Status   int    `json:"status"`   // Redirect status: 301, 302, 307 or 308; 0 means 302
+	Proxy    string `json:"proxy"`    // Upstream base URL requests below Path are forwarded to
+
+	// Recompress has a proxy route fetch bodies uncompressed (or gzip,
+	// decoded on arrival) and compress them itself for the client's
+	// Accept-Encoding like Compress, so an upstream without compression
+	// doesn't force uncompressed delivery
+	Recompress bool `json:"recompress"`
+
+	// Header rules of proxy routes. The Host sent upstream is the
+	// upstream's own unless Host overrides it or PreserveHost forwards the
+	// client's. Path below the route is appended to the upstream's path,
+	// stripping the route's prefix, unless KeepPrefix forwards it whole.
+	RequestHeaders  *HeaderRules `json:"request_headers"`  // Applied to the request sent upstream
+	ResponseHeaders *HeaderRules `json:"response_headers"` // Applied to the upstream's response
+	Host            string       `json:"host"`
+	PreserveHost    bool         `json:"preserve_host"`
+	KeepPrefix      bool         `json:"keep_prefix"`
+}
+
+// HeaderRules rewrite the headers of a proxied request or response.
+// Remove is applied first, then Set, then Add.
+type HeaderRules struct {
+	Remove []string          `json:"remove"` // Dropped entirely
+	Set    map[string]string `json:"set"`    // Replacing any values
+	Add    map[string]string `json:"add"`    // Appended to existing values
+}
+
+// validate rejects malformed names and values, and connection-specific
+// headers the proxy manages itself
+func (h *HeaderRules) validate() error {
+	for _, name := range h.Remove {
+		if !isToken([]byte(name)) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	for _, values := range []map[string]string{h.Set, h.Add} {
+		for name, value := range values {
+			if !isToken([]byte(name)) || !validFieldValue([]byte(value)) {
+				return fmt.Errorf("invalid header %q", name)
+			}
+			if isHopHeader(name) || strings.EqualFold(name, "Host") {
+				return fmt.Errorf("header %s is managed by the proxy", name)
+			}
+		}
+	}
+	return nil
+}
+
+// apply rewrites header
+func (h *HeaderRules) apply(header http.Header) {
+	if h == nil {
+		return
+	}
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+	for name, value := range h.Add {
+		header.Add(name, value)
+	}
+}
+
+// proxyMethods are forwarded by proxy routes
+var proxyMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// proxyClient performs upstream requests for proxy routes
+var proxyClient = &http.Client{
+	Timeout: 30 * time.Second,
+	// Redirects are passed through to the client
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// maxProxyResponseSize bounds the upstream body a proxy route buffers
+const maxProxyResponseSize = 32 << 20
+
+// hopHeaders are connection-specific and never forwarded by proxy routes
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+// LoadRouteTable reads a JSON route table from a file
+func LoadRouteTable(path string) (*RouteTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("route table: %w", err)
+	}
+	var table RouteTable
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&table); err != nil {
+		return nil, fmt.Errorf("route table %s: %w", path, err)
+	}
+	return &table, nil
+}
+
+// Apply validates every route and registers them on the router. Nothing is
+// registered when a route is invalid or conflicts with another route.
+func (t *RouteTable) Apply(r *Router) error {
+	added := make(map[string][]string) // method -> patterns of earlier routes
+	for i, spec := range t.Routes {
+		if err := spec.check(r, added); err != nil {
+			return fmt.Errorf("route table: route %d (%s): %w", i, spec.Path, err)
+		}
+	}
+	for _, spec := range t.Routes {
+		spec.register(r)
+	}
+	return nil
+}
+
+// validate checks a route spec for missing or conflicting fields
+func (spec RouteSpec) validate() error {
+	if !strings.HasPrefix(spec.Path, "/") {
+		return errors.New("path must start with /")
+	}
+	kinds := 0
+	for _, target := range []string{spec.Static, spec.Redirect, spec.Proxy} {
+		if target != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return errors.New("exactly one of static, redirect and proxy is required")
+	}
+	if spec.Proxy == "" && (spec.Recompress || spec.RequestHeaders != nil || spec.ResponseHeaders != nil ||
+		spec.Host != "" || spec.PreserveHost || spec.KeepPrefix) {
+		return errors.New("recompress, header rules, host, preserve_host and keep_prefix require proxy")
+	}
+	if spec.Host != "" && spec.PreserveHost {
+		return errors.New("host and preserve_host are exclusive")
+	}
+	if !validFieldValue([]byte(spec.Host)) || strings.ContainsAny(spec.Host, " \t") {
+		return fmt.Errorf("invalid host %q", spec.Host)
+	}
+	for _, rules := range []*HeaderRules{spec.RequestHeaders, spec.ResponseHeaders} {
+		if rules == nil {
+			continue
+		}
+		if err := rules.validate(); err != nil {
+			return err
+		}
+	}
+	if spec.Redirect != "" && spec.Status != 0 && !slices.Contains([]int{301, 302, 307, 308}, spec.Status) {
+		return fmt.Errorf("unsupported redirect status %d", spec.Status)
+	}
+	if spec.Proxy != "" {
+		upstream, err := url.Parse(spec.Proxy)
+		if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+			return fmt.Errorf("invalid proxy upstream %q", spec.Proxy)
+		}
+	}
+	return nil
+}
+
+// check validates a spec and makes sure its routes conflict neither with
+// the router's nor with those added by earlier specs, adding its own
+func (spec RouteSpec) check(r *Router, added map[string][]string) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	for _, route := range spec.routes() {
+		method, path := route[0], route[1]
+		if err := r.conflict(method, path); err != nil {
+			return err
+		}
+		if err := patternConflict(added[method], method, path); err != nil {
+			return err
+		}
+		added[method] = append(added[method], path)
+	}
+	return nil
+}
+
+// routes lists the method and pattern of every route register adds
+func (spec RouteSpec) routes() [][2]string {
+	prefix := strings.TrimSuffix(spec.Path, "/")
+	switch {
+	case spec.Static != "":
+		return [][2]string{{"GET", prefix + "/*file"}, {"HEAD", prefix + "/*file"}}
+	case spec.Redirect != "":
+		return [][2]string{{spec.redirectMethod(), spec.Path}}
+	}
+	var routes [][2]string
+	for _, method := range proxyMethods {
+		if prefix != "" {
+			routes = append(routes, [2]string{method, prefix})
+		}
+		routes = append(routes, [2]string{method, prefix + "/*rest"})
+	}
+	return routes
+}
+
+// redirectMethod returns the method a redirect route answers, GET by default
+func (spec RouteSpec) redirectMethod() string {
+	if spec.Method == "" {
+		return "GET"
+	}
+	return strings.ToUpper(spec.Method)
+}
+
+// register adds the routes a spec describes
+func (spec RouteSpec) register(r *Router) {
+	prefix := strings.TrimSuffix(spec.Path, "/")
+	switch {
+	case spec.Static != "":
+		r.Static(prefix, spec.Static)
+	case spec.Redirect != "":
+		r.Register(spec.redirectMethod(), spec.Path, redirectHandler(spec.Redirect, spec.Status))
+	default:
+		handler := proxyHandler(spec, prefix)
+		for _, method := range proxyMethods {
+			if prefix != "" {
+				r.Register(method, prefix, handler)
+			}
+			r.Register(method, prefix+"/*rest", handler)
+		}
+	}
+}
+
+// redirectHandler answers with a redirect to location
+func redirectHandler(location string, status int) RouteHandler {
+	if status == 0 {
+		status = 302
+	}
+	return func(req *Request) ([]byte, string) {
+		headers := map[string]string{"Location": location}
+		return RespondWithHeaders(status, "text/plain", headers, []byte("Redirecting to "+location))
+	}
+}
+
+// proxyHandler forwards requests to the spec's upstream, replacing prefix
+// with the upstream's path unless KeepPrefix is set. The query is forwarded
+// as sent, the client's address is appended to X-Forwarded-For, the header
+// rules run last, and upstream bodies over maxProxyResponseSize get a 502.
+func proxyHandler(spec RouteSpec, prefix string) RouteHandler {
+	base := strings.TrimSuffix(spec.Proxy, "/")
+	return func(req *Request) ([]byte, string) {
+		target := base + strings.TrimPrefix(req.Path, prefix)
+		if spec.KeepPrefix {
+			target = base + req.Path
+		}
+		if req.rawQuery != "" {
+			target += "?" + req.rawQuery
+		} else if len(req.Query) > 0 {
+			// Requests built without a request line only have the parsed query
+			query := url.Values{}
+			for key, value := range req.Query {
+				query.Set(key, value)
+			}
+			target += "?" + query.Encode()
+		}
+
+		outbound, err := http.NewRequest(req.Method, target, req.BodyReader())
+		if err != nil {
+			return Serve502("")
+		}
+		for name, value := range req.Headers {
+			if !isHopHeader(name) && !strings.EqualFold(name, "Host") {
+				outbound.Header.Set(name, value)
+			}
+		}
+		if ip := remoteIP(req); ip != "" {
+			if prior := headerValue(req.Headers, "X-Forwarded-For"); prior != "" {
+				ip = prior + ", " + ip
+			}
+			outbound.Header.Set("X-Forwarded-For", ip)
+		}
+		outbound.Header.Set("X-Forwarded-Host", headerValue(req.Headers, "Host"))
+		if spec.Recompress {
+			// The transport then asks for gzip and decodes it
+			outbound.Header.Del("Accept-Encoding")
+		}
+		switch {
+		case spec.Host != "":
+			outbound.Host = spec.Host
+		case spec.PreserveHost:
+			outbound.Host = headerValue(req.Headers, "Host")
+		}
+		spec.RequestHeaders.apply(outbound.Header)
+
+		resp, err := proxyClient.Do(outbound)
+		if err != nil {
+			return Serve502("Upstream unavailable")
+		}
+		defer resp.Body.Close()
+		spec.ResponseHeaders.apply(resp.Header)
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxProxyResponseSize+1))
+		if err != nil {
+			return Serve502("Upstream response incomplete")
+		}
+		if len(body) > maxProxyResponseSize {
+			return Serve502("Upstream response too large")
+		}
+
+		response, status := Respond(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		names := make([]string, 0, len(resp.Header))
+		for name := range resp.Header {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if isHopHeader(name) || name == "Content-Type" {
+				continue
+			}
+			for _, value := range resp.Header[name] {
+				response = appendResponseHeader(response, name, value)
+			}
+		}
+		if length := resp.Header.Get("Content-Length"); req.Method == "HEAD" && length != "" {
+			// HEAD has no body, but the length is that of the GET response
+			response = setResponseHeader(response, "Content-Length", length)
+		}
+		if spec.Recompress && req.Method != "HEAD" {
+			response = compressResponse(req, response)
+		}
+		return response, status
+	}
+}
+
+// isHopHeader reports whether a header is connection-specific
+func isHopHeader(name string) bool {
+	return slices.ContainsFunc(hopHeaders, func(hop string) bool { return strings.EqualFold(hop, name) })
+}
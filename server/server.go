@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -25,14 +26,36 @@ type Server struct {
 	TLSCertFile string // Path to TLS certificate file
 	TLSKeyFile  string // Path to TLS key file
 
+	// TLSPreset selects the minimum version, cipher suites and curves;
+	// the zero value is TLSIntermediate
+	TLSPreset TLSPreset
+
+	// TLSHandshakeTimeout bounds the TLS handshake separately from
+	// ReadTimeout; 0 means 10 seconds
+	TLSHandshakeTimeout time.Duration
+
+	// DebugConsole offers the DebugALPN protocol on TLS connections, which
+	// opens a text console (stats, routes, log toggle) instead of HTTP.
+	// Anyone who can connect may use it, so enable it for debugging only.
+	DebugConsole bool
+
 	// Internal state
 	listener    net.Listener
 	tlsListener net.Listener
 	mu          sync.Mutex
 	running     bool
 	shutdownCh  chan struct{}
+	stopped     chan struct{} // Closed once serve has run the hooks
+	stopErr     error         // The hooks' joined error, set before stopped closes
+	hooks       []func() error
+	plugins     []Plugin
+	tlsStats    tlsHandshakeStats
+	started     time.Time
 }
 
+// shutdownGracePeriod is how long active connections get to finish
+var shutdownGracePeriod = 2 * time.Second
+
 // NewServer creates a new server with default settings.
 func NewServer(addr string) *Server {
 	return &Server{
@@ -60,65 +83,138 @@ func (s *Server) EnableTLS(addr, certFile, keyFile string) *Server {
 }
 
 // Register is a convenience method to register routes on the server's router.
-func (s *Server) Register(method, path string, handler RouteHandler) *Server {
-	s.Router.Register(method, path, handler)
+func (s *Server) Register(method, path string, handler RouteHandler, opts ...RouteOption) *Server {
+	s.Router.Register(method, path, handler, opts...)
+	return s
+}
+
+// Unregister is a convenience method to remove routes from the server's router.
+func (s *Server) Unregister(method, path string) bool {
+	return s.Router.Unregister(method, path)
+}
+
+// HandleFunc is a convenience method to register writer-based handlers on the server's router.
+func (s *Server) HandleFunc(method, path string, handler HandlerFunc, opts ...RouteOption) *Server {
+	s.Router.HandleFunc(method, path, handler, opts...)
 	return s
 }
 
-// ListenAndServe starts the server and blocks until shutdown.
+// Use is a convenience method to add middleware to the server's router.
+func (s *Server) Use(mw ...Middleware) *Server {
+	s.Router.Use(mw...)
+	return s
+}
+
+// OnShutdown registers a hook that runs during shutdown, after the listeners
+// are closed and active connections had time to finish. Hooks run in
+// registration order; failures are logged and don't stop later hooks.
+func (s *Server) OnShutdown(hook func() error) *Server {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, hook)
+	s.mu.Unlock()
+	return s
+}
+
+// listenAddrs are the addresses and certificate pair one run serves with
+type listenAddrs struct {
+	addr     string // plain HTTP; "" serves none
+	tlsAddr  string
+	certFile string // TLS is served when both files are set
+	keyFile  string
+}
+
+// listenAddrs returns the addresses configured on the server
+func (s *Server) listenAddrs() listenAddrs {
+	return listenAddrs{addr: s.Addr, tlsAddr: s.TLSAddr, certFile: s.TLSCertFile, keyFile: s.TLSKeyFile}
+}
+
+// ListenAndServe serves HTTP on addr, or on Addr when addr is "", plus
+// HTTPS when EnableTLS was called, and blocks until shutdown.
 // It handles graceful shutdown on SIGINT/SIGTERM.
-func (s *Server) ListenAndServe() error {
-	return s.ListenAndServeContext(context.Background())
+func (s *Server) ListenAndServe(addr string) error {
+	addrs := s.listenAddrs()
+	if addr != "" {
+		addrs.addr = addr
+	}
+	return s.serve(context.Background(), addrs)
+}
+
+// ListenAndServeTLS serves HTTPS only on addr using the given certificate
+// pair, ignoring Addr and EnableTLS. It blocks until shutdown like
+// ListenAndServe.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	return s.serve(context.Background(), listenAddrs{tlsAddr: addr, certFile: certFile, keyFile: keyFile})
 }
 
 // ListenAndServeContext starts the server with a custom context for shutdown control.
 func (s *Server) ListenAndServeContext(ctx context.Context) error {
+	return s.serve(ctx, s.listenAddrs())
+}
+
+// serve listens on addrs and runs until ctx ends, a signal arrives or
+// Shutdown is called
+func (s *Server) serve(ctx context.Context, addrs listenAddrs) error {
 	// Setup signal handling for graceful shutdown
 	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	// Start HTTP listener
-	var err error
-	s.listener, err = net.Listen("tcp", s.Addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", s.Addr, err)
-	}
-	log.Printf("Server listening on http://localhost%s\n", s.Addr)
-
-	// Start TLS listener if configured
-	hasTLS := false
-	if s.TLSCertFile != "" && s.TLSKeyFile != "" {
-		if FileExists(s.TLSCertFile) && FileExists(s.TLSKeyFile) {
-			cert, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
-			if err != nil {
-				log.Printf("Failed to load TLS certificate: %v\n", err)
-			} else {
-				tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
-				s.tlsListener, err = tls.Listen("tcp", s.TLSAddr, tlsConfig)
-				if err != nil {
-					log.Printf("Failed to listen on TLS %s: %v\n", s.TLSAddr, err)
-				} else {
-					hasTLS = true
-					log.Printf("TLS server listening on https://localhost%s\n", s.TLSAddr)
-				}
+	var listener, tlsListener net.Listener
+	if addrs.addr != "" {
+		var err error
+		listener, err = net.Listen("tcp", addrs.addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", addrs.addr, err)
+		}
+		log.Printf("Server listening on http://localhost%s\n", addrs.addr)
+	}
+
+	// Start TLS listener if configured. When plain HTTP is also served a TLS
+	// failure is logged and HTTP keeps running; a TLS-only server fails.
+	if addrs.certFile != "" && addrs.keyFile != "" {
+		var err error
+		tlsListener, err = s.listenTLS(addrs)
+		if err != nil {
+			if listener == nil {
+				return err
 			}
+			log.Printf("TLS disabled: %v\n", err)
+		} else {
+			log.Printf("TLS server listening on https://localhost%s\n", addrs.tlsAddr)
 		}
 	}
 
+	if listener == nil && tlsListener == nil {
+		return errors.New("no listen address configured")
+	}
+
+	// Shutdown reads the listeners under the lock. One called before this
+	// point has already closed shutdownCh, so the select below returns at
+	// once.
 	s.mu.Lock()
+	s.listener = listener
+	s.tlsListener = tlsListener
 	s.running = true
+	s.started = time.Now()
+	stopped := make(chan struct{})
+	s.stopped = stopped
 	s.mu.Unlock()
 
 	// HTTP accept loop
-	go s.acceptLoop(s.listener, ctx)
+	if listener != nil {
+		go s.acceptLoop(listener, ctx)
+	}
 
 	// HTTPS accept loop
-	if hasTLS {
-		go s.acceptLoop(s.tlsListener, ctx)
+	if tlsListener != nil {
+		go s.acceptLoop(tlsListener, ctx)
 	}
 
-	// Wait for shutdown signal
-	<-ctx.Done()
+	// Wait for shutdown signal or an explicit Shutdown call
+	select {
+	case <-ctx.Done():
+	case <-s.shutdownCh:
+	}
 	log.Println("Shutting down server...")
 
 	// Close listeners
@@ -126,18 +222,68 @@ func (s *Server) ListenAndServeContext(ctx context.Context) error {
 	s.running = false
 	s.mu.Unlock()
 
-	if s.listener != nil {
-		s.listener.Close()
+	if listener != nil {
+		listener.Close()
 	}
-	if s.tlsListener != nil {
-		s.tlsListener.Close()
+	if tlsListener != nil {
+		tlsListener.Close()
 	}
 
 	// Give active connections time to finish
-	time.Sleep(2 * time.Second)
+	time.Sleep(shutdownGracePeriod)
+
+	err := s.runShutdownHooks()
 	log.Println("Server stopped.")
 
-	return nil
+	s.mu.Lock()
+	s.stopErr = err
+	s.mu.Unlock()
+	close(stopped)
+	return err
+}
+
+// runShutdownHooks runs the OnShutdown hooks in order, then shuts down the
+// installed plugins, and joins their errors
+func (s *Server) runShutdownHooks() error {
+	s.mu.Lock()
+	hooks := s.hooks
+	s.mu.Unlock()
+
+	var errs []error
+	for _, hook := range hooks {
+		if err := hook(); err != nil {
+			log.Println("Shutdown hook failed:", err)
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, s.shutdownPlugins()...)
+	return errors.Join(errs...)
+}
+
+// listenTLS loads the certificate pair and opens the TLS listener
+func (s *Server) listenTLS(addrs listenAddrs) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(addrs.certFile, addrs.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	tlsConfig, err := s.TLSPreset.Config()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	if s.DebugConsole {
+		// HTTP stays the preferred protocol for clients offering both
+		tlsConfig.NextProtos = []string{"http/1.1", DebugALPN}
+	}
+	listener, err := net.Listen("tcp", addrs.tlsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on TLS %s: %w", addrs.tlsAddr, err)
+	}
+	if s.Router.config.ProxyProtocol {
+		// The preamble comes before the TLS handshake
+		listener = proxyListener{listener}
+	}
+	return tls.NewListener(listener, tlsConfig), nil
 }
 
 // acceptLoop accepts and handles connections.
@@ -149,6 +295,9 @@ func (s *Server) acceptLoop(listener net.Listener, ctx context.Context) {
 			case <-ctx.Done():
 				return
 			default:
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				// Only log if still running
 				s.mu.Lock()
 				running := s.running
@@ -159,27 +308,46 @@ func (s *Server) acceptLoop(listener net.Listener, ctx context.Context) {
 				continue
 			}
 		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			go s.serveTLS(tlsConn)
+			continue
+		}
 		go s.Router.RunConnection(conn)
 	}
 }
 
-// Shutdown gracefully stops the server.
+// Shutdown gracefully stops the server and waits, like ListenAndServe, for
+// active connections to finish and the OnShutdown hooks to run; it returns
+// their joined error. Called before the server is running, it returns nil
+// at once and makes the next ListenAndServe shut down as soon as it starts.
+// Hooks must not call it, since it waits for them.
 func (s *Server) Shutdown() error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if !s.running {
-		return nil
-	}
-
-	s.running = false
-
-	if s.listener != nil {
-		s.listener.Close()
+	if s.shutdownCh != nil {
+		select {
+		case <-s.shutdownCh:
+			// Already shutting down
+		default:
+			close(s.shutdownCh)
+		}
 	}
-	if s.tlsListener != nil {
-		s.tlsListener.Close()
+	if s.running {
+		s.running = false
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		if s.tlsListener != nil {
+			s.tlsListener.Close()
+		}
 	}
+	stopped := s.stopped
+	s.mu.Unlock()
 
-	return nil
+	if stopped == nil {
+		return nil
+	}
+	<-stopped
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopErr
 }
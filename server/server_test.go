@@ -1,9 +1,32 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 
 	"time"
 )
@@ -131,13 +154,12 @@ func TestParseRequestLine(t *testing.T) {
 }
 
 func TestParseHeaders(t *testing.T) {
-	headers := []string{
-		"Content-Type: application/json",
-		"Content-Length: 100",
-		"User-Agent: Mozilla/5.0",
+	raw := "GET / HTTP/1.1\r\nContent-Type: application/json\r\nContent-Length:100\r\nUser-Agent: \tMozilla/5.0 \r\n\r\n"
+	head, err := readRequestHead(bufio.NewReader(strings.NewReader(raw)), DefaultConfig(), nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	result := parseHeaders(headers)
+	result := head.headers
 
 	expected := map[string]string{
 		"Content-Type":   "application/json",
@@ -150,6 +172,13 @@ func TestParseHeaders(t *testing.T) {
 			t.Errorf("Expected %s=%s, got %s=%s", key, expectedValue, key, actualValue)
 		}
 	}
+
+	for _, line := range []string{"Bad-Space : x", "No-Colon", "X-Null: a\x00b", " Folded: x"} {
+		raw := "GET / HTTP/1.1\r\nHost: x\r\n" + line + "\r\n\r\n"
+		if _, err := readRequestHead(bufio.NewReader(strings.NewReader(raw)), DefaultConfig(), nil); err == nil {
+			t.Errorf("Expected %q to be rejected", line)
+		}
+	}
 }
 
 func TestDetectBrowser(t *testing.T) {
@@ -604,3 +633,4476 @@ func TestPostWithBody(t *testing.T) {
 		t.Error("Response should contain user name")
 	}
 }
+
+// mapResolver serves static files from memory
+type mapResolver map[string]string
+
+func (m mapResolver) Open(name string) (*StaticFile, error) {
+	content, ok := m[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &StaticFile{Content: []byte(content), ModTime: time.Unix(0, 0), Size: int64(len(content))}, nil
+}
+
+// Test pluggable static file resolver
+func TestFileResolver(t *testing.T) {
+	router := NewRouter()
+	router.SetFileResolver(mapResolver{"/hello.txt": "hello from memory"})
+
+	response, status := router.routeRequest(&Request{Method: "GET", Path: "/hello.txt"})
+	if status != "200" {
+		t.Errorf("Expected status 200, got %s", status)
+	}
+	if !strings.Contains(string(response), "hello from memory") {
+		t.Error("Response should contain resolver content")
+	}
+	if !strings.Contains(string(response), "Content-Type: text/plain") {
+		t.Error("Content-Type should be derived from the file extension")
+	}
+
+	_, status = router.routeRequest(&Request{Method: "GET", Path: "/missing.txt"})
+	if status != "404" {
+		t.Errorf("Expected status 404 for missing file, got %s", status)
+	}
+}
+
+// Test DirResolver path traversal protection
+func TestDirResolverTraversal(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := DirResolver(dir).Open("/a.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(file.Content) != "a" || file.Size != 1 {
+		t.Errorf("Unexpected file: %q size %d", file.Content, file.Size)
+	}
+
+	if _, err := DirResolver(dir).Open("/../../etc/passwd"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected fs.ErrPermission for traversal, got %v", err)
+	}
+}
+
+// Test gzip-encoded request bodies are decompressed before parsing
+func TestGzipRequestBody(t *testing.T) {
+	router := NewRouter()
+	router.Register("POST", "/submit", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("name="+req.Body["name"]))
+	})
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("name=gopher"))
+	zw.Close()
+
+	request := "POST /submit HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/x-www-form-urlencoded\r\n" +
+		"Content-Encoding: gzip\r\nContent-Length: " + strconv.Itoa(compressed.Len()) + "\r\n\r\n" + compressed.String()
+
+	response, status, _ := router.processRequest(nil, []byte(request))
+	if status != "200" {
+		t.Fatalf("Expected status 200, got %s", status)
+	}
+	if !strings.Contains(string(response), "name=gopher") {
+		t.Errorf("Expected decoded body, got %q", response)
+	}
+
+	// Decompressed size is capped
+	if _, err := decodeRequestBody("gzip", compressed.Bytes(), 4); !errors.Is(err, errBodyTooLarge) {
+		t.Errorf("Expected errBodyTooLarge, got %v", err)
+	}
+}
+
+// Test pagination parsing and headers
+func TestPagination(t *testing.T) {
+	opts := PaginationOptions{MaxLimit: 50, SortFields: []string{"name", "created"}}
+
+	p, err := ParsePagination(map[string]string{"limit": "10", "offset": "20", "sort": "name,-created"}, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p.Limit != 10 || p.Offset != 20 {
+		t.Errorf("Expected limit=10 offset=20, got limit=%d offset=%d", p.Limit, p.Offset)
+	}
+	if len(p.Sort) != 2 || p.Sort[1].Field != "created" || !p.Sort[1].Desc {
+		t.Errorf("Unexpected sort fields: %+v", p.Sort)
+	}
+
+	invalid := []map[string]string{
+		{"limit": "0"},
+		{"limit": "51"},
+		{"offset": "-1"},
+		{"sort": "password"},
+		{"cursor": "abc", "offset": "10"},
+	}
+	for _, query := range invalid {
+		if _, err := ParsePagination(query, opts); err == nil {
+			t.Errorf("Expected error for query %v", query)
+		}
+	}
+
+	headers := p.Headers("/items", map[string]string{"limit": "10", "offset": "20"}, 45)
+	if headers["X-Total-Count"] != "45" {
+		t.Errorf("Expected X-Total-Count 45, got %s", headers["X-Total-Count"])
+	}
+	for _, part := range []string{
+		`</items?limit=10&offset=0>; rel="first"`,
+		`</items?limit=10&offset=10>; rel="prev"`,
+		`</items?limit=10&offset=30>; rel="next"`,
+		`</items?limit=10&offset=40>; rel="last"`,
+	} {
+		if !strings.Contains(headers["Link"], part) {
+			t.Errorf("Link header missing %s: %s", part, headers["Link"])
+		}
+	}
+
+	response, _ := CreateResponseBytesWithHeaders("200", "application/json", "OK", headers, []byte("[]"))
+	if !strings.Contains(string(response), "\r\nX-Total-Count: 45\r\n") {
+		t.Error("Response should contain pagination headers")
+	}
+
+	// Links generated for a cursor request parse back as offset requests
+	linked := p.Headers("/items", map[string]string{"cursor": "abc", "limit": "10"}, 45)
+	var next string
+	for _, link := range strings.Split(linked["Link"], ", ") {
+		if target, found := strings.CutSuffix(link, `>; rel="next"`); found {
+			next = strings.TrimPrefix(target, "<")
+		}
+	}
+	_, rawQuery, _ := strings.Cut(next, "?")
+	followed, err := ParsePagination(parseKeyValuePairsFromBytes([]byte(rawQuery)), opts)
+	if err != nil || followed.Offset != 30 || followed.Cursor != "" {
+		t.Errorf("Expected the next link %q to parse at offset 30, got %+v %v", next, followed, err)
+	}
+
+	unlimited := Pagination{}.Headers("/items", nil, 45)
+	if _, hasLink := unlimited["Link"]; hasLink || unlimited["X-Total-Count"] != "45" {
+		t.Errorf("Expected only X-Total-Count without a limit, got %v", unlimited)
+	}
+}
+
+// Test header and query matchers select between routes on the same path
+func TestRouteMatchers(t *testing.T) {
+	router := NewRouter()
+	router.Register("GET", "/api/items", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("default"))
+	})
+	router.Register("GET", "/api/items", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("v2"))
+	}, WithHeader("X-API-Version", "2"))
+	router.Register("POST", "/api/items/:id", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("json "+req.PathParams["id"]))
+	}, WithHeader("Content-Type", "application/json"))
+	router.Register("GET", "/search", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("legacy"))
+	}, WithQuery("format", "legacy"))
+
+	tests := []struct {
+		method   string
+		path     string
+		query    map[string]string
+		headers  map[string]string
+		status   string
+		expected string
+	}{
+		{"GET", "/api/items", nil, nil, "200", "default"},
+		{"GET", "/api/items", nil, map[string]string{"x-api-version": "2"}, "200", "v2"},
+		{"GET", "/api/items", nil, map[string]string{"X-API-Version": "3"}, "200", "default"},
+		{"POST", "/api/items/7", nil, map[string]string{"Content-Type": "application/json; charset=utf-8"}, "200", "json 7"},
+		{"POST", "/api/items/7", nil, map[string]string{"Content-Type": "text/plain"}, "404", ""},
+		{"GET", "/search", map[string]string{"format": "legacy"}, nil, "200", "legacy"},
+		{"GET", "/search", nil, nil, "404", ""},
+	}
+
+	for _, test := range tests {
+		req := &Request{Method: test.method, Path: test.path, Query: test.query, Headers: test.headers}
+		response, status := router.dispatch(req)
+		if status != test.status {
+			t.Errorf("%s %s %v: expected status %s, got %s", test.method, test.path, test.headers, test.status, status)
+			continue
+		}
+		if test.expected != "" && !strings.HasSuffix(string(response), test.expected) {
+			t.Errorf("%s %s %v: expected body %q, got %q", test.method, test.path, test.headers, test.expected, response)
+		}
+	}
+}
+
+// Test API versioning adds deprecation headers and counts usage
+func TestAPIVersioning(t *testing.T) {
+	sunset := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := PathVersioning("version").Versions("v2").Deprecate("v1", time.Unix(1700000000, 0), sunset)
+
+	router := NewRouter()
+	router.Register("GET", "/api/:version/users", versions.Wrap(func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("users"))
+	}))
+
+	response, status := router.Handle("GET", "/api/v1/users", nil, nil, "Chrome")
+	if status != "200" {
+		t.Fatalf("Expected status 200, got %s", status)
+	}
+	for _, part := range []string{"\r\nDeprecation: @1700000000\r\n", "\r\nSunset: Tue, 01 Jan 2030 00:00:00 GMT\r\n", "\r\n\r\nusers"} {
+		if !strings.Contains(response, part) {
+			t.Errorf("Response missing %q: %q", part, response)
+		}
+	}
+
+	response, _ = router.Handle("GET", "/api/v2/users", nil, nil, "Chrome")
+	if strings.Contains(response, "Deprecation") {
+		t.Error("Current version should not be marked deprecated")
+	}
+
+	for _, version := range []string{"v3", "v4"} {
+		router.Handle("GET", "/api/"+version+"/users", nil, nil, "Chrome")
+	}
+
+	usage := versions.Usage()
+	if len(usage) != 3 || usage["v1"] != 1 || usage["v2"] != 1 || usage["unknown"] != 2 {
+		t.Errorf("Unexpected usage counts: %v", usage)
+	}
+
+	byHeader := HeaderVersioning("X-API-Version", "1")
+	if v := byHeader.Version(&Request{Headers: map[string]string{"X-API-Version": "2"}}); v != "2" {
+		t.Errorf("Expected header version 2, got %s", v)
+	}
+	if v := byHeader.Version(&Request{}); v != "1" {
+		t.Errorf("Expected default version 1, got %s", v)
+	}
+}
+
+// Test static extension allow/deny lists
+func TestStaticExtensionFilter(t *testing.T) {
+	files := mapResolver{"/main.go": "package main", "/.env": "SECRET=1", "/app.js": "js", "/logo.png": "png"}
+
+	router := NewRouter()
+	router.SetFileResolver(files)
+
+	tests := []struct {
+		path   string
+		status string
+	}{
+		{"/main.go", "404"},
+		{"/.env", "404"},
+		{"/app.js", "200"},
+		{"/logo.png", "200"},
+	}
+	for _, test := range tests {
+		if _, status := router.routeRequest(&Request{Method: "GET", Path: test.path}); status != test.status {
+			t.Errorf("%s: expected status %s, got %s", test.path, test.status, status)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.StaticAllowedExtensions = []string{".PNG"}
+	cfg.StaticDeniedExtensions = []string{}
+	router = NewRouterWithConfig(cfg)
+	router.SetFileResolver(files)
+
+	if _, status := router.routeRequest(&Request{Method: "GET", Path: "/logo.png"}); status != "200" {
+		t.Errorf("Allowed extension should be served, got %s", status)
+	}
+	if _, status := router.routeRequest(&Request{Method: "GET", Path: "/app.js"}); status != "404" {
+		t.Errorf("Extension outside the allow-list should not be served, got %s", status)
+	}
+}
+
+// Test trailing slashes and dot segments don't slip past the filters
+func TestStaticFilterBypass(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main"), 0o644)
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("SECRET=1"), 0o644)
+
+	router := NewRouter()
+	router.SetFileResolver(DirResolver(dir))
+	for _, path := range []string{"/main.go", "/main.go/", "/main.go//", "/main.go/.", "/.env/"} {
+		if _, status := router.routeRequest(&Request{Method: "GET", Path: path}); status != "404" {
+			t.Errorf("%s: expected status 404, got %s", path, status)
+		}
+	}
+}
+
+// Test dotfile and hidden directory blocking
+func TestDotfileBlocking(t *testing.T) {
+	files := mapResolver{
+		"/.git/config":                    "[core]",
+		"/.hidden/page.html":              "hidden",
+		"/.well-known/security.txt":       "Contact: security@example.com",
+		"/assets/.DS_Store":               "junk",
+		"/assets/app.css":                 "body{}",
+		"/.well-known/acme-challenge/tok": "token",
+	}
+
+	router := NewRouter()
+	router.SetFileResolver(files)
+
+	tests := []struct {
+		path   string
+		status string
+	}{
+		{"/.git/config", "404"},
+		{"/.hidden/page.html", "404"},
+		{"/assets/.DS_Store", "404"},
+		{"/assets/app.css", "200"},
+		{"/.well-known/security.txt", "200"},
+		{"/.well-known/acme-challenge/tok", "200"},
+	}
+	for _, test := range tests {
+		if _, status := router.routeRequest(&Request{Method: "GET", Path: test.path}); status != test.status {
+			t.Errorf("%s: expected status %s, got %s", test.path, test.status, status)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.AllowDotfiles = true
+	router = NewRouterWithConfig(cfg)
+	router.SetFileResolver(files)
+	if _, status := router.routeRequest(&Request{Method: "GET", Path: "/.hidden/page.html"}); status != "200" {
+		t.Errorf("AllowDotfiles should serve hidden paths, got %s", status)
+	}
+}
+
+// Test RFC 3986 dot-segment removal and slash collapsing
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"/users/42", "/users/42"},
+		{"//users//42", "/users/42"},
+		{"/a/./b", "/a/b"},
+		{"/a/b/../c", "/a/c"},
+		{"/a/b/..", "/a/"},
+		{"/../../etc/passwd", "/etc/passwd"},
+		{"/docs/", "/docs/"},
+		{"/.", "/"},
+		{"*", "*"},
+	}
+
+	for _, test := range tests {
+		if result := normalizePath(test.input); result != test.expected {
+			t.Errorf("normalizePath(%q): expected %q, got %q", test.input, test.expected, result)
+		}
+	}
+}
+
+// Test non-canonical paths are routed or redirected
+func TestPathNormalizationRouting(t *testing.T) {
+	handler := func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("user "+req.PathParams["id"]))
+	}
+
+	router := NewRouter()
+	router.Register("GET", "/users/:id", handler)
+	response, status, _ := router.processRequest(nil, []byte("GET //users/./x/../42 HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if status != "200" || !strings.Contains(string(response), "user 42") {
+		t.Errorf("Expected normalized route match, got %s %q", status, response)
+	}
+
+	cfg := DefaultConfig()
+	cfg.RedirectNormalizedPaths = true
+	router = NewRouterWithConfig(cfg)
+	router.Register("GET", "/users/:id", handler)
+	response, status, _ = router.processRequest(nil, []byte("GET //users/42?tab=posts HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if status != "301" {
+		t.Fatalf("Expected status 301, got %s", status)
+	}
+	if !strings.Contains(string(response), "\r\nLocation: /users/42?tab=posts\r\n") {
+		t.Errorf("Expected Location header, got %q", response)
+	}
+}
+
+// Test TLS-only servers report certificate errors instead of starting, and
+// the listen methods use the addresses they are given
+func TestListenAndServeTLSMissingCert(t *testing.T) {
+	srv := NewServer(":0")
+	dir := t.TempDir()
+
+	err := srv.ListenAndServeTLS("127.0.0.1:0", filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key"))
+	if err == nil || !strings.Contains(err.Error(), "TLS certificate") {
+		t.Errorf("Expected certificate error, got %v", err)
+	}
+	if srv.Addr != ":0" || srv.TLSAddr != "" || srv.TLSCertFile != "" {
+		t.Errorf("Expected ListenAndServeTLS to leave the server's addresses alone, got %q %q %q", srv.Addr, srv.TLSAddr, srv.TLSCertFile)
+	}
+
+	blocker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer blocker.Close()
+	err = srv.ListenAndServe(blocker.Addr().String())
+	if err == nil || !strings.Contains(err.Error(), blocker.Addr().String()) {
+		t.Errorf("Expected ListenAndServe to listen on the given address, got %v", err)
+	}
+}
+
+// Test Router.Serve returns once its listener is closed
+func TestServeReturnsOnClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create listener: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- NewRouter().Serve(listener) }()
+	listener.Close()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after listener close")
+	}
+}
+
+// Test upload progress is reported while the body arrives
+func TestUploadProgress(t *testing.T) {
+	tracker := NewUploadProgress()
+	var reports []int64
+
+	router := NewRouter()
+	router.OnBodyProgress(func(token string, received, total int64) {
+		reports = append(reports, received)
+		tracker.Update(token, received, total)
+	})
+	router.Register("POST", "/upload", func(req *Request) ([]byte, string) {
+		return Serve201("stored")
+	})
+	router.Register("GET", "/upload/progress/:token", tracker.Handler())
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	defer serverConn.Close()
+	go func() {
+		client.Write([]byte("fghij"))
+	}()
+
+	request := "POST /upload?upload_token=abc HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabcde"
+	_, status, _ := router.processRequest(serverConn, []byte(request))
+	if status != "201" {
+		t.Fatalf("Expected status 201, got %s", status)
+	}
+	if len(reports) < 2 || reports[0] != 5 || reports[len(reports)-1] != 10 {
+		t.Errorf("Unexpected progress reports: %v", reports)
+	}
+
+	response, status := router.Handle("GET", "/upload/progress/abc", nil, nil, "Chrome")
+	if status != "200" || !strings.Contains(response, `{"received":10,"total":10}`) {
+		t.Errorf("Unexpected progress response %s: %q", status, response)
+	}
+
+	if _, status := router.Handle("GET", "/upload/progress/unknown", nil, nil, "Chrome"); status != "404" {
+		t.Errorf("Expected 404 for unknown token, got %s", status)
+	}
+
+	router.HandleFunc("GET", "/upload/events/:token", tracker.Events(5*time.Millisecond), WriteThrough())
+	tracker.Update("def", 4, 10)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		tracker.Update("def", 10, 10)
+	}()
+	response, status = router.Handle("GET", "/upload/events/def", nil, nil, "Chrome")
+	head, body, _ := splitResponse([]byte(response))
+	if status != "200" || responseHeader(head, "Content-Type") != "text/event-stream" ||
+		string(body) != "data: {\"received\":4,\"total\":10}\n\ndata: {\"received\":10,\"total\":10}\n\n" {
+		t.Errorf("Unexpected progress events %s: %q", status, response)
+	}
+	if _, status := router.Handle("GET", "/upload/events/unknown", nil, nil, "Chrome"); status != "404" {
+		t.Errorf("Expected 404 events for unknown token, got %s", status)
+	}
+
+	clock := NewFakeClock(time.Now())
+	bounded := NewUploadProgress()
+	bounded.Clock = clock
+	for i := 0; i <= maxTrackedUploads; i++ {
+		bounded.Update(strconv.Itoa(i), 1, 2)
+	}
+	if _, _, ok := bounded.Get("0"); ok {
+		t.Error("Expected the oldest token to be evicted once the tracker is full")
+	}
+	if _, _, ok := bounded.Get("1"); !ok {
+		t.Error("Expected later tokens to stay tracked")
+	}
+	clock.Advance(uploadTTL + time.Second)
+	if _, _, ok := bounded.Get("1"); ok {
+		t.Error("Expected a token to expire after uploadTTL")
+	}
+}
+
+// Test middleware ordering and static opt-in
+func TestMiddlewareChain(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next RouteHandler) RouteHandler {
+			return func(req *Request) ([]byte, string) {
+				order = append(order, name)
+				response, status := next(req)
+				return AddResponseHeaders(response, map[string]string{"X-" + name: "1"}), status
+			}
+		}
+	}
+
+	router := NewRouter()
+	router.SetFileResolver(mapResolver{"/app.css": "body{}"})
+	router.Use(tag("First"), tag("Second"))
+	router.Register("GET", "/users/:id", func(req *Request) ([]byte, string) {
+		order = append(order, "handler")
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.PathParams["id"]))
+	})
+
+	response, _ := router.Handle("GET", "/users/1", nil, nil, "Chrome")
+	if strings.Join(order, ",") != "First,Second,handler" {
+		t.Errorf("Unexpected middleware order: %v", order)
+	}
+	if !strings.Contains(response, "X-First: 1") || !strings.Contains(response, "X-Second: 1") {
+		t.Errorf("Middleware headers missing: %q", response)
+	}
+
+	static, _ := router.routeRequest(&Request{Method: "GET", Path: "/app.css"})
+	if strings.Contains(string(static), "X-First") {
+		t.Error("Middleware should not wrap static files by default")
+	}
+
+	router.ApplyMiddlewareToStatic(true)
+	static, _ = router.routeRequest(&Request{Method: "GET", Path: "/app.css"})
+	if !strings.Contains(string(static), "X-First: 1") {
+		t.Error("Middleware should wrap static files when enabled")
+	}
+}
+
+// Test disk storage round trip and serving it as static files
+func TestDiskStorage(t *testing.T) {
+	store, err := NewDiskStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	if err := store.Put("avatars/42.png", strings.NewReader("png-bytes"), 9); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put("../escape.txt", strings.NewReader("x"), 1); err == nil {
+		t.Error("Expected error for key escaping the root")
+	}
+
+	body, info, err := store.Get("avatars/42.png")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	content, _ := io.ReadAll(body)
+	body.Close()
+	if string(content) != "png-bytes" || info.Size != 9 {
+		t.Errorf("Unexpected object %q size %d", content, info.Size)
+	}
+
+	objects, err := store.List("avatars/")
+	if err != nil || len(objects) != 1 || objects[0].Key != "avatars/42.png" {
+		t.Errorf("Unexpected listing %v (err %v)", objects, err)
+	}
+
+	router := NewRouter()
+	router.SetFileResolver(StorageResolver{Storage: store})
+	if _, status := router.routeRequest(&Request{Method: "GET", Path: "/avatars/42.png"}); status != "200" {
+		t.Errorf("Expected stored object to be served, got %s", status)
+	}
+
+	if err := store.Delete("avatars/42.png"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, _, err := store.Get("avatars/42.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist after delete, got %v", err)
+	}
+}
+
+// Test S3 storage sends signed path-style requests
+func TestS3Storage(t *testing.T) {
+	objects := map[string]string{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			objects[key] = string(data)
+		case http.MethodGet:
+			if r.URL.Query().Get("list-type") == "2" {
+				fmt.Fprint(w, `<ListBucketResult><Contents><Key>docs/a.txt</Key><Size>5</Size></Contents></ListBucketResult>`)
+				return
+			}
+			data, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, data)
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer backend.Close()
+
+	store := &S3Storage{Endpoint: backend.URL, Region: "us-east-1", Bucket: "bucket", AccessKey: "AKID", SecretKey: "secret"}
+
+	if err := store.Put("docs/a.txt", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	body, _, err := store.Get("docs/a.txt")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	content, _ := io.ReadAll(body)
+	body.Close()
+	if string(content) != "hello" {
+		t.Errorf("Expected hello, got %q", content)
+	}
+
+	listing, err := store.List("docs/")
+	if err != nil || len(listing) != 1 || listing[0].Key != "docs/a.txt" {
+		t.Errorf("Unexpected listing %v (err %v)", listing, err)
+	}
+
+	if err := store.Delete("docs/a.txt"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, _, err := store.Get("docs/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+// Test catch-all route segments
+func TestCatchAllRoutes(t *testing.T) {
+	tests := []struct {
+		pattern     string
+		path        string
+		shouldMatch bool
+		expected    map[string]string
+	}{
+		{"/assets/*path", "/assets/css/app.css", true, map[string]string{"path": "css/app.css"}},
+		{"/assets/*path", "/assets/logo.png", true, map[string]string{"path": "logo.png"}},
+		{"/assets/*path", "/assets", true, map[string]string{"path": ""}},
+		{"/repos/:owner/*file", "/repos/go/src/net/http.go", true, map[string]string{"owner": "go", "file": "src/net/http.go"}},
+		{"/*", "/anything/at/all", true, map[string]string{"*": "anything/at/all"}},
+		{"/assets/*path", "/images/logo.png", false, nil},
+	}
+
+	for _, test := range tests {
+		params, matched := matchRoute(test.path, test.pattern)
+		if matched != test.shouldMatch {
+			t.Errorf("Pattern %s, path %s: expected matched=%v", test.pattern, test.path, test.shouldMatch)
+			continue
+		}
+		for key, expected := range test.expected {
+			if params[key] != expected {
+				t.Errorf("Pattern %s, path %s: expected %s=%q, got %q", test.pattern, test.path, key, expected, params[key])
+			}
+		}
+	}
+
+	router := NewRouter()
+	router.Register("GET", "/files/*path", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.PathParams["path"]))
+	})
+	response, status := router.Handle("GET", "/files/a/b/c.txt", nil, nil, "Chrome")
+	if status != "200" || !strings.HasSuffix(response, "a/b/c.txt") {
+		t.Errorf("Unexpected catch-all response %s: %q", status, response)
+	}
+}
+
+// Test fake clock drives time-dependent features without sleeping
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	clock.Advance(90 * time.Minute)
+	if got := clock.Now(); !got.Equal(start.Add(90 * time.Minute)) {
+		t.Errorf("Expected %v, got %v", start.Add(90*time.Minute), got)
+	}
+
+	versions := PathVersioning("version")
+	versions.Clock = clock
+	versions.Deprecate("v1", time.Time{}, time.Time{})
+
+	router := NewRouter()
+	router.Register("GET", "/:version/ping", versions.Wrap(func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("pong"))
+	}))
+	response, _ := router.Handle("GET", "/v1/ping", nil, nil, "Chrome")
+	expected := "Deprecation: @" + strconv.FormatInt(start.Add(90*time.Minute).Unix(), 10)
+	if !strings.Contains(response, expected) {
+		t.Errorf("Expected %q in %q", expected, response)
+	}
+}
+
+// Test writer-based handlers with custom headers
+func TestResponseWriterHandler(t *testing.T) {
+	router := NewRouter()
+	router.HandleFunc("GET", "/report", func(w ResponseWriter, req *Request) {
+		w.SetHeader("Content-Type", "text/csv")
+		w.SetHeader("Cache-Control", "no-store")
+		w.WriteHeader(202)
+		w.WriteHeader(500) // ignored
+		w.Write([]byte("a,b\n"))
+		w.Write([]byte("1,2\n"))
+	})
+	router.HandleFunc("GET", "/implicit", func(w ResponseWriter, req *Request) {
+		w.Write([]byte("ok"))
+	})
+
+	response, status := router.Handle("GET", "/report", nil, nil, "Chrome")
+	if status != "202" {
+		t.Errorf("Expected status 202, got %s", status)
+	}
+	for _, part := range []string{"HTTP/1.1 202 Accepted", "Content-Type: text/csv", "Cache-Control: no-store", "Content-Length: 8", "a,b\n1,2\n"} {
+		if !strings.Contains(response, part) {
+			t.Errorf("Response missing %q: %q", part, response)
+		}
+	}
+
+	response, status = router.Handle("GET", "/implicit", nil, nil, "Chrome")
+	if status != "200" || !strings.Contains(response, "HTTP/1.1 200 OK") {
+		t.Errorf("Expected implicit 200, got %s %q", status, response)
+	}
+}
+
+// Test headers, protocol, remote address and TLS state reach handlers
+func TestRequestConnectionInfo(t *testing.T) {
+	var captured *Request
+	router := NewRouter()
+	router.Register("GET", "/whoami", func(req *Request) ([]byte, string) {
+		captured = req
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	defer serverConn.Close()
+
+	request := "GET /whoami HTTP/1.0\r\nHost: example.com\r\nX-Token: secret\r\n\r\n"
+	if _, status, _ := router.processRequest(serverConn, []byte(request)); status != "200" {
+		t.Fatalf("Expected status 200, got %s", status)
+	}
+
+	if captured.Headers["X-Token"] != "secret" || captured.Headers["Host"] != "example.com" {
+		t.Errorf("Headers not populated: %v", captured.Headers)
+	}
+	if captured.Proto != "HTTP/1.0" {
+		t.Errorf("Expected Proto HTTP/1.0, got %s", captured.Proto)
+	}
+	if captured.RemoteAddr != serverConn.RemoteAddr().String() {
+		t.Errorf("Expected RemoteAddr %s, got %s", serverConn.RemoteAddr(), captured.RemoteAddr)
+	}
+	if captured.TLS {
+		t.Error("Plain connection reported as TLS")
+	}
+}
+
+// Test deterministic random source and ID helpers
+func TestRandomIDs(t *testing.T) {
+	a := NewRequestID(NewDeterministicRandom(42))
+	b := NewRequestID(NewDeterministicRandom(42))
+	if a != b {
+		t.Errorf("Same seed should produce the same ID: %s vs %s", a, b)
+	}
+	if len(a) != 32 {
+		t.Errorf("Expected 32 hex characters, got %d", len(a))
+	}
+	if NewToken(nil) == NewToken(nil) {
+		t.Error("Crypto tokens should differ")
+	}
+	if len(NewToken(nil)) != 43 {
+		t.Errorf("Expected 43 character token, got %d", len(NewToken(nil)))
+	}
+	if id := NewRequestID(iotest.OneByteReader(strings.NewReader(strings.Repeat("\xff", 16)))); id != strings.Repeat("f", 32) {
+		t.Errorf("Expected short reads to be retried until the ID is filled, got %s", id)
+	}
+
+	router := NewRouter()
+	router.Use(RequestID(NewDeterministicRandom(7)))
+	var seen string
+	router.Register("GET", "/ping", func(req *Request) ([]byte, string) {
+		seen = req.Headers["X-Request-Id"]
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("pong"))
+	})
+
+	response, _ := router.Handle("GET", "/ping", nil, nil, "Chrome")
+	expected := NewRequestID(NewDeterministicRandom(7))
+	if seen != expected || !strings.Contains(response, "X-Request-Id: "+expected) {
+		t.Errorf("Expected request ID %s, handler saw %s, response %q", expected, seen, response)
+	}
+
+	kept, _ := router.dispatch(&Request{Method: "GET", Path: "/ping", Headers: map[string]string{"X-Request-Id": "client-id.1"}})
+	if !strings.Contains(string(kept), "X-Request-Id: client-id.1") {
+		t.Errorf("Well-formed client ID should be kept: %q", kept)
+	}
+	replaced, _ := router.dispatch(&Request{Method: "GET", Path: "/ping", Headers: map[string]string{"X-Request-Id": "bad\r\nid"}})
+	if strings.Contains(string(replaced), "bad") {
+		t.Errorf("Malformed client ID should be replaced: %q", replaced)
+	}
+}
+
+// Test fault injection truncates and resets connections
+func TestFaultInjection(t *testing.T) {
+	serve := func(faults *FaultConfig) string {
+		cfg := DefaultConfig()
+		cfg.Faults = faults
+		router := NewRouterWithConfig(cfg)
+		router.Register("GET", "/data", func(req *Request) ([]byte, string) {
+			return CreateResponseBytes("200", "text/plain", "OK", []byte(strings.Repeat("x", 100)))
+		})
+
+		client, serverConn := net.Pipe()
+		defer client.Close()
+		go router.RunConnection(serverConn)
+
+		client.SetDeadline(time.Now().Add(time.Second))
+		client.Write([]byte("GET /data HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+		response, _ := io.ReadAll(client)
+		return string(response)
+	}
+
+	if response := serve(&FaultConfig{}); !strings.HasSuffix(response, strings.Repeat("x", 100)) {
+		t.Errorf("No faults configured, expected full response: %q", response)
+	}
+
+	truncated := serve(&FaultConfig{TruncateProbability: 1})
+	if truncated == "" || strings.HasSuffix(truncated, strings.Repeat("x", 100)) {
+		t.Errorf("Expected truncated response, got %d bytes", len(truncated))
+	}
+
+	if response := serve(&FaultConfig{ResetProbability: 1}); response != "" {
+		t.Errorf("Expected reset connection, got %q", response)
+	}
+
+	start := time.Now()
+	serve(&FaultConfig{DelayProbability: 1, MaxDelay: 20 * time.Millisecond, Random: NewDeterministicRandom(1)})
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("Injected delays should stay below MaxDelay per call")
+	}
+}
+
+// Test raw body is preserved for nested JSON and binary payloads
+func TestRequestRawBody(t *testing.T) {
+	var captured *Request
+	router := NewRouter()
+	router.Register("POST", "/upload", func(req *Request) ([]byte, string) {
+		captured = req
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	defer serverConn.Close()
+
+	body := `{"user":{"name":"ada"},"tags":["a","b"]}`
+	request := fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	if _, status, _ := router.processRequest(serverConn, []byte(request)); status != "200" {
+		t.Fatalf("Expected status 200, got %s", status)
+	}
+
+	if string(captured.RawBody) != body {
+		t.Errorf("Expected raw body %q, got %q", body, captured.RawBody)
+	}
+	var decoded struct {
+		User struct{ Name string }
+		Tags []string
+	}
+	if err := json.NewDecoder(captured.BodyReader()).Decode(&decoded); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.User.Name != "ada" || len(decoded.Tags) != 2 {
+		t.Errorf("Unexpected decoded body: %+v", decoded)
+	}
+}
+
+// Test OnShutdown hooks run in order after Shutdown
+func TestOnShutdownHooks(t *testing.T) {
+	defer func(period time.Duration) { shutdownGracePeriod = period }(shutdownGracePeriod)
+	shutdownGracePeriod = 0
+
+	var order []string
+	srv := NewServer("127.0.0.1:0")
+	srv.OnShutdown(func() error {
+		order = append(order, "db")
+		return errors.New("db close failed")
+	}).OnShutdown(func() error {
+		order = append(order, "logs")
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe("") }()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		srv.mu.Lock()
+		running := srv.running
+		srv.mu.Unlock()
+		if running || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := srv.Shutdown(); err == nil || !strings.Contains(err.Error(), "db close failed") {
+		t.Errorf("Expected Shutdown to wait for the hooks and return their error, got %v", err)
+	}
+	if strings.Join(order, ",") != "db,logs" {
+		t.Errorf("Expected the hooks to have run when Shutdown returns, got %v", order)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "db close failed") {
+			t.Errorf("Expected hook error to be returned, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenAndServe did not return after Shutdown")
+	}
+	if strings.Join(order, ",") != "db,logs" {
+		t.Errorf("Expected hooks in registration order, got %v", order)
+	}
+}
+
+// Test a Shutdown that comes before the server is running still stops it
+func TestShutdownBeforeServe(t *testing.T) {
+	defer func(period time.Duration) { shutdownGracePeriod = period }(shutdownGracePeriod)
+	shutdownGracePeriod = 0
+
+	srv := NewServer("127.0.0.1:0")
+	if err := srv.Shutdown(); err != nil {
+		t.Errorf("Expected an early Shutdown to return nil, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe("") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected a clean stop, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenAndServe did not return after an early Shutdown")
+	}
+}
+
+// Test chunked Transfer-Encoding request bodies are decoded
+func TestChunkedRequestBody(t *testing.T) {
+	var captured *Request
+	router := NewRouter()
+	router.Register("POST", "/submit", func(req *Request) ([]byte, string) {
+		captured = req
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	defer serverConn.Close()
+
+	// First chunk arrives with the headers, the rest streams in afterwards
+	head := "POST /submit HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nContent-Type: application/x-www-form-urlencoded\r\n\r\n5;ext=1\r\nname=\r\n"
+	go client.Write([]byte("3\r\nada\r\n0\r\nX-Trailer: yes\r\n\r\n"))
+
+	if _, status, _ := router.processRequest(serverConn, []byte(head)); status != "200" {
+		t.Fatalf("Expected status 200, got %s", status)
+	}
+	if string(captured.RawBody) != "name=ada" || captured.Body["name"] != "ada" {
+		t.Errorf("Expected decoded body name=ada, got %q", captured.RawBody)
+	}
+
+	malformed := "POST /submit HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nabc\r\n0\r\n\r\n"
+	if _, status, _ := router.processRequest(serverConn, []byte(malformed)); status != "400" {
+		t.Errorf("Expected 400 for malformed chunk size, got %s", status)
+	}
+
+	cfg := DefaultConfig()
+	cfg.MaxBodySize = 4
+	limited := NewRouterWithConfig(cfg)
+	oversized := "POST /submit HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n8\r\n12345678\r\n0\r\n\r\n"
+	if _, status, _ := limited.processRequest(serverConn, []byte(oversized)); status != "413" {
+		t.Errorf("Expected 413 for oversized chunked body, got %s", status)
+	}
+
+	notFinal := "POST /submit HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked, gzip\r\nContent-Length: 3\r\n\r\nabc"
+	if _, status, closeConn := router.processRequest(serverConn, []byte(notFinal)); status != "400" || !closeConn {
+		t.Errorf("Expected 400 closing the connection when chunked isn't final, got %s close=%v", status, closeConn)
+	}
+	both := "POST /submit HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\nContent-Length: 99\r\n\r\n3\r\nabc\r\n0\r\n\r\n"
+	if _, status, closeConn := router.processRequest(serverConn, []byte(both)); status != "200" || !closeConn {
+		t.Errorf("Expected chunked framing to win and the connection to close, got %s close=%v", status, closeConn)
+	}
+}
+
+// Test route docs are listed by Routes and automatic OPTIONS responses
+func TestRouteDocs(t *testing.T) {
+	router := NewRouter()
+	handler := func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	}
+	router.Register("GET", "/users/:id", handler, WithDoc("Fetch a user by id"))
+	router.Register("DELETE", "/users/:id", handler, WithDoc("Delete a user"))
+	router.Register("GET", "/health", handler)
+	router.Register("GET", "/debug/routes", router.RoutesHandler())
+
+	routes := router.Routes()
+	if len(routes) != 4 || routes[2].Path != "/users/:id" || routes[2].Method != "DELETE" || routes[3].Doc != "Fetch a user by id" {
+		t.Errorf("Unexpected routes: %+v", routes)
+	}
+
+	response, status := router.dispatch(&Request{Method: "GET", Path: "/debug/routes"})
+	if status != "200" || !strings.Contains(string(response), `"doc":"Delete a user"`) {
+		t.Errorf("Expected route listing, got %s: %s", status, response)
+	}
+
+	response, status = router.dispatch(&Request{Method: "OPTIONS", Path: "/users/42"})
+	if status != "200" {
+		t.Fatalf("Expected 200 for OPTIONS, got %s", status)
+	}
+	if !strings.Contains(string(response), "Allow: DELETE, GET, HEAD, OPTIONS\r\n") {
+		t.Errorf("Expected Allow header, got %s", response)
+	}
+	if !strings.Contains(string(response), `"doc":"Fetch a user by id"`) {
+		t.Errorf("Expected docs in OPTIONS body, got %s", response)
+	}
+
+	if _, status := router.dispatch(&Request{Method: "OPTIONS", Path: "/missing"}); status != "404" {
+		t.Errorf("Expected 404 for OPTIONS on unknown path, got %s", status)
+	}
+}
+
+// Test Flush streams a chunked response over the connection
+func TestStreamingResponse(t *testing.T) {
+	router := NewRouter()
+	router.HandleFunc("GET", "/export", func(w ResponseWriter, req *Request) {
+		w.SetHeader("Content-Type", "text/csv")
+		for i := range 3 {
+			fmt.Fprintf(w, "row%d\n", i)
+			if err := w.Flush(); err != nil {
+				t.Errorf("Flush failed: %v", err)
+			}
+		}
+		w.Write([]byte("done\n"))
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+
+	client.SetDeadline(time.Now().Add(time.Second))
+	client.Write([]byte("GET /export HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("Expected chunked Transfer-Encoding, got %v", resp.TransferEncoding)
+	}
+	if resp.Header.Get("Content-Type") != "text/csv" {
+		t.Errorf("Expected text/csv, got %s", resp.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "row0\nrow1\nrow2\ndone\n" {
+		t.Errorf("Unexpected streamed body %q", body)
+	}
+
+	// The connection stays usable for the next request
+	client.Write([]byte("GET /export HTTP/1.0\r\nHost: localhost\r\n\r\n"))
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read second response: %v", err)
+	}
+	if resp.ContentLength != int64(len("row0\nrow1\nrow2\ndone\n")) {
+		t.Errorf("HTTP/1.0 responses should stay buffered, got length %d", resp.ContentLength)
+	}
+}
+
+// Test NoCompress and NoCache routes skip the global middleware
+func TestRouteMiddlewareOptOut(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	cache := NewResponseCache(time.Minute)
+	cache.Clock = clock
+
+	router := NewRouter()
+	router.Use(Compress(), cache.Middleware())
+
+	calls := map[string]int{}
+	payload := []byte(strings.Repeat("compress me ", 100))
+	handler := func(req *Request) ([]byte, string) {
+		calls[req.Path]++
+		return CreateResponseBytes("200", "text/plain", "OK", payload)
+	}
+	router.Register("GET", "/report", handler)
+	router.Register("GET", "/events", handler, NoCompress(), NoCache())
+
+	get := func(path string) []byte {
+		response, status := router.dispatch(&Request{Method: "GET", Path: path, Headers: map[string]string{"Accept-Encoding": "gzip, br"}})
+		if status != "200" {
+			t.Fatalf("Expected 200 for %s, got %s", path, status)
+		}
+		return response
+	}
+
+	compressed := get("/report")
+	get("/report")
+	if calls["/report"] != 1 {
+		t.Errorf("Expected cached /report to run handler once, ran %d times", calls["/report"])
+	}
+	head, body, _ := splitResponse(compressed)
+	if responseHeader(head, "Content-Encoding") != "gzip" || responseHeader(head, "Content-Length") != strconv.Itoa(len(body)) {
+		t.Fatalf("Expected gzip response with updated length, got %s", head)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Invalid gzip body: %v", err)
+	}
+	if plain, _ := io.ReadAll(gz); !bytes.Equal(plain, payload) {
+		t.Error("Decompressed body does not match payload")
+	}
+
+	raw := get("/events")
+	get("/events")
+	if calls["/events"] != 2 {
+		t.Errorf("Expected NoCache route to run handler every time, ran %d times", calls["/events"])
+	}
+	if head, _, _ := splitResponse(raw); responseHeader(head, "Content-Encoding") != "" {
+		t.Errorf("NoCompress route was compressed: %s", head)
+	}
+
+	clock.Advance(2 * time.Minute)
+	get("/report")
+	if calls["/report"] != 2 {
+		t.Errorf("Expected expired entry to be refreshed, ran %d times", calls["/report"])
+	}
+}
+
+// Test cached ETags answer If-None-Match with 304 without running the handler
+func TestResponseCacheETag(t *testing.T) {
+	cache := NewResponseCache(time.Minute)
+	cache.Clock = NewFakeClock(time.Unix(0, 0))
+
+	router := NewRouter()
+	router.Use(cache.Middleware())
+
+	calls := 0
+	router.Register("GET", "/api/status", func(req *Request) ([]byte, string) {
+		calls++
+		return CreateResponseBytesWithHeaders("200", "application/json", "OK", map[string]string{"ETag": `"v7"`}, []byte(`{"ok":true}`))
+	})
+
+	poll := func(ifNoneMatch string) (string, string) {
+		response, status := router.dispatch(&Request{Method: "GET", Path: "/api/status", Headers: map[string]string{"If-None-Match": ifNoneMatch}})
+		return string(response), status
+	}
+
+	if response, status := poll(`"v7"`); status != "304" || !strings.Contains(response, "ETag: \"v7\"") {
+		t.Errorf("Expected 304 with ETag on first matching poll, got %s: %s", status, response)
+	}
+	if _, status := poll(`"v6", W/"v7"`); status != "304" {
+		t.Errorf("Expected weak match to give 304, got %s", status)
+	}
+	if response, status := poll(`"v6"`); status != "200" || !strings.Contains(response, `{"ok":true}`) {
+		t.Errorf("Expected cached 200 for stale ETag, got %s", status)
+	}
+	if calls != 1 {
+		t.Errorf("Expected handler to run once, ran %d times", calls)
+	}
+}
+
+// Test the response cache keys by Host and Vary and skips private responses
+func TestResponseCacheIsolation(t *testing.T) {
+	cache := NewResponseCache(time.Minute)
+	cache.Clock = NewFakeClock(time.Unix(0, 0))
+
+	router := NewRouter()
+	router.Use(cache.Middleware())
+
+	calls := 0
+	router.Register("GET", "/page", func(req *Request) ([]byte, string) {
+		calls++
+		headers := map[string]string{"Vary": "Accept-Encoding"}
+		switch req.Query["kind"] {
+		case "cookie":
+			headers["Set-Cookie"] = "s=1"
+		case "private":
+			headers["Cache-Control"] = "max-age=60, private"
+		}
+		body := req.Host + " " + req.Headers.Get("Accept-Encoding") + " " + strconv.Itoa(calls)
+		return CreateResponseBytesWithHeaders("200", "text/plain", "OK", headers, []byte(body))
+	})
+
+	get := func(host, query string, headers map[string]string) string {
+		req := &Request{Method: "GET", Path: "/page", Host: host, Headers: make(Headers), Query: parseKeyValuePairsFromBytes([]byte(query))}
+		for key, value := range headers {
+			req.Headers.Set(key, value)
+		}
+		response, _ := router.dispatch(req)
+		_, body, _ := splitResponse(response)
+		return string(body)
+	}
+
+	first := get("a.example", "", nil)
+	if again := get("A.example:80", "", nil); again != first {
+		t.Errorf("Expected a cached response for the same host, got %q then %q", first, again)
+	}
+	if other := get("b.example", "", nil); other == first {
+		t.Errorf("Expected another host to miss the cache, got %q", other)
+	}
+	gzip := get("a.example", "", map[string]string{"Accept-Encoding": "gzip"})
+	if gzip == first || get("a.example", "", map[string]string{"Accept-Encoding": "gzip"}) != gzip {
+		t.Errorf("Expected a separate cached variant per Accept-Encoding, got %q", gzip)
+	}
+
+	for _, tc := range []struct {
+		query   string
+		headers map[string]string
+	}{
+		{"kind=cookie", nil},
+		{"kind=private", nil},
+		{"", map[string]string{"Authorization": "Bearer t"}},
+		{"", map[string]string{"Cookie": "s=1"}},
+	} {
+		if a, b := get("a.example", tc.query, tc.headers), get("a.example", tc.query, tc.headers); a == b {
+			t.Errorf("Expected %q %v not to be cached, got %q twice", tc.query, tc.headers, a)
+		}
+	}
+
+	for i := range maxCacheEntries + 1 {
+		get("a.example", "n="+strconv.Itoa(i), nil)
+	}
+	if n := cache.entries.resources.len(); n != maxCacheEntries {
+		t.Errorf("Expected the cache capped at %d resources, got %d", maxCacheEntries, n)
+	}
+}
+
+// Test StreamBody routes decode JSON straight from the connection
+func TestStreamBodyJSONDecoder(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxBodySize = 64
+	router := NewRouterWithConfig(cfg)
+	router.Register("POST", "/import", func(req *Request) ([]byte, string) {
+		if req.RawBody != nil || req.Body != nil {
+			t.Error("Streamed body should not be buffered")
+		}
+		decoder := req.JSONDecoder()
+		count := 0
+		for {
+			var item struct{ ID int }
+			if err := decoder.Decode(&item); err == io.EOF {
+				break
+			} else if err != nil {
+				return Serve400(err.Error())
+			}
+			count++
+		}
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(strconv.Itoa(count)))
+	}, StreamBody())
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+	client.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+
+	// Chunks arrive after the handler has started decoding
+	go func() {
+		client.Write([]byte("POST /import HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n"))
+		client.Write([]byte("9\r\n{\"id\":1}\n\r\n"))
+		client.Write([]byte("9\r\n{\"id\":2}\n\r\n0\r\n\r\n"))
+	}()
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "2" {
+		t.Errorf("Expected 2 decoded items, got %q", body)
+	}
+
+	// The connection is reused, and the limit rejects oversized bodies
+	client.Write([]byte("POST /import HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n"))
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read second response: %v", err)
+	}
+	if resp.StatusCode != 413 {
+		t.Errorf("Expected 413 for oversized streamed body, got %d", resp.StatusCode)
+	}
+}
+
+// Test NDJSON writer emits one JSON value per line and flushes on its interval
+func TestNDJSONWriter(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	flushes := 0
+	w := &countingWriter{bufferedWriter: newBufferedWriter(), flushes: &flushes}
+
+	nw := NewNDJSONWriter(w, time.Second)
+	nw.Clock = clock
+	for i := range 3 {
+		if err := nw.WriteJSONLine(map[string]int{"seq": i}); err != nil {
+			t.Fatalf("WriteJSONLine failed: %v", err)
+		}
+	}
+	if flushes != 1 {
+		t.Errorf("Expected only the first line to flush within the interval, got %d flushes", flushes)
+	}
+	clock.Advance(time.Second)
+	nw.WriteJSONLine(map[string]int{"seq": 3})
+	if flushes != 2 {
+		t.Errorf("Expected a flush after the interval, got %d flushes", flushes)
+	}
+
+	response, _ := w.bytes()
+	if !strings.Contains(string(response), "Content-Type: application/x-ndjson\r\n") {
+		t.Errorf("Expected NDJSON content type, got %s", response)
+	}
+	if !strings.HasSuffix(string(response), "{\"seq\":0}\n{\"seq\":1}\n{\"seq\":2}\n{\"seq\":3}\n") {
+		t.Errorf("Unexpected NDJSON body: %s", response)
+	}
+}
+
+// countingWriter counts Flush calls on a buffered writer
+type countingWriter struct {
+	*bufferedWriter
+	flushes *int
+}
+
+func (w *countingWriter) Flush() error {
+	*w.flushes++
+	return w.bufferedWriter.Flush()
+}
+
+// Test MaxBodySize rejects oversized Content-Length bodies without reading them
+func TestMaxBodySizeEnforced(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxBodySize = 10
+	router := NewRouterWithConfig(cfg)
+	router.Register("POST", "/upload", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", req.RawBody)
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	defer serverConn.Close()
+
+	// Nothing is written to the pipe, so reading the body would block
+	oversized := "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1073741824\r\n\r\n"
+	response, status, shouldClose := router.processRequest(serverConn, []byte(oversized))
+	if status != "413" || !shouldClose {
+		t.Errorf("Expected 413 and connection close, got %s (close=%v)", status, shouldClose)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 413 Payload Too Large\r\n") {
+		t.Errorf("Unexpected response: %s", response)
+	}
+
+	within := "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\n0123456789"
+	if _, status, _ := router.processRequest(serverConn, []byte(within)); status != "200" {
+		t.Errorf("Expected 200 for body at the limit, got %s", status)
+	}
+}
+
+// Test idle, trickling and non-reading clients are disconnected
+func TestConnectionTimeouts(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ReadTimeout = 100 * time.Millisecond
+	cfg.WriteTimeout = 50 * time.Millisecond
+	cfg.IdleTimeout = 50 * time.Millisecond
+	router := NewRouterWithConfig(cfg)
+	router.Register("GET", "/", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+	router.SetFileResolver(nil)
+
+	run := func(client func(conn net.Conn)) time.Duration {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		done := make(chan struct{})
+		start := time.Now()
+		go func() {
+			router.RunConnection(serverConn)
+			close(done)
+		}()
+		go client(clientConn)
+		select {
+		case <-done:
+			return time.Since(start)
+		case <-time.After(2 * time.Second):
+			t.Fatal("Connection was not closed")
+			return 0
+		}
+	}
+
+	// Idle keep-alive client: served once, then dropped after IdleTimeout
+	run(func(conn net.Conn) {
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		http.ReadResponse(bufio.NewReader(conn), nil)
+	})
+
+	// Trickling client: refreshing the deadline per byte must not keep it alive
+	elapsed := run(func(conn net.Conn) {
+		for range 40 {
+			if _, err := conn.Write([]byte("X")); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Trickling client kept the connection for %v", elapsed)
+	}
+
+	// Stalled client that never reads the response: dropped after WriteTimeout
+	run(func(conn net.Conn) {
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	})
+}
+
+// Test TLS handshakes time out early and failures are counted by reason
+func TestTLSHandshakeFailures(t *testing.T) {
+	srv := NewServer(":0")
+	srv.TLSHandshakeTimeout = 50 * time.Millisecond
+
+	handshake := func(client func(conn net.Conn)) bool {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		go client(clientConn)
+		return srv.handshake(tls.Server(serverConn, &tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+
+	start := time.Now()
+	if handshake(func(conn net.Conn) {}) {
+		t.Error("Silent client should fail the handshake")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Handshake timeout not applied, took %v", elapsed)
+	}
+
+	handshake(func(conn net.Conn) {
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	})
+
+	handshake(func(conn net.Conn) {
+		tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}).Handshake()
+	})
+
+	failures := srv.TLSHandshakeFailures()
+	for _, reason := range []string{"timeout", "client_hello", "version"} {
+		if failures[reason] != 1 {
+			t.Errorf("Expected one %q failure, got %v", reason, failures)
+		}
+	}
+}
+
+// Test the Connection header reflects the keep-alive decision
+func TestConnectionHeaderDecision(t *testing.T) {
+	exchange := func(cfg *Config, request string) (string, bool) {
+		router := NewRouterWithConfig(cfg)
+		router.Register("GET", "/ping", func(req *Request) ([]byte, string) {
+			return CreateResponseBytes("200", "text/plain", "OK", []byte("pong"))
+		})
+
+		client, serverConn := net.Pipe()
+		defer client.Close()
+		done := make(chan struct{})
+		go func() {
+			router.RunConnection(serverConn)
+			close(done)
+		}()
+
+		client.SetDeadline(time.Now().Add(time.Second))
+		client.Write([]byte(request))
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		// ReadResponse moves "Connection: close" into resp.Close
+		header := resp.Header.Get("Connection")
+		if resp.Close {
+			header = "close"
+		}
+		select {
+		case <-done:
+			return header, true
+		case <-time.After(50 * time.Millisecond):
+			return header, false
+		}
+	}
+
+	cases := []struct {
+		name      string
+		keepAlive bool
+		request   string
+		header    string
+		closed    bool
+	}{
+		{"HTTP/1.1 default", true, "GET /ping HTTP/1.1\r\nHost: a\r\n\r\n", "keep-alive", false},
+		{"HTTP/1.1 close", true, "GET /ping HTTP/1.1\r\nHost: a\r\nConnection: Close\r\n\r\n", "close", true},
+		{"HTTP/1.0 default", true, "GET /ping HTTP/1.0\r\n\r\n", "close", true},
+		{"HTTP/1.0 keep-alive", true, "GET /ping HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", "keep-alive", false},
+		{"keep-alive disabled", false, "GET /ping HTTP/1.1\r\nHost: a\r\n\r\n", "close", true},
+	}
+	for _, tc := range cases {
+		cfg := DefaultConfig()
+		cfg.EnableKeepAlive = tc.keepAlive
+		header, closed := exchange(cfg, tc.request)
+		if header != tc.header || closed != tc.closed {
+			t.Errorf("%s: expected Connection %q (closed=%v), got %q (closed=%v)", tc.name, tc.header, tc.closed, header, closed)
+		}
+	}
+}
+
+// Test TLS presets map to minimum versions and reject downgraded clients
+func TestTLSPresets(t *testing.T) {
+	expected := map[TLSPreset]uint16{
+		"":              tls.VersionTLS12,
+		TLSModern:       tls.VersionTLS13,
+		TLSIntermediate: tls.VersionTLS12,
+		TLSLegacy:       tls.VersionTLS10,
+	}
+	for preset, version := range expected {
+		cfg, err := preset.Config()
+		if err != nil {
+			t.Fatalf("Preset %q failed: %v", preset, err)
+		}
+		if cfg.MinVersion != version {
+			t.Errorf("Preset %q: expected MinVersion %x, got %x", preset, version, cfg.MinVersion)
+		}
+		if preset != TLSModern && len(cfg.CipherSuites) == 0 {
+			t.Errorf("Preset %q has no cipher suites", preset)
+		}
+	}
+	if _, err := TLSPreset("paranoid").Config(); err == nil {
+		t.Error("Expected error for unknown preset")
+	}
+
+	srv := NewServer(":0")
+	srv.TLSHandshakeTimeout = time.Second
+	modern, _ := TLSModern.Config()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}).Handshake()
+	if srv.handshake(tls.Server(serverConn, modern)) {
+		t.Error("Modern preset accepted a TLS 1.2 client")
+	}
+	if failures := srv.TLSHandshakeFailures(); failures["version"] != 1 {
+		t.Errorf("Expected a version failure, got %v", failures)
+	}
+}
+
+// Test handlers can close the connection after responding
+func TestHandlerClosesConnection(t *testing.T) {
+	router := NewRouter()
+	router.Register("GET", "/admin", func(req *Request) ([]byte, string) {
+		return CloseConnection(Serve401("invalid token"))
+	})
+	router.HandleFunc("GET", "/violation", func(w ResponseWriter, req *Request) {
+		w.SetHeader("Connection", "close")
+		w.WriteHeader(400)
+		w.Write([]byte("protocol violation"))
+	})
+	router.Register("GET", "/ok", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	defer serverConn.Close()
+
+	for _, path := range []string{"/admin", "/violation"} {
+		response, _, shouldClose := router.processRequest(serverConn, []byte("GET "+path+" HTTP/1.1\r\nHost: a\r\n\r\n"))
+		if !shouldClose {
+			t.Errorf("%s: expected the connection to close", path)
+		}
+		if !strings.Contains(string(response), "Connection: close\r\n") || strings.Contains(string(response), "keep-alive") {
+			t.Errorf("%s: expected a single Connection: close header, got %s", path, response)
+		}
+	}
+
+	if _, _, shouldClose := router.processRequest(serverConn, []byte("GET /ok HTTP/1.1\r\nHost: a\r\n\r\n")); shouldClose {
+		t.Error("Regular responses should keep the connection open")
+	}
+}
+
+// Test Cookie header parsing and Set-Cookie serialization
+func TestCookies(t *testing.T) {
+	var captured *Request
+	router := NewRouter()
+	router.Register("GET", "/session", func(req *Request) ([]byte, string) {
+		captured = req
+		response, status := CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+		response = SetCookie(response, &Cookie{Name: "session", Value: "abc123", Path: "/", MaxAge: 3600, HttpOnly: true, Secure: true, SameSite: SameSiteLax})
+		response = SetCookie(response, &Cookie{Name: "theme", Value: "dark; mode", Expires: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)})
+		return response, status
+	})
+	router.HandleFunc("GET", "/logout", func(w ResponseWriter, req *Request) {
+		w.AddHeader("Set-Cookie", (&Cookie{Name: "session", MaxAge: -1}).String())
+		w.AddHeader("Set-Cookie", (&Cookie{Name: "theme", MaxAge: -1}).String())
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	defer serverConn.Close()
+
+	request := "GET /session HTTP/1.1\r\nHost: localhost\r\nCookie: session=old; theme=\"light\"; session=dup; bad name=x\r\n\r\n"
+	response, _, _ := router.processRequest(serverConn, []byte(request))
+	if captured.Cookies["session"] != "old" || captured.Cookies["theme"] != "light" || len(captured.Cookies) != 2 {
+		t.Errorf("Unexpected cookies: %v", captured.Cookies)
+	}
+	for _, line := range []string{
+		"Set-Cookie: session=abc123; Path=/; Max-Age=3600; HttpOnly; Secure; SameSite=Lax\r\n",
+		"Set-Cookie: theme=\"dark mode\"; Expires=Wed, 02 Jan 2030 03:04:05 GMT\r\n",
+	} {
+		if !strings.Contains(string(response), line) {
+			t.Errorf("Missing %q in %s", line, response)
+		}
+	}
+
+	response, _ = router.dispatch(&Request{Method: "GET", Path: "/logout"})
+	if strings.Count(string(response), "Set-Cookie: ") != 2 || !strings.Contains(string(response), "session=; Max-Age=0") {
+		t.Errorf("Expected two deleting cookies, got %s", response)
+	}
+
+	if (&Cookie{Name: "bad;name", Value: "x"}).String() != "" {
+		t.Error("Invalid cookie names should not serialize")
+	}
+}
+
+// Test 405 responses list the methods registered for the path
+func TestMethodNotAllowedAllowHeader(t *testing.T) {
+	router := NewRouter()
+	handler := func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	}
+	router.Register("GET", "/items/:id", handler)
+	router.Register("PUT", "/items/:id", handler)
+	router.Register("DELETE", "/items/7", handler)
+
+	response, status := router.dispatch(&Request{Method: "POST", Path: "/items/7"})
+	if status != "405" {
+		t.Fatalf("Expected 405, got %s", status)
+	}
+	if !strings.Contains(string(response), "\r\nAllow: DELETE, GET, HEAD, OPTIONS, PUT\r\n") {
+		t.Errorf("Expected Allow header with all methods, got %s", response)
+	}
+
+	response, _ = router.dispatch(&Request{Method: "OPTIONS", Path: "/items/8"})
+	if !strings.Contains(string(response), "\r\nAllow: GET, HEAD, OPTIONS, PUT\r\n") {
+		t.Errorf("Expected OPTIONS to share the Allow set, got %s", response)
+	}
+
+	if _, status := router.dispatch(&Request{Method: "POST", Path: "/other"}); status != "404" {
+		t.Errorf("Expected 404 for unknown path, got %s", status)
+	}
+
+	// GET routes answer HEAD with the same headers and no body
+	response, status, _ = router.processRequest(nil, []byte("HEAD /items/8 HTTP/1.1\r\nHost: x\r\n\r\n"))
+	head, body, _ := splitResponse(response)
+	if status != "200" || responseHeader(head, "Content-Length") != "2" || len(body) != 0 {
+		t.Errorf("Expected HEAD to use the GET route without a body, got %s %q", status, response)
+	}
+}
+
+// Test overlong request targets get 414 URI Too Long
+func TestMaxURLLength(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxURLLength = 64
+	cfg.MaxHeaderSize = 1 << 20
+	router := NewRouterWithConfig(cfg)
+	router.Register("GET", "/search", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	defer serverConn.Close()
+
+	long := "GET /search?q=" + strings.Repeat("a", 100) + " HTTP/1.1\r\nHost: a\r\n\r\n"
+	if _, status, shouldClose := router.processRequest(serverConn, []byte(long)); status != "414" || !shouldClose {
+		t.Errorf("Expected 414 and close, got %s (close=%v)", status, shouldClose)
+	}
+	if _, status, _ := router.processRequest(serverConn, []byte("GET /search?q=go HTTP/1.1\r\nHost: a\r\n\r\n")); status != "200" {
+		t.Errorf("Expected 200 for short URL, got %s", status)
+	}
+
+	// A request line that never ends is cut off once it passes the limit
+	go router.RunConnection(serverConn)
+	client.SetDeadline(time.Now().Add(time.Second))
+	go client.Write([]byte("GET /" + strings.Repeat("a", 4096)))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("Expected a 414 response, got %v", err)
+	}
+	if resp.StatusCode != 414 {
+		t.Errorf("Expected 414, got %d", resp.StatusCode)
+	}
+}
+
+// Benchmark request parsing and dispatch; compare GC pressure against the
+// arena experiment with -tags rawhttp_arena
+func BenchmarkProcessRequest(b *testing.B) {
+	router := NewRouter()
+	router.Register("GET", "/users/:id", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.PathParams["id"]))
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	defer serverConn.Close()
+
+	request := []byte("GET /users/42?verbose=1 HTTP/1.1\r\nHost: example.com\r\n" +
+		"User-Agent: Mozilla/5.0 Chrome/120.0\r\nAccept: */*\r\nAccept-Encoding: gzip\r\n" +
+		"Cookie: session=abc; theme=dark\r\nX-Request-Id: 0123456789\r\n\r\n")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, status, _ := router.processRequest(serverConn, request); status != "200" {
+			b.Fatalf("Expected status 200, got %s", status)
+		}
+	}
+}
+
+// Test RateLimit rejects clients past their allowance and refills over time
+func TestRateLimit(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	router := NewRouter()
+	router.Use(RateLimit(RateLimitConfig{Requests: 2, Window: time.Minute, Clock: clock}))
+	router.Register("GET", "/", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+
+	request := func(addr string) ([]byte, string) {
+		return router.dispatch(&Request{Method: "GET", Path: "/", RemoteAddr: addr})
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, status := request("10.0.0.1:5000"); status != "200" {
+			t.Fatalf("Request %d: expected 200, got %s", i, status)
+		}
+	}
+	response, status := request("10.0.0.1:5001")
+	if status != "429" {
+		t.Fatalf("Expected 429, got %s", status)
+	}
+	if !strings.Contains(string(response), "Retry-After: 30\r\n") {
+		t.Errorf("Expected Retry-After: 30, got %q", response)
+	}
+	if _, status := request("10.0.0.2:5000"); status != "200" {
+		t.Errorf("Expected other client to get 200, got %s", status)
+	}
+
+	clock.Advance(30 * time.Second)
+	if _, status := request("10.0.0.1:5000"); status != "200" {
+		t.Errorf("Expected 200 after refill, got %s", status)
+	}
+}
+
+// Test idle buckets are evicted once full again
+func TestRateLimitEvictsIdleBuckets(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := &rateLimiter{
+		cfg:     RateLimitConfig{Requests: 1, Window: time.Second, Burst: 1, Clock: clock},
+		rate:    1,
+		buckets: make(map[string]*tokenBucket),
+	}
+	l.allow("a")
+	clock.Advance(2 * time.Second)
+	l.allow("b")
+
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("Expected idle bucket to be evicted")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("Expected active bucket to remain")
+	}
+}
+
+// Test Authorize guards routes by role and permission
+func TestAuthorize(t *testing.T) {
+	principals := map[string]*Principal{
+		"admin":  {ID: "1", Roles: []string{"admin"}, Permissions: []string{"users:read", "users:write"}},
+		"viewer": {ID: "2", Roles: []string{"viewer"}, Permissions: []string{"users:read"}},
+	}
+	router := NewRouter()
+	router.Use(Authorize(func(req *Request) (*Principal, error) {
+		return principals[req.Headers["Authorization"]], nil
+	}))
+	ok := func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.Principal().ID))
+	}
+	router.Register("GET", "/public", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("public"))
+	})
+	router.Register("GET", "/admin", ok, RequireRoles("admin", "owner"))
+	router.Register("DELETE", "/users", ok, RequirePermissions("users:read", "users:write"))
+
+	tests := []struct {
+		method, path, user, status string
+	}{
+		{"GET", "/public", "", "200"},
+		{"GET", "/admin", "", "401"},
+		{"GET", "/admin", "viewer", "403"},
+		{"GET", "/admin", "admin", "200"},
+		{"DELETE", "/users", "viewer", "403"},
+		{"DELETE", "/users", "admin", "200"},
+	}
+	for _, tt := range tests {
+		req := &Request{Method: tt.method, Path: tt.path, Headers: map[string]string{"Authorization": tt.user}}
+		response, status := router.dispatch(req)
+		if status != tt.status {
+			t.Errorf("%s %s as %q: expected %s, got %s", tt.method, tt.path, tt.user, tt.status, status)
+		}
+		if status == "403" && !strings.Contains(string(response), `{"error":"missing required`) {
+			t.Errorf("Expected JSON error body, got %q", response)
+		}
+	}
+}
+
+// Test Audit records state-changing requests to a file sink
+func TestAuditFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	router := NewRouter()
+	router.Use(Authorize(func(req *Request) (*Principal, error) {
+		return &Principal{ID: "alice", Roles: []string{"admin"}}, nil
+	}), Audit(sink, clock))
+	handler := func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	}
+	router.Register("GET", "/items", handler)
+	router.Register("POST", "/items", handler, RequireRoles("admin"))
+
+	router.dispatch(&Request{Method: "GET", Path: "/items", RemoteAddr: "10.0.0.1:1234"})
+	router.dispatch(&Request{Method: "POST", Path: "/items", RemoteAddr: "10.0.0.1:1234", RawBody: []byte("hello")})
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one audit entry, got %q", data)
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := AuditEntry{
+		Time:       clock.Now(),
+		Method:     "POST",
+		Path:       "/items",
+		Principal:  "alice",
+		ClientIP:   "10.0.0.1",
+		BodySHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		Status:     200,
+	}
+	if entry != want {
+		t.Errorf("Expected %+v, got %+v", want, entry)
+	}
+}
+
+// signTestJWT builds an HS256 token for claims
+func signTestJWT(key []byte, claims map[string]any) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Test JWT verifies bearer tokens and exposes their claims
+func TestJWT(t *testing.T) {
+	key := []byte("secret")
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	router := NewRouter()
+	router.Use(JWT(JWTConfig{
+		Key:      func(kid string) ([]byte, error) { return key, nil },
+		Audience: "api",
+		Clock:    clock,
+	}))
+	router.Register("GET", "/me", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.Auth.Subject()))
+	})
+
+	valid := map[string]any{"sub": "alice", "aud": []string{"api"}, "exp": 1700000600}
+	tests := []struct {
+		name, authorization, status string
+	}{
+		{"valid", "Bearer " + signTestJWT(key, valid), "200"},
+		{"missing", "", "401"},
+		{"wrong key", "Bearer " + signTestJWT([]byte("other"), valid), "401"},
+		{"expired", "Bearer " + signTestJWT(key, map[string]any{"sub": "alice", "aud": "api", "exp": 1699999999}), "401"},
+		{"string exp", "Bearer " + signTestJWT(key, map[string]any{"sub": "alice", "aud": "api", "exp": "1699999999"}), "401"},
+		{"string nbf", "Bearer " + signTestJWT(key, map[string]any{"sub": "alice", "aud": "api", "nbf": "soon"}), "401"},
+		{"wrong audience", "Bearer " + signTestJWT(key, map[string]any{"sub": "alice", "aud": "web"}), "401"},
+		{"malformed", "Bearer abc.def", "401"},
+	}
+	for _, tt := range tests {
+		req := &Request{Method: "GET", Path: "/me", Headers: map[string]string{"Authorization": tt.authorization}}
+		response, status := router.dispatch(req)
+		if status != tt.status {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.status, status)
+		}
+		if status == "200" && !strings.HasSuffix(string(response), "alice") {
+			t.Errorf("%s: expected subject in body, got %q", tt.name, response)
+		}
+		if status == "401" && !strings.Contains(string(response), "WWW-Authenticate: Bearer") {
+			t.Errorf("%s: expected WWW-Authenticate header, got %q", tt.name, response)
+		}
+	}
+}
+
+// Test Honeypot answers trap paths and bans the client
+func TestHoneypot(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	var trapped []string
+	honeypot := NewHoneypot(HoneypotConfig{
+		BanFor: time.Hour,
+		Clock:  clock,
+		OnTrap: func(ip, path string) { trapped = append(trapped, ip+" "+path) },
+	})
+	router := NewRouter()
+	router.Use(honeypot.Middleware())
+	honeypot.Register(router)
+	router.Register("GET", "/", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+
+	request := func(path, addr string) ([]byte, string) {
+		return router.dispatch(&Request{Method: "GET", Path: path, RemoteAddr: addr})
+	}
+
+	response, status := request("/.env", "10.0.0.1:5000")
+	if status != "418" || !strings.Contains(string(response), "Connection: close") {
+		t.Errorf("Expected 418 closing the connection, got %s %q", status, response)
+	}
+	if len(trapped) != 1 || trapped[0] != "10.0.0.1 /.env" {
+		t.Errorf("Expected OnTrap call, got %v", trapped)
+	}
+	if _, status := request("/", "10.0.0.1:5001"); status != "403" {
+		t.Errorf("Expected banned client to get 403, got %s", status)
+	}
+	if _, status := request("/", "10.0.0.2:5000"); status != "200" {
+		t.Errorf("Expected other client to get 200, got %s", status)
+	}
+
+	request("/wp-admin", "10.0.0.3:5000")
+	clock.Advance(time.Hour)
+	if _, status := request("/", "10.0.0.1:5000"); status != "200" {
+		t.Errorf("Expected 200 once the ban expired, got %s", status)
+	}
+	if n := len(honeypot.banned); n != 0 {
+		t.Errorf("Expected expired bans of clients that didn't return to be pruned, %d left", n)
+	}
+}
+
+// Test a tarpit drips the trap response and closes the connection
+func TestHoneypotTarpit(t *testing.T) {
+	router := NewRouter()
+	NewHoneypot(HoneypotConfig{Paths: []string{"/wp-login.php"}, Status: 403, Tarpit: 20 * time.Millisecond}).Register(router)
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+
+	client.Write([]byte("GET /wp-login.php HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 403 || string(body) != "Forbidden" || !resp.Close {
+		t.Errorf("Expected 403 Forbidden closing the connection, got %d %q close=%v", resp.StatusCode, body, resp.Close)
+	}
+
+	// With every tarpit slot taken, trapped requests are answered at once
+	full := NewRouter()
+	honeypot := NewHoneypot(HoneypotConfig{Paths: []string{"/.env"}, Tarpit: time.Hour, MaxTarpits: 1})
+	honeypot.Register(full)
+	honeypot.tarpits <- struct{}{}
+	if response, status, _ := full.processRequest(serverConn, []byte("GET /.env HTTP/1.1\r\nHost: x\r\n\r\n")); status != "418" || response == nil {
+		t.Errorf("Expected an immediate 418 with the tarpits full, got %s %q", status, response)
+	}
+}
+
+// nopWriteCloser adds a no-op Close to a writer
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Test Compress negotiates among registered encoders by quality value
+func TestCompressNegotiation(t *testing.T) {
+	saved := encoders
+	defer func() { encoders = saved }()
+	RegisterEncoder("x-upper", func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level != 3 {
+			t.Errorf("Expected configured level 3, got %d", level)
+		}
+		return nopWriteCloser{w}, nil
+	})
+
+	router := NewRouterWithConfig(&Config{CompressionLevels: map[string]int{"x-upper": 3}})
+	router.Use(Compress())
+	body := strings.Repeat("compress me ", 100)
+	router.Register("GET", "/", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(body))
+	})
+
+	tests := []struct {
+		acceptEncoding, want string
+	}{
+		{"gzip", "gzip"},
+		{"gzip, x-upper", "x-upper"},
+		{"gzip;q=1.0, x-upper;q=0.5", "gzip"},
+		{"*", "x-upper"},
+		{"*;q=0.5, x-upper;q=0", "gzip"},
+		{"x-upper;q=0, gzip;q=0", ""},
+		{"br", ""},
+	}
+	for _, tt := range tests {
+		client, serverConn := net.Pipe()
+		request := "GET / HTTP/1.1\r\nHost: x\r\nAccept-Encoding: " + tt.acceptEncoding + "\r\n\r\n"
+		response, _, _ := router.processRequest(serverConn, []byte(request))
+		client.Close()
+		serverConn.Close()
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("Content-Encoding"); got != tt.want {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", tt.acceptEncoding, tt.want, got)
+		}
+	}
+}
+
+// buildTestMMDB builds an IPv4 MaxMind DB mapping 1.0.0.0/8 to one record
+func buildTestMMDB() []byte {
+	str := func(s string) []byte {
+		if len(s) >= 29 {
+			return append([]byte{2<<5 | 29, byte(len(s) - 29)}, s...)
+		}
+		return append([]byte{2<<5 | byte(len(s))}, s...)
+	}
+	uint16Field := func(n uint16) []byte { return []byte{5<<5 | 2, byte(n >> 8), byte(n)} }
+	uint32Field := func(n uint32) []byte { return []byte{6<<5 | 4, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)} }
+	mapField := func(pairs ...[]byte) []byte {
+		out := []byte{7<<5 | byte(len(pairs)/2)}
+		for _, p := range pairs {
+			out = append(out, p...)
+		}
+		return out
+	}
+
+	// Eight nodes follow the bits of 0x01; the last right record points at
+	// data offset 0, every other branch is "not found" (node_count)
+	const nodeCount = 8
+	var db []byte
+	for d := 0; d < nodeCount; d++ {
+		left, right := d+1, nodeCount
+		if d == nodeCount-1 {
+			left, right = nodeCount, nodeCount+16
+		}
+		db = append(db, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, mapField(
+		str("country"), mapField(str("iso_code"), str("NG")),
+		str("autonomous_system_number"), uint32Field(64500),
+		str("autonomous_system_organization"), str("Example Net"),
+	)...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	db = append(db, mapField(
+		str("node_count"), uint32Field(nodeCount),
+		str("record_size"), uint16Field(24),
+		str("ip_version"), uint16Field(4),
+	)...)
+	return db
+}
+
+// Test MaxMindDB lookups and CountryFilter
+func TestGeoIP(t *testing.T) {
+	db, err := NewMaxMindDB(buildTestMMDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := lookupGeo(db, "[::ffff:1.2.3.4]:5000")
+	want := GeoInfo{Country: "NG", ASN: 64500, ASOrg: "Example Net"}
+	if info != want {
+		t.Errorf("Expected %+v, got %+v", want, info)
+	}
+	if info, err := db.Lookup(netip.MustParseAddr("2.0.0.1")); err != nil || info != (GeoInfo{}) {
+		t.Errorf("Expected no record, got %+v %v", info, err)
+	}
+
+	router := NewRouter()
+	router.Use(CountryFilter(nil, []string{"ng"}))
+	router.Register("GET", "/", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+	if _, status := router.dispatch(&Request{Method: "GET", Path: "/", Geo: info}); status != "403" {
+		t.Errorf("Expected denied country to get 403, got %s", status)
+	}
+	if _, status := router.dispatch(&Request{Method: "GET", Path: "/"}); status != "200" {
+		t.Errorf("Expected unknown country to pass, got %s", status)
+	}
+}
+
+// Test deflate request bodies are decoded and unknown encodings get a 415
+func TestRequestContentEncodings(t *testing.T) {
+	router := NewRouter()
+	router.Register("POST", "/submit", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("name="+req.Body["name"]))
+	})
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("name=gopher"))
+	zw.Close()
+
+	post := func(encoding string, body []byte) ([]byte, string) {
+		request := "POST /submit HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/x-www-form-urlencoded\r\n" +
+			"Content-Encoding: " + encoding + "\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body)
+		response, status, _ := router.processRequest(nil, []byte(request))
+		return response, status
+	}
+
+	if response, status := post("deflate", compressed.Bytes()); status != "200" || !strings.Contains(string(response), "name=gopher") {
+		t.Errorf("Expected decoded deflate body, got %s %q", status, response)
+	}
+	if _, status := post("br", []byte("name=gopher")); status != "415" {
+		t.Errorf("Expected 415 for unsupported encoding, got %s", status)
+	}
+	if _, status := post("gzip", []byte("not gzip")); status != "400" {
+		t.Errorf("Expected 400 for corrupt body, got %s", status)
+	}
+}
+
+// Test Minify strips comments and whitespace from HTML, CSS and JS
+func TestMinify(t *testing.T) {
+	tests := []struct {
+		contentType, body, want string
+	}{
+		{
+			"text/css",
+			"/* theme */\nbody {\n  color: red;\n  margin: 0 auto;\n}\na :hover > b { content: \"a  b\"; }\n",
+			"body{color:red;margin:0 auto}a :hover>b{content:\"a  b\"}",
+		},
+		{
+			"application/javascript; charset=utf-8",
+			"// setup\nconst url = \"http://x\";  /* note */\n\n    let a = 1\n    let b = `//kept`\n",
+			"const url = \"http://x\";\nlet a = 1\nlet b = `//kept`",
+		},
+		{
+			"text/javascript",
+			"s = s.replace(/\\/\\//g, \"/\");  // slashes\nq = s.split(/'/)\nr = [/[/]/, a / b / c]\nreturn /x/.test(s) /* done */\n",
+			"s = s.replace(/\\/\\//g, \"/\");\nq = s.split(/'/)\nr = [/[/]/, a / b / c]\nreturn /x/.test(s)",
+		},
+		{
+			"text/html",
+			"<!-- nav -->\n<p>Hello   <b>world</b></p>\n<pre>  keep\n   this </pre>\n",
+			"<p>Hello <b>world</b></p>\n<pre>  keep\n   this </pre>",
+		},
+		{
+			"text/html",
+			"<p   title=\"a   b\"  data-x='>  <'>x    y</p>\n",
+			"<p   title=\"a   b\"  data-x='>  <'>x y</p>",
+		},
+	}
+
+	for _, tt := range tests {
+		router := NewRouter()
+		router.Use(Minify())
+		router.Register("GET", "/", func(req *Request) ([]byte, string) {
+			return CreateResponseBytes("200", tt.contentType, "OK", []byte(tt.body))
+		})
+		for i := 0; i < 2; i++ { // second pass is served from the cache
+			response, _ := router.dispatch(&Request{Method: "GET", Path: "/"})
+			head, body, _ := splitResponse(response)
+			if string(body) != tt.want {
+				t.Errorf("%s: expected %q, got %q", tt.contentType, tt.want, body)
+			}
+			if responseHeader(head, "Content-Length") != strconv.Itoa(len(body)) {
+				t.Errorf("%s: Content-Length not updated: %s", tt.contentType, head)
+			}
+		}
+	}
+}
+
+// Test Preload adds Link headers to HTML responses only
+func TestPreload(t *testing.T) {
+	router := NewRouter()
+	assets := Preload("/static/app.css", "/static/app.js?v=2", "/fonts/inter.woff2")
+	router.Register("GET", "/", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/html; charset=utf-8", "OK", []byte("<html></html>"))
+	}, assets)
+	router.Register("GET", "/api", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "application/json", "OK", []byte("{}"))
+	}, assets)
+
+	response, _ := router.dispatch(&Request{Method: "GET", Path: "/"})
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"</static/app.css>; rel=preload; as=style",
+		"</static/app.js?v=2>; rel=preload; as=script",
+		"</fonts/inter.woff2>; rel=preload; as=font; crossorigin",
+	}
+	if got := resp.Header.Values("Link"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected Link headers %q, got %q", want, got)
+	}
+
+	response, _ = router.dispatch(&Request{Method: "GET", Path: "/api"})
+	if strings.Contains(string(response), "Link:") {
+		t.Errorf("Expected no Link header on JSON response, got %q", response)
+	}
+}
+
+// Test static files carry validators and answer conditional requests with 304
+func TestStaticConditionalGet(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.css")
+	if err := os.WriteFile(path, []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+	router.SetFileResolver(DirResolver(dir))
+
+	get := func(headers map[string]string) ([]byte, string) {
+		return router.routeRequest(&Request{Method: "GET", Path: "/app.css", Headers: headers})
+	}
+
+	response, status := get(nil)
+	head, _, _ := splitResponse(response)
+	etag := responseHeader(head, "ETag")
+	if status != "200" || etag == "" || responseHeader(head, "Last-Modified") != "Fri, 01 Mar 2024 10:00:00 GMT" {
+		t.Fatalf("Expected 200 with validators, got %s %s", status, head)
+	}
+
+	tests := []struct {
+		headers map[string]string
+		status  string
+	}{
+		{map[string]string{"If-None-Match": etag}, "304"},
+		{map[string]string{"If-None-Match": `"other", W/` + etag}, "304"},
+		{map[string]string{"If-None-Match": `"other"`}, "200"},
+		{map[string]string{"If-Modified-Since": "Fri, 01 Mar 2024 10:00:00 GMT"}, "304"},
+		{map[string]string{"If-Modified-Since": "Thu, 29 Feb 2024 10:00:00 GMT"}, "200"},
+		{map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Fri, 01 Mar 2024 10:00:00 GMT"}, "200"},
+	}
+	for _, tt := range tests {
+		response, status := get(tt.headers)
+		if status != tt.status {
+			t.Errorf("%v: expected %s, got %s", tt.headers, tt.status, status)
+		}
+		if _, body, _ := splitResponse(response); status == "304" && len(body) != 0 {
+			t.Errorf("%v: expected empty 304 body, got %q", tt.headers, body)
+		}
+		head, _, _ := splitResponse(response)
+		if status == "304" && (responseHeader(head, "Content-Type") != "" || responseHeader(head, "Content-Length") != "" ||
+			responseHeader(head, "ETag") != etag || responseHeader(head, "Last-Modified") == "") {
+			t.Errorf("%v: expected a 304 carrying only validators, got %q", tt.headers, head)
+		}
+	}
+}
+
+// Test a JSON route table mounts static files, redirects and proxies
+func TestRouteTable(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/big":
+			w.Write(make([]byte, maxProxyResponseSize+1))
+			return
+		case r.Method == "HEAD":
+			w.Header().Set("Content-Length", "1234")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "%s %s?%s xff=%s", r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log(1)"), 0o644)
+	tablePath := filepath.Join(t.TempDir(), "routes.json")
+	table := `{"routes": [
+		{"path": "/assets", "static": "` + filepath.ToSlash(dir) + `"},
+		{"path": "/old", "redirect": "/new", "status": 308},
+		{"path": "/api", "proxy": "` + upstream.URL + `/v1"}
+	]}`
+	os.WriteFile(tablePath, []byte(table), 0o644)
+
+	routes, err := LoadRouteTable(tablePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+	if err := routes.Apply(router); err != nil {
+		t.Fatal(err)
+	}
+
+	response, status := router.dispatch(&Request{Method: "GET", Path: "/assets/app.js"})
+	if status != "200" || !strings.HasSuffix(string(response), "console.log(1)") {
+		t.Errorf("Expected static file, got %s %q", status, response)
+	}
+	response, status = router.dispatch(&Request{Method: "GET", Path: "/old"})
+	if status != "308" || !strings.Contains(string(response), "Location: /new\r\n") {
+		t.Errorf("Expected 308 redirect, got %s %q", status, response)
+	}
+
+	req := &Request{Method: "POST", Path: "/api/users", Query: map[string]string{"page": "2"}, RemoteAddr: "10.0.0.1:5000", Headers: map[string]string{"Host": "gw"}}
+	response, status = router.dispatch(req)
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if status != "202" || string(body) != "POST /v1/users?page=2 xff=10.0.0.1" {
+		t.Errorf("Expected proxied response, got %s %q", status, body)
+	}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) != 2 {
+		t.Errorf("Expected both Set-Cookie headers, got %q", cookies)
+	}
+
+	response, _ = router.dispatch(&Request{Method: "GET", Path: "/api/items", rawQuery: "b=2&b=1&c=%20", RemoteAddr: "10.0.0.1:5000",
+		Headers: map[string]string{"Host": "gw", "X-Forwarded-For": "203.0.113.9"}})
+	if _, body, _ := splitResponse(response); string(body) != "GET /v1/items?b=2&b=1&c=%20 xff=203.0.113.9, 10.0.0.1" {
+		t.Errorf("Expected the raw query and an appended X-Forwarded-For, got %q", body)
+	}
+	response, _ = router.dispatch(&Request{Method: "HEAD", Path: "/api/items"})
+	head, _, _ := splitResponse(response)
+	if got := responseHeader(head, "Content-Length"); got != "1234" {
+		t.Errorf("Expected HEAD to keep the upstream Content-Length, got %q", got)
+	}
+	if _, status := router.dispatch(&Request{Method: "GET", Path: "/api/big"}); status != "502" {
+		t.Errorf("Expected 502 for an oversized upstream body, got %s", status)
+	}
+
+	invalid := &RouteTable{Routes: []RouteSpec{{Path: "/x", Static: "a", Proxy: "http://b"}}}
+	if err := invalid.Apply(NewRouter()); err == nil {
+		t.Error("Expected error for route with two targets")
+	}
+
+	existing := NewRouter()
+	existing.Register("GET", "/users/:id", func(req *Request) ([]byte, string) { return Serve400("") })
+	for _, table := range []*RouteTable{
+		{Routes: []RouteSpec{{Path: "/old", Redirect: "/new"}, {Path: "/users/:name", Redirect: "/people"}}},
+		{Routes: []RouteSpec{{Path: "/a/:x", Redirect: "/new"}, {Path: "/a/:y", Redirect: "/other"}}},
+	} {
+		if err := table.Apply(existing); err == nil || !strings.Contains(err.Error(), "conflicts with") {
+			t.Errorf("Expected a conflict error, got %v", err)
+		}
+	}
+	if _, status, _ := existing.processRequest(nil, []byte("GET /old HTTP/1.1\r\nHost: localhost\r\n\r\n")); status != "404" {
+		t.Errorf("Expected nothing registered from a conflicting table, got %s", status)
+	}
+}
+
+// Test recompress proxy routes decode upstream bodies and encode them for the client
+func TestProxyRecompress(t *testing.T) {
+	text := strings.Repeat("recompressed upstream body ", 64)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/gzipped" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(text))
+			gz.Close()
+			return
+		}
+		w.Write([]byte(text))
+	}))
+	defer upstream.Close()
+
+	router := NewRouter()
+	table := &RouteTable{Routes: []RouteSpec{{Path: "/up", Proxy: upstream.URL, Recompress: true}}}
+	if err := table.Apply(router); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ path, acceptEncoding, encoding string }{
+		{"/up/plain", "gzip", "gzip"},
+		{"/up/gzipped", "gzip", "gzip"},
+		{"/up/gzipped", "", ""},
+		{"/up/plain", "identity", ""},
+	} {
+		headers := Headers{}
+		if tc.acceptEncoding != "" {
+			headers["Accept-Encoding"] = tc.acceptEncoding
+		}
+		response, status := router.dispatch(&Request{Method: "GET", Path: tc.path, Headers: headers})
+		head, body, _ := splitResponse(response)
+		if status != "200" || responseHeader(head, "Content-Encoding") != tc.encoding ||
+			responseHeader(head, "Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("%s %q: expected encoding %q with a matching length, got %s %q", tc.path, tc.acceptEncoding, tc.encoding, status, head)
+			continue
+		}
+		if tc.encoding == "gzip" {
+			reader, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("%s: invalid gzip body: %v", tc.path, err)
+			}
+			body, _ = io.ReadAll(reader)
+		}
+		if string(body) != text {
+			t.Errorf("%s %q: expected the upstream text, got %q", tc.path, tc.acceptEncoding, body)
+		}
+	}
+
+	if err := (&RouteTable{Routes: []RouteSpec{{Path: "/x", Redirect: "/y", Recompress: true}}}).Apply(NewRouter()); err == nil {
+		t.Error("Expected recompress without proxy to be rejected")
+	}
+}
+
+// Test proxy header rules, host rewriting and keep_prefix
+func TestProxyHeaderRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Server", "upstream/1.0")
+		w.Header().Set("X-Upstream", "a")
+		fmt.Fprintf(w, "%s %s env=%s cookie=%s tags=%s",
+			r.Host, r.URL.Path, r.Header.Get("X-Env"), r.Header.Get("Cookie"), strings.Join(r.Header.Values("X-Tag"), ","))
+	}))
+	defer upstream.Close()
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	rules := &HeaderRules{Remove: []string{"Cookie"}, Set: map[string]string{"X-Env": "prod"}, Add: map[string]string{"X-Tag": "proxy"}}
+	router := NewRouter()
+	table := &RouteTable{Routes: []RouteSpec{
+		{Path: "/rules", Proxy: upstream.URL, RequestHeaders: rules, ResponseHeaders: &HeaderRules{
+			Remove: []string{"Server"}, Set: map[string]string{"Content-Type": "text/markdown"}, Add: map[string]string{"X-Upstream": "b"},
+		}},
+		{Path: "/host", Proxy: upstream.URL, Host: "api.internal"},
+		{Path: "/preserve", Proxy: upstream.URL, PreserveHost: true},
+		{Path: "/keep", Proxy: upstream.URL, KeepPrefix: true},
+	}}
+	if err := table.Apply(router); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ path, body string }{
+		{"/rules/x", upstreamHost + " /x env=prod cookie= tags=client,proxy"},
+		{"/host/x", "api.internal /x env= cookie=c tags=client"},
+		{"/preserve/x", "example.com /x env= cookie=c tags=client"},
+		{"/keep/x", upstreamHost + " /keep/x env= cookie=c tags=client"},
+	} {
+		headers := Headers{"Host": "example.com", "Cookie": "c", "X-Tag": "client"}
+		response, status := router.dispatch(&Request{Method: "GET", Path: tc.path, Headers: headers})
+		_, body, _ := splitResponse(response)
+		if status != "200" || string(body) != tc.body {
+			t.Errorf("%s: expected %q, got %s %q", tc.path, tc.body, status, body)
+		}
+	}
+
+	response, _ := router.dispatch(&Request{Method: "GET", Path: "/rules/x", Headers: Headers{}})
+	head, _, _ := splitResponse(response)
+	if responseHeader(head, "Server") != "" || responseHeader(head, "Content-Type") != "text/markdown" ||
+		!strings.Contains(string(head), "X-Upstream: a\r\nX-Upstream: b") {
+		t.Errorf("Expected the response rules applied, got %q", head)
+	}
+
+	for _, spec := range []RouteSpec{
+		{Path: "/x", Redirect: "/y", KeepPrefix: true},
+		{Path: "/x", Proxy: upstream.URL, Host: "a", PreserveHost: true},
+		{Path: "/x", Proxy: upstream.URL, Host: "a\r\nX-Injected: 1"},
+		{Path: "/x", Proxy: upstream.URL, RequestHeaders: &HeaderRules{Set: map[string]string{"Bad Name": "v"}}},
+		{Path: "/x", Proxy: upstream.URL, RequestHeaders: &HeaderRules{Add: map[string]string{"X-Ok": "a\r\nb"}}},
+		{Path: "/x", Proxy: upstream.URL, ResponseHeaders: &HeaderRules{Set: map[string]string{"Content-Length": "1"}}},
+		{Path: "/x", Proxy: upstream.URL, RequestHeaders: &HeaderRules{Set: map[string]string{"Host": "a"}}},
+	} {
+		if err := (&RouteTable{Routes: []RouteSpec{spec}}).Apply(NewRouter()); err == nil {
+			t.Errorf("Expected %+v to be rejected", spec)
+		}
+	}
+}
+
+// Test Config.StaticDir, DisableStatic and Static mounts
+func TestStaticDirAndMounts(t *testing.T) {
+	root, docs := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(root, "index.html"), []byte("home"), 0o644)
+	os.WriteFile(filepath.Join(root, "404.html"), []byte("custom missing"), 0o644)
+	os.WriteFile(filepath.Join(docs, "guide.txt"), []byte("guide"), 0o644)
+	os.WriteFile(filepath.Join(docs, "secret.env"), []byte("KEY=1"), 0o644)
+
+	config := DefaultConfig()
+	config.StaticDir = root
+	router := NewRouterWithConfig(config)
+	router.Static("/docs/", docs)
+
+	tests := []struct {
+		path, status, body string
+	}{
+		{"/", "200", "home"},
+		{"/docs/guide.txt", "200", "guide"},
+		{"/docs/secret.env", "404", "custom missing"},
+		{"/docs/missing.txt", "404", "custom missing"},
+		{"/nothing", "404", "custom missing"},
+	}
+	for _, tt := range tests {
+		response, status := router.routeRequest(&Request{Method: "GET", Path: tt.path})
+		if _, body, _ := splitResponse(response); status != tt.status || string(body) != tt.body {
+			t.Errorf("%s: expected %s %q, got %s %q", tt.path, tt.status, tt.body, status, body)
+		}
+	}
+
+	config = DefaultConfig()
+	config.StaticDir = root
+	config.DisableStatic = true
+	router = NewRouterWithConfig(config)
+	if response, status := router.routeRequest(&Request{Method: "GET", Path: "/index.html"}); status != "404" || strings.Contains(string(response), "custom") {
+		t.Errorf("Expected plain 404 with static serving disabled, got %s %q", status, response)
+	}
+}
+
+// Test RequireSignature accepts SignRequest signatures once and within the skew
+func TestRequestSignature(t *testing.T) {
+	key := []byte("shared-secret")
+	clock := NewFakeClock(time.Unix(1700000000, 0))
+	router := NewRouter()
+	router.Use(RequireSignature(SignatureConfig{
+		Key: func(keyID string) ([]byte, error) {
+			if keyID != "billing" && keyID != "billing-legacy" {
+				return nil, errors.New("unknown key")
+			}
+			return key, nil
+		},
+		Clock: clock,
+	}))
+	router.Register("POST", "/charges", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("charged"))
+	})
+
+	signed := func(body string, at time.Time) *Request {
+		outbound, _ := http.NewRequest("POST", "http://internal/charges?currency=eur", strings.NewReader(body))
+		if err := SignRequest(outbound, "billing", key, at); err != nil {
+			t.Fatal(err)
+		}
+		if restored, _ := io.ReadAll(outbound.Body); string(restored) != body {
+			t.Fatalf("Expected body to be restored, got %q", restored)
+		}
+		headers := make(map[string]string)
+		for name := range outbound.Header {
+			headers[name] = outbound.Header.Get(name)
+		}
+		return &Request{Method: "POST", Path: "/charges", Headers: headers, RawBody: []byte(body), rawQuery: "currency=eur"}
+	}
+
+	req := signed(`{"amount":5}`, clock.Now())
+	if _, status := router.dispatch(req); status != "200" {
+		t.Fatalf("Expected 200, got %s", status)
+	}
+	if _, status := router.dispatch(req); status != "401" {
+		t.Errorf("Expected replay to get 401, got %s", status)
+	}
+
+	tampered := signed(`{"amount":5}`, clock.Now().Add(-time.Second))
+	tampered.RawBody = []byte(`{"amount":500}`)
+	if _, status := router.dispatch(tampered); status != "401" {
+		t.Errorf("Expected tampered body to get 401, got %s", status)
+	}
+	if _, status := router.dispatch(signed("{}", clock.Now().Add(-10*time.Minute))); status != "401" {
+		t.Errorf("Expected stale timestamp to get 401, got %s", status)
+	}
+	if _, status := router.dispatch(&Request{Method: "POST", Path: "/charges"}); status != "401" {
+		t.Errorf("Expected unsigned request to get 401, got %s", status)
+	}
+
+	if _, status := router.dispatch(signed(`{"amount":5}`, clock.Now())); status != "200" {
+		t.Errorf("Expected an identical request with a fresh nonce to get 200, got %s", status)
+	}
+	requery := signed(`{"amount":5}`, clock.Now())
+	requery.rawQuery = "currency=usd"
+	if _, status := router.dispatch(requery); status != "401" {
+		t.Errorf("Expected a changed query to get 401, got %s", status)
+	}
+	rekeyed := signed(`{"amount":5}`, clock.Now())
+	rekeyed.Headers[SignatureKeyIDHeader] = "billing-legacy"
+	if _, status := router.dispatch(rekeyed); status != "401" {
+		t.Errorf("Expected a swapped key ID to get 401, got %s", status)
+	}
+
+	// Escaped paths are signed as they arrive on the wire
+	router.Register("POST", "/files/:name", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("stored"))
+	})
+	outbound, _ := http.NewRequest("POST", "http://internal/files/a%20b?v=1", strings.NewReader("data"))
+	if err := SignRequest(outbound, "billing", key, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var wire bytes.Buffer
+	outbound.Write(&wire)
+	if _, status, _ := router.processRequest(nil, wire.Bytes()); status != "200" {
+		t.Errorf("Expected a signed escaped path to get 200, got %s", status)
+	}
+}
+
+// Test StaticFS serves files from an fs.FS with content-based ETags
+func TestStaticFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app.css":       {Data: []byte("body{}")},
+		"img/logo.svg":  {Data: []byte("<svg/>")},
+		"img/.DS_Store": {Data: []byte("junk")},
+	}
+	router := NewRouter()
+	router.StaticFS("/assets", fsys)
+
+	response, status := router.dispatch(&Request{Method: "GET", Path: "/assets/img/logo.svg"})
+	head, body, _ := splitResponse(response)
+	if status != "200" || string(body) != "<svg/>" || !strings.Contains(responseHeader(head, "Content-Type"), "svg") {
+		t.Fatalf("Expected embedded SVG, got %s %q", status, response)
+	}
+	etag := responseHeader(head, "ETag")
+	if etag == "" || responseHeader(head, "Last-Modified") != "" {
+		t.Errorf("Expected content ETag without Last-Modified, got %s", head)
+	}
+	if _, status := router.dispatch(&Request{Method: "GET", Path: "/assets/img/logo.svg", Headers: map[string]string{"If-None-Match": etag}}); status != "304" {
+		t.Errorf("Expected 304 for matching ETag, got %s", status)
+	}
+
+	for _, path := range []string{"/assets/img", "/assets/img/.DS_Store", "/assets/missing.js"} {
+		if _, status := router.dispatch(&Request{Method: "GET", Path: path}); status != "404" {
+			t.Errorf("%s: expected 404, got %s", path, status)
+		}
+	}
+	if _, err := (FSResolver{FS: fsys}).Open("/../app.css"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected fs.ErrPermission for traversal, got %v", err)
+	}
+}
+
+// Test directory index files and the opt-in directory listing
+func TestDirectoryListing(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "files", "sub"), 0o755)
+	os.MkdirAll(filepath.Join(root, "site"), 0o755)
+	os.WriteFile(filepath.Join(root, "files", "a <b>.txt"), []byte("hello"), 0o644)
+	os.WriteFile(filepath.Join(root, "files", ".secret"), []byte("x"), 0o644)
+	os.WriteFile(filepath.Join(root, "files", "main.go"), []byte("package main"), 0o644)
+	os.WriteFile(filepath.Join(root, "site", "index.html"), []byte("site index"), 0o644)
+
+	config := DefaultConfig()
+	config.StaticDir = root
+	router := NewRouterWithConfig(config)
+
+	response, status := router.routeRequest(&Request{Method: "GET", Path: "/site"})
+	if _, body, _ := splitResponse(response); status != "200" || string(body) != "site index" {
+		t.Errorf("Expected directory index.html, got %s %q", status, response)
+	}
+	if _, status := router.routeRequest(&Request{Method: "GET", Path: "/files/"}); status != "404" {
+		t.Errorf("Expected 404 with listing disabled, got %s", status)
+	}
+
+	config.DirectoryListing = true
+	response, status = router.routeRequest(&Request{Method: "GET", Path: "/files/"})
+	listing := string(response)
+	if status != "200" {
+		t.Fatalf("Expected listing, got %s %q", status, response)
+	}
+	for _, want := range []string{"Index of /files/", `href="/files/sub/">sub/</a>`, `href="/files/a%20%3Cb%3E.txt">a &lt;b&gt;.txt</a></td><td>5</td>`, `href="/">../</a>`} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("Expected listing to contain %q, got %s", want, listing)
+		}
+	}
+	if strings.Contains(listing, ".secret") || strings.Contains(listing, "main.go") {
+		t.Errorf("Expected hidden and denied files to be omitted, got %s", listing)
+	}
+	if strings.Index(listing, "sub/") > strings.Index(listing, "a &lt;b&gt;") {
+		t.Error("Expected directories to be listed first")
+	}
+}
+
+// Test AutoETag fingerprints bodies and serves 304 from remembered fingerprints
+func TestAutoETag(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	calls := 0
+	router := NewRouter()
+	router.Use(AutoETag(AutoETagConfig{MaxAge: time.Minute, Clock: clock}))
+	router.Register("GET", "/status", func(req *Request) ([]byte, string) {
+		calls++
+		return CreateResponseBytes("200", "application/json", "OK", []byte(`{"ok":true}`))
+	})
+
+	get := func(ifNoneMatch string) ([]byte, string) {
+		return router.dispatch(&Request{Method: "GET", Path: "/status", Headers: map[string]string{"If-None-Match": ifNoneMatch}})
+	}
+
+	response, _ := get("")
+	head, _, _ := splitResponse(response)
+	etag := responseHeader(head, "ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("Expected weak ETag, got %s", head)
+	}
+
+	response, status := get(etag)
+	if _, body, _ := splitResponse(response); status != "304" || len(body) != 0 {
+		t.Errorf("Expected empty 304, got %s %q", status, response)
+	}
+	if calls != 1 {
+		t.Errorf("Expected remembered fingerprint to skip the handler, got %d calls", calls)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, status := get(etag); status != "304" || calls != 2 {
+		t.Errorf("Expected handler to run once the fingerprint expired, got %s after %d calls", status, calls)
+	}
+	if _, status := get(`W/"other"`); status != "200" {
+		t.Errorf("Expected 200 for stale ETag, got %s", status)
+	}
+
+	// Fingerprints are kept per host and Vary'd header, never for credentials
+	router.Register("GET", "/lang", func(req *Request) ([]byte, string) {
+		calls++
+		return CreateResponseBytesWithHeaders("200", "text/plain", "OK", map[string]string{"Vary": "Accept-Language"},
+			[]byte(req.Host+" "+req.Headers.Get("Accept-Language")))
+	})
+	lang := func(host string, headers map[string]string) (string, string) {
+		response, status := router.dispatch(&Request{Method: "GET", Path: "/lang", Host: host, Headers: headers})
+		head, _, _ := splitResponse(response)
+		return responseHeader(head, "ETag"), status
+	}
+	enTag, _ := lang("a.example", map[string]string{"Accept-Language": "en"})
+	for _, tc := range []struct {
+		host    string
+		headers map[string]string
+	}{
+		{"b.example", map[string]string{"If-None-Match": enTag, "Accept-Language": "en"}},
+		{"a.example", map[string]string{"If-None-Match": enTag, "Accept-Language": "fr"}},
+	} {
+		before := calls
+		if _, status := lang(tc.host, tc.headers); status != "200" || calls != before+1 {
+			t.Errorf("%s %v: expected the handler to run for another host or variant, got %s", tc.host, tc.headers, status)
+		}
+	}
+	before := calls
+	deTag, _ := lang("a.example", map[string]string{"Accept-Language": "de", "Authorization": "Bearer t"})
+	lang("a.example", map[string]string{"Accept-Language": "de", "If-None-Match": deTag})
+	if calls != before+2 {
+		t.Errorf("Expected no fingerprint remembered for a request with credentials, got %d calls", calls-before)
+	}
+}
+
+// Test caches are purged by key, by prefix, when expired and entirely
+func TestCachePurge(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	cache := NewResponseCache(time.Minute)
+	cache.Clock = clock
+	etags := NewETagCache(AutoETagConfig{MaxAge: time.Hour, Clock: clock})
+
+	calls := 0
+	router := NewRouter()
+	router.Use(etags.Middleware(), cache.Middleware())
+	router.Register("GET", "/*page", func(req *Request) ([]byte, string) {
+		calls++
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.Path))
+	})
+	router.Register("POST", "/admin/purge", PurgeHandler(cache, etags), NoCache())
+
+	get := func(host, path string) ([]byte, string) {
+		return router.dispatch(&Request{Method: "GET", Path: path, Host: host, Headers: make(Headers)})
+	}
+	cached := func(host, path string) bool {
+		before := calls
+		get(host, path)
+		return calls == before
+	}
+	fill := func() {
+		for _, url := range []string{"a.example/articles/1", "b.example/articles/1", "a.example/articles/2", "a.example/home"} {
+			host, path, _ := strings.Cut(url, "/")
+			get(host, "/"+path)
+		}
+	}
+	purge := func(query string) string {
+		response, _ := router.dispatch(&Request{Method: "POST", Path: "/admin/purge", Headers: make(Headers),
+			Query: parseKeyValuePairsFromBytes([]byte(query))})
+		_, body, _ := splitResponse(response)
+		return string(body)
+	}
+
+	fill()
+	if n := cache.PurgeKey("a.example/articles/1"); n != 1 || cached("a.example", "/articles/1") || !cached("b.example", "/articles/1") {
+		t.Errorf("Expected PurgeKey to drop one host's resource, purged %d", n)
+	}
+	if n := cache.PurgeKey("/articles/1"); n != 2 || cached("b.example", "/articles/1") {
+		t.Errorf("Expected a path key to match every host, purged %d", n)
+	}
+
+	fill()
+	if body := purge("prefix=/articles/"); body != `{"purged":6}` {
+		t.Errorf("Expected three resources purged from each cache, got %s", body)
+	}
+	if cached("a.example", "/articles/2") || !cached("a.example", "/home") {
+		t.Error("Expected only the prefix to be purged")
+	}
+
+	// Remembered fingerprints answer 304 until purged
+	response, _ := get("a.example", "/home")
+	head, _, _ := splitResponse(response)
+	revalidate := &Request{Method: "GET", Path: "/home", Host: "a.example", Headers: Headers{"If-None-Match": responseHeader(head, "ETag")}}
+	cache.Purge()
+	before := calls
+	if _, status := router.dispatch(revalidate); status != "304" || calls != before {
+		t.Errorf("Expected the fingerprint to answer 304 without the handler, got %s", status)
+	}
+	if n := etags.PurgePrefix("a.example/"); n == 0 {
+		t.Error("Expected PurgePrefix to forget a.example fingerprints")
+	}
+	if router.dispatch(revalidate); calls != before+1 {
+		t.Error("Expected the handler to run once the fingerprint was purged")
+	}
+
+	fill()
+	clock.Advance(2 * time.Minute)
+	if n := cache.PurgeExpired(); n != 4 || etags.PurgeExpired() != 0 {
+		t.Errorf("Expected the expired responses purged and the fingerprints kept, purged %d", n)
+	}
+	if body := purge(""); body != `{"purged":4}` || cached("a.example", "/home") {
+		t.Errorf("Expected everything purged, got %s", body)
+	}
+}
+
+// Test per-phase timeouts: header reads and slow handlers
+func TestPhaseTimeouts(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ReadTimeout = 5 * time.Second
+	cfg.HeaderReadTimeout = 50 * time.Millisecond
+	cfg.HandlerTimeout = 50 * time.Millisecond
+	router := NewRouterWithConfig(cfg)
+	router.SetFileResolver(nil)
+	release := make(chan struct{})
+	defer close(release)
+	router.Register("GET", "/slow", func(req *Request) ([]byte, string) {
+		<-release
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("late"))
+	})
+	router.Register("GET", "/fast", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("ok"))
+	})
+
+	// Headers that never finish are cut off by HeaderReadTimeout, not ReadTimeout
+	client, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		router.RunConnection(serverConn)
+		close(done)
+	}()
+	client.Write([]byte("GET /fast HTTP/1.1\r\n"))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Incomplete headers did not time out")
+	}
+	client.Close()
+
+	// A handler exceeding HandlerTimeout gets a 503 and the connection closes
+	client, serverConn = net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+	client.Write([]byte("GET /slow HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 503 || !resp.Close {
+		t.Errorf("Expected 503 closing the connection, got %d close=%v", resp.StatusCode, resp.Close)
+	}
+
+	if _, status, _ := router.processRequest(nil, []byte("GET /fast HTTP/1.1\r\nHost: x\r\n\r\n")); status != "200" {
+		t.Errorf("Expected fast handler to succeed, got %s", status)
+	}
+}
+
+// Test SPA fallback serves index.html for unmatched paths except API prefixes
+func TestSPAFallback(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "index.html"), []byte("app shell"), 0o644)
+
+	config := DefaultConfig()
+	config.StaticDir = root
+	router := NewRouterWithConfig(config)
+	router.Register("GET", "/api/users", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("users"))
+	})
+
+	if _, status := router.routeRequest(&Request{Method: "GET", Path: "/dashboard/settings"}); status != "404" {
+		t.Errorf("Expected 404 with fallback disabled, got %s", status)
+	}
+
+	config.SPAFallback = true
+	response, status := router.routeRequest(&Request{Method: "GET", Path: "/dashboard/settings"})
+	if _, body, _ := splitResponse(response); status != "200" || string(body) != "app shell" {
+		t.Errorf("Expected index.html fallback, got %s %q", status, response)
+	}
+	response, _ = router.routeRequest(&Request{Method: "GET", Path: "/api/users"})
+	if _, body, _ := splitResponse(response); string(body) != "users" {
+		t.Errorf("Expected routes to take precedence, got %q", response)
+	}
+	for _, req := range []*Request{
+		{Method: "GET", Path: "/api/missing"},
+		{Method: "GET", Path: "/api"},
+		{Method: "POST", Path: "/dashboard"},
+	} {
+		if _, status := router.routeRequest(req); status != "404" {
+			t.Errorf("Expected 404 for %s %s, got %s", req.Method, req.Path, status)
+		}
+	}
+	if _, status := router.routeRequest(&Request{Method: "GET", Path: "/apidocs"}); status != "200" {
+		t.Errorf("Expected /apidocs to fall back, got %s", status)
+	}
+
+	config.SPAExcludePrefixes = []string{"/rpc/"}
+	if _, status := router.routeRequest(&Request{Method: "GET", Path: "/api/missing"}); status != "200" {
+		t.Errorf("Expected custom prefixes to replace the default, got %s", status)
+	}
+	if _, status := router.routeRequest(&Request{Method: "GET", Path: "/rpc/call"}); status != "404" {
+		t.Errorf("Expected 404 under custom prefix, got %s", status)
+	}
+}
+
+// Test routes can be added and removed while requests are being served
+func TestUnregisterRoute(t *testing.T) {
+	router := NewRouter()
+	ok := func(body string) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			return CreateResponseBytes("200", "text/plain", "OK", []byte(body))
+		}
+	}
+	router.Register("GET", "/items/:id", ok("get"))
+	router.Register("DELETE", "/items/:id", ok("delete"))
+
+	// Handlers run without the router lock, so they may change routes
+	router.Register("POST", "/plugins", func(req *Request) ([]byte, string) {
+		router.Register("GET", "/plugin", ok("plugin"))
+		return CreateResponseBytes("201", "text/plain", "Created", nil)
+	})
+	if _, status := router.dispatch(&Request{Method: "POST", Path: "/plugins"}); status != "201" {
+		t.Fatalf("Expected 201, got %s", status)
+	}
+	if _, status := router.dispatch(&Request{Method: "GET", Path: "/plugin"}); status != "200" {
+		t.Errorf("Expected route registered by a handler, got %s", status)
+	}
+
+	if !router.Unregister("DELETE", "/items/:id") {
+		t.Error("Expected Unregister to report the removed route")
+	}
+	if router.Unregister("DELETE", "/items/:id") || router.Unregister("PUT", "/nowhere") {
+		t.Error("Expected Unregister of a missing route to report false")
+	}
+	response, status := router.dispatch(&Request{Method: "DELETE", Path: "/items/1"})
+	if status != "405" || responseHeader(response, "Allow") != "GET, HEAD, OPTIONS" {
+		t.Errorf("Expected 405 allowing only GET, got %s %q", status, response)
+	}
+
+	router.Unregister("GET", "/items/:id")
+	if _, status := router.dispatch(&Request{Method: "DELETE", Path: "/items/1"}); status != "404" {
+		t.Errorf("Expected 404 once every method is gone, got %s", status)
+	}
+	for _, info := range router.Routes() {
+		if info.Path == "/items/:id" {
+			t.Errorf("Expected removed route to leave Routes, got %+v", info)
+		}
+	}
+
+	// Concurrent changes and lookups (meaningful under -race)
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			path := "/dyn/" + strconv.Itoa(i)
+			for range 100 {
+				router.Register("GET", path, ok("dyn"))
+				router.Unregister("GET", path)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				router.dispatch(&Request{Method: "GET", Path: "/dyn/" + strconv.Itoa(i)})
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// testPlugin records its lifecycle calls
+type testPlugin struct {
+	name    string
+	initErr error
+	events  *[]string
+}
+
+func (p *testPlugin) Init(s *Server) error {
+	*p.events = append(*p.events, p.name+".init")
+	return p.initErr
+}
+
+func (p *testPlugin) RegisterRoutes(r *Router) {
+	*p.events = append(*p.events, p.name+".routes")
+	r.Register("GET", "/"+p.name, func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(p.name))
+	})
+}
+
+func (p *testPlugin) Shutdown() error {
+	*p.events = append(*p.events, p.name+".shutdown")
+	return nil
+}
+
+// Test plugins are initialized in order and shut down in reverse order
+func TestPluginLifecycle(t *testing.T) {
+	var events []string
+	srv := NewServer("127.0.0.1:0")
+	srv.OnShutdown(func() error {
+		events = append(events, "hook")
+		return nil
+	})
+
+	err := srv.Install(
+		&testPlugin{name: "metrics", events: &events},
+		&testPlugin{name: "admin", events: &events},
+		&testPlugin{name: "broken", initErr: errors.New("no config"), events: &events},
+		&testPlugin{name: "never", events: &events},
+	)
+	if err == nil || !strings.Contains(err.Error(), "no config") {
+		t.Errorf("Expected Init error, got %v", err)
+	}
+	if _, status := srv.Router.dispatch(&Request{Method: "GET", Path: "/admin"}); status != "200" {
+		t.Errorf("Expected plugin route, got %s", status)
+	}
+	if _, status := srv.Router.dispatch(&Request{Method: "GET", Path: "/broken"}); status != "404" {
+		t.Errorf("Expected failed plugin to register no routes, got %s", status)
+	}
+
+	if err := srv.runShutdownHooks(); err != nil {
+		t.Errorf("Unexpected shutdown error: %v", err)
+	}
+	want := "metrics.init,metrics.routes,admin.init,admin.routes,broken.init,hook,admin.shutdown,metrics.shutdown"
+	if got := strings.Join(events, ","); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+// Test precompressed .br and .gz variants are served to clients accepting them
+func TestPrecompressedStatic(t *testing.T) {
+	router := NewRouter()
+	router.SetFileResolver(nil)
+	router.StaticFS("/assets", fstest.MapFS{
+		"style.css":    {Data: []byte("body { color: red }")},
+		"style.css.gz": {Data: []byte("gzip bytes")},
+		"style.css.br": {Data: []byte("brotli bytes")},
+		"app.js":       {Data: []byte("run()")},
+	})
+
+	for _, tc := range []struct {
+		acceptEncoding, path, body, encoding string
+	}{
+		{"gzip, br", "/assets/style.css", "brotli bytes", "br"},
+		{"gzip", "/assets/style.css", "gzip bytes", "gzip"},
+		{"br;q=0.5, gzip", "/assets/style.css", "gzip bytes", "gzip"},
+		{"*", "/assets/style.css", "brotli bytes", "br"},
+		{"br;q=0, gzip;q=0", "/assets/style.css", "body { color: red }", ""},
+		{"", "/assets/style.css", "body { color: red }", ""},
+		{"gzip, br", "/assets/app.js", "run()", ""},
+	} {
+		req := &Request{Method: "GET", Path: tc.path, Headers: map[string]string{}}
+		if tc.acceptEncoding != "" {
+			req.Headers["Accept-Encoding"] = tc.acceptEncoding
+		}
+		response, status := router.dispatch(req)
+		head, body, _ := splitResponse(response)
+		if status != "200" || string(body) != tc.body || responseHeader(head, "Content-Encoding") != tc.encoding {
+			t.Errorf("Accept-Encoding %q for %s: got %s %q", tc.acceptEncoding, tc.path, status, response)
+		}
+		if tc.path == "/assets/style.css" && !strings.HasPrefix(responseHeader(head, "Content-Type"), "text/css") {
+			t.Errorf("Expected the original Content-Type, got %q", responseHeader(head, "Content-Type"))
+		}
+		if hasVariants := tc.path == "/assets/style.css"; hasVariants != (responseHeader(head, "Vary") == "Accept-Encoding") {
+			t.Errorf("Expected Vary: Accept-Encoding exactly on files with variants, got %q", response)
+		}
+	}
+}
+
+// Test Headers canonicalizes keys so lookups ignore case
+func TestHeadersCaseInsensitive(t *testing.T) {
+	h := parseHeaders([]string{
+		"content-type: application/json",
+		"x-forwarded-for: 10.0.0.1",
+		"X-Forwarded-For: 10.0.0.2",
+		"cookie: a=1",
+		"Cookie: b=2",
+	})
+	if h["Content-Type"] != "application/json" || h.Get("CONTENT-TYPE") != "application/json" {
+		t.Errorf("Expected canonical Content-Type, got %v", h)
+	}
+	if got := h.Values("x-forwarded-for"); len(got) != 2 || got[0] != "10.0.0.1" || got[1] != "10.0.0.2" {
+		t.Errorf("Expected repeated headers to be combined, got %q", got)
+	}
+	if h.Get("Cookie") != "a=1; b=2" {
+		t.Errorf("Expected cookies joined with '; ', got %q", h.Get("Cookie"))
+	}
+
+	// Hand-built maps with other spellings still work
+	h = Headers{"x-api-key": "k1"}
+	if h.Get("X-Api-Key") != "k1" {
+		t.Errorf("Expected lookup of a non-canonical key, got %q", h.Get("X-Api-Key"))
+	}
+	h.Set("X-API-KEY", "k2")
+	if len(h) != 1 || h["X-Api-Key"] != "k2" {
+		t.Errorf("Expected Set to replace every spelling, got %v", h)
+	}
+	h.Add("x-api-key", "k3")
+	h.Del("X-Missing")
+	if h.Get("x-api-key") != "k2, k3" || h.Values("X-Missing") != nil {
+		t.Errorf("Unexpected headers after Add/Del: %v", h)
+	}
+	h.Del("x-api-key")
+	if len(h) != 0 {
+		t.Errorf("Expected Del to remove the header, got %v", h)
+	}
+
+	// Lowercase request headers drive body parsing and writer headers replace each other
+	router := NewRouter()
+	router.HandleFunc("POST", "/users", func(w ResponseWriter, req *Request) {
+		w.SetHeader("content-type", "text/html")
+		w.SetHeader("Content-Type", "application/json")
+		w.Write([]byte(req.Body["name"]))
+	})
+	response, _, _ := router.processRequest(nil, []byte("POST /users HTTP/1.1\r\nhost: x\r\ncontent-type: application/json\r\ncontent-length: 14\r\n\r\n{\"name\":\"ada\"}"))
+	head, body, _ := splitResponse(response)
+	if string(body) != "ada" || responseHeader(head, "Content-Type") != "application/json" {
+		t.Errorf("Expected JSON body parsed from a lowercase Content-Type, got %q", response)
+	}
+}
+
+// Test WriteThrough and ResponseBufferSize control when ResponseWriter flushes
+func TestResponseBufferPolicy(t *testing.T) {
+	config := DefaultConfig()
+	config.ResponseBufferSize = 8
+	router := NewRouterWithConfig(config)
+
+	written := make(chan struct{})
+	router.HandleFunc("GET", "/events", func(w ResponseWriter, req *Request) {
+		w.Write([]byte("tick\n"))
+		<-written // the first event must arrive before the handler moves on
+		w.Write([]byte("tock\n"))
+	}, WriteThrough())
+	parts := func(w ResponseWriter, req *Request) {
+		for _, part := range []string{"aaaa", "bbbb", "cccc"} {
+			w.Write([]byte(part))
+		}
+	}
+	router.HandleFunc("GET", "/threshold", parts)
+	router.HandleFunc("GET", "/whole", parts, ResponseBuffer(1<<20))
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+	client.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+
+	client.Write([]byte("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	first := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "tick\n" {
+		t.Fatalf("Expected the first event before the handler finished, got %q %v", first, err)
+	}
+	close(written)
+	if rest, _ := io.ReadAll(resp.Body); string(rest) != "tock\n" {
+		t.Errorf("Expected the second event, got %q", rest)
+	}
+
+	client.Write([]byte("GET /threshold HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read head: %v", err)
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	raw := make([]byte, len("8\r\naaaabbbb\r\n4\r\ncccc\r\n0\r\n\r\n"))
+	io.ReadFull(reader, raw)
+	if string(raw) != "8\r\naaaabbbb\r\n4\r\ncccc\r\n0\r\n\r\n" {
+		t.Errorf("Expected a flush once 8 bytes were buffered, got %q", raw)
+	}
+
+	client.Write([]byte("GET /whole HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ContentLength != 12 || string(body) != "aaaabbbbcccc" {
+		t.Errorf("Expected a fully buffered response, got length %d %q", resp.ContentLength, body)
+	}
+}
+
+// Test a streamed response whose write fails closes the connection
+func TestStreamWriteErrorCloses(t *testing.T) {
+	router := NewRouter()
+	router.HandleFunc("GET", "/events", func(w ResponseWriter, req *Request) {
+		w.Write([]byte("tick\n"))
+	}, WriteThrough())
+
+	client, serverConn := net.Pipe()
+	client.Close()
+	defer serverConn.Close()
+	response, _, shouldClose := router.processRequest(serverConn, []byte("GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if response != nil || !shouldClose {
+		t.Errorf("Expected a failed stream to close the connection, got %q close=%v", response, shouldClose)
+	}
+}
+
+// Test heads are parsed line by line and pipelined requests keep their bytes
+func TestIncrementalHeadParsing(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxHeaderSize = 256
+	router := NewRouterWithConfig(config)
+	router.Register("POST", "/echo", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", req.RawBody)
+	})
+	router.Register("GET", "/ping", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("pong "+req.Headers.Get("X-N")))
+	})
+
+	head, err := readRequestHead(bufio.NewReader(strings.NewReader("\r\nGET /a?b=1 HTTP/1.1\nhost: x\r\nx-list: 1\r\nX-List: 2\r\n\r\nbody")), config, nil)
+	if err != nil || head.method != "GET" || head.target != "/a?b=1" || head.headers.Get("Host") != "x" || head.headers.Get("X-List") != "1, 2" {
+		t.Errorf("Unexpected head %+v, %v", head, err)
+	}
+	if _, err := readRequestHead(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n")), config, nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected a truncated head to fail, got %v", err)
+	}
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+	client.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+
+	// Three requests in one write, the first with a body
+	go client.Write([]byte("POST /echo HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello" +
+		"GET /ping HTTP/1.1\r\nHost: x\r\nX-N: 2\r\n\r\n" +
+		"GET /ping HTTP/1.1\r\nHost: x\r\nX-N: 3\r\n\r\n"))
+	for _, want := range []string{"hello", "pong 2", "pong 3"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != want {
+			t.Errorf("Expected %q, got %q", want, body)
+		}
+	}
+
+	// An oversized head gets a 431 before the client finishes sending it
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Write([]byte("GET /ping HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 300) + "\r\n"))
+		if err == nil {
+			_, err = client.Write([]byte("X-More: " + strings.Repeat("b", 8192) + "\r\n\r\n"))
+		}
+		done <- err
+	}()
+	if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != 431 || !resp.Close {
+		t.Errorf("Expected 431 and close, got %v %v", resp, err)
+	} else {
+		io.ReadAll(resp.Body)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to close, got %v", err)
+	}
+	if err := <-done; err == nil {
+		t.Error("Expected the rest of the oversized head to be refused")
+	}
+}
+
+// Test Accepts and AcceptsLanguage negotiate by q-values and specificity
+func TestContentNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		offers []string
+		want   string
+	}{
+		{"", []string{"application/json", "text/html"}, "application/json"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", []string{"application/json", "text/html"}, "text/html"},
+		{"application/json", []string{"text/html", "application/json"}, "application/json"},
+		{"text/*;q=0.5, application/json;q=0.4", []string{"application/json", "text/html"}, "text/html"},
+		{"*/*", []string{"application/json", "text/html"}, "application/json"},
+		{"text/html;q=0, */*", []string{"text/html", "text/plain"}, "text/plain"},
+		{"image/png", []string{"application/json", "text/html"}, ""},
+	} {
+		req := &Request{Headers: Headers{}}
+		if tc.accept != "" {
+			req.Headers.Set("Accept", tc.accept)
+		}
+		if got := req.Accepts(tc.offers...); got != tc.want {
+			t.Errorf("Accept %q with %v: expected %q, got %q", tc.accept, tc.offers, tc.want, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		acceptLanguage string
+		offers         []string
+		want           string
+	}{
+		{"", []string{"en", "fr"}, "en"},
+		{"fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5", []string{"en", "fr"}, "fr"},
+		{"de-DE, en;q=0.5", []string{"en-US", "fr"}, "en-US"},
+		{"en-GB", []string{"en", "en-GB"}, "en-GB"},
+		{"*;q=0.1, fr;q=0", []string{"fr", "es"}, "es"},
+		{"ja", []string{"en", "fr"}, ""},
+	} {
+		req := &Request{Headers: Headers{"Accept-Language": tc.acceptLanguage}}
+		if got := req.AcceptsLanguage(tc.offers...); got != tc.want {
+			t.Errorf("Accept-Language %q with %v: expected %q, got %q", tc.acceptLanguage, tc.offers, tc.want, got)
+		}
+	}
+}
+
+// Test routes pick their own body parser
+func TestRouteBodyParser(t *testing.T) {
+	var captured *Request
+	capture := func(req *Request) ([]byte, string) {
+		captured = req
+		return CreateResponseBytes("200", "text/plain", "OK", nil)
+	}
+	router := NewRouter()
+	router.Register("POST", "/auto", capture)
+	router.Register("POST", "/blob", capture, WithBodyParser(nil))
+	router.Register("POST", "/json", capture, WithBodyParser(ParseJSONBody))
+	router.Register("POST", "/form", capture, WithBodyParser(ParseMultipartBody))
+	router.Register("POST", "/csv", capture, WithBodyParser(func(contentType string, body []byte) (map[string]string, error) {
+		key, value, _ := strings.Cut(string(body), ",")
+		return map[string]string{key: value}, nil
+	}))
+
+	post := func(path, contentType, body string) string {
+		raw := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: x\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s", path, contentType, len(body), body)
+		captured = nil
+		_, status, _ := router.processRequest(nil, []byte(raw))
+		return status
+	}
+
+	if post("/auto", "application/x-www-form-urlencoded", "a=1") != "200" || captured.Body["a"] != "1" {
+		t.Errorf("Expected automatic form parsing, got %v", captured)
+	}
+	if post("/blob", "application/x-www-form-urlencoded", "a=1") != "200" || captured.Body != nil || string(captured.RawBody) != "a=1" {
+		t.Errorf("Expected raw body only, got %+v", captured)
+	}
+	if post("/json", "text/plain", `{"a":1}`) != "200" || captured.Body["a"] != "1" {
+		t.Errorf("Expected JSON parsing regardless of Content-Type, got %+v", captured)
+	}
+	if status := post("/json", "application/json", "a=1"); status != "400" || captured != nil {
+		t.Errorf("Expected 400 for malformed JSON, got %s", status)
+	}
+	if post("/csv", "text/csv", "name,ada") != "200" || captured.Body["name"] != "ada" {
+		t.Errorf("Expected custom parser output, got %+v", captured)
+	}
+
+	multipartBody := "--xyz\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nReport\r\n" +
+		"--xyz\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n\r\nfile data\r\n--xyz--\r\n"
+	if post("/form", "multipart/form-data; boundary=xyz", multipartBody) != "200" || captured.Body["title"] != "Report" || len(captured.Body) != 1 {
+		t.Errorf("Expected multipart fields without files, got %+v", captured)
+	}
+	if status := post("/form", "text/plain", "x"); status != "400" {
+		t.Errorf("Expected 400 for a non-multipart body, got %s", status)
+	}
+}
+
+// Test Expect: 100-continue gets an interim response before the body is sent
+func TestExpectContinue(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxBodySize = 16
+	router := NewRouterWithConfig(config)
+	router.Register("PUT", "/upload", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", req.RawBody)
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+	client.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+
+	go client.Write([]byte("PUT /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n"))
+	interim := make([]byte, len(continueResponse))
+	if _, err := io.ReadFull(reader, interim); err != nil || string(interim) != string(continueResponse) {
+		t.Fatalf("Expected 100 Continue before the body, got %q %v", interim, err)
+	}
+	go client.Write([]byte("hello"))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != 200 || string(body) != "hello" {
+		t.Errorf("Expected 200 hello, got %d %q", resp.StatusCode, body)
+	}
+
+	// A body that would be refused is rejected without asking for it
+	go client.Write([]byte("PUT /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 1000\r\nExpect: 100-continue\r\n\r\n"))
+	resp, err = http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != 413 || !resp.Close {
+		t.Errorf("Expected 413 and close, got %v %v", resp, err)
+	}
+
+	for _, tc := range []struct{ request, status string }{
+		{"PUT /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\nExpect: something-else\r\n\r\nhi", "417"},
+		{"PUT /upload HTTP/1.0\r\nHost: x\r\nContent-Length: 2\r\nExpect: 100-continue\r\n\r\nhi", "200"},
+	} {
+		if _, status, _ := router.processRequest(nil, []byte(tc.request)); status != tc.status {
+			t.Errorf("Expected %s for %q, got %s", tc.status, tc.request, status)
+		}
+	}
+}
+
+// Test ServeImage caches and revalidates images and ServeInline streams readers
+func TestServeImageAndInline(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "avatar.png")
+	large := filepath.Join(dir, "banner.png")
+	os.WriteFile(small, []byte("png-bytes"), 0644)
+	os.WriteFile(large, bytes.Repeat([]byte("x"), 3*mediaChunkSize), 0644)
+
+	router := NewRouter()
+	router.HandleFunc("GET", "/avatar", func(w ResponseWriter, req *Request) {
+		ServeImage(w, req, small, time.Hour)
+	})
+	router.HandleFunc("GET", "/missing", func(w ResponseWriter, req *Request) {
+		ServeImage(w, req, filepath.Join(dir, "none.png"), time.Hour)
+	})
+	router.HandleFunc("GET", "/thumb", func(w ResponseWriter, req *Request) {
+		ServeInline(w, req, "image/png", strings.NewReader("thumb"))
+	})
+
+	response, status, _ := router.processRequest(nil, []byte("GET /avatar HTTP/1.1\r\nHost: x\r\n\r\n"))
+	etag := responseHeader(response, "ETag")
+	if status != "200" || responseHeader(response, "Cache-Control") != "public, max-age=3600" || etag == "" ||
+		responseHeader(response, "Content-Type") != "image/png" || !bytes.HasSuffix(response, []byte("png-bytes")) {
+		t.Fatalf("Unexpected image response %s: %q", status, response)
+	}
+	if _, status, _ := router.processRequest(nil, []byte("GET /avatar HTTP/1.1\r\nHost: x\r\nIf-None-Match: "+etag+"\r\n\r\n")); status != "304" {
+		t.Errorf("Expected 304 on revalidation, got %s", status)
+	}
+	if _, status, _ := router.processRequest(nil, []byte("GET /missing HTTP/1.1\r\nHost: x\r\n\r\n")); status != "404" {
+		t.Errorf("Expected 404 for a missing image, got %s", status)
+	}
+
+	response, status, _ = router.processRequest(nil, []byte("GET /thumb HTTP/1.1\r\nHost: x\r\n\r\n"))
+	etag = responseHeader(response, "ETag")
+	if status != "200" || etag == "" || responseHeader(response, "Cache-Control") != "no-cache" {
+		t.Fatalf("Unexpected inline response %s: %q", status, response)
+	}
+	if _, status, _ := router.processRequest(nil, []byte("GET /thumb HTTP/1.1\r\nHost: x\r\nIf-None-Match: "+etag+"\r\n\r\n")); status != "304" {
+		t.Errorf("Expected 304 for unchanged inline media, got %s", status)
+	}
+
+	// Large images are streamed in chunks
+	router.HandleFunc("GET", "/banner", func(w ResponseWriter, req *Request) {
+		ServeImage(w, req, large, time.Hour)
+	})
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go client.Write([]byte("GET /banner HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if len(resp.TransferEncoding) == 0 || len(body) != 3*mediaChunkSize || resp.Header.Get("ETag") == "" {
+		t.Errorf("Expected a chunked %d-byte image, got %v %d", 3*mediaChunkSize, resp.TransferEncoding, len(body))
+	}
+}
+
+// Test the debug console commands over a connection
+func TestDebugConsole(t *testing.T) {
+	srv := NewServer(":0")
+	srv.DebugConsole = true
+	srv.Register("GET", "/ping", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("pong"))
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go srv.serveDebugConsole(serverConn)
+	client.SetDeadline(time.Now().Add(time.Second))
+
+	go client.Write([]byte("routes\nlog on\nstats\nbogus\nquit\n"))
+	output, _ := io.ReadAll(client)
+	for _, want := range []string{"GET     /ping", "request logging on", "goroutines", "logging     true", `unknown command "bogus"`, "bye"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("Expected %q in console output:\n%s", want, output)
+		}
+	}
+	if !srv.Router.logging.Load() {
+		t.Error("Expected log on to enable request logging")
+	}
+}
+
+// Test malformed request lines and header fields are rejected with 400
+func TestStrictRequestParsing(t *testing.T) {
+	router := NewRouter()
+	router.Register("GET", "/ping", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("pong"))
+	})
+
+	cases := map[string]string{
+		"GET /ping HTTP/1.1\r\nHost: x\r\nX-Tab:\tok\r\n\r\n":      "200",
+		"GET /ping HTTP/1.1\r\nHost: x\r\n\r\n":                    "200",
+		"G(T /ping HTTP/1.1\r\nHost: x\r\n\r\n":                    "400",
+		"GET /pi ng HTTP/1.1\r\nHost: x\r\n\r\n":                   "400",
+		"GET /pi\x01ng HTTP/1.1\r\nHost: x\r\n\r\n":                "400",
+		"GET  /ping HTTP/1.1\r\nHost: x\r\n\r\n":                   "400",
+		"GET /ping HTTP/x\r\nHost: x\r\n\r\n":                      "400",
+		"GET /ping HTTP/1.1\r\nHost : x\r\n\r\n":                   "400",
+		"GET /ping HTTP/1.1\r\nBad Name: x\r\n\r\n":                "400",
+		"GET /ping HTTP/1.1\r\nno-colon\r\n\r\n":                   "400",
+		"GET /ping HTTP/1.1\r\nHost: x\r\n folded\r\n\r\n":         "400",
+		"GET /ping HTTP/1.1\r\nHost: x\r\nX-Evil: a\rb\r\n\r\n":    "400",
+		"GET /ping HTTP/1.1\r\nHost: x\r\nX-Nul: a\x00b\r\n\r\n":   "400",
+		"GET /ping HTTP/1.1\r\nHost: x\r\n\xffName: value\r\n\r\n": "400",
+	}
+	for raw, want := range cases {
+		if _, status, _ := router.processRequest(nil, []byte(raw)); status != want {
+			t.Errorf("Expected %s for %q, got %s", want, raw, status)
+		}
+	}
+}
+
+// Fuzz the request head parser: it must not panic, and anything it accepts
+// must satisfy the token and control-byte rules
+func FuzzReadRequestHead(f *testing.F) {
+	f.Add([]byte("GET /ping?x=1 HTTP/1.1\r\nHost: localhost\r\nAccept: */*\r\n\r\n"))
+	f.Add([]byte("\r\nPOST /upload HTTP/1.0\nContent-Length: 3\n\nabc"))
+	f.Add([]byte("GET / HTTP/1.1\r\nCookie: a=1\r\nCookie: b=2\r\n\r\n"))
+	f.Add([]byte("GET /\x7f HTTP/1.1\r\nX: a\rb\r\n\r\n"))
+	config := DefaultConfig()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		head, err := readRequestHead(bufio.NewReader(bytes.NewReader(data)), config, nil)
+		if err != nil {
+			return
+		}
+		if !isToken([]byte(head.method)) || !validTarget([]byte(head.target)) || !validProto([]byte(head.proto)) {
+			t.Fatalf("Accepted invalid request line %q %q %q", head.method, head.target, head.proto)
+		}
+		for key, value := range head.headers {
+			if !isToken([]byte(key)) || strings.ContainsAny(value, "\r\n\x00") {
+				t.Fatalf("Accepted invalid header %q: %q", key, value)
+			}
+		}
+	})
+}
+
+// Test header count and line limits answer with 431, and long targets with 414
+func TestHeaderLimits(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxHeaderCount = 3
+	config.MaxHeaderLineSize = 32
+	config.MaxURLLength = 64
+	router := NewRouterWithConfig(config)
+	router.Register("GET", "/ping", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("pong"))
+	})
+
+	cases := map[string]string{
+		"GET /ping HTTP/1.1\r\nHost: x\r\nA: 1\r\nB: 2\r\n\r\n":                            "200",
+		"GET /ping HTTP/1.1\r\nHost: x\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n":                    "431",
+		"GET /ping HTTP/1.1\r\nHost: x\r\nX-Long: " + strings.Repeat("a", 24) + "\r\n\r\n": "200",
+		"GET /ping HTTP/1.1\r\nHost: x\r\nX-Long: " + strings.Repeat("a", 25) + "\r\n\r\n": "431",
+		"GET /ping?q=" + strings.Repeat("a", 64) + " HTTP/1.1\r\nHost: x\r\n\r\n":          "414",
+	}
+	for raw, want := range cases {
+		response, status, closeConn := router.processRequest(nil, []byte(raw))
+		if status != want {
+			t.Errorf("Expected %s for %q, got %s", want, raw, status)
+		}
+		if want == "431" && (!closeConn || !bytes.Contains(response, []byte("Request Header Fields Too Large"))) {
+			t.Errorf("Expected a closing 431 response, got %q", response)
+		}
+	}
+}
+
+// Test integer status codes build responses with canonical reason phrases
+func TestIntStatusCodes(t *testing.T) {
+	response, status := Respond(StatusCreated, "text/plain", []byte("made"))
+	if status != "201" || !strings.HasPrefix(string(response), "HTTP/1.1 201 Created\r\n") {
+		t.Errorf("Unexpected response %s: %q", status, response)
+	}
+	response, _ = RespondWithHeaders(StatusTeapot, "text/plain", Headers{"X-Brew": "tea"}, nil)
+	if !strings.HasPrefix(string(response), "HTTP/1.1 418 I'm a teapot\r\n") || responseHeader(response, "X-Brew") != "tea" {
+		t.Errorf("Unexpected response %q", response)
+	}
+	if _, status := Serve405("GET", "/"); StatusCode(status) != StatusMethodNotAllowed {
+		t.Errorf("Expected StatusCode to parse %q", status)
+	}
+	if StatusCode("abc") != 0 || StatusText(299) != "" || StatusText(StatusTooManyRequests) != "Too Many Requests" {
+		t.Error("Unexpected StatusCode/StatusText results")
+	}
+}
+
+// Test malformed JSON bodies are reported in BodyErr or rejected with 400
+func TestBodyParseError(t *testing.T) {
+	handler := func(req *Request) ([]byte, string) {
+		if req.BodyErr != nil {
+			return Serve400("bad body: " + req.Body["name"])
+		}
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("name="+req.Body["name"]))
+	}
+	post := func(router *Router, body string) string {
+		raw := fmt.Sprintf("POST /users HTTP/1.1\r\nHost: x\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		response, _, _ := router.processRequest(nil, []byte(raw))
+		_, respBody, _ := splitResponse(response)
+		return string(respBody)
+	}
+
+	router := NewRouter()
+	router.Register("POST", "/users", handler)
+	for body, want := range map[string]string{
+		`{"name":"ada"}`: "name=ada",
+		`[1,2]`:          "name=",
+		`{"name":`:       "bad body: ",
+	} {
+		if got := post(router, body); got != want {
+			t.Errorf("Expected %q for %s, got %q", want, body, got)
+		}
+	}
+
+	config := DefaultConfig()
+	config.RejectInvalidBody = true
+	strict := NewRouterWithConfig(config)
+	strict.Register("POST", "/users", handler)
+	if got := post(strict, `{"name":`); got != "Invalid request body" {
+		t.Errorf("Expected the server to reject malformed JSON, got %q", got)
+	}
+}
+
+// Test HTTP/1.1 requests need one Host header and virtual hosts pick routers
+func TestHostHeaderAndVirtualHosts(t *testing.T) {
+	named := func(name string) *Router {
+		router := NewRouter()
+		router.SetFileResolver(nil)
+		router.Register("GET", "/", func(req *Request) ([]byte, string) {
+			return CreateResponseBytes("200", "text/plain", "OK", []byte(name+" "+req.Host))
+		})
+		return router
+	}
+	front := named("default")
+	vh := NewVirtualHosts(front)
+	vh.Host("API.example.com", named("api"))
+	vh.Host("*.example.com", named("tenant"))
+
+	for raw, want := range map[string]string{
+		"GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n":      "200 api api.example.com",
+		"GET / HTTP/1.1\r\nHost: Api.Example.com:8080\r\n\r\n": "200 api Api.Example.com:8080",
+		"GET / HTTP/1.1\r\nHost: shop.example.com\r\n\r\n":     "200 tenant shop.example.com",
+		"GET / HTTP/1.1\r\nHost: a.b.example.com.\r\n\r\n":     "200 tenant a.b.example.com.",
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n":          "200 default example.com",
+		"GET / HTTP/1.0\r\n\r\n":                               "200 default ",
+		"GET / HTTP/1.1\r\n\r\n":                               "400 Missing or invalid Host header",
+		"GET / HTTP/1.1\r\nHost: a.com\r\nHost: b.com\r\n\r\n": "400 Missing or invalid Host header",
+		"GET / HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n":           "200 default [::1]:8080",
+		"GET / HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n":             "200 default 10.0.0.1",
+		"GET / HTTP/1.1\r\nHost: <x>.example.com\r\n\r\n":      "400 Missing or invalid Host header",
+		"GET / HTTP/1.1\r\nHost: a/b.example.com\r\n\r\n":      "400 Missing or invalid Host header",
+		"GET / HTTP/1.1\r\nHost: example.com:80a\r\n\r\n":      "400 Missing or invalid Host header",
+		"GET / HTTP/1.1\r\nHost: [::1\r\n\r\n":                 "400 Missing or invalid Host header",
+		"GET / HTTP/1.1\r\nHost: x'or'1.example.com\r\n\r\n":   "400 Missing or invalid Host header",
+	} {
+		response, status, _ := front.processRequest(nil, []byte(raw))
+		_, body, _ := splitResponse(response)
+		if got := status + " " + string(body); got != want {
+			t.Errorf("Expected %q for %q, got %q", want, raw, got)
+		}
+	}
+
+	vh.Host("api.example.com", nil)
+	response, _, _ := front.processRequest(nil, []byte("GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n"))
+	if _, body, _ := splitResponse(response); string(body) != "tenant api.example.com" {
+		t.Errorf("Expected the removed host to fall back to the wildcard, got %q", body)
+	}
+}
+
+// Test unread StreamBody bodies are drained for keep-alive up to MaxDrainSize
+func TestStreamBodyDrain(t *testing.T) {
+	exchange := func(drainSize int64) (string, bool) {
+		config := DefaultConfig()
+		config.MaxDrainSize = drainSize
+		router := NewRouterWithConfig(config)
+		router.Register("POST", "/ignore", func(req *Request) ([]byte, string) {
+			return CreateResponseBytes("200", "text/plain", "OK", []byte("ignored"))
+		}, StreamBody())
+		router.Register("GET", "/ping", func(req *Request) ([]byte, string) {
+			return CreateResponseBytes("200", "text/plain", "OK", []byte("pong"))
+		})
+
+		client, serverConn := net.Pipe()
+		defer client.Close()
+		go router.RunConnection(serverConn)
+		client.SetDeadline(time.Now().Add(time.Second))
+		reader := bufio.NewReader(client)
+
+		go client.Write([]byte("POST /ignore HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\n0123456789" +
+			"GET /ping HTTP/1.1\r\nHost: x\r\n\r\n"))
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		io.ReadAll(resp.Body)
+		if resp.Close {
+			return "", true
+		}
+		resp, err = http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read second response: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), false
+	}
+
+	if body, closed := exchange(0); closed || body != "pong" {
+		t.Errorf("Expected the unread body to be drained and the next request answered, got %q closed=%v", body, closed)
+	}
+	if _, closed := exchange(4); !closed {
+		t.Error("Expected a body over MaxDrainSize to close the connection")
+	}
+}
+
+// Test :param labels in virtual host names are captured into PathParams
+func TestVirtualHostParams(t *testing.T) {
+	front := NewRouter()
+	front.SetFileResolver(nil)
+	shop := NewRouter()
+	shop.SetFileResolver(nil)
+	shop.Register("GET", "/items/:id", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.PathParams["tenant"]+"/"+req.PathParams["id"]))
+	})
+	shop.Register("GET", "/as/:tenant", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.PathParams["tenant"]))
+	})
+	vh := NewVirtualHosts(front)
+	vh.Host(":tenant.shop.example.com", shop)
+	vh.Host("admin.shop.example.com", NewRouter())
+
+	for raw, want := range map[string]string{
+		"GET /items/7 HTTP/1.1\r\nHost: Acme.shop.example.com:443\r\n\r\n": "200 acme/7",
+		"GET /as/path HTTP/1.1\r\nHost: acme.shop.example.com\r\n\r\n":     "200 path",
+		"GET /items/7 HTTP/1.1\r\nHost: a.b.shop.example.com\r\n\r\n":      "404",
+		"GET /items/7 HTTP/1.1\r\nHost: admin.shop.example.com\r\n\r\n":    "404",
+	} {
+		response, status, _ := front.processRequest(nil, []byte(raw))
+		got := status
+		if status == "200" {
+			_, body, _ := splitResponse(response)
+			got += " " + string(body)
+		}
+		if got != want {
+			t.Errorf("Expected %q for %q, got %q", want, raw, got)
+		}
+	}
+
+	vh.Host(":tenant.shop.example.com", nil)
+	if _, status, _ := front.processRequest(nil, []byte("GET /items/7 HTTP/1.1\r\nHost: acme.shop.example.com\r\n\r\n")); status != "404" {
+		t.Errorf("Expected the removed pattern to fall back to the default router, got %s", status)
+	}
+}
+
+// Test ConcurrentRequests runs pipelined GETs in parallel, answering in order
+func TestConcurrentRequests(t *testing.T) {
+	config := DefaultConfig()
+	config.ConcurrentRequests = true
+	router := NewRouterWithConfig(config)
+	router.SetFileResolver(nil)
+	release := make(chan struct{})
+	router.Register("GET", "/slow", func(req *Request) ([]byte, string) {
+		<-release
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("slow"))
+	})
+	router.Register("GET", "/fast", func(req *Request) ([]byte, string) {
+		// Only reachable while /slow is blocked if handlers run concurrently
+		close(release)
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("fast"))
+	})
+	router.Register("POST", "/echo", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", req.RawBody)
+	})
+	router.Register("GET", "/panic", func(req *Request) ([]byte, string) {
+		panic("boom")
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(client)
+
+	go client.Write([]byte("GET /slow HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"GET /fast HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"POST /echo HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET /panic HTTP/1.1\r\nHost: x\r\n\r\n"))
+	for _, want := range []string{"200 slow", "200 fast", "200 body", "500 Internal server error occurred"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response for %q: %v", want, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if got := fmt.Sprintf("%d %s", resp.StatusCode, body); got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to close after the panic, got %v", err)
+	}
+}
+
+// Test ContentLength and ContentType are parsed from the request head
+func TestContentLengthAndType(t *testing.T) {
+	router := NewRouter()
+	router.Register("POST", "/upload", func(req *Request) ([]byte, string) {
+		body := fmt.Sprintf("%d %s %s", req.ContentLength, req.ContentType.Type, req.ContentType.Params["charset"])
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(body))
+	})
+
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{
+			name:    "length and params",
+			request: "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: Application/JSON; charset=UTF-8\r\nContent-Length: 2\r\n\r\n{}",
+			want:    "2 application/json UTF-8",
+		},
+		{
+			name:    "chunked",
+			request: "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+			want:    "3 text/plain ",
+		},
+		{
+			name:    "no body",
+			request: "POST /upload HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			want:    "0  ",
+		},
+		{
+			name:    "unparseable params",
+			request: "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/csv; charset\r\nContent-Length: 1\r\n\r\na",
+			want:    "1 text/csv ",
+		},
+	}
+	for _, tt := range tests {
+		response, _, _ := router.processRequest(nil, []byte(tt.request))
+		if _, body, _ := splitResponse(response); string(body) != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, body)
+		}
+	}
+}
+
+// Test CONNECT tunnels authenticate, splice bytes and refuse guarded targets
+func TestConnectTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	address := echo.Addr().String()
+	config := DefaultConfig()
+	config.Tunnel = &TunnelConfig{
+		Authenticate: func(username, password string) bool {
+			return username == "ada" && password == "secret"
+		},
+		Allow:       func(target string) bool { return target == address },
+		IdleTimeout: 100 * time.Millisecond,
+	}
+	router := NewRouterWithConfig(config)
+
+	connect := func(head string) (*http.Response, net.Conn, *bufio.Reader) {
+		client, serverConn := net.Pipe()
+		go router.RunConnection(serverConn)
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		go client.Write([]byte(head))
+		reader := bufio.NewReader(client)
+		resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+		if err != nil {
+			t.Fatalf("Failed to read CONNECT response: %v", err)
+		}
+		return resp, client, reader
+	}
+
+	resp, client, _ := connect("CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n\r\n")
+	client.Close()
+	if resp.StatusCode != 407 || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Errorf("Expected 407 with Proxy-Authenticate, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// Bytes sent right after the head must reach the target too
+	credentials := base64.StdEncoding.EncodeToString([]byte("ada:secret"))
+	resp, client, reader := connect("CONNECT " + address + " HTTP/1.1\r\nHost: " + address +
+		"\r\nProxy-Authorization: Basic " + credentials + "\r\n\r\nhello ")
+	defer client.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	go client.Write([]byte("world"))
+	got := make([]byte, len("hello world"))
+	if _, err := io.ReadFull(reader, got); err != nil || string(got) != "hello world" {
+		t.Errorf("Expected the tunnel to echo %q, got %q (%v)", "hello world", got, err)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected an idle tunnel to close, got %v", err)
+	}
+
+	// Middleware wraps the outcome, and internal targets need Allow
+	guarded := DefaultConfig()
+	guarded.Tunnel = &TunnelConfig{}
+	router = NewRouterWithConfig(guarded)
+	var seen string
+	router.Use(func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			response, status := next(req)
+			seen = status
+			return response, status
+		}
+	})
+	router.Use(func(next RouteHandler) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			if req.Headers.Get("X-Block") != "" {
+				return Serve429("")
+			}
+			return next(req)
+		}
+	})
+	for _, tc := range []struct{ target, header, want string }{
+		{address, "X-Block: 1\r\n", "429"},
+		{address, "", "403"},
+		{"localhost:22", "", "403"},
+		{"169.254.169.254:80", "", "403"},
+		{"[::1]:80", "", "403"},
+		{"100.64.0.1:80", "", "403"},
+		{"0.1.2.3:80", "", "403"},
+	} {
+		seen = ""
+		_, serverConn := net.Pipe()
+		request := "CONNECT " + tc.target + " HTTP/1.1\r\nHost: " + tc.target + "\r\n" + tc.header + "\r\n"
+		if _, status, _ := router.processRequest(serverConn, []byte(request)); status != tc.want {
+			t.Errorf("CONNECT %s %q: expected %s, got %s", tc.target, tc.header, tc.want, status)
+		}
+		if StatusCode(seen) != StatusCode(tc.want) {
+			t.Errorf("CONNECT %s %q: expected middleware to see %s, got %q", tc.target, tc.header, tc.want, seen)
+		}
+		serverConn.Close()
+	}
+}
+
+// Test PROXY protocol preambles set RemoteAddr and connections without one are dropped
+func TestProxyProtocol(t *testing.T) {
+	config := DefaultConfig()
+	config.ProxyProtocol = true
+	router := NewRouterWithConfig(config)
+	router.Register("GET", "/ip", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.RemoteAddr))
+	})
+
+	v2 := append([]byte(nil), proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 203, 0, 113, 7, 10, 0, 0, 1, 0x1f, 0x90, 0, 80)
+	tests := []struct {
+		name     string
+		preamble []byte
+		want     string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 198.51.100.22 10.0.0.1 35646 80\r\n"), "198.51.100.22:35646"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 443\r\n"), "[2001:db8::1]:4000"},
+		{"v2 tcp4", v2, "203.0.113.7:8080"},
+		{"missing", nil, ""},
+	}
+	for _, tt := range tests {
+		client, serverConn := net.Pipe()
+		go router.RunConnection(serverConn)
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		go client.Write(append(tt.preamble, "GET /ip HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"...))
+
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		switch {
+		case tt.want == "":
+			if err == nil {
+				t.Errorf("%s: expected the connection to be dropped, got %d", tt.name, resp.StatusCode)
+			}
+		case err != nil:
+			t.Errorf("%s: failed to read response: %v", tt.name, err)
+		default:
+			if body, _ := io.ReadAll(resp.Body); string(body) != tt.want {
+				t.Errorf("%s: expected RemoteAddr %q, got %q", tt.name, tt.want, body)
+			}
+		}
+		client.Close()
+	}
+}
+
+// Test ClientIP follows forwarding headers only from trusted proxies
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name    string
+		remote  string
+		header  string // Config.ForwardedHeader
+		headers Headers
+		want    string
+	}{
+		{"untrusted peer", "203.0.113.9:5000", "", Headers{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.9"},
+		{"no headers", "10.0.0.2:5000", "", Headers{}, "10.0.0.2"},
+		{"x-forwarded-for", "10.0.0.2:5000", "", Headers{"X-Forwarded-For": "6.6.6.6, 198.51.100.7, 10.1.1.1"}, "198.51.100.7"},
+		{"x-real-ip", "10.0.0.2:5000", "X-Real-IP", Headers{"X-Real-Ip": "198.51.100.7"}, "198.51.100.7"},
+		{"forwarded", "10.0.0.2:5000", "Forwarded", Headers{
+			"Forwarded":       `for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"`,
+			"X-Forwarded-For": "198.51.100.7",
+		}, "2001:db8::1"},
+		{"client-sent forwarded", "10.0.0.2:5000", "", Headers{
+			"Forwarded":       "for=1.2.3.4",
+			"X-Forwarded-For": "198.51.100.7",
+		}, "198.51.100.7"},
+		{"client-sent x-real-ip", "10.0.0.2:5000", "", Headers{"X-Real-Ip": "1.2.3.4"}, "10.0.0.2"},
+		{"unknown hop", "10.0.0.2:5000", "Forwarded", Headers{"Forwarded": "for=198.51.100.7, for=unknown"}, "10.0.0.2"},
+		{"all trusted", "10.0.0.2:5000", "", Headers{"X-Forwarded-For": "10.3.3.3, 10.4.4.4"}, "10.3.3.3"},
+	}
+	for _, tt := range tests {
+		req := &Request{RemoteAddr: tt.remote, Headers: tt.headers, trustedProxies: trusted, forwardedHeader: tt.header}
+		if got := req.ClientIP(); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+// Test static segments beat parameters, which beat wildcards, in any registration order
+func TestRoutePriority(t *testing.T) {
+	named := func(name string) RouteHandler {
+		return func(req *Request) ([]byte, string) {
+			return CreateResponseBytes("200", "text/plain", "OK", []byte(name))
+		}
+	}
+	patterns := []string{"/users/:id", "/users/new", "/users/*rest", "/users/:id/posts", "/*any"}
+	for _, order := range [][]int{{0, 1, 2, 3, 4}, {4, 3, 2, 1, 0}, {2, 4, 0, 3, 1}} {
+		router := NewRouter()
+		for _, i := range order {
+			router.Register("GET", patterns[i], named(patterns[i]))
+		}
+		for path, want := range map[string]string{
+			"/users/new":       "/users/new",
+			"/users/42":        "/users/:id",
+			"/users/42/posts":  "/users/:id/posts",
+			"/users/42/photos": "/users/*rest",
+			"/teams/1":         "/*any",
+		} {
+			for i := 0; i < 5; i++ {
+				_, got, _ := splitResponse(routeGet(router, path))
+				if string(got) != want {
+					t.Fatalf("Order %v: expected %s to match %s, got %s", order, path, want, got)
+				}
+			}
+		}
+	}
+
+	router := NewRouter()
+	router.Register("GET", "/users/:id", named("id"))
+	router.Register("POST", "/users/:name", named("name")) // other methods don't conflict
+	router.Register("GET", "/users/:id", named("replaced"))
+	defer func() {
+		if err := recover(); err == nil || !strings.Contains(fmt.Sprint(err), "conflicts with GET /users/:id") {
+			t.Errorf("Expected a conflict panic, got %v", err)
+		}
+	}()
+	router.Register("GET", "/users/:name", named("name"))
+}
+
+// routeGet sends a GET for path through router and returns the response
+func routeGet(router *Router, path string) []byte {
+	response, _, _ := router.processRequest(nil, []byte("GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	return response
+}
+
+// Test trailing-slash redirects and case-insensitive routing
+func TestTrailingSlashAndCase(t *testing.T) {
+	config := DefaultConfig()
+	config.RedirectTrailingSlash = true
+	config.CaseInsensitiveRouting = true
+	router := NewRouterWithConfig(config)
+	router.Register("GET", "/users/:id", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte(req.PathParams["id"]))
+	})
+	router.Register("GET", "/docs/", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("docs"))
+	})
+	router.Register("POST", "/users/:id", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("posted"))
+	})
+
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/Users/AbC", "200 AbC"},
+		{"GET", "/USERS/AbC/?page=2", "301 /USERS/AbC?page=2"},
+		{"GET", "/docs", "301 /docs/"},
+		{"GET", "/DOCS/", "200 docs"},
+		{"POST", "/users/7/", "200 posted"},
+	}
+	for _, tt := range tests {
+		response, status, _ := router.processRequest(nil, []byte(tt.method+" "+tt.path+" HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n"))
+		head, body, _ := splitResponse(response)
+		if status == "301" {
+			body = []byte(responseHeader(head, "Location"))
+		}
+		if got := status + " " + string(body); got != tt.want {
+			t.Errorf("%s %s: expected %q, got %q", tt.method, tt.path, tt.want, got)
+		}
+	}
+
+	router.Register("GET", "/:page", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("page"))
+	})
+	for _, path := range []string{"//evil.com/", "/\\evil.com/"} {
+		response, _, _ := router.processRequest(nil, []byte("GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		head, _, _ := splitResponse(response)
+		if location := responseHeader(head, "Location"); strings.HasPrefix(location, "//") || strings.HasPrefix(location, "/\\") {
+			t.Errorf("GET %s: expected no off-site redirect, got Location %q", path, location)
+		}
+	}
+}
+
+// Test per-route middleware, body limits and timeouts
+func TestPerRouteOptions(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next RouteHandler) RouteHandler {
+			return func(req *Request) ([]byte, string) {
+				order = append(order, name)
+				return next(req)
+			}
+		}
+	}
+	echo := func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", req.RawBody)
+	}
+
+	router := NewRouter()
+	router.Use(trace("global"))
+	router.Register("POST", "/admin", echo, WithMiddleware(trace("auth"), trace("audit")), WithMaxBodySize(4))
+	router.Register("POST", "/open", echo)
+	router.Register("GET", "/slow", func(req *Request) ([]byte, string) {
+		time.Sleep(200 * time.Millisecond)
+		return CreateResponseBytes("200", "text/plain", "OK", []byte("late"))
+	}, WithTimeout(20*time.Millisecond))
+
+	post := func(path, body string) string {
+		request := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n\r\n%s", path, len(body), body)
+		_, status, _ := router.processRequest(nil, []byte(request))
+		return status
+	}
+	if status := post("/admin", "tiny"); status != "200" || strings.Join(order, ",") != "global,auth,audit" {
+		t.Errorf("Expected 200 through global,auth,audit, got %s through %v", status, order)
+	}
+	order = nil
+	if status := post("/open", "tiny"); status != "200" || strings.Join(order, ",") != "global" {
+		t.Errorf("Expected 200 through global only, got %s through %v", status, order)
+	}
+	if status := post("/admin", "too big"); status != "413" {
+		t.Errorf("Expected 413 above the route's body limit, got %s", status)
+	}
+	if status := post("/open", "too big"); status != "200" {
+		t.Errorf("Expected other routes to keep MaxBodySize, got %s", status)
+	}
+	if _, status, _ := router.processRequest(nil, []byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")); status != "503" {
+		t.Errorf("Expected 503 after the route's timeout, got %s", status)
+	}
+}
+
+// Test ServeJSON and WriteJSON encode values and report marshal errors
+func TestServeJSON(t *testing.T) {
+	response, status := ServeJSON("201", map[string]any{"id": 7, "tags": []string{"a"}})
+	head, body, _ := splitResponse(response)
+	if status != "201" || !bytes.HasPrefix(head, []byte("HTTP/1.1 201 Created\r\n")) {
+		t.Errorf("Expected 201 Created, got %q", head)
+	}
+	if got := responseHeader(head, "Content-Type"); got != "application/json; charset=utf-8" {
+		t.Errorf("Expected a JSON content type, got %q", got)
+	}
+	if string(body) != `{"id":7,"tags":["a"]}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+
+	if _, status := ServeJSON("200", make(chan int)); status != "500" {
+		t.Errorf("Expected 500 for an unmarshalable value, got %s", status)
+	}
+
+	handler := WrapHandlerFunc(func(w ResponseWriter, req *Request) {
+		if req.Query["bad"] != "" {
+			if err := WriteJSON(w, StatusOK, func() {}); err == nil {
+				t.Error("Expected WriteJSON to return the marshal error")
+			}
+			return
+		}
+		WriteJSON(w, StatusAccepted, []int{1, 2})
+	})
+	for query, want := range map[string]string{"": "202 [1,2]", "bad=1": "500 Failed to encode JSON response"} {
+		response, status := handler(&Request{Query: parseKeyValuePairsFromBytes([]byte(query))})
+		_, body, _ := splitResponse(response)
+		if got := status + " " + string(body); got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+}
+
+// Test a body cut short of its Content-Length gets 400 and closes the connection
+func TestTruncatedBody(t *testing.T) {
+	router := NewRouter()
+	router.Register("POST", "/upload", func(req *Request) ([]byte, string) {
+		return CreateResponseBytes("200", "text/plain", "OK", req.RawBody)
+	})
+
+	response, status, closeConn := router.processRequest(nil, []byte("POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nabc"))
+	if status != "400" || !closeConn {
+		t.Errorf("Expected 400 closing the connection, got %s close=%v: %q", status, closeConn, response)
+	}
+}
+
+// Test HEAD responses keep Content-Length but carry no body, so pipelined
+// responses after them stay in sync
+func TestHeadResponsesHaveNoBody(t *testing.T) {
+	config := DefaultConfig()
+	config.DisableStatic = true
+	router := NewRouterWithConfig(config)
+	router.StaticFS("/assets", fstest.MapFS{"a.txt": {Data: []byte("hello world\n")}})
+	router.HandleFunc("HEAD", "/stream", func(w ResponseWriter, req *Request) {
+		w.Write([]byte("streamed body"))
+		w.Flush()
+	})
+
+	client, serverConn := net.Pipe()
+	defer client.Close()
+	go router.RunConnection(serverConn)
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	go client.Write([]byte("HEAD /assets/a.txt HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"HEAD /assets/a.txt HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"HEAD /stream HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"GET /assets/a.txt HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"))
+
+	reader := bufio.NewReader(client)
+	for i, method := range []string{"HEAD", "HEAD", "HEAD", "GET"} {
+		resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+		if err != nil {
+			t.Fatalf("Response %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if i < 2 && (resp.StatusCode != 200 || resp.ContentLength != 12) {
+			t.Errorf("Response %d: expected 200 with Content-Length 12, got %d %d", i, resp.StatusCode, resp.ContentLength)
+		}
+		if method == "GET" && string(body) != "hello world\n" {
+			t.Errorf("Expected the GET body after the HEAD responses, got %q", body)
+		}
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected nothing after the last response, got %v", err)
+	}
+}
+
+// Test StreamCommand streams a process's output and kills it once the client leaves
+func TestStreamCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not installed")
+	}
+	stopped := make(chan error, 1)
+	router := NewRouter()
+	router.HandleFunc("GET", "/build", func(w ResponseWriter, req *Request) {
+		StreamCommand(w, exec.Command("sh", "-c", "echo one; echo two"))
+	})
+	router.HandleFunc("GET", "/events", func(w ResponseWriter, req *Request) {
+		StreamCommandEvents(w, exec.Command("sh", "-c", "echo one; echo two; exit 3"))
+	})
+	router.HandleFunc("GET", "/forever", func(w ResponseWriter, req *Request) {
+		stopped <- StreamCommand(w, exec.Command("sh", "-c", "while :; do echo tick; sleep 0.01; done"))
+	})
+
+	connect := func(path string) (net.Conn, *http.Response) {
+		client, serverConn := net.Pipe()
+		go router.RunConnection(serverConn)
+		client.SetDeadline(time.Now().Add(2 * time.Second))
+		go client.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatalf("GET %s: failed to read response: %v", path, err)
+		}
+		return client, resp
+	}
+
+	for path, want := range map[string]string{
+		"/build":  "one\ntwo\n",
+		"/events": "data: one\n\ndata: two\n\nevent: exit\ndata: 3\n\n",
+	} {
+		client, resp := connect(path)
+		body, err := io.ReadAll(resp.Body)
+		client.Close()
+		if err != nil || string(body) != want || len(resp.TransferEncoding) == 0 {
+			t.Errorf("GET %s: expected chunked %q, got %q %v (%v)", path, want, body, resp.TransferEncoding, err)
+		}
+	}
+
+	client, resp := connect("/forever")
+	first := make([]byte, len("tick\n"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "tick\n" {
+		t.Fatalf("Expected output before the process exits, got %q %v", first, err)
+	}
+	client.Close()
+	select {
+	case err := <-stopped:
+		if err == nil {
+			t.Error("Expected the failed write to be returned")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("StreamCommand kept running after the client disconnected")
+	}
+}
+
+// Test resumable uploads resume after an interrupted PATCH, expire and terminate
+func TestResumableUploads(t *testing.T) {
+	store, err := NewDiskStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC))
+	var completed []ResumableUpload
+	uploads := NewResumableUploads(ResumableConfig{
+		Storage:    store,
+		Prefix:     "incoming",
+		MaxSize:    1 << 20,
+		Expiry:     time.Hour,
+		OnComplete: func(upload ResumableUpload) { completed = append(completed, upload) },
+		Clock:      clock,
+	})
+	router := NewRouter()
+	uploads.Register(router, "/files")
+
+	send := func(request string) (head []byte, status string) {
+		response, status, _ := router.processRequest(nil, []byte(request))
+		head, _, _ = splitResponse(response)
+		return head, status
+	}
+	const tus = "Tus-Resumable: 1.0.0\r\n"
+	create := func() string {
+		head, status := send("POST /files HTTP/1.1\r\nHost: x\r\n" + tus + "Upload-Length: 11\r\nUpload-Metadata: filename aGVsbG8udHh0\r\n\r\n")
+		location := responseHeader(head, "Location")
+		if status != "201" || !strings.HasPrefix(location, "/files/") || responseHeader(head, "Tus-Resumable") != "1.0.0" {
+			t.Fatalf("Expected 201 with a Location, got %s %q", status, head)
+		}
+		return location
+	}
+	offsetOf := func(location string) (string, string) {
+		head, status := send("HEAD " + location + " HTTP/1.1\r\nHost: x\r\n" + tus + "\r\n")
+		return responseHeader(head, "Upload-Offset"), status
+	}
+	patch := func(location, offset, body string, contentLength int) (string, string) {
+		head, status := send("PATCH " + location + " HTTP/1.1\r\nHost: x\r\n" + tus +
+			"Content-Type: application/offset+octet-stream\r\nUpload-Offset: " + offset +
+			"\r\nContent-Length: " + strconv.Itoa(contentLength) + "\r\n\r\n" + body)
+		return responseHeader(head, "Upload-Offset"), status
+	}
+
+	if head, status := send("OPTIONS /files HTTP/1.1\r\nHost: x\r\n\r\n"); status != "204" ||
+		responseHeader(head, "Tus-Version") != "1.0.0" || !strings.Contains(responseHeader(head, "Tus-Extension"), "expiration") {
+		t.Errorf("Expected OPTIONS to advertise tus, got %s %q", status, head)
+	}
+	if _, status := send("POST /files HTTP/1.1\r\nHost: x\r\nUpload-Length: 11\r\n\r\n"); status != "412" {
+		t.Errorf("Expected 412 without Tus-Resumable, got %s", status)
+	}
+	if _, status := send("POST /files HTTP/1.1\r\nHost: x\r\n" + tus + "Upload-Length: 2000000\r\n\r\n"); status != "413" {
+		t.Errorf("Expected 413 above MaxSize, got %s", status)
+	}
+
+	location := create()
+	if offset, status := offsetOf(location); status != "200" || offset != "0" {
+		t.Errorf("Expected offset 0 for a new upload, got %s %q", status, offset)
+	}
+	if _, status := send("PATCH " + location + " HTTP/1.1\r\nHost: x\r\n" + tus + "Upload-Offset: 0\r\nContent-Length: 1\r\n\r\nx"); status != "415" {
+		t.Errorf("Expected 415 without the offset content type, got %s", status)
+	}
+	if offset, status := patch(location, "3", "abc", 3); status != "409" || offset != "0" {
+		t.Errorf("Expected 409 with the current offset, got %s %q", status, offset)
+	}
+
+	// The connection drops after 5 of 11 bytes; those are kept
+	if offset, status := patch(location, "0", "hello", 11); status != "204" || offset != "5" {
+		t.Errorf("Expected the interrupted PATCH to store 5 bytes, got %s %q", status, offset)
+	}
+	if offset, _ := offsetOf(location); offset != "5" {
+		t.Errorf("Expected HEAD to report offset 5, got %q", offset)
+	}
+	if offset, status := patch(location, "5", " world", 6); status != "204" || offset != "11" {
+		t.Errorf("Expected the resumed PATCH to finish the upload, got %s %q", status, offset)
+	}
+	if len(completed) != 1 || completed[0].Metadata["filename"] != "hello.txt" {
+		t.Fatalf("Expected OnComplete with the metadata, got %+v", completed)
+	}
+	body, _, err := store.Get(completed[0].Key)
+	if err != nil {
+		t.Fatalf("Expected the upload in storage: %v", err)
+	}
+	content, _ := io.ReadAll(body)
+	body.Close()
+	if string(content) != "hello world" || !strings.HasPrefix(completed[0].Key, "incoming/") {
+		t.Errorf("Expected %q stored below the prefix, got %q at %s", "hello world", content, completed[0].Key)
+	}
+
+	// Unfinished uploads expire with their bytes; terminated ones go at once
+	abandoned := create()
+	patch(abandoned, "0", "hel", 3)
+	clock.Advance(2 * time.Hour)
+	if _, status := offsetOf(abandoned); status != "404" {
+		t.Errorf("Expected an expired upload to be gone, got %s", status)
+	}
+	if objects, _ := store.List("incoming/"); len(objects) != 1 {
+		t.Errorf("Expected only the finished upload left in storage, got %+v", objects)
+	}
+	terminated := create()
+	if _, status := send("DELETE " + terminated + " HTTP/1.1\r\nHost: x\r\n" + tus + "\r\n"); status != "204" {
+		t.Errorf("Expected 204 on termination, got %s", status)
+	}
+	if _, status := offsetOf(terminated); status != "404" {
+		t.Errorf("Expected a terminated upload to be gone, got %s", status)
+	}
+}
@@ -0,0 +1,99 @@
+// Package servertest provides utilities for testing raw-http handlers.
+package servertest
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// VolatileHeaders are replaced by a placeholder before golden comparison
+// because their values change between runs
+var VolatileHeaders = []string{"Date", "X-Request-Id"}
+
+// UpdateEnv names the environment variable that rewrites golden files,
+// e.g. UPDATE_GOLDEN=1 go test ./...
+const UpdateEnv = "UPDATE_GOLDEN"
+
+// MatchGolden compares a raw HTTP response with testdata/<name>.
+// Values of VolatileHeaders and of any extra ignored headers are normalized
+// first. With UPDATE_GOLDEN=1 the golden file is (re)written instead.
+func MatchGolden(t testing.TB, resp []byte, name string, ignoreHeaders ...string) {
+	t.Helper()
+
+	actual := normalizeResponse(resp, append(append([]string{}, VolatileHeaders...), ignoreHeaders...))
+	goldenPath := filepath.Join("testdata", name)
+
+	if os.Getenv(UpdateEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(goldenPath), 0o755); err != nil {
+			t.Fatalf("servertest: creating testdata: %v", err)
+		}
+		if err := os.WriteFile(goldenPath, actual, 0o644); err != nil {
+			t.Fatalf("servertest: writing golden file: %v", err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("servertest: reading golden file (run with %s=1 to create it): %v", UpdateEnv, err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("servertest: response does not match %s:\n%s", goldenPath, diffLines(string(expected), string(actual)))
+	}
+}
+
+// normalizeResponse converts CRLF to LF and masks volatile header values
+func normalizeResponse(resp []byte, volatile []string) []byte {
+	text := strings.ReplaceAll(string(resp), "\r\n", "\n")
+	head, body, found := strings.Cut(text, "\n\n")
+
+	lines := strings.Split(head, "\n")
+	for i, line := range lines[1:] {
+		key, _, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		for _, name := range volatile {
+			if strings.EqualFold(strings.TrimSpace(key), name) {
+				lines[i+1] = key + ": <" + strings.ToLower(name) + ">"
+			}
+		}
+	}
+
+	normalized := strings.Join(lines, "\n")
+	if found {
+		normalized += "\n\n" + body
+	}
+	return []byte(normalized)
+}
+
+// diffLines renders a minimal line diff of two texts
+func diffLines(expected, actual string) string {
+	expectedLines := strings.Split(expected, "\n")
+	actualLines := strings.Split(actual, "\n")
+
+	var b strings.Builder
+	for i := 0; i < max(len(expectedLines), len(actualLines)); i++ {
+		var e, a string
+		if i < len(expectedLines) {
+			e = expectedLines[i]
+		}
+		if i < len(actualLines) {
+			a = actualLines[i]
+		}
+		if e == a {
+			b.WriteString("  " + e + "\n")
+			continue
+		}
+		if i < len(expectedLines) {
+			b.WriteString("- " + e + "\n")
+		}
+		if i < len(actualLines) {
+			b.WriteString("+ " + a + "\n")
+		}
+	}
+	return b.String()
+}
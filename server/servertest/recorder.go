@@ -0,0 +1,110 @@
+package servertest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/codetesla51/raw-http/server"
+)
+
+// NewRequest builds a Request as the router would hand it to a handler, so
+// handlers can be called directly without a listener. path may carry a
+// query string. The request is serialized and parsed by server.ReadRequest,
+// so query, cookies and body parse exactly as they would when served. Host
+// defaults to example.com, Content-Length is set from body and RemoteAddr
+// is 192.0.2.1:1234. PathParams is left for the test to fill in. It panics
+// on a request the router would refuse.
+func NewRequest(method, path string, body []byte, headers map[string]string) *server.Request {
+	header := make(server.Headers, len(headers)+2)
+	for key, value := range headers {
+		header.Set(key, value)
+	}
+	if header.Get("Host") == "" {
+		header.Set("Host", "example.com")
+	}
+	if len(body) > 0 && header.Get("Content-Length") == "" {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	var raw bytes.Buffer
+	fmt.Fprintf(&raw, "%s %s HTTP/1.1\r\n", method, path)
+	for key, value := range header {
+		fmt.Fprintf(&raw, "%s: %s\r\n", key, value)
+	}
+	raw.WriteString("\r\n")
+	raw.Write(body)
+
+	req, err := server.ReadRequest(bufio.NewReader(&raw))
+	if err != nil {
+		panic("servertest: " + err.Error())
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	if req.PathParams == nil {
+		req.PathParams = make(map[string]string)
+	}
+	return req
+}
+
+// ResponseRecorder is a raw response split into its parts
+type ResponseRecorder struct {
+	Code    int            // Status code, e.g. 404
+	Reason  string         // Reason phrase, e.g. "Not Found"
+	Headers server.Headers // Response headers; repeated ones are comma-joined
+	Body    []byte
+	Raw     []byte // The response as the handler returned it
+}
+
+// errMalformedResponse is returned by ParseResponse for bytes that aren't
+// an HTTP/1.x response
+var errMalformedResponse = errors.New("servertest: malformed response")
+
+// ParseResponse splits a raw HTTP/1.x response into status, headers and body
+func ParseResponse(raw []byte) (*ResponseRecorder, error) {
+	head, body, found := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !found {
+		return nil, errMalformedResponse
+	}
+	lines := strings.Split(string(head), "\r\n")
+
+	proto, status, _ := strings.Cut(lines[0], " ")
+	codeText, reason, _ := strings.Cut(status, " ")
+	code, err := strconv.Atoi(codeText)
+	if !strings.HasPrefix(proto, "HTTP/1.") || err != nil {
+		return nil, errMalformedResponse
+	}
+
+	rec := &ResponseRecorder{Code: code, Reason: reason, Headers: make(server.Headers), Body: body, Raw: raw}
+	for _, line := range lines[1:] {
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, errMalformedResponse
+		}
+		rec.Headers.Add(key, strings.TrimSpace(value))
+	}
+	if length, err := strconv.Atoi(rec.Headers.Get("Content-Length")); err == nil && length <= len(body) {
+		rec.Body = body[:length]
+	}
+	return rec, nil
+}
+
+// Record calls handler with req and parses the response it returns,
+// failing the test when it isn't a valid HTTP response
+func Record(t testing.TB, handler server.RouteHandler, req *server.Request) *ResponseRecorder {
+	t.Helper()
+	raw, _ := handler(req)
+	rec, err := ParseResponse(raw)
+	if err != nil {
+		t.Fatalf("%v: %q", err, raw)
+	}
+	return rec
+}
+
+// BodyString returns the body as a string
+func (rec *ResponseRecorder) BodyString() string {
+	return string(rec.Body)
+}
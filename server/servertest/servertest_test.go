@@ -0,0 +1,86 @@
+package servertest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/codetesla51/raw-http/server"
+)
+
+// Test golden comparison masks volatile headers
+func TestMatchGolden(t *testing.T) {
+	resp, _ := server.CreateResponseBytesWithHeaders("200", "text/html", "OK",
+		map[string]string{"Date": "Mon, 02 Jan 2006 15:04:05 GMT", "X-Request-Id": "abc123"},
+		[]byte("<h1>Welcome</h1>"))
+
+	MatchGolden(t, resp, "welcome.golden")
+}
+
+// Test normalization and diff output
+func TestNormalizeResponse(t *testing.T) {
+	resp := []byte("HTTP/1.1 200 OK\r\nDate: today\r\nX-Trace: 1\r\n\r\nbody")
+	normalized := string(normalizeResponse(resp, []string{"date", "X-Trace"}))
+
+	expected := "HTTP/1.1 200 OK\nDate: <date>\nX-Trace: <x-trace>\n\nbody"
+	if normalized != expected {
+		t.Errorf("Expected %q, got %q", expected, normalized)
+	}
+
+	diff := diffLines("a\nb", "a\nc")
+	if !strings.Contains(diff, "- b") || !strings.Contains(diff, "+ c") {
+		t.Errorf("Unexpected diff: %q", diff)
+	}
+}
+
+// Test handlers run directly on built requests
+func TestRecordHandler(t *testing.T) {
+	handler := func(req *server.Request) ([]byte, string) {
+		if req.Body["name"] == "" {
+			return server.Serve400("name required")
+		}
+		body := req.Body["name"] + " " + req.Query["lang"] + " " + req.Cookies["session"]
+		return server.CreateResponseBytesWithHeaders("201", "text/plain", "Created",
+			map[string]string{"X-Charset": req.ContentType.Params["charset"]}, []byte(body))
+	}
+
+	req := NewRequest("POST", "/users?lang=go", []byte(`{"name":"ada"}`), map[string]string{
+		"content-type": "application/json; charset=utf-8",
+		"Cookie":       "session=s1; theme=dark",
+	})
+	rec := Record(t, handler, req)
+	if rec.Code != 201 || rec.Reason != "Created" || rec.BodyString() != "ada go s1" {
+		t.Errorf("Unexpected response: %d %s %q", rec.Code, rec.Reason, rec.Body)
+	}
+	if got := rec.Headers.Get("x-charset"); got != "utf-8" {
+		t.Errorf("Expected X-Charset utf-8, got %q", got)
+	}
+
+	rec = Record(t, handler, NewRequest("POST", "/users", []byte("name="), nil))
+	if rec.Code != 400 {
+		t.Errorf("Expected 400 for an empty form field, got %d", rec.Code)
+	}
+
+	if _, err := ParseResponse([]byte("not a response")); err == nil {
+		t.Error("Expected an error for a malformed response")
+	}
+}
+
+// Test built requests parse query, cookies and body like the router does
+func TestNewRequestMatchesRouter(t *testing.T) {
+	req := NewRequest("POST", "/items?a=1&a=2&b=%zz", []byte("[1]"), map[string]string{
+		"Content-Type": "application/json",
+		"Cookie":       `s=old; s=dup; t="q"`,
+	})
+	if req.Query["a"] != "2" || req.Query["b"] != "%zz" {
+		t.Errorf("Unexpected query %v", req.Query)
+	}
+	if len(req.Cookies) != 2 || req.Cookies["s"] != "old" || req.Cookies["t"] != "q" {
+		t.Errorf("Unexpected cookies %v", req.Cookies)
+	}
+	if req.BodyErr != nil || string(req.RawBody) != "[1]" {
+		t.Errorf("Unexpected body %q: %v", req.RawBody, req.BodyErr)
+	}
+	if req.Host != "example.com" || req.RemoteAddr != "192.0.2.1:1234" || req.PathParams == nil {
+		t.Errorf("Unexpected defaults: host %q, remote %q", req.Host, req.RemoteAddr)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import "strings"
+
+// defaultSPAExcludePrefixes keeps API paths answering 404 under SPA fallback
+var defaultSPAExcludePrefixes = []string{"/api"}
+
+// spaExcluded reports whether path sits under one of the SPA exclude prefixes
+func (c *Config) spaExcluded(path string) bool {
+	prefixes := c.SPAExcludePrefixes
+	if prefixes == nil {
+		prefixes = defaultSPAExcludePrefixes
+	}
+	for _, prefix := range prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// spaFallback serves the static root's index.html for GET and HEAD requests
+// that matched neither a file nor a route, so client-side routers can handle
+// the path
+func (r *Router) spaFallback(req *Request) ([]byte, string, bool) {
+	if !r.config.SPAFallback || req.Method != "GET" && req.Method != "HEAD" || r.config.spaExcluded(req.Path) {
+		return nil, "", false
+	}
+
+	r.mu.RLock()
+	resolver := r.resolver
+	var middleware []Middleware
+	if r.staticMiddleware {
+		middleware = r.middleware
+	}
+	r.mu.RUnlock()
+
+	if resolver == nil {
+		return nil, "", false
+	}
+	file, err := resolver.Open("/index.html")
+	if err != nil {
+		return nil, "", false
+	}
+	serveIndex := func(req *Request) ([]byte, string) {
+		return serveStaticFile(req, resolver, "/index.html", file)
+	}
+	serveIndex = applyMiddleware(serveIndex, middleware)
+	response, status := serveIndex(req)
+	return response, status, true
+}
@@ -1,11 +1,343 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
 	"mime"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+// FileResolver locates static content for a request path.
+// Implementations can back static serving with the local disk, object
+// storage, encrypted stores, or generated content.
+type FileResolver interface {
+	// Open returns the file for a slash-separated request path such as
+	// "/css/app.css". It returns an error wrapping fs.ErrNotExist when
+	// nothing is stored there and fs.ErrPermission when access is denied.
+	Open(name string) (*StaticFile, error)
+}
+
+// StaticFile is the content and metadata returned by a FileResolver
+type StaticFile struct {
+	Content []byte
+	ModTime time.Time
+	Size    int64
+}
+
+// DirResolver serves files from a directory on the local filesystem
+type DirResolver string
+
+// DirectoryLister is implemented by resolvers that can list directories,
+// enabling index.html lookup in subdirectories and Config.DirectoryListing
+type DirectoryLister interface {
+	ReadDir(name string) ([]fs.FileInfo, error)
+}
+
+// resolve maps a request path to a path below the directory, rejecting
+// paths that escape it
+func (d DirResolver) resolve(name string) (string, error) {
+	absBaseDir, err := filepath.Abs(string(d))
+	if err != nil {
+		return "", err
+	}
+	absFilePath, err := filepath.Abs(filepath.Join(absBaseDir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+
+	// Security: Check for path traversal
+	if absFilePath != absBaseDir && !strings.HasPrefix(absFilePath, absBaseDir+string(filepath.Separator)) {
+		return "", fs.ErrPermission
+	}
+	return absFilePath, nil
+}
+
+// Open reads a file below the directory, rejecting paths that escape it
+func (d DirResolver) Open(name string) (*StaticFile, error) {
+	absFilePath, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(absFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+
+	content, err := os.ReadFile(absFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticFile{Content: content, ModTime: info.ModTime(), Size: info.Size()}, nil
+}
+
+// ReadDir lists a directory below the root
+func (d DirResolver) ReadDir(name string) ([]fs.FileInfo, error) {
+	absDirPath, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(absDirPath)
+	if err != nil {
+		return nil, err
+	}
+	return entryInfos(entries)
+}
+
+// FSResolver serves files from an fs.FS, such as an embed.FS
+type FSResolver struct {
+	FS fs.FS
+}
+
+// Open reads a file from the file system. Embedded files have no
+// modification time, so their ETag is derived from the content.
+func (f FSResolver) Open(name string) (*StaticFile, error) {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrPermission
+	}
+
+	info, err := fs.Stat(f.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+	content, err := fs.ReadFile(f.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticFile{Content: content, ModTime: info.ModTime(), Size: info.Size()}, nil
+}
+
+// staticPathAllowed applies dotfile blocking and the extension allow/deny lists to a path.
+// The path is cleaned first, as resolvers drop trailing slashes: "/main.go/" opens main.go.
+func staticPathAllowed(config *Config, name string) bool {
+	name = path.Clean("/" + name)
+	if !config.AllowDotfiles && hasHiddenSegment(name) {
+		return false
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+
+	denied := config.StaticDeniedExtensions
+	if denied == nil {
+		denied = DefaultDeniedExtensions
+	}
+	for _, deniedExt := range denied {
+		if strings.EqualFold(ext, deniedExt) {
+			return false
+		}
+	}
+
+	if len(config.StaticAllowedExtensions) == 0 {
+		return true
+	}
+	for _, allowedExt := range config.StaticAllowedExtensions {
+		if strings.EqualFold(ext, allowedExt) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHiddenSegment reports whether a path contains a dot-prefixed segment such
+// as .git or .env. "." and ".." are left to the traversal check, and
+// .well-known (RFC 8615) is allowed.
+func hasHiddenSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if len(segment) < 2 || segment[0] != '.' || segment == ".." || segment == ".well-known" {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// staticETag derives a strong ETag from the file's size and modification
+// time, or from a hash of its content when the resolver reports no ModTime
+func staticETag(file *StaticFile) string {
+	if file.ModTime.IsZero() {
+		h := fnv.New64a()
+		h.Write(file.Content)
+		return fmt.Sprintf(`"%x"`, h.Sum64())
+	}
+	return fmt.Sprintf(`"%x-%x"`, len(file.Content), file.ModTime.UnixNano())
+}
+
+// staticNotModified evaluates If-None-Match, or If-Modified-Since when no
+// If-None-Match is sent (RFC 9110 section 13.2.2)
+func staticNotModified(req *Request, etag string, modTime time.Time) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if ifNoneMatch := headerValue(req.Headers, "If-None-Match"); ifNoneMatch != "" {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	if modTime.IsZero() {
+		return false
+	}
+	since, err := time.Parse(httpTimeFormat, headerValue(req.Headers, "If-Modified-Since"))
+	return err == nil && !modTime.Truncate(time.Second).After(since)
+}
+
+// precompressedVariants lists the suffixes of precompressed static files by
+// Content-Encoding, most preferred first
+var precompressedVariants = []struct{ encoding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// openPrecompressed returns the precompressed variant of name (name.br or
+// name.gz) with the highest quality in the client's Accept-Encoding, or nil.
+// varies reports whether any variant exists, in which case every response
+// for name depends on Accept-Encoding.
+func openPrecompressed(req *Request, resolver FileResolver, name string) (best *StaticFile, encoding string, varies bool) {
+	if resolver == nil {
+		return nil, "", false
+	}
+	qualities := parseQualityValues(headerValue(req.Headers, "Accept-Encoding"))
+
+	bestQ := 0.0
+	for _, variant := range precompressedVariants {
+		q, ok := qualities[variant.encoding]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q <= bestQ && varies {
+			continue
+		}
+		file, err := resolver.Open(name + variant.ext)
+		if err != nil {
+			continue
+		}
+		varies = true
+		if q > bestQ {
+			best, encoding, bestQ = file, variant.encoding, q
+		}
+	}
+	return best, encoding, varies
+}
+
+// serveStaticFile builds the response for a resolved static file, answering
+// conditional requests with 304. A precompressed variant stored next to the
+// file is sent instead when the client accepts its encoding.
+func serveStaticFile(req *Request, resolver FileResolver, name string, file *StaticFile) ([]byte, string) {
+	validators := make(map[string]string)
+	variant, encoding, varies := openPrecompressed(req, resolver, name)
+	if variant != nil {
+		file = variant
+	}
+	if varies {
+		validators["Vary"] = "Accept-Encoding"
+	}
+	etag := staticETag(file)
+	validators["ETag"] = etag
+	if !file.ModTime.IsZero() {
+		validators["Last-Modified"] = file.ModTime.UTC().Format(httpTimeFormat)
+	}
+	if staticNotModified(req, etag, file.ModTime) {
+		return CreateResponseBytesWithHeaders("304", "", "Not Modified", validators, nil)
+	}
+
+	headers := validators
+	if variant != nil {
+		headers["Content-Encoding"] = encoding
+	}
+	return CreateResponseBytesWithHeaders("200", getContentType(name), "OK", headers, file.Content)
+}
+
+// Static serves the files below dir at urlPrefix, e.g.
+// router.Static("/assets", "./public") serves ./public/app.css at
+// /assets/app.css. Mounts are ordinary GET and HEAD routes, so middleware
+// applies to them, and they use the same extension filters and conditional
+// GET handling as the static root.
+func (r *Router) Static(urlPrefix, dir string) {
+	r.mountResolver(urlPrefix, DirResolver(dir))
+}
+
+// ReadDir lists a directory of the file system
+func (f FSResolver) ReadDir(name string) ([]fs.FileInfo, error) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrPermission
+	}
+	entries, err := fs.ReadDir(f.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	return entryInfos(entries)
+}
+
+// entryInfos returns the FileInfo of each directory entry
+func entryInfos(entries []fs.DirEntry) ([]fs.FileInfo, error) {
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// StaticFS serves the files of fsys at urlPrefix, like Static. Use it with
+// go:embed to ship assets inside the binary:
+//
+//	//go:embed public
+//	var public embed.FS
+//
+//	assets, _ := fs.Sub(public, "public")
+//	router.StaticFS("/assets", assets)
+func (r *Router) StaticFS(urlPrefix string, fsys fs.FS) {
+	r.mountResolver(urlPrefix, FSResolver{FS: fsys})
+}
+
+// mountResolver serves resolver's files below urlPrefix
+func (r *Router) mountResolver(urlPrefix string, resolver FileResolver) {
+	pattern := strings.TrimSuffix(urlPrefix, "/") + "/*file"
+	handler := func(req *Request) ([]byte, string) {
+		name := "/" + req.PathParams["file"]
+		if name == "/" {
+			name = "/index.html"
+		}
+		if !staticPathAllowed(r.config, name) {
+			return serve404Bytes(r.config)
+		}
+		file, err := resolver.Open(name)
+		switch {
+		case err == nil:
+			return serveStaticFile(req, resolver, name, file)
+		case errors.Is(err, fs.ErrPermission):
+			return Serve403("")
+		}
+		if response, status, ok := r.serveDirectory(req, resolver, "/"+req.PathParams["file"]); ok {
+			return response, status
+		}
+		return serve404Bytes(r.config)
+	}
+	for _, method := range []string{"GET", "HEAD"} {
+		r.Register(method, pattern, handler)
+	}
+}
+
 // FileExists checks if a file exists at the given path
 func FileExists(filePath string) bool {
 	_, err := os.Stat(filePath)
@@ -0,0 +1,116 @@
+package server
+
+import "strconv"
+
+// HTTP status codes, for Respond and for comparing the status a handler
+// returned: StatusCode(status) == StatusNotFound
+const (
+	StatusContinue                    = 100
+	StatusSwitchingProtocols          = 101
+	StatusOK                          = 200
+	StatusCreated                     = 201
+	StatusAccepted                    = 202
+	StatusNoContent                   = 204
+	StatusPartialContent              = 206
+	StatusMovedPermanently            = 301
+	StatusFound                       = 302
+	StatusSeeOther                    = 303
+	StatusNotModified                 = 304
+	StatusTemporaryRedirect           = 307
+	StatusPermanentRedirect           = 308
+	StatusBadRequest                  = 400
+	StatusUnauthorized                = 401
+	StatusForbidden                   = 403
+	StatusNotFound                    = 404
+	StatusMethodNotAllowed            = 405
+	StatusNotAcceptable               = 406
+	StatusProxyAuthRequired           = 407
+	StatusRequestTimeout              = 408
+	StatusConflict                    = 409
+	StatusGone                        = 410
+	StatusLengthRequired              = 411
+	StatusPreconditionFailed          = 412
+	StatusPayloadTooLarge             = 413
+	StatusURITooLong                  = 414
+	StatusUnsupportedMediaType        = 415
+	StatusRangeNotSatisfiable         = 416
+	StatusExpectationFailed           = 417
+	StatusTeapot                      = 418
+	StatusUnprocessableEntity         = 422
+	StatusTooManyRequests             = 429
+	StatusRequestHeaderFieldsTooLarge = 431
+	StatusInternalServerError         = 500
+	StatusNotImplemented              = 501
+	StatusBadGateway                  = 502
+	StatusServiceUnavailable          = 503
+	StatusGatewayTimeout              = 504
+	StatusHTTPVersionNotSupported     = 505
+)
+
+// statusText maps status codes to their canonical reason phrases
+var statusText = map[int]string{
+	StatusContinue:                    "Continue",
+	StatusSwitchingProtocols:          "Switching Protocols",
+	StatusOK:                          "OK",
+	StatusCreated:                     "Created",
+	StatusAccepted:                    "Accepted",
+	StatusNoContent:                   "No Content",
+	StatusPartialContent:              "Partial Content",
+	StatusMovedPermanently:            "Moved Permanently",
+	StatusFound:                       "Found",
+	StatusSeeOther:                    "See Other",
+	StatusNotModified:                 "Not Modified",
+	StatusTemporaryRedirect:           "Temporary Redirect",
+	StatusPermanentRedirect:           "Permanent Redirect",
+	StatusBadRequest:                  "Bad Request",
+	StatusUnauthorized:                "Unauthorized",
+	StatusForbidden:                   "Forbidden",
+	StatusNotFound:                    "Not Found",
+	StatusMethodNotAllowed:            "Method Not Allowed",
+	StatusNotAcceptable:               "Not Acceptable",
+	StatusProxyAuthRequired:           "Proxy Authentication Required",
+	StatusRequestTimeout:              "Request Timeout",
+	StatusConflict:                    "Conflict",
+	StatusGone:                        "Gone",
+	StatusLengthRequired:              "Length Required",
+	StatusPreconditionFailed:          "Precondition Failed",
+	StatusPayloadTooLarge:             "Payload Too Large",
+	StatusURITooLong:                  "URI Too Long",
+	StatusUnsupportedMediaType:        "Unsupported Media Type",
+	StatusRangeNotSatisfiable:         "Range Not Satisfiable",
+	StatusExpectationFailed:           "Expectation Failed",
+	StatusTeapot:                      "I'm a teapot",
+	StatusUnprocessableEntity:         "Unprocessable Entity",
+	StatusTooManyRequests:             "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+	StatusInternalServerError:         "Internal Server Error",
+	StatusNotImplemented:              "Not Implemented",
+	StatusBadGateway:                  "Bad Gateway",
+	StatusServiceUnavailable:          "Service Unavailable",
+	StatusGatewayTimeout:              "Gateway Timeout",
+	StatusHTTPVersionNotSupported:     "HTTP Version Not Supported",
+}
+
+// StatusText returns the canonical reason phrase for a status code, or ""
+// if the code is unknown
+func StatusText(code int) string {
+	return statusText[code]
+}
+
+// StatusCode converts a status string returned by a handler ("404") to its
+// integer code, or 0 if it isn't a number
+func StatusCode(status string) int {
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+// reasonPhrase returns the reason phrase for a status code
+func reasonPhrase(code int) string {
+	if text, ok := statusText[code]; ok {
+		return text
+	}
+	return "Status"
+}
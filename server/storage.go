@@ -0,0 +1,222 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage is a blob store for uploads and static content.
+// Keys are slash-separated paths without a leading slash, e.g. "avatars/42.png".
+// Get and Delete return an error wrapping fs.ErrNotExist for unknown keys.
+type Storage interface {
+	Put(key string, r io.Reader, size int64) error
+	Get(key string) (io.ReadCloser, ObjectInfo, error)
+	Delete(key string) error
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// errInvalidKey is returned for keys that are empty or escape the store
+var errInvalidKey = errors.New("invalid storage key")
+
+// cleanStorageKey validates a key and returns it in canonical form
+func cleanStorageKey(key string) (string, error) {
+	key = strings.TrimPrefix(key, "/")
+	if key == "" || strings.Contains(key, "\x00") {
+		return "", errInvalidKey
+	}
+	cleaned := path.Clean(key)
+	if cleaned != key || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errInvalidKey
+	}
+	return cleaned, nil
+}
+
+// DiskStorage stores objects as files below a root directory
+type DiskStorage struct {
+	Root string
+}
+
+// NewDiskStorage creates a disk store, creating the root directory if needed
+func NewDiskStorage(root string) (*DiskStorage, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskStorage{Root: root}, nil
+}
+
+// filePath maps a key to a path below the root
+func (d *DiskStorage) filePath(key string) (string, error) {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(d.Root, filepath.FromSlash(key)), nil
+}
+
+// Put writes the object to a temporary file and renames it into place, so
+// readers never observe a partially written object
+func (d *DiskStorage) Put(key string, r io.Reader, size int64) error {
+	target, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("storage: wrote %d bytes, expected %d", written, size)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// Append adds r to the end of the object, creating it when offset is 0. It
+// fails unless the object is offset bytes long. Unlike Put it writes in
+// place, keeping what arrived when r fails part way, so a resumable upload
+// can continue from there.
+func (d *DiskStorage) Append(key string, offset int64, r io.Reader) (int64, error) {
+	target, err := d.filePath(key)
+	if err != nil {
+		return 0, err
+	}
+	flags := os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return 0, err
+		}
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(target, flags, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() != offset {
+		return 0, fmt.Errorf("storage: %s is %d bytes, not %d", key, info.Size(), offset)
+	}
+	written, err := io.Copy(file, r)
+	if err != nil {
+		return written, err
+	}
+	return written, file.Close()
+}
+
+// Get opens the object for reading
+func (d *DiskStorage) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	target, err := d.filePath(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	file, err := os.Open(target)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		if err == nil {
+			err = fs.ErrNotExist
+		}
+		return nil, ObjectInfo{}, err
+	}
+	return file, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the object
+func (d *DiskStorage) Delete(key string) error {
+	target, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(target)
+}
+
+// List returns objects whose key starts with prefix, sorted by key
+func (d *DiskStorage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	err := filepath.WalkDir(d.Root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.Root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+// StorageResolver serves static files from a Storage, optionally below a key prefix
+type StorageResolver struct {
+	Storage Storage
+	Prefix  string
+}
+
+// Open reads the object stored for a request path
+func (s StorageResolver) Open(name string) (*StaticFile, error) {
+	key, err := cleanStorageKey(path.Join(s.Prefix, strings.TrimPrefix(name, "/")))
+	if err != nil {
+		return nil, fs.ErrNotExist
+	}
+	if prefix := strings.Trim(s.Prefix, "/"); prefix != "" && !strings.HasPrefix(key, prefix+"/") {
+		return nil, fs.ErrPermission
+	}
+	body, info, err := s.Storage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticFile{Content: content, ModTime: info.ModTime, Size: int64(len(content))}, nil
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Storage stores objects in an S3-compatible bucket (AWS S3, MinIO, R2, ...)
+// using path-style URLs and AWS Signature Version 4.
+type S3Storage struct {
+	Endpoint  string // e.g. "https://s3.us-east-1.amazonaws.com" or "http://localhost:9000"
+	Region    string // e.g. "us-east-1"
+	Bucket    string
+	AccessKey string
+	SecretKey string
+
+	// Client performs the requests; nil means a client with a 60s timeout
+	Client *http.Client
+}
+
+// s3DefaultClient is used when S3Storage.Client is nil
+var s3DefaultClient = &http.Client{Timeout: 60 * time.Second}
+
+// s3UnsignedPayload lets uploads stream without hashing the body first
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Put uploads an object. size must be the exact body length.
+func (s *S3Storage) Put(key string, r io.Reader, size int64) error {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return fmt.Errorf("s3: object size is required")
+	}
+	resp, err := s.do(http.MethodPut, key, nil, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3Error(resp)
+}
+
+// Get downloads an object; the caller must close the returned body
+func (s *S3Storage) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	resp, err := s.do(http.MethodGet, key, nil, nil, 0)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if err := s3Error(resp); err != nil {
+		resp.Body.Close()
+		return nil, ObjectInfo{}, err
+	}
+
+	info := ObjectInfo{Key: key, Size: resp.ContentLength}
+	if modTime, err := time.Parse(httpTimeFormat, resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return resp.Body, info, nil
+}
+
+// Delete removes an object
+func (s *S3Storage) Delete(key string) error {
+	key, err := cleanStorageKey(key)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return s3Error(resp)
+}
+
+// s3ListResult is the subset of a ListObjectsV2 response we use
+type s3ListResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns all objects whose key starts with prefix, following pagination
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = s3Error(resp)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range result.Contents {
+			modTime, _ := time.Parse(time.RFC3339, item.LastModified)
+			objects = append(objects, ObjectInfo{Key: item.Key, Size: item.Size, ModTime: modTime})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request for a key (or the bucket when key is empty)
+func (s *S3Storage) do(method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("s3: invalid endpoint: %w", err)
+	}
+
+	canonicalPath := "/" + s3URIEncode(s.Bucket, false)
+	if key != "" {
+		canonicalPath += "/" + s3URIEncode(key, true)
+	}
+	target := endpoint.Scheme + "://" + endpoint.Host + canonicalPath
+	if len(query) > 0 {
+		target += "?" + s3CanonicalQuery(query)
+	}
+
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, canonicalPath, query, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = s3DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign adds AWS Signature Version 4 headers to req
+func (s *S3Storage) sign(req *http.Request, canonicalPath string, query url.Values, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + s3UnsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath,
+		s3CanonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := shortDate + "/" + s.Region + "/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretKey), shortDate)
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// hmacSHA256 computes HMAC-SHA256(key, data)
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query parameters sorted by key as SigV4 requires
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3URIEncode(key, false)+"="+s3URIEncode(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3URIEncode percent-encodes everything except unreserved characters
+// (and "/" when keepSlash is set), as required by SigV4
+func s3URIEncode(value string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Error converts non-2xx responses to errors; 404 wraps fs.ErrNotExist
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3: %w: %s", fs.ErrNotExist, strings.TrimSpace(string(detail)))
+	}
+	return fmt.Errorf("s3: status %s: %s", strconv.Itoa(resp.StatusCode), strings.TrimSpace(string(detail)))
+}
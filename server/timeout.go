@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// errHandlerTimeout is returned to a streaming handler whose response was
+// replaced by a 503 after HandlerTimeout
+var errHandlerTimeout = errors.New("handler timed out")
+
+// handlerDeadline arbitrates between a handler starting a streamed response
+// and HandlerTimeout replacing it with a 503
+type handlerDeadline struct {
+	mu       sync.Mutex
+	started  bool
+	timedOut bool
+}
+
+// startResponse reports whether the handler may write to the connection.
+// Once it has, HandlerTimeout no longer applies.
+func (req *Request) startResponse() bool {
+	d := req.deadline
+	if d == nil {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timedOut {
+		return false
+	}
+	d.started = true
+	return true
+}
+
+// headerReadTimeout bounds reading the request line and headers
+func (c *Config) headerReadTimeout() time.Duration {
+	if c.HeaderReadTimeout > 0 {
+		return c.HeaderReadTimeout
+	}
+	return c.ReadTimeout
+}
+
+// bodyReadTimeout bounds each wait for request body data
+func (c *Config) bodyReadTimeout() time.Duration {
+	if c.BodyReadTimeout > 0 {
+		return c.BodyReadTimeout
+	}
+	return c.ReadTimeout
+}
+
+// runHandler routes the request, giving up after HandlerTimeout (or the
+// route's WithTimeout) unless the handler has started streaming. A
+// timed-out handler keeps running in the background; timedOut tells the
+// caller to close the connection.
+func (r *Router) runHandler(req *Request) (response []byte, status string, timedOut bool) {
+	if req.timeout <= 0 {
+		response, status = r.routeRequest(req)
+		return response, status, false
+	}
+
+	type result struct {
+		response []byte
+		status   string
+	}
+	done := make(chan result, 1)
+	req.deadline = &handlerDeadline{}
+	go func() {
+		// Panics can't reach RunConnection's recovery from this goroutine
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("PANIC recovered: %v\n%s", err, debug.Stack())
+				response, status := Serve500("Internal server error occurred")
+				done <- result{response, status}
+			}
+		}()
+		response, status := r.routeRequest(req)
+		done <- result{response, status}
+	}()
+
+	timer := time.NewTimer(req.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.response, res.status, false
+	case <-timer.C:
+	}
+
+	d := req.deadline
+	d.mu.Lock()
+	started := d.started
+	d.timedOut = !started
+	d.mu.Unlock()
+	if started {
+		res := <-done
+		return res.response, res.status, false
+	}
+
+	// The handler still holds the request, so its headers must outlive it
+	req.arena.abandon()
+	log.Printf("Handler for %s %s exceeded HandlerTimeout\n", req.Method, req.Path)
+	response, status = Serve503("Request timed out")
+	return response, status, true
+}
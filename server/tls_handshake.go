@@ -0,0 +1,102 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTLSHandshakeTimeout applies when Server.TLSHandshakeTimeout is 0
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
+// tlsHandshakeStats counts failed TLS handshakes by reason
+type tlsHandshakeStats struct {
+	mu       sync.Mutex
+	failures map[string]int64
+}
+
+// record counts one failure
+func (st *tlsHandshakeStats) record(reason string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.failures == nil {
+		st.failures = make(map[string]int64)
+	}
+	st.failures[reason]++
+}
+
+// TLSHandshakeFailures returns the number of failed TLS handshakes by reason:
+// "timeout", "client_hello" (not TLS or malformed hello), "version",
+// "cipher", "certificate", "closed" (client went away) and "other"
+func (s *Server) TLSHandshakeFailures() map[string]int64 {
+	s.tlsStats.mu.Lock()
+	defer s.tlsStats.mu.Unlock()
+	failures := make(map[string]int64, len(s.tlsStats.failures))
+	for reason, count := range s.tlsStats.failures {
+		failures[reason] = count
+	}
+	return failures
+}
+
+// serveTLS completes the handshake under its own deadline before handing the
+// connection to the router, so slow handshakes are closed early
+func (s *Server) serveTLS(conn *tls.Conn) {
+	if !s.handshake(conn) {
+		conn.Close()
+		return
+	}
+	if s.isDebugConsole(conn) {
+		s.serveDebugConsole(conn)
+		return
+	}
+	s.Router.RunConnection(conn)
+}
+
+// handshake runs the TLS handshake and records why it failed
+func (s *Server) handshake(conn *tls.Conn) bool {
+	timeout := s.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		s.tlsStats.record(handshakeFailureReason(err))
+		return false
+	}
+	return true
+}
+
+// handshakeFailureReason classifies a handshake error
+func handshakeFailureReason(err error) string {
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	message := strings.ToLower(err.Error())
+
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &recordErr):
+		return "client_hello"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrClosedPipe), errors.Is(err, net.ErrClosed),
+		strings.Contains(message, "connection reset"):
+		return "closed"
+	case strings.Contains(message, "version"):
+		return "version"
+	case strings.Contains(message, "cipher"):
+		return "cipher"
+	case strings.Contains(message, "certificate"):
+		return "certificate"
+	case strings.Contains(message, "client hello"), strings.Contains(message, "clienthello"),
+		strings.Contains(message, "unexpected message"):
+		return "client_hello"
+	default:
+		return "other"
+	}
+}
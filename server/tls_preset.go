@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSPreset names a TLS security profile, following Mozilla's server side
+// TLS recommendations
+type TLSPreset string
+
+const (
+	// TLSModern allows TLS 1.3 only
+	TLSModern TLSPreset = "modern"
+	// TLSIntermediate allows TLS 1.2+ with AEAD ECDHE suites (the default)
+	TLSIntermediate TLSPreset = "intermediate"
+	// TLSLegacy also allows TLS 1.0/1.1 and CBC suites for very old clients
+	TLSLegacy TLSPreset = "legacy"
+)
+
+// Config returns a tls.Config with the preset's minimum version, cipher
+// suites and curves. The empty preset means TLSIntermediate.
+func (p TLSPreset) Config() (*tls.Config, error) {
+	intermediateSuites := []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	}
+	curves := []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}
+
+	switch p {
+	case TLSModern:
+		// TLS 1.3 suites are fixed by crypto/tls
+		return &tls.Config{MinVersion: tls.VersionTLS13, CurvePreferences: curves}, nil
+	case TLSIntermediate, "":
+		return &tls.Config{MinVersion: tls.VersionTLS12, CipherSuites: intermediateSuites, CurvePreferences: curves}, nil
+	case TLSLegacy:
+		legacySuites := append(intermediateSuites,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		)
+		return &tls.Config{
+			MinVersion:       tls.VersionTLS10,
+			CipherSuites:     legacySuites,
+			CurvePreferences: append(curves, tls.CurveP521),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown TLS preset %q", string(p))
+	}
+}
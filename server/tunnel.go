@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TunnelConfig enables CONNECT tunneling, turning the server into a forward
+// proxy for clients that speak HTTPS (or any TCP protocol) through it.
+// Meant for testing proxy-aware clients; don't expose it to the internet.
+// CONNECT requests pass through the router's middleware (Use), which sees
+// the outcome of authenticating and dialing the target as the status, so
+// RateLimit, Honeypot bans and Audit apply to them.
+type TunnelConfig struct {
+	// Authenticate checks the Basic credentials of Proxy-Authorization;
+	// clients without valid ones get 407. nil lets every client connect.
+	Authenticate func(username, password string) bool
+
+	// Allow decides whether a "host:port" may be tunneled to; refused
+	// targets get 403. nil allows every target that resolves only to
+	// public addresses: loopback, private, shared (100.64.0.0/10),
+	// link-local (cloud metadata) and 0.0.0.0/8 addresses are refused.
+	Allow func(address string) bool
+
+	// DialTimeout bounds connecting to the target; 0 means 10 seconds
+	DialTimeout time.Duration
+
+	// IdleTimeout closes a tunnel once no bytes have crossed it in either
+	// direction for this long; 0 means 5 minutes
+	IdleTimeout time.Duration
+}
+
+// dialTimeout returns DialTimeout, defaulting to 10 seconds
+func (c *TunnelConfig) dialTimeout() time.Duration {
+	if c.DialTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return c.DialTimeout
+}
+
+// idleTimeout returns IdleTimeout, defaulting to 5 minutes
+func (c *TunnelConfig) idleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return 5 * time.Minute
+	}
+	return c.IdleTimeout
+}
+
+// errTunnelTargetDenied is returned by publicTarget for internal addresses
+var errTunnelTargetDenied = errors.New("tunnel target not allowed")
+
+// serveTunnel answers a CONNECT request by dialing its target and splicing
+// bytes between the client and the target until either side closes or the
+// tunnel goes idle. The connection is never reused for HTTP afterwards.
+func (r *Router) serveTunnel(conn net.Conn, br *bufio.Reader, head *requestHead) *served {
+	tunnel := r.config.Tunnel
+	address := head.target
+	refuse := func(response []byte, status string) *served {
+		if r.logging.Load() {
+			logRequest("CONNECT", address, StatusCode(status))
+		}
+		return &served{response, status, true}
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || port == "" {
+		return refuse(Serve400("CONNECT target must be host:port"))
+	}
+
+	var upstream net.Conn
+	response, status := r.admitTunnel(conn, head, func(req *Request) ([]byte, string) {
+		if tunnel.Authenticate != nil && !proxyAuthorized(req.Headers, tunnel.Authenticate) {
+			return RespondWithHeaders(StatusProxyAuthRequired, "text/plain",
+				Headers{"Proxy-Authenticate": `Basic realm="proxy"`}, []byte("Proxy authentication required"))
+		}
+		if tunnel.Allow != nil && !tunnel.Allow(address) {
+			return Serve403("Tunnel target not allowed")
+		}
+		if conn == nil {
+			return Serve400("CONNECT needs a live connection")
+		}
+
+		// Without Allow, the resolved address is dialed so a second lookup
+		// can't swap in an internal one
+		dialAddress := address
+		if tunnel.Allow == nil {
+			ip, err := publicTarget(host, tunnel.dialTimeout())
+			if errors.Is(err, errTunnelTargetDenied) {
+				return Serve403("Tunnel target not allowed")
+			}
+			if err != nil {
+				return Serve502("Could not reach " + address)
+			}
+			dialAddress = net.JoinHostPort(ip.String(), port)
+		}
+
+		dialed, err := net.DialTimeout("tcp", dialAddress, tunnel.dialTimeout())
+		if err != nil {
+			return Serve502("Could not reach " + address)
+		}
+		upstream = dialed
+		return nil, "200"
+	})
+	if upstream != nil {
+		defer upstream.Close()
+	}
+	if upstream == nil || StatusCode(status) != StatusOK {
+		// Refused, or a middleware replaced the established tunnel
+		return refuse(response, status)
+	}
+
+	// The tunnel lives until a side hangs up or it goes idle, so the
+	// request deadlines go
+	conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return &served{close: true}
+	}
+	if r.logging.Load() {
+		logRequest("CONNECT", address, StatusOK)
+	}
+
+	// Bytes the client sent after the head are still buffered in br
+	idle := &idleTracker{timeout: tunnel.idleTimeout()}
+	idle.touch()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		idle.copy(upstream, br, conn)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		idle.copy(conn, upstream, upstream)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+	return &served{close: true}
+}
+
+// admitTunnel runs a CONNECT request through the router's middleware around
+// open, which authenticates and dials the target. The middleware sees open's
+// status, so Audit records refused and failed tunnels as such; a request
+// stopped on the way gets the middleware's response.
+func (r *Router) admitTunnel(conn net.Conn, head *requestHead, open RouteHandler) ([]byte, string) {
+	r.mu.RLock()
+	middleware := r.middleware
+	r.mu.RUnlock()
+
+	remoteAddr, isTLS := connectionInfo(conn)
+	req := &Request{
+		Method:     head.method,
+		Path:       head.target,
+		Headers:    head.headers,
+		Host:       head.headers["Host"],
+		Proto:      head.proto,
+		RemoteAddr: remoteAddr,
+		TLS:        isTLS,
+
+		trustedProxies:  r.config.TrustedProxies,
+		forwardedHeader: r.config.ForwardedHeader,
+	}
+	return applyMiddleware(open, middleware)(req)
+}
+
+// publicTarget resolves host and returns its first address, failing with
+// errTunnelTargetDenied when any address it resolves to is internal
+func publicTarget(host string, timeout time.Duration) (netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if len(addrs) == 0 {
+		return netip.Addr{}, errors.New("no addresses for " + host)
+	}
+	for _, addr := range addrs {
+		if internalAddr(addr.Unmap()) {
+			return netip.Addr{}, errTunnelTargetDenied
+		}
+	}
+	return addrs[0].Unmap(), nil
+}
+
+// nonPublicPrefixes are ranges the netip.Addr predicates don't cover:
+// carrier-grade NAT space, often internal in clouds, and "this network",
+// which Linux routes to the local host
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("0.0.0.0/8"),
+}
+
+// internalAddr reports whether addr is not a public unicast address
+func internalAddr(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsUnspecified() || addr.IsMulticast() {
+		return true
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// idleTracker ends both directions of a tunnel once neither has carried
+// bytes for timeout
+type idleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64 // Unix nanoseconds of the last byte in either direction
+}
+
+// touch records activity
+func (t *idleTracker) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+// copy copies src, read from conn, to dst until either fails or the tunnel
+// is idle. A read that times out while the other direction is busy retries.
+func (t *idleTracker) copy(dst net.Conn, src io.Reader, conn net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(t.timeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			t.touch()
+			dst.SetWriteDeadline(time.Now().Add(t.timeout))
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, t.last.Load())) < t.timeout {
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// proxyAuthorized reports whether the Basic credentials of the
+// Proxy-Authorization header pass authenticate
+func proxyAuthorized(headers Headers, authenticate func(username, password string) bool) bool {
+	scheme, encoded, found := strings.Cut(headers.Get("Proxy-Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	return found && authenticate(username, password)
+}
+
+// closeWrite half-closes conn so the peer sees EOF while replies can still
+// arrive, closing it outright when it can't be half-closed
+func closeWrite(conn net.Conn) {
+	for {
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+			return
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			conn.Close()
+			return
+		}
+		conn = wrapper.NetConn()
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressFunc is called while a request body is being received.
+// token identifies the upload (X-Upload-Token header or upload_token query
+// parameter), received counts body bytes so far and total is the declared
+// Content-Length, or -1 for chunked bodies of unknown length.
+type ProgressFunc func(token string, received, total int64)
+
+// UploadProgress records the latest progress of each upload token so a
+// separate endpoint can report it to the uploading UI. It tracks at most
+// maxTrackedUploads tokens, dropping the least recently updated one to make
+// room, and forgets a token uploadTTL after its last update.
+type UploadProgress struct {
+	// Clock timestamps updates for expiry; nil means the system clock
+	Clock Clock
+
+	mu      sync.Mutex
+	uploads *lru[uploadState]
+}
+
+// uploadState is the last progress report of one upload
+type uploadState struct {
+	Received int64     `json:"received"`
+	Total    int64     `json:"total"`
+	Updated  time.Time `json:"-"`
+}
+
+// done reports whether the whole declared body has arrived
+func (s uploadState) done() bool {
+	return s.Total >= 0 && s.Received >= s.Total
+}
+
+const (
+	maxTrackedUploads = 1024      // tokens tracked at once
+	uploadTTL         = time.Hour // how long a token is kept after its last update
+)
+
+// NewUploadProgress creates an empty progress tracker
+func NewUploadProgress() *UploadProgress {
+	return &UploadProgress{uploads: newLRU[uploadState](maxTrackedUploads)}
+}
+
+// Update records progress for a token. It matches ProgressFunc, so it can be
+// passed directly to Router.OnBodyProgress.
+func (p *UploadProgress) Update(token string, received, total int64) {
+	now := clockOrSystem(p.Clock).Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, tracked := p.uploads.get(token); !tracked {
+		// Tokens taken from headers don't outlive the request
+		token = strings.Clone(token)
+	}
+	p.uploads.put(token, uploadState{Received: received, Total: total, Updated: now})
+}
+
+// Get returns the last recorded progress for a token
+func (p *UploadProgress) Get(token string) (received, total int64, ok bool) {
+	state, ok := p.state(token)
+	return state.Received, state.Total, ok
+}
+
+// Forget drops the progress of a finished upload
+func (p *UploadProgress) Forget(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.uploads.remove(token)
+}
+
+// state returns the progress of a token, dropping it once expired
+func (p *UploadProgress) state(token string) (uploadState, bool) {
+	now := clockOrSystem(p.Clock).Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.uploads.get(token)
+	if ok && now.Sub(state.Updated) > uploadTTL {
+		p.uploads.remove(token)
+		return uploadState{}, false
+	}
+	return state, ok
+}
+
+// uploadToken returns the token named by the "token" path or query parameter
+func uploadToken(req *Request) string {
+	if token := req.PathParams["token"]; token != "" {
+		return token
+	}
+	return req.Query["token"]
+}
+
+// Handler returns a route handler reporting {"received":n,"total":n} for the
+// token given in the "token" path parameter or query parameter. Clients poll it.
+func (p *UploadProgress) Handler() RouteHandler {
+	return func(req *Request) ([]byte, string) {
+		state, ok := p.state(uploadToken(req))
+		if !ok {
+			return ServeJSON("404", map[string]string{"error": "unknown upload"})
+		}
+
+		body, _ := json.Marshal(state)
+		return CreateResponseBytesWithHeaders("200", "application/json", "OK", map[string]string{"Cache-Control": "no-store"}, body)
+	}
+}
+
+// Events returns a handler streaming the progress of the token given in the
+// "token" path or query parameter as Server-Sent Events, one
+// `data: {"received":n,"total":n}` event whenever it changes, checked every
+// interval. The stream ends once the upload completes or its token is
+// forgotten. Register it with WriteThrough so events aren't buffered:
+//
+//	events := progress.Events(250 * time.Millisecond)
+//	router.HandleFunc("GET", "/upload/events/:token", events, server.WriteThrough())
+func (p *UploadProgress) Events(interval time.Duration) HandlerFunc {
+	return func(w ResponseWriter, req *Request) {
+		token := uploadToken(req)
+		state, ok := p.state(token)
+		if !ok {
+			w.SetHeader("Content-Type", "application/json")
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error":"unknown upload"}`))
+			return
+		}
+
+		w.SetHeader("Content-Type", "text/event-stream")
+		w.SetHeader("Cache-Control", "no-store")
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last uploadState
+		for sent := false; ok; state, ok = p.state(token) {
+			if !sent || state.Received != last.Received || state.Total != last.Total {
+				body, _ := json.Marshal(state)
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", body); err != nil {
+					return
+				}
+				last, sent = state, true
+			}
+			if state.done() {
+				return
+			}
+			<-ticker.C
+		}
+	}
+}
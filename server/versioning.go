@@ -0,0 +1,161 @@
+package server
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIVersions tracks API versions read from a path parameter or a header,
+// marks versions deprecated, and counts requests per version. Only known
+// versions are counted by name: the default version and those passed to
+// Versions, Deprecate or Match. Requests for any other version are counted
+// under "unknown", so clients can't grow the counts without bound.
+type APIVersions struct {
+	// Clock supplies the default deprecation time; nil means the system clock
+	Clock Clock
+
+	param          string // path parameter holding the version (path-based)
+	header         string // request header holding the version (header-based)
+	defaultVersion string // version assumed when the header is missing
+
+	mu         sync.Mutex
+	known      map[string]bool
+	deprecated map[string]apiDeprecation
+	usage      map[string]int64
+}
+
+// unknownVersion is the usage key for requests naming an unknown version
+const unknownVersion = "unknown"
+
+// apiDeprecation describes when a version was deprecated and will be removed
+type apiDeprecation struct {
+	since  time.Time
+	sunset time.Time
+}
+
+// PathVersioning reads the version from a path parameter, e.g. "version"
+// for routes registered as "/api/:version/users".
+func PathVersioning(param string) *APIVersions {
+	return &APIVersions{
+		param:      param,
+		known:      make(map[string]bool),
+		deprecated: make(map[string]apiDeprecation),
+		usage:      make(map[string]int64),
+	}
+}
+
+// HeaderVersioning reads the version from a request header such as
+// "X-API-Version", using defaultVersion when the header is absent.
+func HeaderVersioning(header, defaultVersion string) *APIVersions {
+	return &APIVersions{
+		header:         header,
+		defaultVersion: defaultVersion,
+		known:          map[string]bool{defaultVersion: true},
+		deprecated:     make(map[string]apiDeprecation),
+		usage:          make(map[string]int64),
+	}
+}
+
+// Versions declares versions as known, so their usage is counted by name
+func (v *APIVersions) Versions(versions ...string) *APIVersions {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, version := range versions {
+		v.known[version] = true
+	}
+	return v
+}
+
+// Deprecate marks a version deprecated since the given time. Responses for it
+// carry a Deprecation header and, when sunset is non-zero, a Sunset header.
+func (v *APIVersions) Deprecate(version string, since, sunset time.Time) *APIVersions {
+	if since.IsZero() {
+		since = clockOrSystem(v.Clock).Now()
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.known[version] = true
+	v.deprecated[version] = apiDeprecation{since: since, sunset: sunset}
+	return v
+}
+
+// Version returns the API version requested by req
+func (v *APIVersions) Version(req *Request) string {
+	if v.param != "" {
+		return req.PathParams[v.param]
+	}
+	if version := headerValue(req.Headers, v.header); version != "" {
+		return version
+	}
+	return v.defaultVersion
+}
+
+// Match is a route option selecting a handler by header version, so
+// handlers for each version can be registered on the same path.
+func (v *APIVersions) Match(version string) RouteOption {
+	v.Versions(version)
+	return WithMatcher(func(req *Request) bool {
+		return v.Version(req) == version
+	})
+}
+
+// Wrap counts usage per version and adds deprecation headers to responses
+func (v *APIVersions) Wrap(handler RouteHandler) RouteHandler {
+	return func(req *Request) ([]byte, string) {
+		version := v.Version(req)
+
+		v.mu.Lock()
+		if !v.known[version] {
+			version = unknownVersion
+		} else if _, counted := v.usage[version]; !counted {
+			// Header values don't outlive the request
+			version = strings.Clone(version)
+		}
+		v.usage[version]++
+		count := v.usage[version]
+		dep, isDeprecated := v.deprecated[version]
+		v.mu.Unlock()
+
+		response, status := handler(req)
+		if !isDeprecated {
+			return response, status
+		}
+
+		if count == 1 {
+			log.Printf("Deprecated API version %s used: %s %s\n", version, req.Method, req.Path)
+		}
+
+		headers := map[string]string{"Deprecation": "@" + strconv.FormatInt(dep.since.Unix(), 10)}
+		if !dep.sunset.IsZero() {
+			headers["Sunset"] = dep.sunset.UTC().Format(httpTimeFormat)
+		}
+		return AddResponseHeaders(response, headers), status
+	}
+}
+
+// Usage returns a snapshot of request counts per version
+func (v *APIVersions) Usage() map[string]int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	usage := make(map[string]int64, len(v.usage))
+	for version, count := range v.usage {
+		usage[version] = count
+	}
+	return usage
+}
+
+// LogUsage writes the request count of every version to the log
+func (v *APIVersions) LogUsage() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for version, count := range v.usage {
+		_, deprecated := v.deprecated[version]
+		log.Printf("API version %s: %d requests (deprecated: %t)\n", version, count, deprecated)
+	}
+}
+
+// httpTimeFormat is the IMF-fixdate layout used by HTTP date headers
+const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
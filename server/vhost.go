@@ -0,0 +1,135 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// VirtualHosts sends requests to a Router chosen by their Host header, so
+// one server can host several sites:
+//
+//	vh := server.NewVirtualHosts(srv.Router)
+//	vh.Host("api.example.com", apiRouter)
+//	vh.Host("*.example.com", tenantRouter)
+//	vh.Host(":tenant.shop.example.com", shopRouter) // req.PathParams["tenant"]
+//
+// Requests for other hosts, and HTTP/1.0 requests without Host, go to the
+// default router. Connections are always served by the default router, so
+// its Config sets timeouts, keep-alive and header limits; the host's router
+// applies its own routes, middleware and body limits.
+type VirtualHosts struct {
+	mu       sync.RWMutex
+	hosts    map[string]*Router
+	patterns []hostPattern // names with :param labels, in registration order
+	def      *Router
+}
+
+// hostPattern is a host name with parameter labels, e.g. ":tenant.example.com"
+type hostPattern struct {
+	name   string
+	labels []string
+	router *Router
+}
+
+// match reports whether a normalized host name fits the pattern, returning
+// the captured labels
+func (p hostPattern) match(name string) (map[string]string, bool) {
+	labels := strings.Split(name, ".")
+	if len(labels) != len(p.labels) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, label := range p.labels {
+		if strings.HasPrefix(label, ":") {
+			if labels[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[label[1:]] = labels[i]
+		} else if label != labels[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// NewVirtualHosts enables virtual hosting on defaultRouter
+func NewVirtualHosts(defaultRouter *Router) *VirtualHosts {
+	vh := &VirtualHosts{hosts: make(map[string]*Router), def: defaultRouter}
+	defaultRouter.mu.Lock()
+	defaultRouter.vhosts = vh
+	defaultRouter.mu.Unlock()
+	return vh
+}
+
+// Host routes requests for name to router. Names are matched without port
+// and case-insensitively. A ":param" label matches any one label and puts it
+// in req.PathParams, unless the path has a parameter of the same name.
+// "*.example.com" matches any subdomain of example.com that no other name
+// matches. A nil router removes the host.
+func (vh *VirtualHosts) Host(name string, router *Router) {
+	vh.mu.Lock()
+	defer vh.mu.Unlock()
+	labels := strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".")
+	if slices.ContainsFunc(labels, func(label string) bool { return strings.HasPrefix(label, ":") }) {
+		name = strings.Join(labels, ".")
+		vh.patterns = slices.DeleteFunc(vh.patterns, func(p hostPattern) bool { return p.name == name })
+		if router != nil {
+			vh.patterns = append(vh.patterns, hostPattern{name: name, labels: labels, router: router})
+		}
+		return
+	}
+	name = hostName(name)
+	if router == nil {
+		delete(vh.hosts, name)
+		return
+	}
+	vh.hosts[name] = router
+}
+
+// router returns the Router for a Host header value, and the parameters
+// captured from it
+func (vh *VirtualHosts) router(host string) (*Router, map[string]string) {
+	name := hostName(host)
+	vh.mu.RLock()
+	defer vh.mu.RUnlock()
+	if router, ok := vh.hosts[name]; ok {
+		return router, nil
+	}
+	for _, p := range vh.patterns {
+		if params, ok := p.match(name); ok {
+			return p.router, params
+		}
+	}
+	// Most specific wildcard first: a.b.example.com tries *.b.example.com
+	for rest := name; ; {
+		_, parent, ok := strings.Cut(rest, ".")
+		if !ok {
+			break
+		}
+		if router, ok := vh.hosts["*."+parent]; ok {
+			return router, nil
+		}
+		rest = parent
+	}
+	return vh.def, nil
+}
+
+// hostName normalizes a Host value: lowercase, without port or trailing dot
+func hostName(host string) string {
+	host = strings.ToLower(host)
+	if strings.HasPrefix(host, "[") {
+		// IPv6 literal, e.g. [::1]:8080
+		if end := strings.IndexByte(host, ']'); end > 0 {
+			return host[:end+1]
+		}
+		return host
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(host, ".")
+}